@@ -0,0 +1,298 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	AccessLogCombined = "combined"
+	AccessLogJSON     = "json"
+)
+
+// accessLogTimeFormat is the timestamp format used by the Apache Combined log format.
+const accessLogTimeFormat = "02/Jan/2006:15:04:05 -0700"
+
+// rotatedLogTimeFormat is appended to the name of a log file when it is rotated. If a log
+// was already rotated at the same time, a counter is added after it.
+const rotatedLogTimeFormat = "20060102-150405.000000"
+
+// AccessLogEntry holds the information logged for each request.
+type AccessLogEntry struct {
+	Time       time.Time `json:"time"`
+	ClientIP   string    `json:"client_ip"`
+	Method     string    `json:"method"`
+	URI        string    `json:"uri"`
+	Proto      string    `json:"proto"`
+	Host       string    `json:"host"`
+	Status     int       `json:"status"`
+	Bytes      int       `json:"bytes"`
+	Referrer   string    `json:"referrer"`
+	UserAgent  string    `json:"user_agent"`
+	DurationUs int64     `json:"duration_us"`
+}
+
+// TrustedProxies is a list of networks whose X-Forwarded-For headers are believed.
+type TrustedProxies []*net.IPNet
+
+// ParseTrustedProxies parses a comma-separated list of IP addresses and CIDR networks.
+func ParseTrustedProxies(list string) (TrustedProxies, error) {
+	proxies := TrustedProxies{}
+	for _, item := range strings.Split(list, ",") {
+		item = strings.TrimSpace(item)
+		if item == "" {
+			continue
+		}
+
+		if !strings.Contains(item, "/") {
+			ip := net.ParseIP(item)
+			if ip == nil {
+				return nil, fmt.Errorf("Invalid trusted proxy address %s", item)
+			}
+			bits := 32
+			if ip.To4() == nil {
+				bits = 128
+			}
+			item = fmt.Sprintf("%s/%d", item, bits)
+		}
+
+		_, network, err := net.ParseCIDR(item)
+		if err != nil {
+			return nil, fmt.Errorf("Invalid trusted proxy network %s", item)
+		}
+		proxies = append(proxies, network)
+	}
+	return proxies, nil
+}
+
+func (tp TrustedProxies) Contains(ip net.IP) bool {
+	for _, network := range tp {
+		if network.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// ClientIP returns the address of the client that made the request. If the request came
+// from a trusted proxy, the X-Forwarded-For header is searched from the right for the
+// first address that is not itself a trusted proxy.
+func (tp TrustedProxies) ClientIP(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+
+	ip := net.ParseIP(host)
+	if ip == nil || !tp.Contains(ip) {
+		return host
+	}
+
+	forwarded := []string{}
+	for _, header := range r.Header["X-Forwarded-For"] {
+		forwarded = append(forwarded, strings.Split(header, ",")...)
+	}
+
+	for i := len(forwarded) - 1; i >= 0; i-- {
+		addr := strings.TrimSpace(forwarded[i])
+		forwardedIP := net.ParseIP(addr)
+		if forwardedIP == nil {
+			// Garbage in the header, so don't trust anything before it.
+			break
+		}
+		host = addr
+		if !tp.Contains(forwardedIP) {
+			break
+		}
+	}
+
+	return host
+}
+
+// AccessLog writes a line for each request to a dedicated log file, separate from the
+// application logs, rotating the file when it gets too large or too old.
+type AccessLog struct {
+	lock   sync.Mutex
+	path   string
+	format string
+	file   *os.File
+	size   int64
+	opened time.Time
+
+	// Rotate when the file reaches this many bytes. 0 means no limit.
+	maxSize int64
+	// Rotate when the file has been open this long. 0 means no limit.
+	maxAge time.Duration
+	// Number of rotated files to keep. 0 keeps them all.
+	maxFiles int
+
+	// Returns the current time. Replaced in tests.
+	now func() time.Time
+}
+
+func NewAccessLog(path, format string, maxSize int64, maxAge time.Duration, maxFiles int) (*AccessLog, error) {
+	if format != AccessLogCombined && format != AccessLogJSON {
+		return nil, fmt.Errorf("Unknown access log format %s", format)
+	}
+
+	al := &AccessLog{
+		path:     path,
+		format:   format,
+		maxSize:  maxSize,
+		maxAge:   maxAge,
+		maxFiles: maxFiles,
+		now:      time.Now,
+	}
+
+	err := al.open()
+	if err != nil {
+		return nil, err
+	}
+	return al, nil
+}
+
+func (al *AccessLog) open() error {
+	f, err := os.OpenFile(al.path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+	if err != nil {
+		return err
+	}
+
+	stat, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return err
+	}
+
+	al.file = f
+	al.size = stat.Size()
+	al.opened = al.now()
+	return nil
+}
+
+// rotate renames the current log file with a timestamp suffix and opens a new one.
+func (al *AccessLog) rotate() error {
+	al.file.Close()
+
+	rotatedPath := al.path + "." + al.now().Format(rotatedLogTimeFormat)
+	for i := 1; ; i++ {
+		if _, err := os.Lstat(rotatedPath); os.IsNotExist(err) {
+			break
+		}
+		rotatedPath = fmt.Sprintf("%s.%s-%03d", al.path, al.now().Format(rotatedLogTimeFormat), i)
+	}
+	err := os.Rename(al.path, rotatedPath)
+	if err != nil {
+		return err
+	}
+
+	if al.maxFiles > 0 {
+		rotated, _ := filepath.Glob(al.path + ".*")
+		// The timestamp format sorts chronologically.
+		sort.Strings(rotated)
+		for len(rotated) > al.maxFiles {
+			os.Remove(rotated[0])
+			rotated = rotated[1:]
+		}
+	}
+
+	return al.open()
+}
+
+// Log writes an entry for a completed request.
+func (al *AccessLog) Log(entry AccessLogEntry) error {
+	var line []byte
+	if al.format == AccessLogJSON {
+		buf, err := json.Marshal(entry)
+		if err != nil {
+			return err
+		}
+		line = append(buf, '\n')
+	} else {
+		line = []byte(entry.Combined() + "\n")
+	}
+
+	al.lock.Lock()
+	defer al.lock.Unlock()
+
+	if al.file == nil {
+		// A previous rotation failed. Try again.
+		if err := al.open(); err != nil {
+			return err
+		}
+	}
+
+	if al.size > 0 && ((al.maxSize > 0 && al.size+int64(len(line)) > al.maxSize) ||
+		(al.maxAge > 0 && al.now().Sub(al.opened) > al.maxAge)) {
+		if err := al.rotate(); err != nil {
+			al.file = nil
+			return err
+		}
+	}
+
+	n, err := al.file.Write(line)
+	al.size += int64(n)
+	return err
+}
+
+func (al *AccessLog) Close() error {
+	al.lock.Lock()
+	defer al.lock.Unlock()
+	if al.file == nil {
+		return nil
+	}
+	err := al.file.Close()
+	al.file = nil
+	return err
+}
+
+func quoteOrDash(s string) string {
+	if s == "" {
+		return `"-"`
+	}
+	return strconv.Quote(s)
+}
+
+// Combined formats the entry in the Apache Combined log format.
+func (e AccessLogEntry) Combined() string {
+	bytes := "-"
+	if e.Bytes != 0 {
+		bytes = strconv.Itoa(e.Bytes)
+	}
+
+	return fmt.Sprintf(`%s - - [%s] "%s %s %s" %d %s %s %s`,
+		e.ClientIP,
+		e.Time.Format(accessLogTimeFormat),
+		e.Method, e.URI, e.Proto,
+		e.Status,
+		bytes,
+		quoteOrDash(e.Referrer),
+		quoteOrDash(e.UserAgent))
+}
+
+// NewAccessLogEntry creates the log entry for a completed request.
+func NewAccessLogEntry(r *http.Request, clientIP string, startTime time.Time,
+	duration time.Duration, status, bytes int) AccessLogEntry {
+
+	return AccessLogEntry{
+		Time:       startTime,
+		ClientIP:   clientIP,
+		Method:     r.Method,
+		URI:        r.RequestURI,
+		Proto:      r.Proto,
+		Host:       r.Host,
+		Status:     status,
+		Bytes:      bytes,
+		Referrer:   r.Referer(),
+		UserAgent:  r.UserAgent(),
+		DurationUs: int64(duration / time.Microsecond),
+	}
+}
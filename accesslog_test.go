@@ -0,0 +1,172 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestClientIP(t *testing.T) {
+	proxies, err := ParseTrustedProxies("10.0.0.0/8, 192.168.1.1, ::1")
+	if err != nil {
+		t.Fatal("ParseTrustedProxies failed:", err)
+	}
+
+	tests := []struct {
+		remoteAddr string
+		forwarded  []string
+		expected   string
+	}{
+		{"1.2.3.4:5678", nil, "1.2.3.4"},
+		// Untrusted client can't spoof its address.
+		{"1.2.3.4:5678", []string{"5.6.7.8"}, "1.2.3.4"},
+		{"192.168.1.1:80", []string{"5.6.7.8"}, "5.6.7.8"},
+		{"[::1]:80", []string{"5.6.7.8"}, "5.6.7.8"},
+		// Skip over trusted proxies in the chain, but not untrusted ones.
+		{"10.1.1.1:80", []string{"9.9.9.9, 5.6.7.8, 10.2.2.2"}, "5.6.7.8"},
+		{"10.1.1.1:80", []string{"9.9.9.9", "5.6.7.8, 10.2.2.2"}, "5.6.7.8"},
+		// Everything in the chain is trusted.
+		{"10.1.1.1:80", []string{"10.2.2.2"}, "10.2.2.2"},
+		// Stop at garbage.
+		{"10.1.1.1:80", []string{"5.6.7.8, garbage"}, "10.1.1.1"},
+		{"10.1.1.1:80", nil, "10.1.1.1"},
+	}
+
+	for _, test := range tests {
+		r, _ := http.NewRequest("GET", "/", nil)
+		r.RemoteAddr = test.remoteAddr
+		for _, f := range test.forwarded {
+			r.Header.Add("X-Forwarded-For", f)
+		}
+
+		ip := proxies.ClientIP(r)
+		if ip != test.expected {
+			t.Errorf("%s with X-Forwarded-For %v: expected %s, saw %s",
+				test.remoteAddr, test.forwarded, test.expected, ip)
+		}
+	}
+
+	_, err = ParseTrustedProxies("10.0.0.0/8, notanip")
+	if err == nil {
+		t.Error("ParseTrustedProxies accepted an invalid address")
+	}
+}
+
+func testAccessLogEntry() AccessLogEntry {
+	r, _ := http.NewRequest("GET", "http://localhost/2014/05/first-post", nil)
+	r.RequestURI = "/2014/05/first-post"
+	r.Header.Set("Referer", "http://example.com/")
+	r.Header.Set("User-Agent", `Agent "with quotes"`)
+	startTime := time.Date(2014, 5, 14, 23, 14, 0, 0, time.UTC)
+	return NewAccessLogEntry(r, "1.2.3.4", startTime, 1500*time.Microsecond, 200, 1234)
+}
+
+func TestAccessLogFormats(t *testing.T) {
+	entry := testAccessLogEntry()
+	expected := `1.2.3.4 - - [14/May/2014:23:14:00 +0000] "GET /2014/05/first-post HTTP/1.1" 200 1234 ` +
+		`"http://example.com/" "Agent \"with quotes\""`
+	if line := entry.Combined(); line != expected {
+		t.Errorf("Expected combined log line\n%s\nsaw\n%s", expected, line)
+	}
+
+	entry.Bytes = 0
+	entry.Referrer = ""
+	if line := entry.Combined(); !strings.Contains(line, ` 200 - "-" `) {
+		t.Errorf("Empty values not shown as dashes: %s", line)
+	}
+
+	dir, err := ioutil.TempDir("", "accesslog")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	logPath := filepath.Join(dir, "access.log")
+	al, err := NewAccessLog(logPath, AccessLogJSON, 0, 0, 0)
+	if err != nil {
+		t.Fatal("NewAccessLog failed:", err)
+	}
+	al.Log(testAccessLogEntry())
+	al.Close()
+
+	buf, _ := ioutil.ReadFile(logPath)
+	decoded := AccessLogEntry{}
+	if err := json.Unmarshal(buf, &decoded); err != nil {
+		t.Fatalf("Could not decode JSON log line %s: %s", string(buf), err)
+	}
+	if decoded.ClientIP != "1.2.3.4" || decoded.Status != 200 || decoded.DurationUs != 1500 {
+		t.Errorf("Unexpected JSON log entry %+v", decoded)
+	}
+
+	if _, err := NewAccessLog(logPath, "apache", 0, 0, 0); err == nil {
+		t.Error("NewAccessLog accepted an unknown format")
+	}
+}
+
+func TestAccessLogRotation(t *testing.T) {
+	dir, err := ioutil.TempDir("", "accesslog")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	logPath := filepath.Join(dir, "access.log")
+	lineLength := len(testAccessLogEntry().Combined()) + 1
+	al, err := NewAccessLog(logPath, AccessLogCombined, int64(lineLength*2), time.Hour, 2)
+	if err != nil {
+		t.Fatal("NewAccessLog failed:", err)
+	}
+	defer al.Close()
+
+	now := time.Date(2014, 5, 14, 0, 0, 0, 0, time.UTC)
+	al.now = func() time.Time { return now }
+
+	countRotated := func() int {
+		rotated, _ := filepath.Glob(logPath + ".*")
+		return len(rotated)
+	}
+
+	al.Log(testAccessLogEntry())
+	al.Log(testAccessLogEntry())
+	if countRotated() != 0 {
+		t.Error("Log rotated before reaching the size limit")
+	}
+
+	now = now.Add(time.Second)
+	al.Log(testAccessLogEntry())
+	if countRotated() != 1 {
+		t.Error("Log did not rotate at the size limit")
+	}
+
+	now = now.Add(2 * time.Hour)
+	al.Log(testAccessLogEntry())
+	if countRotated() != 2 {
+		t.Error("Log did not rotate at the age limit")
+	}
+
+	now = now.Add(2 * time.Hour)
+	al.Log(testAccessLogEntry())
+	if countRotated() != 2 {
+		t.Errorf("Expected 2 rotated logs to be kept, saw %d", countRotated())
+	}
+
+	buf, _ := ioutil.ReadFile(logPath)
+	if len(buf) != lineLength {
+		t.Errorf("Expected current log to have one line, saw %s", string(buf))
+	}
+
+	// Rotating twice at the same time keeps both logs.
+	os.Remove(logPath + "." + now.Format(rotatedLogTimeFormat))
+	al.lock.Lock()
+	al.rotate()
+	al.rotate()
+	al.lock.Unlock()
+	if rotated, _ := filepath.Glob(logPath + "." + now.Format(rotatedLogTimeFormat) + "*"); len(rotated) != 2 {
+		t.Errorf("Expected both logs rotated at the same time to be kept, saw %v", rotated)
+	}
+}
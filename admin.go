@@ -0,0 +1,209 @@
+package main
+
+import (
+	"encoding/json"
+	"github.com/dimfeld/glog"
+	"github.com/dimfeld/httptreemux"
+	"html/template"
+	"net/http"
+)
+
+// setupAdminRouter creates the router for the administrative endpoints. These are served on
+// config.AdminAddr, separate from the public site. If any Users are configured, every
+// endpoint except the login page requires signing in. Otherwise, only the endpoints that
+// read are served.
+func setupAdminRouter(globalData *GlobalData) *httptreemux.TreeMux {
+	router := httptreemux.New()
+	router.PanicHandler = httptreemux.ShowErrorsPanicHandler
+
+	auth := globalData.auth
+	// protect requires a signed in user before running the handler.
+	protect := func(route string, handler simpleBlogHandler) httptreemux.HandlerFunc {
+		return handlerWrapper(route, auth.Protect("/login", handler), globalData)
+	}
+
+	if auth.Enabled() {
+		router.GET("/login", handlerWrapper(RouteAdmin, auth.loginFormHandler, globalData))
+		router.POST("/login", handlerWrapper(RouteAdmin, auth.loginHandler, globalData))
+		router.POST("/logout", protect(RouteAdmin, auth.logoutHandler))
+	}
+
+	router.GET("/cache/stats", protect(RouteAdmin, cacheStatsHandler))
+	router.GET("/metrics", protect(RouteMetrics, metricsHandler))
+	if globalData.comments != nil {
+		router.GET("/comments", protect(RouteAdmin, commentQueueHandler))
+	}
+
+	// Nothing can be changed without signing in.
+	if !auth.Enabled() {
+		if config.EnableEditor {
+			glog.Warningln("EnableEditor is set, but the editor is disabled because no Users are configured")
+		}
+		return router
+	}
+
+	router.POST("/cache/purge", protect(RouteAdmin, cachePurgeHandler))
+	router.POST("/cache/purge-all", protect(RouteAdmin, cachePurgeAllHandler))
+	if globalData.comments != nil {
+		router.POST("/comments/approve", protect(RouteAdmin, commentApproveHandler))
+		router.POST("/comments/delete", protect(RouteAdmin, commentDeleteHandler))
+	}
+
+	if config.EnableEditor {
+		editor := NewEditor(auth.csrf)
+		router.GET("/admin/", protect(RouteAdmin, editor.listHandler))
+		router.GET("/admin/new", protect(RouteAdmin, editor.newHandler))
+		router.GET("/admin/edit/*post", protect(RouteAdmin, editor.editHandler))
+		router.POST("/admin/save", protect(RouteAdmin, editor.saveHandler))
+		router.POST("/admin/delete", protect(RouteAdmin, editor.deleteHandler))
+		router.POST("/admin/preview", protect(RouteAdmin, editor.previewHandler))
+		router.GET("/admin/tags", protect(RouteAdmin, editor.tagsHandler))
+		router.POST("/admin/images", protect(RouteAdmin, editor.imageUploadHandler))
+	}
+
+	return router
+}
+
+func sendJSON(w http.ResponseWriter, r *http.Request, data interface{}) {
+	buf, err := json.MarshalIndent(data, "", "  ")
+	if err != nil {
+		handleError(w, r, err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Write(buf)
+}
+
+func cacheStatsHandler(globalData *GlobalData, w http.ResponseWriter,
+	r *http.Request, urlParams map[string]string) {
+
+	sendJSON(w, r, globalData.stats.Snapshot())
+}
+
+// cachePurgeHandler removes the object with the cache key given in the "key" form value,
+// along with its compressed variants.
+func cachePurgeHandler(globalData *GlobalData, w http.ResponseWriter,
+	r *http.Request, urlParams map[string]string) {
+
+	key := r.FormValue("key")
+	if key == "" {
+		http.Error(w, "Missing key", http.StatusBadRequest)
+		return
+	}
+
+	glog.Infoln("Admin purging cache key", key)
+	keys := cacheKeyVariants(key)
+	for _, variant := range keys {
+		globalData.cache.Del(variant)
+	}
+
+	sendJSON(w, r, map[string][]string{"Purged": keys})
+}
+
+func cachePurgeAllHandler(globalData *GlobalData, w http.ResponseWriter,
+	r *http.Request, urlParams map[string]string) {
+
+	glog.Infoln("Admin purging entire cache")
+	globalData.cache.Del("*")
+	globalData.deps.Reset()
+	globalData.notFound.Del("*")
+	globalData.warmer.Warm()
+
+	sendJSON(w, r, map[string][]string{"Purged": {"*"}})
+}
+
+var commentQueueTemplate = template.Must(template.New("queue").Funcs(templateFuncs).Parse(`<!DOCTYPE html>
+<html lang="en">
+<head><title>Comment moderation</title></head>
+<body>
+<h1>Comments awaiting moderation</h1>
+{{$csrf := .}}
+{{range .Comments}}
+<div class="comment">
+	<p><a href="/{{.Post}}">{{.Post}}</a>
+		{{if .ParentID}}(reply to {{.ParentID}}){{end}}</p>
+	<p>{{.Author}}{{with .Email}} &lt;{{.}}&gt;{{end}}{{with .URL}} {{.}}{{end}},
+		{{FormatTime .Timestamp}}</p>
+	<div class="body">{{.HTMLContent}}</div>
+	<form method="post" action="/comments/approve">
+		<input type="hidden" name="{{$csrf.CSRFField}}" value="{{$csrf.Token}}">
+		<input type="hidden" name="post" value="{{.Post}}">
+		<input type="hidden" name="id" value="{{.ID}}">
+		<button type="submit">Approve</button>
+	</form>
+	<form method="post" action="/comments/delete">
+		<input type="hidden" name="{{$csrf.CSRFField}}" value="{{$csrf.Token}}">
+		<input type="hidden" name="post" value="{{.Post}}">
+		<input type="hidden" name="id" value="{{.ID}}">
+		<button type="submit">Delete</button>
+	</form>
+</div>
+{{else}}
+<p>No comments are waiting.</p>
+{{end}}
+</body>
+</html>
+`))
+
+// CommentQueue is the template data for the moderation page.
+type CommentQueue struct {
+	Comments  []*Comment
+	CSRFField string
+	Token     string
+}
+
+// commentQueueHandler shows the comments waiting for moderation.
+func commentQueueHandler(globalData *GlobalData, w http.ResponseWriter,
+	r *http.Request, urlParams map[string]string) {
+
+	pending, err := globalData.comments.Pending()
+	if err != nil {
+		handleError(w, r, err)
+		return
+	}
+
+	token, err := globalData.auth.csrf.Token(w, r)
+	if err != nil {
+		handleError(w, r, err)
+		return
+	}
+
+	sendAdminPage(w, commentQueueTemplate, CommentQueue{
+		Comments:  pending,
+		CSRFField: globalData.auth.csrf.Field,
+		Token:     token,
+	}, http.StatusOK)
+}
+
+// moderateComment applies a moderation action to the comment named in the form, then
+// removes the post's page from the cache so that it shows the change.
+func moderateComment(globalData *GlobalData, w http.ResponseWriter, r *http.Request,
+	action func(post, id string) error) {
+
+	post := r.PostFormValue("post")
+	err := action(post, r.PostFormValue("id"))
+	if err == ErrCommentNotFound {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	} else if err != nil {
+		handleError(w, r, err)
+		return
+	}
+
+	globalData.deps.Invalidate(globalData.cache, CommentsDependency(postSourcePath(post)))
+	http.Redirect(w, r, "/comments", http.StatusSeeOther)
+}
+
+func commentApproveHandler(globalData *GlobalData, w http.ResponseWriter,
+	r *http.Request, urlParams map[string]string) {
+
+	moderateComment(globalData, w, r, globalData.comments.Approve)
+}
+
+func commentDeleteHandler(globalData *GlobalData, w http.ResponseWriter,
+	r *http.Request, urlParams map[string]string) {
+
+	moderateComment(globalData, w, r, globalData.comments.Delete)
+}
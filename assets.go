@@ -0,0 +1,138 @@
+package main
+
+import (
+	"github.com/dimfeld/glog"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"sync"
+)
+
+// AssetManifest holds the content fingerprint of each file in the assets directory,
+// so that templates can link to URLs that change whenever the file does.
+type AssetManifest struct {
+	lock sync.RWMutex
+	dir  string
+	// Fingerprints indexed by path relative to the assets directory, with forward slashes.
+	fingerprints map[string]string
+}
+
+// assetManifest is used by the asset template function.
+var assetManifest *AssetManifest
+
+func NewAssetManifest(dir string) *AssetManifest {
+	return &AssetManifest{dir: dir, fingerprints: make(map[string]string)}
+}
+
+// Scan fingerprints every file in the assets directory.
+func (am *AssetManifest) Scan() error {
+	fingerprints := make(map[string]string)
+	err := filepath.Walk(am.dir, func(filePath string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if info.IsDir() || path.Base(filePath)[0] == '.' {
+			return nil
+		}
+
+		relPath, err := filepath.Rel(am.dir, filePath)
+		if err != nil {
+			return err
+		}
+
+		data, err := ioutil.ReadFile(filePath)
+		if err != nil {
+			glog.Errorf("Could not fingerprint asset %s: %s", filePath, err)
+			return nil
+		}
+		fingerprints[filepath.ToSlash(relPath)] = contentFingerprint(data)
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	am.lock.Lock()
+	am.fingerprints = fingerprints
+	am.updateBundles()
+	am.lock.Unlock()
+	return nil
+}
+
+// Update refingerprints a single asset, given its path relative to the assets directory.
+// It returns true if the fingerprint changed.
+func (am *AssetManifest) Update(name string) bool {
+	name = filepath.ToSlash(name)
+	fingerprint := ""
+	data, err := ioutil.ReadFile(filepath.Join(am.dir, filepath.FromSlash(name)))
+	if err == nil {
+		fingerprint = contentFingerprint(data)
+	}
+
+	am.lock.Lock()
+	defer am.lock.Unlock()
+
+	old := am.fingerprints[name]
+	if fingerprint == "" {
+		delete(am.fingerprints, name)
+	} else {
+		am.fingerprints[name] = fingerprint
+	}
+	am.updateBundles()
+	return old != fingerprint
+}
+
+// updateBundles fingerprints each bundle from the fingerprints of its sources,
+// so that a bundle's URL changes whenever any of its sources do. The lock must be held.
+func (am *AssetManifest) updateBundles() {
+	for name, sources := range config.Bundles {
+		delete(am.fingerprints, name)
+
+		combined := make([]string, 0, len(sources))
+		for _, source := range sources {
+			fingerprint, ok := am.fingerprints[source]
+			if !ok {
+				break
+			}
+			combined = append(combined, source+"="+fingerprint)
+		}
+
+		if len(combined) == len(sources) {
+			am.fingerprints[name] = contentFingerprint([]byte(strings.Join(combined, "\n")))
+		}
+	}
+}
+
+// Fingerprint returns the fingerprint for an asset, given its path relative to the
+// assets directory.
+func (am *AssetManifest) Fingerprint(name string) (string, bool) {
+	if am == nil {
+		return "", false
+	}
+	am.lock.RLock()
+	defer am.lock.RUnlock()
+	fingerprint, ok := am.fingerprints[name]
+	return fingerprint, ok
+}
+
+// URL returns the fingerprinted URL for an asset, or its plain URL if it isn't in the manifest.
+func (am *AssetManifest) URL(name string) string {
+	plainURL := "/" + path.Join("assets", name)
+	if am == nil {
+		return plainURL
+	}
+
+	fingerprint, ok := am.Fingerprint(path.Clean(name))
+	if !ok {
+		return plainURL
+	}
+	return fingerprintedName(plainURL, fingerprint)
+}
+
+// AssetURL is the asset template function. Given a path relative to the assets directory,
+// such as "style.css", it returns the URL of the current version of the file.
+func AssetURL(name string) string {
+	return assetManifest.URL(name)
+}
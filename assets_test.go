@@ -0,0 +1,60 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestAssetManifest(t *testing.T) {
+	dir, err := ioutil.TempDir("", "simpleblog-assets")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	stylePath := filepath.Join(dir, "style.css")
+	ioutil.WriteFile(stylePath, []byte("body { color: red; }"), 0644)
+	os.Mkdir(filepath.Join(dir, "js"), 0755)
+	ioutil.WriteFile(filepath.Join(dir, "js", "site.js"), []byte("var x;"), 0644)
+
+	manifest := NewAssetManifest(dir)
+	if err := manifest.Scan(); err != nil {
+		t.Fatal(err)
+	}
+
+	fingerprint, ok := manifest.Fingerprint("style.css")
+	if !ok || fingerprint != contentFingerprint([]byte("body { color: red; }")) {
+		t.Fatalf("Unexpected fingerprint %s for style.css", fingerprint)
+	}
+	if url := manifest.URL("style.css"); url != "/assets/style."+fingerprint+".css" {
+		t.Errorf("Unexpected URL %s for style.css", url)
+	}
+	if _, ok := manifest.Fingerprint("js/site.js"); !ok {
+		t.Error("Asset in subdirectory was not fingerprinted")
+	}
+	if url := manifest.URL("missing.css"); url != "/assets/missing.css" {
+		t.Errorf("Expected plain URL for unknown asset, saw %s", url)
+	}
+
+	if manifest.Update("style.css") {
+		t.Error("Update reported a change for an unchanged file")
+	}
+	ioutil.WriteFile(stylePath, []byte("body { color: blue; }"), 0644)
+	if !manifest.Update("style.css") {
+		t.Error("Update did not report a change for a modified file")
+	}
+	os.Remove(stylePath)
+	if !manifest.Update("style.css") {
+		t.Error("Update did not report a change for a removed file")
+	}
+	if _, ok := manifest.Fingerprint("style.css"); ok {
+		t.Error("Removed file is still in the manifest")
+	}
+
+	var nilManifest *AssetManifest
+	if url := nilManifest.URL("style.css"); url != "/assets/style.css" {
+		t.Errorf("Expected plain URL without a manifest, saw %s", url)
+	}
+}
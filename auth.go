@@ -0,0 +1,490 @@
+package main
+
+import (
+	"bufio"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha1"
+	"crypto/subtle"
+	"encoding/base32"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"flag"
+	"fmt"
+	"github.com/dimfeld/glog"
+	"golang.org/x/crypto/argon2"
+	"golang.org/x/crypto/bcrypt"
+	"html/template"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+var hashPasswordFlag = flag.Bool("hash-password", false,
+	"Read a password from standard input, print its hash for the Users config, and exit")
+
+const (
+	sessionCookieName   = "admin_session"
+	adminCSRFCookieName = "admin_csrf"
+	// TOTP codes change every totpPeriod seconds. Codes from one period before and after
+	// the current one are accepted, to allow for clock drift.
+	totpPeriod = 30
+)
+
+// Compared against when the user doesn't exist, so that the response takes as long as it
+// does for a wrong password.
+const dummyPasswordHash = "$2a$10$TTnF.l9Lu4Kv9/Y2K6mWB.HEVlvsxPzNCkYdK6a7B2AwZuNqvTXae"
+
+// UserConfig is an account that can sign in to the admin endpoints.
+type UserConfig struct {
+	// bcrypt or argon2id hash of the password, such as the one printed by -hash-password.
+	PasswordHash string
+	// Base32 secret for a TOTP authenticator app. If empty, the password is enough.
+	TOTPSecret string
+}
+
+// argon2Params are the parameters encoded in an argon2id hash, in the
+// $argon2id$v=19$m=65536,t=3,p=4$salt$key format.
+type argon2Params struct {
+	memory  uint32
+	time    uint32
+	threads uint8
+	salt    []byte
+	key     []byte
+}
+
+func parseArgon2Hash(hash string) (*argon2Params, error) {
+	parts := strings.Split(hash, "$")
+	if len(parts) != 6 || parts[1] != "argon2id" {
+		return nil, errors.New("not an argon2id hash")
+	}
+	var version int
+	if _, err := fmt.Sscanf(parts[2], "v=%d", &version); err != nil || version != argon2.Version {
+		return nil, fmt.Errorf("unsupported argon2 version %s", parts[2])
+	}
+
+	p := &argon2Params{}
+	var threads uint
+	if _, err := fmt.Sscanf(parts[3], "m=%d,t=%d,p=%d", &p.memory, &p.time, &threads); err != nil {
+		return nil, fmt.Errorf("invalid argon2 parameters %s", parts[3])
+	}
+	if threads == 0 || threads > 255 {
+		return nil, fmt.Errorf("invalid argon2 parallelism %d", threads)
+	}
+	p.threads = uint8(threads)
+
+	var err error
+	if p.salt, err = base64.RawStdEncoding.DecodeString(parts[4]); err != nil {
+		return nil, fmt.Errorf("invalid argon2 salt: %s", err)
+	}
+	if p.key, err = base64.RawStdEncoding.DecodeString(parts[5]); err != nil || len(p.key) == 0 {
+		return nil, errors.New("invalid argon2 key")
+	}
+	return p, nil
+}
+
+// validPasswordHash returns an error if the hash isn't a bcrypt or argon2id hash.
+func validPasswordHash(hash string) error {
+	if strings.HasPrefix(hash, "$argon2") {
+		_, err := parseArgon2Hash(hash)
+		return err
+	}
+	_, err := bcrypt.Cost([]byte(hash))
+	return err
+}
+
+// checkPassword returns true if the password matches the hash.
+func checkPassword(hash, password string) bool {
+	if strings.HasPrefix(hash, "$argon2") {
+		p, err := parseArgon2Hash(hash)
+		if err != nil {
+			return false
+		}
+		key := argon2.IDKey([]byte(password), p.salt, p.time, p.memory, p.threads, uint32(len(p.key)))
+		return subtle.ConstantTimeCompare(key, p.key) == 1
+	}
+	return bcrypt.CompareHashAndPassword([]byte(hash), []byte(password)) == nil
+}
+
+func decodeTOTPSecret(secret string) ([]byte, error) {
+	secret = strings.ToUpper(strings.Replace(secret, " ", "", -1))
+	return base32.StdEncoding.WithPadding(base32.NoPadding).DecodeString(strings.TrimRight(secret, "="))
+}
+
+// totpCode returns the code for a time step, as described in RFC 6238.
+func totpCode(key []byte, step int64) string {
+	var msg [8]byte
+	binary.BigEndian.PutUint64(msg[:], uint64(step))
+	mac := hmac.New(sha1.New, key)
+	mac.Write(msg[:])
+	sum := mac.Sum(nil)
+
+	offset := sum[len(sum)-1] & 0xf
+	value := binary.BigEndian.Uint32(sum[offset:offset+4]) & 0x7fffffff
+	return fmt.Sprintf("%06d", value%1000000)
+}
+
+// Session is a signed in user.
+type Session struct {
+	User    string
+	Expires time.Time
+}
+
+// Auth controls access to the admin endpoints. Users sign in with a password and, if they
+// have a TOTP secret, a code from their authenticator app. Sessions are kept in memory, so
+// everyone has to sign in again after a restart.
+type Auth struct {
+	users map[string]UserConfig
+	// Protects every form on the admin endpoints.
+	csrf    *CSRF
+	limiter *RateLimiter
+	ttl     time.Duration
+
+	lock     sync.Mutex
+	sessions map[string]*Session
+	// The last TOTP time step used by each user, so that a code can't be used twice.
+	usedSteps map[string]int64
+	now       func() time.Time
+}
+
+// NewAuth creates an Auth for the users in the config. If there are no users, no one needs
+// to sign in, and setupAdminRouter leaves out the endpoints that change anything.
+func NewAuth() (*Auth, error) {
+	for name, user := range config.Users {
+		if err := validPasswordHash(user.PasswordHash); err != nil {
+			return nil, fmt.Errorf("user %s has an invalid password hash: %s", name, err)
+		}
+		if user.TOTPSecret != "" {
+			if key, err := decodeTOTPSecret(user.TOTPSecret); err != nil || len(key) < 10 {
+				return nil, fmt.Errorf("user %s has an invalid TOTP secret", name)
+			}
+		}
+	}
+
+	csrf, err := NewCSRF(config.CSRFSecret, "/")
+	if err != nil {
+		return nil, err
+	}
+	// The public site uses the default cookie name, and cookies are shared between ports.
+	csrf.Cookie = adminCSRFCookieName
+
+	ttl := time.Duration(config.SessionTTL) * time.Hour
+	if ttl <= 0 {
+		ttl = 12 * time.Hour
+	}
+
+	return &Auth{
+		users: config.Users,
+		csrf:  csrf,
+		// Five failed attempts, then one more every minute.
+		limiter:   NewRateLimiter(1.0/60, 5),
+		ttl:       ttl,
+		sessions:  make(map[string]*Session),
+		usedSteps: make(map[string]int64),
+		now:       time.Now,
+	}, nil
+}
+
+// Enabled returns true if any users are configured.
+func (a *Auth) Enabled() bool {
+	return len(a.users) != 0
+}
+
+// checkTOTP returns true if the code is valid for the user and hasn't been used before.
+func (a *Auth) checkTOTP(name, secret, code string) bool {
+	key, err := decodeTOTPSecret(secret)
+	if err != nil {
+		return false
+	}
+	code = strings.Replace(code, " ", "", -1)
+
+	a.lock.Lock()
+	defer a.lock.Unlock()
+	current := a.now().Unix() / totpPeriod
+	for step := current - 1; step <= current+1; step++ {
+		if step > a.usedSteps[name] && subtle.ConstantTimeCompare([]byte(totpCode(key, step)), []byte(code)) == 1 {
+			a.usedSteps[name] = step
+			return true
+		}
+	}
+	return false
+}
+
+// checkLogin returns true if the credentials are correct.
+func (a *Auth) checkLogin(name, password, code string) bool {
+	user, found := a.users[name]
+	if !found {
+		checkPassword(dummyPasswordHash, password)
+		return false
+	}
+	if !checkPassword(user.PasswordHash, password) {
+		return false
+	}
+	return user.TOTPSecret == "" || a.checkTOTP(name, user.TOTPSecret, code)
+}
+
+// newSession starts a session for the user, and returns its ID.
+func (a *Auth) newSession(name string) (string, error) {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	id := base64.RawURLEncoding.EncodeToString(b)
+
+	a.lock.Lock()
+	defer a.lock.Unlock()
+	now := a.now()
+	for sid, session := range a.sessions {
+		if now.After(session.Expires) {
+			delete(a.sessions, sid)
+		}
+	}
+	a.sessions[id] = &Session{User: name, Expires: now.Add(a.ttl)}
+	return id, nil
+}
+
+// session returns the unexpired session for the request's cookie, or nil.
+func (a *Auth) session(r *http.Request) *Session {
+	cookie, err := r.Cookie(sessionCookieName)
+	if err != nil {
+		return nil
+	}
+
+	a.lock.Lock()
+	defer a.lock.Unlock()
+	session := a.sessions[cookie.Value]
+	if session == nil {
+		return nil
+	}
+	if _, found := a.users[session.User]; !found || a.now().After(session.Expires) {
+		delete(a.sessions, cookie.Value)
+		return nil
+	}
+	return session
+}
+
+func (a *Auth) endSession(r *http.Request) {
+	if cookie, err := r.Cookie(sessionCookieName); err == nil {
+		a.lock.Lock()
+		delete(a.sessions, cookie.Value)
+		a.lock.Unlock()
+	}
+}
+
+func safeMethod(method string) bool {
+	return method == "GET" || method == "HEAD"
+}
+
+// requestUser returns the name of the user making the request, or an empty string.
+// Clients that can't keep a session, such as Prometheus, can use basic authentication,
+// but only to read, and only for users without a TOTP secret.
+func (a *Auth) requestUser(globalData *GlobalData, r *http.Request) string {
+	if session := a.session(r); session != nil {
+		return session.User
+	}
+
+	name, password, ok := r.BasicAuth()
+	if !ok || !safeMethod(r.Method) {
+		return ""
+	}
+	// Take a token before checking, so that many requests at once can't all be checked,
+	// and give it back if the password was right.
+	client := globalData.proxies.ClientIP(r)
+	if !a.limiter.Take(client) {
+		return ""
+	}
+	if user, found := a.users[name]; found && user.TOTPSecret == "" && checkPassword(user.PasswordHash, password) {
+		a.limiter.Refund(client)
+		return name
+	}
+	return ""
+}
+
+// Protect wraps a handler so that it requires a signed in user, if any users are configured.
+// Browsers asking for a page are sent to loginPath, unless it is empty. Requests that change
+// something must always have the CSRF token.
+func (a *Auth) Protect(loginPath string, handler simpleBlogHandler) simpleBlogHandler {
+	return func(globalData *GlobalData, w http.ResponseWriter, r *http.Request, urlParams map[string]string) {
+		if a.Enabled() && a.requestUser(globalData, r) == "" {
+			if loginPath != "" && safeMethod(r.Method) && strings.Contains(r.Header.Get("Accept"), "text/html") {
+				http.Redirect(w, r, loginPath+"?next="+url.QueryEscape(r.URL.RequestURI()), http.StatusSeeOther)
+				return
+			}
+			w.Header().Set("WWW-Authenticate", `Basic realm="simpleblog admin", charset="UTF-8"`)
+			http.Error(w, "Sign in required", http.StatusUnauthorized)
+			return
+		}
+
+		if !safeMethod(r.Method) {
+			// Reading the token parses the form, so apply the largest limit of any admin
+			// form here. Handlers with smaller limits check them again.
+			limit := int64(10 * 1024 * 1024)
+			if upload := int64(config.ImageUploadMaxSize) + 4096; upload > limit {
+				limit = upload
+			}
+			r.Body = http.MaxBytesReader(w, r.Body, limit)
+			if !a.csrf.Verify(r) {
+				http.Error(w, "Invalid CSRF token", http.StatusForbidden)
+				return
+			}
+		}
+		handler(globalData, w, r, urlParams)
+	}
+}
+
+// adminHome returns where to go after signing in, if the login page didn't say.
+func adminHome() string {
+	if config.EnableEditor {
+		return "/admin/"
+	}
+	return "/cache/stats"
+}
+
+// localRedirect returns target if it is a path on this site, or adminHome otherwise,
+// so that the login page can't be used to send someone elsewhere.
+func localRedirect(target string) string {
+	if !strings.HasPrefix(target, "/") || strings.HasPrefix(target, "//") || strings.Contains(target, `\`) {
+		return adminHome()
+	}
+	return target
+}
+
+// LoginForm is the template data for the login page.
+type LoginForm struct {
+	User      string
+	Next      string
+	Error     string
+	CSRFField string
+	Token     string
+}
+
+var loginTemplate = template.Must(template.New("login").Parse(`<!DOCTYPE html>
+<html lang="en">
+<head><title>Sign in</title></head>
+<body>
+<h1>Sign in</h1>
+{{with .Error}}<p class="errors">{{.}}</p>{{end}}
+<form method="post" action="/login">
+	<input type="hidden" name="{{.CSRFField}}" value="{{.Token}}">
+	<input type="hidden" name="next" value="{{.Next}}">
+	<p><label>User <input type="text" name="user" value="{{.User}}" autocomplete="username" required autofocus></label></p>
+	<p><label>Password <input type="password" name="password" autocomplete="current-password" required></label></p>
+	<p><label>Code <input type="text" name="code" inputmode="numeric" autocomplete="one-time-code"
+		placeholder="If you use an authenticator app"></label></p>
+	<button type="submit">Sign in</button>
+</form>
+</body>
+</html>
+`))
+
+func (a *Auth) renderLogin(w http.ResponseWriter, r *http.Request, form *LoginForm, status int) {
+	token, err := a.csrf.Token(w, r)
+	if err != nil {
+		handleError(w, r, err)
+		return
+	}
+	form.CSRFField = a.csrf.Field
+	form.Token = token
+	sendAdminPage(w, loginTemplate, form, status)
+}
+
+func (a *Auth) loginFormHandler(globalData *GlobalData, w http.ResponseWriter,
+	r *http.Request, urlParams map[string]string) {
+
+	a.renderLogin(w, r, &LoginForm{Next: localRedirect(r.FormValue("next"))}, http.StatusOK)
+}
+
+func (a *Auth) loginHandler(globalData *GlobalData, w http.ResponseWriter,
+	r *http.Request, urlParams map[string]string) {
+
+	r.Body = http.MaxBytesReader(w, r.Body, 64*1024)
+	if err := r.ParseForm(); err != nil {
+		http.Error(w, "Invalid form", http.StatusBadRequest)
+		return
+	}
+
+	name := strings.TrimSpace(r.PostFormValue("user"))
+	form := &LoginForm{User: name, Next: localRedirect(r.PostFormValue("next"))}
+	if !a.csrf.Verify(r) {
+		form.Error = "The login page expired. Please try again."
+		a.renderLogin(w, r, form, http.StatusForbidden)
+		return
+	}
+
+	// Every attempt takes a token, and a successful one gives it back.
+	client := globalData.proxies.ClientIP(r)
+	if !a.limiter.Take(client) {
+		w.Header().Set("Retry-After", fmt.Sprintf("%.0f", a.limiter.RetryAfter(client).Seconds()+1))
+		form.Error = "Too many failed attempts. Please try again later."
+		a.renderLogin(w, r, form, http.StatusTooManyRequests)
+		return
+	}
+
+	if !a.checkLogin(name, r.PostFormValue("password"), r.PostFormValue("code")) {
+		glog.Warningf("Failed login for %q from %s", name, client)
+		form.Error = "The user name, password, or code is wrong."
+		a.renderLogin(w, r, form, http.StatusUnauthorized)
+		return
+	}
+
+	a.limiter.Refund(client)
+
+	// Always start a new session, so that one set by someone else can't be taken over.
+	a.endSession(r)
+	id, err := a.newSession(name)
+	if err != nil {
+		handleError(w, r, err)
+		return
+	}
+	glog.Infof("%s signed in from %s", name, client)
+
+	http.SetCookie(w, &http.Cookie{
+		Name:     sessionCookieName,
+		Value:    id,
+		Path:     "/",
+		MaxAge:   int(a.ttl / time.Second),
+		Secure:   config.SecureCookies,
+		HttpOnly: true,
+		SameSite: http.SameSiteLaxMode,
+	})
+	http.Redirect(w, r, form.Next, http.StatusSeeOther)
+}
+
+// logoutHandler ends the session. It goes through Protect, so it needs the CSRF token.
+func (a *Auth) logoutHandler(globalData *GlobalData, w http.ResponseWriter,
+	r *http.Request, urlParams map[string]string) {
+
+	a.endSession(r)
+	http.SetCookie(w, &http.Cookie{
+		Name:     sessionCookieName,
+		Path:     "/",
+		MaxAge:   -1,
+		Secure:   config.SecureCookies,
+		HttpOnly: true,
+	})
+	http.Redirect(w, r, "/login", http.StatusSeeOther)
+}
+
+// hashPasswordCommand prints the hash of a password read from in, for the -hash-password
+// flag, and returns the exit code.
+func hashPasswordCommand(in io.Reader, out io.Writer) int {
+	password, _ := bufio.NewReader(in).ReadString('\n')
+	password = strings.TrimRight(password, "\r\n")
+	if password == "" {
+		fmt.Fprintln(os.Stderr, "Could not read a password")
+		return 1
+	}
+
+	hash, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "Could not hash password:", err)
+		return 1
+	}
+	fmt.Fprintln(out, string(hash))
+	return 0
+}
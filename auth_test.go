@@ -0,0 +1,287 @@
+package main
+
+import (
+	"bytes"
+	"encoding/base64"
+	"golang.org/x/crypto/argon2"
+	"golang.org/x/crypto/bcrypt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestCheckPassword(t *testing.T) {
+	bcryptHash, _ := bcrypt.GenerateFromPassword([]byte("secret"), bcrypt.MinCost)
+	salt := []byte("0123456789abcdef")
+	argon2Hash := "$argon2id$v=19$m=1024,t=1,p=1$" + base64.RawStdEncoding.EncodeToString(salt) + "$" +
+		base64.RawStdEncoding.EncodeToString(argon2.IDKey([]byte("secret"), salt, 1, 1024, 1, 32))
+
+	for _, hash := range []string{string(bcryptHash), argon2Hash} {
+		if err := validPasswordHash(hash); err != nil {
+			t.Errorf("Hash %s was not valid: %s", hash, err)
+		}
+		if !checkPassword(hash, "secret") {
+			t.Errorf("Right password did not match %s", hash)
+		}
+		if checkPassword(hash, "wrong") {
+			t.Errorf("Wrong password matched %s", hash)
+		}
+	}
+
+	for _, hash := range []string{"", "secret", "$argon2id$v=19$m=1024$salt$key", "$argon2i$v=19$m=1,t=1,p=1$c2FsdA$a2V5"} {
+		if validPasswordHash(hash) == nil {
+			t.Errorf("Expected %q to be invalid", hash)
+		}
+	}
+
+	out := &bytes.Buffer{}
+	if code := hashPasswordCommand(strings.NewReader("hunter2\n"), out); code != 0 {
+		t.Fatal("hashPasswordCommand failed")
+	}
+	if hash := strings.TrimSpace(out.String()); !checkPassword(hash, "hunter2") {
+		t.Errorf("Printed hash %q does not match the password", hash)
+	}
+}
+
+func TestTOTPCode(t *testing.T) {
+	// Test vectors from RFC 6238, truncated to six digits.
+	key := []byte("12345678901234567890")
+	tests := map[int64]string{
+		59:         "287082",
+		1111111109: "081804",
+		1234567890: "005924",
+		2000000000: "279037",
+	}
+	for seconds, expected := range tests {
+		if code := totpCode(key, seconds/totpPeriod); code != expected {
+			t.Errorf("Time %d: expected %s, saw %s", seconds, expected, code)
+		}
+	}
+
+	secret, err := decodeTOTPSecret("gezd gnbv gy3t qojq gezd gnbv gy3t qojq")
+	if err != nil || string(secret) != string(key) {
+		t.Errorf("Secret decoded to %q, %v", secret, err)
+	}
+}
+
+func TestAuth(t *testing.T) {
+	oldConfig := *config
+	defer func() { *config = oldConfig }()
+
+	hash, _ := bcrypt.GenerateFromPassword([]byte("secret"), bcrypt.MinCost)
+	config.Users = map[string]UserConfig{
+		"alice": {PasswordHash: string(hash)},
+		// "12345678901234567890" in base32.
+		"bob": {PasswordHash: string(hash), TOTPSecret: "GEZDGNBVGY3TQOJQGEZDGNBVGY3TQOJQ"},
+	}
+	config.EnableEditor = true
+
+	auth, err := NewAuth()
+	if err != nil {
+		t.Fatal(err)
+	}
+	now := time.Unix(59, 0)
+	auth.now = func() time.Time { return now }
+
+	globalData := &GlobalData{RWMutex: &sync.RWMutex{}, auth: auth}
+	protected := auth.Protect("/login", func(globalData *GlobalData, w http.ResponseWriter,
+		r *http.Request, urlParams map[string]string) {
+
+		w.Write([]byte("secret page"))
+	})
+	request := func(method, target string, body url.Values, cookies []*http.Cookie,
+		handler simpleBlogHandler) *httptest.ResponseRecorder {
+
+		r, _ := http.NewRequest(method, target, strings.NewReader(body.Encode()))
+		r.RemoteAddr = "192.0.2.1:1234"
+		r.Header.Set("Accept", "text/html")
+		r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		for _, cookie := range cookies {
+			r.AddCookie(cookie)
+		}
+		w := httptest.NewRecorder()
+		handler(globalData, w, r, nil)
+		return w
+	}
+
+	w := request("GET", "/admin/new", nil, nil, protected)
+	if w.Code != http.StatusSeeOther || w.Header().Get("Location") != "/login?next=%2Fadmin%2Fnew" {
+		t.Fatalf("Expected redirect to the login page, saw %d %s", w.Code, w.Header().Get("Location"))
+	}
+
+	w = request("GET", "/login?next=%2Fadmin%2Fnew", nil, nil, auth.loginFormHandler)
+	match := regexp.MustCompile(`name="csrf_token" value="([^"]+)"`).FindStringSubmatch(w.Body.String())
+	csrfCookies := w.Result().Cookies()
+	if w.Code != http.StatusOK || match == nil || len(csrfCookies) != 1 || csrfCookies[0].Name != adminCSRFCookieName {
+		t.Fatalf("Expected the login form with a CSRF token, saw %d", w.Code)
+	}
+	token := match[1]
+
+	login := func(user, password, code string) *httptest.ResponseRecorder {
+		form := url.Values{"csrf_token": {token}, "user": {user}, "password": {password},
+			"code": {code}, "next": {"/admin/new"}}
+		return request("POST", "/login", form, csrfCookies, auth.loginHandler)
+	}
+
+	if w := request("POST", "/login", url.Values{"user": {"alice"}, "password": {"secret"}}, nil,
+		auth.loginHandler); w.Code != http.StatusForbidden {
+		t.Errorf("Expected 403 logging in without the CSRF token, saw %d", w.Code)
+	}
+	if w := login("alice", "wrong", ""); w.Code != http.StatusUnauthorized {
+		t.Errorf("Expected 401 for a wrong password, saw %d", w.Code)
+	}
+	if w := login("nobody", "secret", ""); w.Code != http.StatusUnauthorized {
+		t.Errorf("Expected 401 for an unknown user, saw %d", w.Code)
+	}
+	if w := login("bob", "secret", "000000"); w.Code != http.StatusUnauthorized {
+		t.Errorf("Expected 401 for a wrong TOTP code, saw %d", w.Code)
+	}
+
+	w = login("bob", "secret", "287082")
+	if w.Code != http.StatusSeeOther || w.Header().Get("Location") != "/admin/new" {
+		t.Fatalf("Expected redirect after signing in, saw %d", w.Code)
+	}
+	session := w.Result().Cookies()
+	if len(session) != 1 || session[0].Name != sessionCookieName || !session[0].HttpOnly {
+		t.Fatalf("Expected a session cookie, saw %v", session)
+	}
+	if w := login("bob", "secret", "287082"); w.Code != http.StatusUnauthorized {
+		t.Errorf("Expected a used TOTP code to be refused, saw %d", w.Code)
+	}
+
+	if w := request("GET", "/admin/new", nil, session, protected); w.Code != http.StatusOK ||
+		w.Body.String() != "secret page" {
+		t.Errorf("Expected the page with a session, saw %d", w.Code)
+	}
+
+	// Changes need the CSRF token as well as the session.
+	both := append(session, csrfCookies...)
+	if w := request("POST", "/admin/save", url.Values{}, both, protected); w.Code != http.StatusForbidden {
+		t.Errorf("Expected 403 for a POST without the CSRF token, saw %d", w.Code)
+	}
+	if w := request("POST", "/admin/save", url.Values{"csrf_token": {token}}, both,
+		protected); w.Code != http.StatusOK {
+		t.Errorf("Expected a POST with the CSRF token to work, saw %d", w.Code)
+	}
+
+	basic := func(method, user string) int {
+		r, _ := http.NewRequest(method, "/metrics", nil)
+		r.RemoteAddr = "192.0.2.2:1234"
+		r.SetBasicAuth(user, "secret")
+		w := httptest.NewRecorder()
+		protected(globalData, w, r, nil)
+		return w.Code
+	}
+	if code := basic("GET", "alice"); code != http.StatusOK {
+		t.Errorf("Expected basic authentication to work for GET, saw %d", code)
+	}
+	if code := basic("POST", "alice"); code != http.StatusUnauthorized {
+		t.Errorf("Expected basic authentication to be refused for POST, saw %d", code)
+	}
+	if code := basic("GET", "bob"); code != http.StatusUnauthorized {
+		t.Errorf("Expected basic authentication to be refused for a user with TOTP, saw %d", code)
+	}
+
+	now = now.Add(13 * time.Hour)
+	if w := request("GET", "/admin/new", nil, session, protected); w.Code != http.StatusSeeOther {
+		t.Errorf("Expected an expired session to be refused, saw %d", w.Code)
+	}
+	now = time.Unix(59, 0)
+
+	w = login("alice", "secret", "")
+	session = w.Result().Cookies()
+	w = request("POST", "/logout", url.Values{"csrf_token": {token}}, append(session, csrfCookies...),
+		auth.Protect("/login", auth.logoutHandler))
+	if w.Code != http.StatusSeeOther {
+		t.Errorf("Expected redirect after logging out, saw %d", w.Code)
+	}
+	if w := request("GET", "/admin/new", nil, session, protected); w.Code != http.StatusSeeOther {
+		t.Errorf("Expected the session to end after logging out, saw %d", w.Code)
+	}
+
+	// Failed attempts used up most of the limit, but signing in successfully doesn't count.
+	for i := 0; i < 6; i++ {
+		if w := login("alice", "secret", ""); w.Code != http.StatusSeeOther {
+			t.Fatalf("Sign in %d was refused with %d", i, w.Code)
+		}
+	}
+	if w := login("alice", "wrong", ""); w.Code != http.StatusUnauthorized {
+		t.Errorf("Expected 401 for the last failed attempt allowed, saw %d", w.Code)
+	}
+	if w := login("alice", "secret", ""); w.Code != http.StatusTooManyRequests {
+		t.Errorf("Expected 429 once the failed attempts are used up, saw %d", w.Code)
+	}
+
+	// Only local paths are followed after signing in.
+	for _, next := range []string{"//evil.example.com/", "https://evil.example.com/", "/\\evil.example.com"} {
+		if target := localRedirect(next); target != "/admin/" {
+			t.Errorf("Expected %q to be replaced, saw %q", next, target)
+		}
+	}
+}
+
+func TestAuthDisabled(t *testing.T) {
+	dir, globalData, cleanup := setupSiteTest(t, "auth-disabled")
+	defer cleanup()
+	config.Users = nil
+
+	auth, err := NewAuth()
+	if err != nil {
+		t.Fatal(err)
+	}
+	called := false
+	handler := auth.Protect("/login", func(globalData *GlobalData, w http.ResponseWriter,
+		r *http.Request, urlParams map[string]string) {
+
+		called = true
+	})
+	r, _ := http.NewRequest("GET", "/cache/stats", nil)
+	handler(nil, httptest.NewRecorder(), r, nil)
+	if !called {
+		t.Error("Handler was not called without any users configured")
+	}
+
+	// The CSRF token is still checked.
+	called = false
+	r, _ = http.NewRequest("POST", "/cache/purge", strings.NewReader("key=index.html"))
+	r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	w := httptest.NewRecorder()
+	handler(nil, w, r, nil)
+	if called || w.Code != http.StatusForbidden {
+		t.Errorf("Expected 403 for a POST without the CSRF token, saw %d", w.Code)
+	}
+
+	// Only the endpoints that read are served.
+	globalData.auth = auth
+	globalData.comments, _ = NewCommentStore(filepath.Join(dir, "comments"))
+	router := setupAdminRouter(globalData)
+	for _, test := range []struct {
+		method, path string
+		code         int
+	}{
+		{"GET", "/cache/stats", http.StatusOK},
+		{"GET", "/comments", http.StatusOK},
+		{"POST", "/cache/purge", http.StatusNotFound},
+		{"POST", "/cache/purge-all", http.StatusNotFound},
+		{"POST", "/comments/approve", http.StatusNotFound},
+		{"POST", "/comments/delete", http.StatusNotFound},
+	} {
+		r, _ := http.NewRequest(test.method, test.path, nil)
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, r)
+		if w.Code != test.code {
+			t.Errorf("%s %s: expected %d, saw %d", test.method, test.path, test.code, w.Code)
+		}
+	}
+
+	config.Users = map[string]UserConfig{"alice": {PasswordHash: "plaintext"}}
+	if _, err := NewAuth(); err == nil {
+		t.Error("Expected an error for a user without a valid hash")
+	}
+}
@@ -0,0 +1,133 @@
+package main
+
+import (
+	"encoding/hex"
+	"hash/fnv"
+	"net/http"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// CachePolicy controls the caching headers sent for a class of routes.
+type CachePolicy struct {
+	// Seconds that browsers and shared caches may use the response without revalidating.
+	MaxAge int
+	// Seconds that shared caches may use the response, if different from MaxAge.
+	// 0 omits it.
+	SharedMaxAge int
+	// Seconds that a cache may serve a stale response while it revalidates in the background.
+	// 0 omits it.
+	StaleWhileRevalidate int
+	// Tells browsers that the response will never change, so they don't need to revalidate it
+	// even on reload. Only appropriate for fingerprinted URLs.
+	Immutable bool
+}
+
+// CacheControlConfig holds the cache policies for each class of route.
+type CacheControlConfig struct {
+	// Single posts and custom pages.
+	Posts CachePolicy
+	// The index, archive, and tag pages.
+	Lists CachePolicy
+	Feeds CachePolicy
+	// Files in /assets, when not requested through a fingerprinted URL.
+	Assets CachePolicy
+	Images CachePolicy
+	// Assets requested through a URL containing a hash of their contents.
+	Fingerprinted CachePolicy
+}
+
+func defaultCacheControl() CacheControlConfig {
+	fiveMinutes := CachePolicy{MaxAge: 300}
+	oneDay := CachePolicy{MaxAge: 86400}
+	return CacheControlConfig{
+		Posts:         fiveMinutes,
+		Lists:         fiveMinutes,
+		Feeds:         fiveMinutes,
+		Assets:        oneDay,
+		Images:        oneDay,
+		Fingerprinted: CachePolicy{MaxAge: 365 * 86400, Immutable: true},
+	}
+}
+
+// Route type for fingerprinted assets. This is only used to pick the cache policy.
+const RouteFingerprinted = "fingerprinted"
+
+// cachePolicy returns the configured cache policy for a route type.
+func cachePolicy(route string) CachePolicy {
+	switch route {
+	case RoutePost, RoutePage:
+		return config.CacheControl.Posts
+	case RouteArchive, RouteTag, RouteIndex:
+		return config.CacheControl.Lists
+	case RouteFeed:
+		return config.CacheControl.Feeds
+	case RouteAsset:
+		return config.CacheControl.Assets
+	case RouteImage:
+		return config.CacheControl.Images
+	case RouteFingerprinted:
+		return config.CacheControl.Fingerprinted
+	}
+	return CachePolicy{}
+}
+
+// CacheControl returns the value of the Cache-Control header for the policy.
+func (cp CachePolicy) CacheControl() string {
+	parts := []string{"public", "max-age=" + strconv.Itoa(cp.MaxAge)}
+	if cp.SharedMaxAge > 0 {
+		parts = append(parts, "s-maxage="+strconv.Itoa(cp.SharedMaxAge))
+	}
+	if cp.StaleWhileRevalidate > 0 {
+		parts = append(parts, "stale-while-revalidate="+strconv.Itoa(cp.StaleWhileRevalidate))
+	}
+	if cp.Immutable {
+		parts = append(parts, "immutable")
+	}
+	return strings.Join(parts, ", ")
+}
+
+// setCacheHeaders sets Cache-Control and Expires according to the policy for the route type.
+func setCacheHeaders(w http.ResponseWriter, route string) {
+	policy := cachePolicy(route)
+	expires := time.Now().Add(time.Duration(policy.MaxAge) * time.Second)
+	w.Header().Set("Cache-Control", policy.CacheControl())
+	w.Header().Set("Expires", expires.UTC().Format(http.TimeFormat))
+}
+
+// Length of the content hash in a fingerprinted file name, in hex characters.
+const fingerprintLength = 16
+
+// contentFingerprint returns the hash of data used in fingerprinted URLs.
+func contentFingerprint(data []byte) string {
+	hash := fnv.New64a()
+	hash.Write(data)
+	return hex.EncodeToString(hash.Sum(nil))
+}
+
+// fingerprintedName inserts a fingerprint before the extension of a file name,
+// so that "assets/style.css" becomes "assets/style.<fingerprint>.css".
+func fingerprintedName(name, fingerprint string) string {
+	ext := path.Ext(name)
+	return name[0:len(name)-len(ext)] + "." + fingerprint + ext
+}
+
+// parseFingerprint reverses fingerprintedName, returning ok == false if the name
+// does not contain a fingerprint.
+func parseFingerprint(name string) (plainName, fingerprint string, ok bool) {
+	ext := path.Ext(name)
+	withoutExt := name[0 : len(name)-len(ext)]
+	fingerprint = path.Ext(withoutExt)
+	if len(fingerprint) != fingerprintLength+1 {
+		return name, "", false
+	}
+	fingerprint = fingerprint[1:]
+
+	if _, err := hex.DecodeString(fingerprint); err != nil {
+		return name, "", false
+	}
+
+	return withoutExt[0:len(withoutExt)-fingerprintLength-1] + ext, fingerprint, true
+}
@@ -0,0 +1,47 @@
+package main
+
+import (
+	"testing"
+)
+
+func TestCachePolicyHeader(t *testing.T) {
+	tests := []struct {
+		policy   CachePolicy
+		expected string
+	}{
+		{CachePolicy{MaxAge: 300}, "public, max-age=300"},
+		{CachePolicy{MaxAge: 60, SharedMaxAge: 600, StaleWhileRevalidate: 30},
+			"public, max-age=60, s-maxage=600, stale-while-revalidate=30"},
+		{CachePolicy{MaxAge: 31536000, Immutable: true}, "public, max-age=31536000, immutable"},
+	}
+
+	for _, test := range tests {
+		if header := test.policy.CacheControl(); header != test.expected {
+			t.Errorf("Expected Cache-Control \"%s\", saw \"%s\"", test.expected, header)
+		}
+	}
+}
+
+func TestFingerprint(t *testing.T) {
+	fingerprint := contentFingerprint([]byte("body { color: red; }"))
+	if len(fingerprint) != fingerprintLength {
+		t.Fatalf("Expected fingerprint of length %d, saw %s", fingerprintLength, fingerprint)
+	}
+
+	name := fingerprintedName("assets/style.css", fingerprint)
+	if name != "assets/style."+fingerprint+".css" {
+		t.Errorf("Unexpected fingerprinted name %s", name)
+	}
+
+	plainName, parsed, ok := parseFingerprint(name)
+	if !ok || plainName != "assets/style.css" || parsed != fingerprint {
+		t.Errorf("parseFingerprint(%s) returned %s, %s, %v", name, plainName, parsed, ok)
+	}
+
+	for _, name := range []string{"assets/style.css", "assets/jquery.min.js",
+		"assets/style.0123456789abcdeg.css", "assets/style.0123.css"} {
+		if plainName, _, ok := parseFingerprint(name); ok || plainName != name {
+			t.Errorf("parseFingerprint(%s) found a fingerprint", name)
+		}
+	}
+}
@@ -0,0 +1,222 @@
+package main
+
+import (
+	"github.com/dimfeld/gocache"
+	"github.com/dimfeld/simpleblog/lru"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// CacheCounters counts the hits, misses, and fill time for lookups in a cache. A lookup
+// that waits for another one's fill of the same key counts as a miss, but not a fill.
+type CacheCounters struct {
+	hits       uint64
+	misses     uint64
+	fills      uint64
+	fillErrors uint64
+	// Total fill time in nanoseconds.
+	fillTime int64
+
+	lock sync.Mutex
+	// Number of fills in progress for each key.
+	filling map[string]int
+}
+
+// statsFiller wraps a Filler, recording whether it was called and how long it took.
+type statsFiller struct {
+	filler   gocache.Filler
+	counters *CacheCounters
+	filled   bool
+}
+
+func (sf *statsFiller) Fill(cache gocache.Cache, key string) (gocache.Object, error) {
+	sf.filled = true
+	sf.counters.startFill(key)
+	start := time.Now()
+	obj, err := sf.filler.Fill(cache, key)
+	sf.counters.addFill(key, time.Since(start), err)
+	return obj, err
+}
+
+func (c *CacheCounters) startFill(key string) {
+	c.lock.Lock()
+	if c.filling == nil {
+		c.filling = make(map[string]int)
+	}
+	c.filling[key]++
+	c.lock.Unlock()
+}
+
+// isFilling returns true if a fill of key is in progress.
+func (c *CacheCounters) isFilling(key string) bool {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	return c.filling[key] != 0
+}
+
+func (c *CacheCounters) addFill(key string, duration time.Duration, err error) {
+	c.lock.Lock()
+	if c.filling[key]--; c.filling[key] == 0 {
+		delete(c.filling, key)
+	}
+	c.lock.Unlock()
+
+	atomic.AddUint64(&c.misses, 1)
+	atomic.AddUint64(&c.fills, 1)
+	atomic.AddInt64(&c.fillTime, int64(duration))
+	if err != nil {
+		atomic.AddUint64(&c.fillErrors, 1)
+	}
+}
+
+// Get looks up key in cache, counting a miss if filler had to be called and a hit otherwise.
+func (c *CacheCounters) Get(cache gocache.Cache, key string, filler gocache.Filler) (gocache.Object, error) {
+	if filler == nil {
+		return cache.Get(key, nil)
+	}
+
+	// A lookup that starts during another one's fill will wait for its result.
+	waited := c.isFilling(key)
+	sf := &statsFiller{filler: filler, counters: c}
+	obj, err := cache.Get(key, sf)
+	if !sf.filled {
+		if waited {
+			atomic.AddUint64(&c.misses, 1)
+		} else if err == nil {
+			atomic.AddUint64(&c.hits, 1)
+		}
+	}
+	return obj, err
+}
+
+func (c *CacheCounters) Snapshot() CacheCounterSnapshot {
+	s := CacheCounterSnapshot{
+		Hits:       atomic.LoadUint64(&c.hits),
+		Misses:     atomic.LoadUint64(&c.misses),
+		FillErrors: atomic.LoadUint64(&c.fillErrors),
+	}
+	s.calculate(time.Duration(atomic.LoadInt64(&c.fillTime)), atomic.LoadUint64(&c.fills))
+	return s
+}
+
+// countingCache wraps a cache level to count its hits and misses.
+type countingCache struct {
+	gocache.Cache
+	counters *CacheCounters
+}
+
+func (cc countingCache) Get(key string, filler gocache.Filler) (gocache.Object, error) {
+	return cc.counters.Get(cc.Cache, key, filler)
+}
+
+// CacheCounterSnapshot is the JSON form of the statistics for a cache level or route type.
+type CacheCounterSnapshot struct {
+	Hits       uint64
+	Misses     uint64
+	FillErrors uint64
+	HitRatio   float64
+	// Average time taken to generate an object on a miss.
+	AverageFillMicroseconds int64
+
+	// Only available for the memory caches.
+	Evictions   uint64 `json:",omitempty"`
+	Expirations uint64 `json:",omitempty"`
+	Entries     int    `json:",omitempty"`
+	Size        int    `json:",omitempty"`
+}
+
+func (s *CacheCounterSnapshot) calculate(fillTime time.Duration, fills uint64) {
+	if total := s.Hits + s.Misses; total != 0 {
+		s.HitRatio = float64(s.Hits) / float64(total)
+	}
+	if fills != 0 {
+		s.AverageFillMicroseconds = int64(fillTime/time.Microsecond) / int64(fills)
+	}
+}
+
+func lruSnapshot(c *lru.AsyncLRU) CacheCounterSnapshot {
+	stats := c.Stats()
+	s := CacheCounterSnapshot{
+		Hits:        stats.Hits,
+		Misses:      stats.Misses,
+		FillErrors:  stats.FillErrors,
+		Evictions:   stats.Evictions,
+		Expirations: stats.Expirations,
+		Entries:     stats.Entries,
+		Size:        stats.Size,
+	}
+	// Misses that waited for another request's fill don't count toward the fill time.
+	s.calculate(stats.FillTime, stats.Fills)
+	return s
+}
+
+// Route types used for the per-route cache statistics.
+const (
+	RoutePost    = "post"
+	RouteArchive = "archive"
+	RouteTag     = "tag"
+	RouteIndex   = "index"
+	RoutePage    = "page"
+	RouteFeed    = "feed"
+	RouteAsset   = "asset"
+	RouteImage   = "image"
+)
+
+var routeTypes = []string{RoutePost, RouteArchive, RouteTag, RouteIndex, RoutePage,
+	RouteFeed, RouteAsset, RouteImage}
+
+// CacheStats collects statistics for each cache level and each type of route.
+type CacheStats struct {
+	smallMemCache *lru.AsyncLRU
+	largeMemCache *lru.AsyncLRU
+	disk          *CacheCounters
+	routes        map[string]*CacheCounters
+}
+
+func NewCacheStats(smallMemCache, largeMemCache *lru.AsyncLRU) *CacheStats {
+	cs := &CacheStats{
+		smallMemCache: smallMemCache,
+		largeMemCache: largeMemCache,
+		disk:          &CacheCounters{},
+		routes:        make(map[string]*CacheCounters),
+	}
+	for _, route := range routeTypes {
+		cs.routes[route] = &CacheCounters{}
+	}
+	return cs
+}
+
+// WrapDiskCache returns the disk cache wrapped so that its lookups are counted.
+func (cs *CacheStats) WrapDiskCache(diskCache gocache.Cache) gocache.Cache {
+	return countingCache{diskCache, cs.disk}
+}
+
+// Get looks up key in cache, counting the result toward the given route type.
+func (cs *CacheStats) Get(route string, cache gocache.Cache, key string,
+	filler gocache.Filler) (gocache.Object, error) {
+
+	return cs.routes[route].Get(cache, key, filler)
+}
+
+// CacheStatsSnapshot is the JSON form of CacheStats.
+type CacheStatsSnapshot struct {
+	Levels map[string]CacheCounterSnapshot
+	Routes map[string]CacheCounterSnapshot
+}
+
+func (cs *CacheStats) Snapshot() CacheStatsSnapshot {
+	s := CacheStatsSnapshot{
+		Levels: map[string]CacheCounterSnapshot{
+			"memory-small": lruSnapshot(cs.smallMemCache),
+			"memory-large": lruSnapshot(cs.largeMemCache),
+			"disk":         cs.disk.Snapshot(),
+		},
+		Routes: make(map[string]CacheCounterSnapshot, len(cs.routes)),
+	}
+
+	for route, counters := range cs.routes {
+		s.Routes[route] = counters.Snapshot()
+	}
+	return s
+}
@@ -0,0 +1,144 @@
+package main
+
+import (
+	"encoding/json"
+	"github.com/dimfeld/gocache"
+	"github.com/dimfeld/simpleblog/lru"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// blockingFiller fills keys after the wait channel is closed.
+type blockingFiller struct {
+	started chan struct{}
+	wait    chan struct{}
+}
+
+func (f blockingFiller) Fill(cache gocache.Cache, key string) (gocache.Object, error) {
+	close(f.started)
+	<-f.wait
+	return gocache.Object{Data: []byte("data for " + key), ModTime: time.Now()}, nil
+}
+
+func TestCacheCounters(t *testing.T) {
+	cache := lru.New(0, 0, 0, 0)
+	counters := &CacheCounters{}
+	filler := stringFiller("data")
+
+	for i := 0; i < 3; i++ {
+		if _, err := counters.Get(cache, "key", filler); err != nil {
+			t.Fatal(err)
+		}
+	}
+	counters.Get(cache, "missing", failFiller{})
+
+	s := counters.Snapshot()
+	if s.Hits != 2 || s.Misses != 2 || s.FillErrors != 1 || s.HitRatio != 0.5 {
+		t.Errorf("Expected 2 hits, 2 misses, and 1 fill error, saw %+v", s)
+	}
+
+	// Lookups that wait for another one's fill are misses, not hits, and aren't fills.
+	blocking := blockingFiller{started: make(chan struct{}), wait: make(chan struct{})}
+	wg := &sync.WaitGroup{}
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		counters.Get(cache, "slow", blocking)
+	}()
+	<-blocking.started
+	for i := 0; i < 3; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if obj, err := counters.Get(cache, "slow", failFiller{}); err != nil ||
+				string(obj.Data) != "data for slow" {
+				t.Errorf("Waiter saw %q, %v", obj.Data, err)
+			}
+		}()
+	}
+	time.Sleep(10 * time.Millisecond)
+	close(blocking.wait)
+	wg.Wait()
+
+	s = counters.Snapshot()
+	if s.Hits != 2 || s.Misses != 6 {
+		t.Errorf("Expected the waiters to count as misses, saw %+v", s)
+	}
+	if fills := counters.fills; fills != 3 {
+		t.Errorf("Expected 3 fills, saw %d", fills)
+	}
+}
+
+type stringFiller string
+
+func (f stringFiller) Fill(cache gocache.Cache, key string) (gocache.Object, error) {
+	return gocache.Object{Data: []byte(f), ModTime: time.Now()}, nil
+}
+
+func TestCacheAdminHandlers(t *testing.T) {
+	_, globalData, cleanup := setupSiteTest(t, "cachestats")
+	defer cleanup()
+	config.CacheWarmIndex = false
+	config.CacheWarmFeed = false
+	config.CacheWarmPosts = 0
+	config.CacheWarmTags = 0
+	globalData.warmer = NewCacheWarmer(globalData)
+
+	get := func(handler simpleBlogHandler, params map[string]string) {
+		r, _ := http.NewRequest("GET", "/", nil)
+		handler(globalData, httptest.NewRecorder(), r, params)
+	}
+	get(indexHandler, map[string]string{})
+	get(indexHandler, map[string]string{})
+	get(postHandler, map[string]string{"year": "2014", "month": "05", "post": "first-post"})
+	get(postHandler, map[string]string{"year": "2014", "month": "05", "post": "missing"})
+
+	w := httptest.NewRecorder()
+	r, _ := http.NewRequest("GET", "/cache/stats", nil)
+	cacheStatsHandler(globalData, w, r, nil)
+	var snapshot CacheStatsSnapshot
+	if err := json.Unmarshal(w.Body.Bytes(), &snapshot); err != nil {
+		t.Fatal(err)
+	}
+	if index := snapshot.Routes[RouteIndex]; index.Hits != 1 || index.Misses != 1 {
+		t.Errorf("Expected 1 hit and 1 miss for the index, saw %+v", index)
+	}
+	if post := snapshot.Routes[RoutePost]; post.Hits != 0 || post.Misses != 2 || post.FillErrors != 1 {
+		t.Errorf("Expected 2 misses and 1 fill error for posts, saw %+v", post)
+	}
+	if memory := snapshot.Levels["memory-small"]; memory.Entries == 0 || memory.Hits != 1 {
+		t.Errorf("Expected the pages in the memory cache, saw %+v", memory)
+	}
+
+	purge := func(handler simpleBlogHandler, form url.Values) *httptest.ResponseRecorder {
+		r, _ := http.NewRequest("POST", "/cache/purge", strings.NewReader(form.Encode()))
+		r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		w := httptest.NewRecorder()
+		handler(globalData, w, r, nil)
+		return w
+	}
+
+	globalData.cache.Set("index.html#gz", gocache.Object{Data: []byte("gz"), ModTime: time.Now()})
+	if w := purge(cachePurgeHandler, url.Values{}); w.Code != http.StatusBadRequest {
+		t.Errorf("Expected 400 without a key, saw %d", w.Code)
+	}
+	w = purge(cachePurgeHandler, url.Values{"key": {"index.html"}})
+	if w.Code != http.StatusOK || !strings.Contains(w.Body.String(), `"index.html#gz"`) {
+		t.Errorf("Expected the variants to be purged, saw %d %s", w.Code, w.Body.String())
+	}
+	if isCached(globalData.cache, "index.html") || isCached(globalData.cache, "index.html#gz") {
+		t.Error("Purged key is still cached")
+	}
+
+	get(postHandler, map[string]string{"year": "2014", "month": "05", "post": "first-post"})
+	purge(cachePurgeAllHandler, url.Values{})
+	if isCached(globalData.cache, "2014/05/first-post.md") ||
+		globalData.deps.HasDependents(SidebarDependency) || globalData.notFound.Contains("2014/05/missing.md") {
+		t.Error("Purging everything left pages, dependencies, or not found results")
+	}
+}
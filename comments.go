@@ -0,0 +1,358 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"github.com/dimfeld/blackfriday"
+	"html/template"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Route type for comment submissions.
+const RouteComment = "comment"
+
+var (
+	ErrCommentNotFound = errors.New("Comment not found")
+	ErrInvalidComment  = errors.New("Invalid comment")
+)
+
+// Comment is a reader's comment on a post.
+type Comment struct {
+	ID string
+	// The post the comment is on, as its path relative to PostsDir without the extension.
+	Post string
+	// ID of the comment this replies to, or empty for a top-level comment.
+	ParentID string
+	Author   string
+	// Never shown on the site.
+	Email     string `json:",omitempty"`
+	URL       string `json:",omitempty"`
+	Body      string
+	Timestamp time.Time
+	Approved  bool
+}
+
+// HTMLContent renders the comment's Markdown body. Raw HTML, styles, and images are
+// dropped, and only safe links are kept.
+func (c *Comment) HTMLContent() template.HTML {
+	htmlFlags := blackfriday.HTML_USE_XHTML |
+		blackfriday.HTML_USE_SMARTYPANTS |
+		blackfriday.HTML_SMARTYPANTS_FRACTIONS |
+		blackfriday.HTML_SMARTYPANTS_LATEX_DASHES |
+		blackfriday.HTML_SKIP_HTML |
+		blackfriday.HTML_SKIP_STYLE |
+		blackfriday.HTML_SKIP_IMAGES |
+		blackfriday.HTML_SAFELINK |
+		blackfriday.HTML_NOFOLLOW_LINKS
+
+	parameters := blackfriday.HtmlRendererParameters{
+		FootnoteAnchorPrefix:       "comment-" + c.ID,
+		FootnoteReturnLinkContents: `&#8617;`,
+	}
+
+	return template.HTML(renderMarkdown([]byte(c.Body), htmlFlags, parameters))
+}
+
+// Action returns the URL that replies to the comment are posted to.
+func (c *Comment) Action() string {
+	return "/" + c.Post + "/comments"
+}
+
+// Honeypot returns the name of the reply form's field that only bots fill in.
+func (c *Comment) Honeypot() string {
+	return honeypotField
+}
+
+// CommentThread is a comment and its replies.
+type CommentThread struct {
+	*Comment
+	Replies []*CommentThread
+}
+
+func newCommentID() (string, error) {
+	b := make([]byte, 8)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
+
+// CommentForm is the template data for the page that confirms a comment. Post pages are
+// cached, so their forms can't carry a CSRF token, and a comment is only stored once it is
+// posted again from this page.
+type CommentForm struct {
+	Action string
+	// Hidden CSRF field.
+	CSRFField string
+	Token     string
+	Honeypot  string
+
+	// Values entered on the post's page.
+	ParentID string
+	Author   string
+	Email    string
+	URL      string
+	Body     string
+
+	Moderated bool
+	Errors    []string
+}
+
+// CommentForms holds the state for checking comment submissions.
+type CommentForms struct {
+	csrf    *CSRF
+	limiter *RateLimiter
+}
+
+// NewCommentForms sets up comment submissions from the configuration.
+func NewCommentForms() (*CommentForms, error) {
+	csrf, err := NewCSRF(config.CSRFSecret, "/")
+	if err != nil {
+		return nil, err
+	}
+	// The cookie is sent with every page, so keep it apart from the contact form's.
+	csrf.Cookie = "comment_csrf"
+
+	cf := &CommentForms{csrf: csrf}
+	if config.CommentRateLimit > 0 {
+		cf.limiter = NewRateLimiter(float64(config.CommentRateLimit)/3600, config.CommentRateLimit)
+	}
+	return cf, nil
+}
+
+// CommentStore keeps comments in a JSON file for each post, under a directory that mirrors
+// the posts directory.
+type CommentStore struct {
+	lock sync.Mutex
+	dir  string
+	// Comments for each post that has been loaded, in the order they were made.
+	posts map[string][]*Comment
+}
+
+func NewCommentStore(dir string) (*CommentStore, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+	return &CommentStore{dir: dir, posts: make(map[string][]*Comment)}, nil
+}
+
+func (cs *CommentStore) postFile(post string) string {
+	return filepath.Join(cs.dir, filepath.FromSlash(post)+".json")
+}
+
+// load returns the comments for a post, reading them from disk if needed.
+// The lock must be held.
+func (cs *CommentStore) load(post string) ([]*Comment, error) {
+	if comments, ok := cs.posts[post]; ok {
+		return comments, nil
+	}
+
+	comments := []*Comment{}
+	data, err := ioutil.ReadFile(cs.postFile(post))
+	if err == nil {
+		err = json.Unmarshal(data, &comments)
+	} else if os.IsNotExist(err) {
+		err = nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	cs.posts[post] = comments
+	return comments, nil
+}
+
+// save writes the comments for a post, replacing the file atomically.
+// The lock must be held.
+func (cs *CommentStore) save(post string, comments []*Comment) error {
+	data, err := json.MarshalIndent(comments, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	filePath := cs.postFile(post)
+	if err := os.MkdirAll(filepath.Dir(filePath), 0755); err != nil {
+		return err
+	}
+
+	tempPath := filePath + ".tmp"
+	if err := ioutil.WriteFile(tempPath, data, 0644); err != nil {
+		return err
+	}
+	if err := os.Rename(tempPath, filePath); err != nil {
+		return err
+	}
+
+	cs.posts[post] = comments
+	return nil
+}
+
+// Add stores a new comment, assigning its ID and timestamp. A reply must be to an approved
+// comment on the same post.
+func (cs *CommentStore) Add(c *Comment) error {
+	if !validPostKey(c.Post) {
+		return ErrInvalidComment
+	}
+
+	id, err := newCommentID()
+	if err != nil {
+		return err
+	}
+
+	cs.lock.Lock()
+	defer cs.lock.Unlock()
+
+	comments, err := cs.load(c.Post)
+	if err != nil {
+		return err
+	}
+
+	if c.ParentID != "" {
+		found := false
+		for _, existing := range comments {
+			if existing.ID == c.ParentID && existing.Approved {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return ErrInvalidComment
+		}
+	}
+
+	c.ID = id
+	c.Timestamp = time.Now()
+
+	updated := make([]*Comment, len(comments), len(comments)+1)
+	copy(updated, comments)
+	return cs.save(c.Post, append(updated, c))
+}
+
+// Threads returns the approved comments for a post, with replies nested under
+// the comments they reply to.
+func (cs *CommentStore) Threads(post string) ([]*CommentThread, error) {
+	cs.lock.Lock()
+	comments, err := cs.load(post)
+	cs.lock.Unlock()
+	if err != nil {
+		return nil, err
+	}
+
+	threads := make(map[string]*CommentThread)
+	for _, c := range comments {
+		if c.Approved {
+			threads[c.ID] = &CommentThread{Comment: c}
+		}
+	}
+
+	roots := []*CommentThread{}
+	for _, c := range comments {
+		thread, ok := threads[c.ID]
+		if !ok {
+			continue
+		}
+
+		if parent, ok := threads[c.ParentID]; ok {
+			parent.Replies = append(parent.Replies, thread)
+		} else if c.ParentID == "" {
+			roots = append(roots, thread)
+		}
+		// Replies to deleted comments are left out.
+	}
+	return roots, nil
+}
+
+// Pending returns every comment awaiting moderation, oldest first.
+func (cs *CommentStore) Pending() ([]*Comment, error) {
+	cs.lock.Lock()
+	defer cs.lock.Unlock()
+
+	pending := []*Comment{}
+	err := filepath.Walk(cs.dir, func(filePath string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if info.IsDir() || !strings.HasSuffix(filePath, ".json") {
+			return nil
+		}
+
+		relPath, err := filepath.Rel(cs.dir, filePath)
+		if err != nil {
+			return err
+		}
+		comments, err := cs.load(strings.TrimSuffix(filepath.ToSlash(relPath), ".json"))
+		if err != nil {
+			return err
+		}
+
+		for _, c := range comments {
+			if !c.Approved {
+				pending = append(pending, c)
+			}
+		}
+		return nil
+	})
+
+	sort.Slice(pending, func(i, j int) bool {
+		return pending[i].Timestamp.Before(pending[j].Timestamp)
+	})
+	return pending, err
+}
+
+// update applies fn to a copy of the post's comments and saves the result.
+func (cs *CommentStore) update(post string, fn func([]*Comment) ([]*Comment, error)) error {
+	if !validPostKey(post) {
+		return ErrCommentNotFound
+	}
+
+	cs.lock.Lock()
+	defer cs.lock.Unlock()
+
+	comments, err := cs.load(post)
+	if err != nil {
+		return err
+	}
+
+	updated := make([]*Comment, len(comments))
+	copy(updated, comments)
+	updated, err = fn(updated)
+	if err != nil {
+		return err
+	}
+	return cs.save(post, updated)
+}
+
+// Approve makes a comment visible on its post.
+func (cs *CommentStore) Approve(post, id string) error {
+	return cs.update(post, func(comments []*Comment) ([]*Comment, error) {
+		for i, c := range comments {
+			if c.ID == id {
+				approved := *c
+				approved.Approved = true
+				comments[i] = &approved
+				return comments, nil
+			}
+		}
+		return nil, ErrCommentNotFound
+	})
+}
+
+// Delete removes a comment. Its replies remain stored but are no longer shown.
+func (cs *CommentStore) Delete(post, id string) error {
+	return cs.update(post, func(comments []*Comment) ([]*Comment, error) {
+		for i, c := range comments {
+			if c.ID == id {
+				return append(comments[:i], comments[i+1:]...), nil
+			}
+		}
+		return nil, ErrCommentNotFound
+	})
+}
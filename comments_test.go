@@ -0,0 +1,160 @@
+package main
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"regexp"
+	"strings"
+	"testing"
+)
+
+func TestCommentStore(t *testing.T) {
+	dir, err := ioutil.TempDir("", "simpleblog-comments")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	store, err := NewCommentStore(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	post := "2014/05/first-post"
+	first := &Comment{Post: post, Author: "Alice", Body: "First!"}
+	if err := store.Add(first); err != nil {
+		t.Fatal(err)
+	}
+	if first.ID == "" || first.Timestamp.IsZero() {
+		t.Error("Add did not assign an ID and timestamp")
+	}
+
+	if err := store.Add(&Comment{Post: post, ParentID: first.ID, Author: "Bob", Body: "Reply"}); err != ErrInvalidComment {
+		t.Errorf("Expected reply to an unapproved comment to fail, saw %v", err)
+	}
+	if err := store.Add(&Comment{Post: "../outside", Author: "Eve", Body: "x"}); err != ErrInvalidComment {
+		t.Errorf("Expected invalid post to fail, saw %v", err)
+	}
+
+	threads, _ := store.Threads(post)
+	if len(threads) != 0 {
+		t.Error("Unapproved comment was shown")
+	}
+	pending, _ := store.Pending()
+	if len(pending) != 1 || pending[0].ID != first.ID {
+		t.Fatalf("Expected first comment in the queue, saw %v", pending)
+	}
+
+	if err := store.Approve(post, first.ID); err != nil {
+		t.Fatal(err)
+	}
+	reply := &Comment{Post: post, ParentID: first.ID, Author: "Bob", Body: "Reply", Approved: true}
+	if err := store.Add(reply); err != nil {
+		t.Fatal(err)
+	}
+	second := &Comment{Post: post, Author: "Carol", Body: "Second", Approved: true}
+	store.Add(second)
+
+	// Read everything back from disk.
+	store, _ = NewCommentStore(dir)
+	threads, err = store.Threads(post)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(threads) != 2 || threads[0].ID != first.ID || threads[1].ID != second.ID {
+		t.Fatalf("Unexpected threads %v", threads)
+	}
+	if len(threads[0].Replies) != 1 || threads[0].Replies[0].ID != reply.ID {
+		t.Errorf("Reply was not nested under its parent")
+	}
+
+	if err := store.Delete(post, first.ID); err != nil {
+		t.Fatal(err)
+	}
+	threads, _ = store.Threads(post)
+	if len(threads) != 1 || threads[0].ID != second.ID {
+		t.Errorf("Expected only the second comment after deleting the first, saw %v", threads)
+	}
+	if err := store.Delete(post, "missing"); err != ErrCommentNotFound {
+		t.Errorf("Expected ErrCommentNotFound, saw %v", err)
+	}
+}
+
+func TestCommentPostHandler(t *testing.T) {
+	dir, globalData, cleanup := setupSiteTest(t, "comments")
+	defer cleanup()
+	config.CommentMaxLength = 100
+	config.CommentsModeration = false
+	config.CommentRateLimit = 2
+
+	globalData.comments, _ = NewCommentStore(dir)
+	globalData.commentForms, _ = NewCommentForms()
+
+	var cookie *http.Cookie
+	postComment := func(postName string, form url.Values) *httptest.ResponseRecorder {
+		r, _ := http.NewRequest("POST", "/2014/05/"+postName+"/comments",
+			strings.NewReader(form.Encode()))
+		r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		if cookie != nil {
+			r.AddCookie(cookie)
+		}
+		w := httptest.NewRecorder()
+		commentPostHandler(globalData, w, r,
+			map[string]string{"year": "2014", "month": "05", "post": postName})
+		return w
+	}
+
+	// The form on the cached post page has no token, so the comment is shown again with one.
+	w := postComment("first-post", url.Values{"author": {"Alice"}, "body": {"Nice post"}})
+	match := regexp.MustCompile(`name="csrf_token" value="([^"]+)"`).FindStringSubmatch(w.Body.String())
+	cookies := w.Result().Cookies()
+	if w.Code != http.StatusOK || match == nil || len(cookies) != 1 ||
+		!strings.Contains(w.Body.String(), "Nice post") {
+		t.Fatalf("Expected the comment on a form with a token, saw %d %s", w.Code, w.Body.String())
+	}
+	cookie = cookies[0]
+	token := match[1]
+	if threads, _ := globalData.comments.Threads("2014/05/first-post"); len(threads) != 0 {
+		t.Error("Comment without a token was stored")
+	}
+
+	w = postComment("first-post", url.Values{"author": {"Alice"}, "body": {"Nice post"},
+		"csrf_token": {token}})
+	if w.Code != http.StatusSeeOther ||
+		!strings.HasPrefix(w.Header().Get("Location"), "/2014/05/first-post#comment-") {
+		t.Errorf("Expected redirect to the new comment, saw %d %s", w.Code, w.Header().Get("Location"))
+	}
+
+	tests := []struct {
+		post string
+		form url.Values
+		code int
+	}{
+		{"missing-post", url.Values{"author": {"Alice"}, "body": {"Hi"}}, http.StatusNotFound},
+		{"first-post", url.Values{"body": {"No name"}}, http.StatusBadRequest},
+		{"first-post", url.Values{"author": {"Alice"}, "body": {strings.Repeat("x", 101)}},
+			http.StatusBadRequest},
+		{"first-post", url.Values{"author": {"Alice"}, "body": {"Hi"}, "url": {"javascript:alert(1)"}},
+			http.StatusBadRequest},
+		{"first-post", url.Values{"author": {"Alice"}, "body": {"Hi"}, "parent": {"missing"}},
+			http.StatusBadRequest},
+		{"first-post", url.Values{"author": {"Bot"}, "body": {"Spam"}, "website": {"x"}},
+			http.StatusSeeOther},
+		// The parent check used the last token in the bucket.
+		{"first-post", url.Values{"author": {"Alice"}, "body": {"Again"}}, http.StatusTooManyRequests},
+	}
+	for _, test := range tests {
+		test.form.Set("csrf_token", token)
+		if w := postComment(test.post, test.form); w.Code != test.code {
+			t.Errorf("Posting %v to %s: expected %d, saw %d", test.form, test.post, test.code, w.Code)
+		}
+	}
+
+	threads, _ := globalData.comments.Threads("2014/05/first-post")
+	if len(threads) != 1 {
+		t.Errorf("Expected 1 stored comment, saw %d", len(threads))
+	}
+}
@@ -0,0 +1,319 @@
+package main
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"github.com/dimfeld/glog"
+	"io/ioutil"
+	"mime"
+	"net/http"
+	"net/mail"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Route type for the contact form.
+const RouteContact = "contact"
+
+// ContactForm is the template data for the contact page.
+type ContactForm struct {
+	Action string
+	// Hidden CSRF field.
+	CSRFField string
+	Token     string
+	Honeypot  string
+
+	// Values entered, so they are kept when the form is shown again.
+	Name    string
+	Email   string
+	Subject string
+	Message string
+
+	// Problems with the values entered.
+	Errors []string
+	// True once the message has been accepted.
+	Sent bool
+	// True if the message could neither be sent nor saved.
+	Failed bool
+}
+
+// ContactMailer delivers contact messages over SMTP, saving them in a spool directory if the
+// server can't be reached so they can be sent later.
+type ContactMailer struct {
+	lock sync.Mutex
+	// True while the spooled messages are being retried. New messages are spooled behind
+	// them instead of being sent, so that they go out in order.
+	retrying bool
+	mailer   *Mailer
+	from     string
+	to       []string
+	spoolDir string
+}
+
+// NewContactMailer creates a mailer using the contact settings from the configuration.
+func NewContactMailer(mailer *Mailer) (*ContactMailer, error) {
+	if err := os.MkdirAll(config.ContactSpoolDir, 0755); err != nil {
+		return nil, err
+	}
+
+	m := &ContactMailer{
+		mailer:   mailer,
+		from:     config.ContactFrom,
+		spoolDir: config.ContactSpoolDir,
+	}
+	for _, to := range strings.Split(config.ContactTo, ",") {
+		if to = strings.TrimSpace(to); to != "" {
+			m.to = append(m.to, to)
+		}
+	}
+	if len(m.to) == 0 {
+		return nil, fmt.Errorf("ContactTo is empty")
+	}
+	return m, nil
+}
+
+// Compose builds the email for a contact form submission. Replies go to the sender.
+func (m *ContactMailer) Compose(form *ContactForm, clientIP string) []byte {
+	subject := "Contact form"
+	if form.Subject != "" {
+		subject += ": " + headerValue(form.Subject)
+	}
+
+	buf := &bytes.Buffer{}
+	fmt.Fprintf(buf, "From: %s\r\n", m.from)
+	fmt.Fprintf(buf, "To: %s\r\n", strings.Join(m.to, ", "))
+	fmt.Fprintf(buf, "Reply-To: %s\r\n", (&mail.Address{Name: headerValue(form.Name), Address: form.Email}).String())
+	fmt.Fprintf(buf, "Subject: %s\r\n", mime.QEncoding.Encode("utf-8", subject))
+	fmt.Fprintf(buf, "Date: %s\r\n", time.Now().Format(time.RFC1123Z))
+	buf.WriteString("MIME-Version: 1.0\r\n")
+	buf.WriteString("Content-Type: text/plain; charset=utf-8\r\n")
+	buf.WriteString("Content-Transfer-Encoding: 8bit\r\n\r\n")
+
+	fmt.Fprintf(buf, "Name: %s\r\nEmail: %s\r\nIP address: %s\r\n\r\n",
+		headerValue(form.Name), form.Email, clientIP)
+	body := strings.Replace(form.Message, "\r\n", "\n", -1)
+	body = strings.Replace(body, "\r", "\n", -1)
+	buf.WriteString(strings.Replace(body, "\n", "\r\n", -1))
+	buf.WriteString("\r\n")
+	return buf.Bytes()
+}
+
+// spool saves a message that could not be delivered.
+func (m *ContactMailer) spool(msg []byte) error {
+	b := make([]byte, 4)
+	if _, err := rand.Read(b); err != nil {
+		return err
+	}
+	// The timestamp makes the files sort in the order they were received.
+	name := time.Now().UTC().Format("20060102T150405.000000000") + "-" + hex.EncodeToString(b) + ".eml"
+
+	filePath := filepath.Join(m.spoolDir, name)
+	tempPath := filepath.Join(m.spoolDir, "."+name+".tmp")
+	if err := ioutil.WriteFile(tempPath, msg, 0600); err != nil {
+		return err
+	}
+	return os.Rename(tempPath, filePath)
+}
+
+// Deliver sends a message, or spools it if sending fails or the spool is being retried.
+// It returns an error only if the message was lost.
+func (m *ContactMailer) Deliver(msg []byte) error {
+	m.lock.Lock()
+	retrying := m.retrying
+	m.lock.Unlock()
+	if retrying {
+		return m.spool(msg)
+	}
+
+	err := m.mailer.Send(m.from, m.to, msg)
+	if err == nil {
+		return nil
+	}
+
+	glog.Errorln("Could not send contact message, spooling it:", err)
+	if spoolErr := m.spool(msg); spoolErr != nil {
+		return fmt.Errorf("sending failed with %s, then spooling failed with %s", err, spoolErr)
+	}
+	return nil
+}
+
+// RetrySpool sends the spooled messages, oldest first, and removes the ones that were sent.
+// It stops at the first failure, since the rest would most likely fail too. If another
+// retry is already running, it returns immediately.
+func (m *ContactMailer) RetrySpool() error {
+	m.lock.Lock()
+	if m.retrying {
+		m.lock.Unlock()
+		return nil
+	}
+	m.retrying = true
+	m.lock.Unlock()
+	defer func() {
+		m.lock.Lock()
+		m.retrying = false
+		m.lock.Unlock()
+	}()
+
+	files, err := filepath.Glob(filepath.Join(m.spoolDir, "*.eml"))
+	if err != nil {
+		return err
+	}
+	sort.Strings(files)
+
+	for _, file := range files {
+		msg, err := ioutil.ReadFile(file)
+		if err != nil {
+			return err
+		}
+		if err := m.mailer.Send(m.from, m.to, msg); err != nil {
+			return err
+		}
+		if err := os.Remove(file); err != nil {
+			return err
+		}
+		glog.Infoln("Sent spooled contact message", filepath.Base(file))
+	}
+	return nil
+}
+
+// retrySpoolEvery calls RetrySpool forever.
+func (m *ContactMailer) retrySpoolEvery(interval time.Duration) {
+	for _ = range time.Tick(interval) {
+		if err := m.RetrySpool(); err != nil {
+			glog.Warningln("Spooled contact messages still can't be sent:", err)
+		}
+	}
+}
+
+// Contact holds the state for the contact form.
+type Contact struct {
+	csrf    *CSRF
+	limiter *RateLimiter
+	mailer  *ContactMailer
+}
+
+// NewContact sets up the contact form from the configuration.
+func NewContact() (*Contact, error) {
+	csrf, err := NewCSRF(config.CSRFSecret, "/contact")
+	if err != nil {
+		return nil, err
+	}
+	mailer, err := NewMailer()
+	if err != nil {
+		return nil, err
+	}
+	contactMailer, err := NewContactMailer(mailer)
+	if err != nil {
+		return nil, err
+	}
+
+	c := &Contact{csrf: csrf, mailer: contactMailer}
+	if config.ContactRateLimit > 0 {
+		c.limiter = NewRateLimiter(float64(config.ContactRateLimit)/3600, config.ContactRateLimit)
+	}
+	return c, nil
+}
+
+// ContactURL returns the path of the contact form, or "" if it is disabled, so that
+// templates only link to it when it exists.
+func ContactURL() string {
+	if !config.EnableContact {
+		return ""
+	}
+	return "/contact"
+}
+
+// renderContactPage renders the contact form or its result.
+func renderContactPage(globalData *GlobalData, w http.ResponseWriter, r *http.Request,
+	form *ContactForm, status int) {
+
+	token, err := globalData.contact.csrf.Token(w, r)
+	if err != nil {
+		handleError(w, r, err)
+		return
+	}
+	form.Action = "/contact"
+	form.CSRFField = globalData.contact.csrf.Field
+	form.Token = token
+	form.Honeypot = honeypotField
+
+	renderDynamicPage(globalData, w, r, TemplateData{WindowTitle: "Contact", Contact: form}, status)
+}
+
+func contactFormHandler(globalData *GlobalData, w http.ResponseWriter,
+	r *http.Request, urlParams map[string]string) {
+
+	renderContactPage(globalData, w, r, &ContactForm{}, http.StatusOK)
+}
+
+func contactPostHandler(globalData *GlobalData, w http.ResponseWriter,
+	r *http.Request, urlParams map[string]string) {
+
+	r.Body = http.MaxBytesReader(w, r.Body, int64(config.ContactMaxLength)+4096)
+	if err := r.ParseForm(); err != nil {
+		http.Error(w, "Invalid form", http.StatusBadRequest)
+		return
+	}
+
+	form := &ContactForm{
+		Name:    strings.TrimSpace(r.PostFormValue("name")),
+		Email:   strings.TrimSpace(r.PostFormValue("email")),
+		Subject: strings.TrimSpace(r.PostFormValue("subject")),
+		Message: strings.TrimSpace(r.PostFormValue("message")),
+	}
+
+	if !globalData.contact.csrf.Verify(r) {
+		form.Errors = []string{"Your session has expired. Please send your message again."}
+		renderContactPage(globalData, w, r, form, http.StatusForbidden)
+		return
+	}
+
+	if r.PostFormValue(honeypotField) != "" {
+		// Pretend it worked, so the bot has no reason to try again.
+		glog.Infoln("Dropped contact message with the honeypot filled in from", r.RemoteAddr)
+		renderContactPage(globalData, w, r, &ContactForm{Sent: true}, http.StatusOK)
+		return
+	}
+
+	if form.Name == "" {
+		form.Errors = append(form.Errors, "Please enter your name.")
+	}
+	if address, err := mail.ParseAddress(form.Email); err != nil || address.Address != form.Email {
+		form.Errors = append(form.Errors, "Please enter a valid email address.")
+	}
+	if form.Message == "" {
+		form.Errors = append(form.Errors, "Please enter a message.")
+	}
+	if len(form.Name) > 100 || len(form.Subject) > 200 || len(form.Message) > config.ContactMaxLength {
+		form.Errors = append(form.Errors, "Your message is too long.")
+	}
+	if form.Errors != nil {
+		renderContactPage(globalData, w, r, form, http.StatusBadRequest)
+		return
+	}
+
+	client := globalData.proxies.ClientIP(r)
+	limiter := globalData.contact.limiter
+	if limiter != nil && !limiter.Take(client) {
+		w.Header().Set("Retry-After", fmt.Sprintf("%.0f", limiter.RetryAfter(client).Seconds()+1))
+		form.Errors = []string{"You have sent too many messages. Please try again later."}
+		renderContactPage(globalData, w, r, form, http.StatusTooManyRequests)
+		return
+	}
+
+	msg := globalData.contact.mailer.Compose(form, client)
+	if err := globalData.contact.mailer.Deliver(msg); err != nil {
+		glog.Errorln("Lost contact message:", err)
+		form.Failed = true
+		renderContactPage(globalData, w, r, form, http.StatusInternalServerError)
+		return
+	}
+
+	renderContactPage(globalData, w, r, &ContactForm{Sent: true}, http.StatusOK)
+}
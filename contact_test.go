@@ -0,0 +1,339 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// fakeSMTPServer accepts messages on a local port, just well enough for net/smtp.
+type fakeSMTPServer struct {
+	listener net.Listener
+	lock     sync.Mutex
+	messages []string
+	// If set, every message is rejected.
+	reject bool
+}
+
+func newFakeSMTPServer(t *testing.T) *fakeSMTPServer {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := &fakeSMTPServer{listener: listener}
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go s.serve(conn)
+		}
+	}()
+	return s
+}
+
+func (s *fakeSMTPServer) Addr() string {
+	return s.listener.Addr().String()
+}
+
+func (s *fakeSMTPServer) Close() {
+	s.listener.Close()
+}
+
+func (s *fakeSMTPServer) Messages() []string {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return append([]string{}, s.messages...)
+}
+
+func (s *fakeSMTPServer) serve(conn net.Conn) {
+	defer conn.Close()
+	r := bufio.NewReader(conn)
+	reply := func(line string) { conn.Write([]byte(line + "\r\n")) }
+
+	reply("220 localhost ready")
+	for {
+		line, err := r.ReadString('\n')
+		if err != nil {
+			return
+		}
+		command := strings.ToUpper(strings.TrimSpace(line))
+		switch {
+		case strings.HasPrefix(command, "EHLO"), strings.HasPrefix(command, "HELO"):
+			reply("250 localhost")
+		case strings.HasPrefix(command, "MAIL"):
+			s.lock.Lock()
+			reject := s.reject
+			s.lock.Unlock()
+			if reject {
+				reply("554 rejected")
+			} else {
+				reply("250 OK")
+			}
+		case strings.HasPrefix(command, "RCPT"), command == "RSET", command == "NOOP":
+			reply("250 OK")
+		case command == "DATA":
+			reply("354 go ahead")
+			data := ""
+			for {
+				line, err := r.ReadString('\n')
+				if err != nil {
+					return
+				}
+				if line == ".\r\n" {
+					break
+				}
+				data += line
+			}
+			s.lock.Lock()
+			s.messages = append(s.messages, data)
+			s.lock.Unlock()
+			reply("250 OK")
+		case command == "QUIT":
+			reply("221 bye")
+			return
+		default:
+			reply("502 not implemented")
+		}
+	}
+}
+
+func setupContactTest(t *testing.T, smtpAddr string) (*GlobalData, func()) {
+	dir, globalData, cleanup := setupSiteTest(t, "contact")
+	config.EnableContact = true
+	config.SMTPAddr = smtpAddr
+	config.ContactFrom = "blog@example.com"
+	config.ContactTo = "me@example.com"
+	config.ContactSpoolDir = filepath.Join(dir, "spool")
+	config.ContactRateLimit = 2
+	config.ContactMaxLength = 1000
+
+	contact, err := NewContact()
+	if err != nil {
+		cleanup()
+		t.Fatal(err)
+	}
+	globalData.contact = contact
+	return globalData, cleanup
+}
+
+func TestContactMailer(t *testing.T) {
+	server := newFakeSMTPServer(t)
+	defer server.Close()
+	globalData, cleanup := setupContactTest(t, server.Addr())
+	defer cleanup()
+	mailer := globalData.contact.mailer
+
+	form := &ContactForm{
+		Name:    "Alice\r\nBcc: victim@example.com",
+		Email:   "alice@example.com",
+		Subject: "Hello\nthere",
+		Message: "First line\n.\nLast line",
+	}
+	msg := mailer.Compose(form, "192.0.2.1")
+	if err := mailer.Deliver(msg); err != nil {
+		t.Fatal(err)
+	}
+
+	messages := server.Messages()
+	if len(messages) != 1 {
+		t.Fatalf("Expected 1 message, saw %d", len(messages))
+	}
+	for _, expected := range []string{
+		"Reply-To: \"Alice Bcc: victim@example.com\" <alice@example.com>\r\n",
+		"Subject: Contact form: Hello there\r\n",
+		"IP address: 192.0.2.1\r\n",
+		"First line\r\n..\r\nLast line\r\n",
+	} {
+		if !strings.Contains(messages[0], expected) {
+			t.Errorf("Expected message to contain %q, saw\n%s", expected, messages[0])
+		}
+	}
+	if strings.Contains(messages[0], "\r\nBcc:") {
+		t.Error("Name added a header to the message")
+	}
+
+	// Rejected messages are spooled, then sent when the server works again.
+	server.lock.Lock()
+	server.reject = true
+	server.lock.Unlock()
+	if err := mailer.Deliver(msg); err != nil {
+		t.Fatal(err)
+	}
+	if err := mailer.Deliver(msg); err != nil {
+		t.Fatal(err)
+	}
+	spooled, _ := filepath.Glob(filepath.Join(config.ContactSpoolDir, "*.eml"))
+	if len(spooled) != 2 {
+		t.Fatalf("Expected 2 spooled messages, saw %d", len(spooled))
+	}
+	if err := mailer.RetrySpool(); err == nil {
+		t.Error("Expected an error retrying while the server rejects messages")
+	}
+
+	server.lock.Lock()
+	server.reject = false
+	server.lock.Unlock()
+	if err := mailer.RetrySpool(); err != nil {
+		t.Fatal(err)
+	}
+	if messages := server.Messages(); len(messages) != 3 {
+		t.Errorf("Expected 3 messages after retrying, saw %d", len(messages))
+	}
+	spooled, _ = filepath.Glob(filepath.Join(config.ContactSpoolDir, "*.eml"))
+	if len(spooled) != 0 {
+		t.Errorf("Expected the spool to be empty, saw %v", spooled)
+	}
+
+	// While the spool is being retried, new messages wait behind it.
+	mailer.retrying = true
+	if err := mailer.Deliver(msg); err != nil {
+		t.Fatal(err)
+	}
+	if err := mailer.RetrySpool(); err != nil {
+		t.Fatal(err)
+	}
+	spooled, _ = filepath.Glob(filepath.Join(config.ContactSpoolDir, "*.eml"))
+	if messages := server.Messages(); len(messages) != 3 || len(spooled) != 1 {
+		t.Errorf("Expected the message spooled during a retry, saw %d sent and %d spooled",
+			len(messages), len(spooled))
+	}
+	mailer.retrying = false
+	if err := mailer.RetrySpool(); err != nil || len(server.Messages()) != 4 {
+		t.Errorf("Message spooled during a retry was not sent: %v", err)
+	}
+}
+
+func TestContactHandler(t *testing.T) {
+	server := newFakeSMTPServer(t)
+	defer server.Close()
+	globalData, cleanup := setupContactTest(t, server.Addr())
+	defer cleanup()
+
+	w := httptest.NewRecorder()
+	r, _ := http.NewRequest("GET", "/contact", nil)
+	contactFormHandler(globalData, w, r, nil)
+	if w.Code != http.StatusOK || w.Header().Get("Cache-Control") != "no-store" {
+		t.Fatalf("Expected uncached 200 for the form, saw %d with Cache-Control %s",
+			w.Code, w.Header().Get("Cache-Control"))
+	}
+	cookies := w.Result().Cookies()
+	if len(cookies) != 1 || cookies[0].Name != csrfCookieName {
+		t.Fatalf("Expected a CSRF cookie, saw %v", cookies)
+	}
+	match := regexp.MustCompile(`name="csrf_token" value="([^"]+)"`).FindStringSubmatch(w.Body.String())
+	if match == nil || match[1] != cookies[0].Value {
+		t.Fatalf("Form does not contain the CSRF token from the cookie:\n%s", w.Body.String())
+	}
+	token := match[1]
+	if !strings.Contains(w.Body.String(), `<a href="/contact">Contact me</a>`) {
+		t.Errorf("Page does not link to the contact form:\n%s", w.Body.String())
+	}
+
+	config.EnableContact = false
+	w = httptest.NewRecorder()
+	contactFormHandler(globalData, w, r, nil)
+	if strings.Contains(w.Body.String(), `<a href="/contact">Contact me</a>`) {
+		t.Errorf("Page links to the disabled contact form:\n%s", w.Body.String())
+	}
+	config.EnableContact = true
+
+	post := func(form url.Values, cookie string) *httptest.ResponseRecorder {
+		r, _ := http.NewRequest("POST", "/contact", strings.NewReader(form.Encode()))
+		r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		r.RemoteAddr = "192.0.2.1:1234"
+		if cookie != "" {
+			r.AddCookie(&http.Cookie{Name: csrfCookieName, Value: cookie})
+		}
+		w := httptest.NewRecorder()
+		contactPostHandler(globalData, w, r, nil)
+		return w
+	}
+	valid := func() url.Values {
+		return url.Values{"csrf_token": {token}, "name": {"Alice"}, "email": {"alice@example.com"},
+			"message": {"Hi there"}}
+	}
+
+	forged := valid()
+	forged.Set("csrf_token", "abc.def")
+	tests := []struct {
+		name   string
+		form   url.Values
+		cookie string
+		code   int
+	}{
+		{"no cookie", valid(), "", http.StatusForbidden},
+		{"forged token", forged, "abc.def", http.StatusForbidden},
+		{"no email", url.Values{"csrf_token": {token}, "name": {"Alice"}, "message": {"Hi"}},
+			token, http.StatusBadRequest},
+		{"too long", url.Values{"csrf_token": {token}, "name": {"Alice"}, "email": {"a@example.com"},
+			"message": {strings.Repeat("x", 1001)}}, token, http.StatusBadRequest},
+	}
+	for _, test := range tests {
+		if w := post(test.form, test.cookie); w.Code != test.code {
+			t.Errorf("%s: expected %d, saw %d", test.name, test.code, w.Code)
+		}
+	}
+
+	// The honeypot is filled in by bots, which are told that it worked.
+	bot := valid()
+	bot.Set(honeypotField, "http://spam.example.com")
+	if w := post(bot, token); w.Code != http.StatusOK || !strings.Contains(w.Body.String(), "Thanks!") {
+		t.Errorf("Expected the success page for the honeypot, saw %d", w.Code)
+	}
+	if messages := server.Messages(); len(messages) != 0 {
+		t.Fatalf("Expected no message for the honeypot, saw %d", len(messages))
+	}
+
+	for i := 0; i < 2; i++ {
+		if w := post(valid(), token); w.Code != http.StatusOK || !strings.Contains(w.Body.String(), "Thanks!") {
+			t.Errorf("Expected the success page, saw %d\n%s", w.Code, w.Body.String())
+		}
+	}
+	if messages := server.Messages(); len(messages) != 2 {
+		t.Errorf("Expected 2 messages, saw %d", len(messages))
+	}
+
+	w = post(valid(), token)
+	if w.Code != http.StatusTooManyRequests || w.Header().Get("Retry-After") == "" {
+		t.Errorf("Expected 429 with Retry-After once the limit is used up, saw %d", w.Code)
+	}
+	if !strings.Contains(w.Body.String(), ">Hi there</textarea>") {
+		t.Error("Rate limited form did not keep the message")
+	}
+}
+
+func TestRedactedConfig(t *testing.T) {
+	c := *config
+	c.SMTPUsername = "blog"
+	c.SMTPPassword = "smtp-password"
+	c.CSRFSecret = "csrf-secret"
+	c.Users = map[string]UserConfig{"alice": {PasswordHash: "password-hash", TOTPSecret: "totp-secret"}}
+	c.MicropubTokens = map[string]string{"micropub-token": "create"}
+	c.GitWebhookSecret = "webhook-secret"
+
+	logged := fmt.Sprintf("%+v", c.redacted())
+	for _, secret := range []string{"smtp-password", "csrf-secret", "password-hash", "totp-secret",
+		"micropub-token", "webhook-secret"} {
+		if strings.Contains(logged, secret) {
+			t.Errorf("Logged configuration contains %s", secret)
+		}
+	}
+	for _, setting := range []string{"SMTPUsername:blog", "alice", "create"} {
+		if !strings.Contains(logged, setting) {
+			t.Errorf("Logged configuration is missing %s", setting)
+		}
+	}
+	if c.SMTPPassword != "smtp-password" || c.Users["alice"].PasswordHash != "password-hash" {
+		t.Error("Redacting changed the configuration")
+	}
+}
@@ -0,0 +1,86 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"net/http"
+	"strings"
+)
+
+const csrfCookieName = "csrf"
+
+// Name of a form field that people never see, so it is only filled in by bots.
+const honeypotField = "website"
+
+// CSRF protects forms with signed double-submit tokens. The token is stored in a cookie
+// and repeated in a form field, and a POST is only accepted if they match. Signing the
+// token prevents an attacker who can set cookies for the domain from choosing it.
+type CSRF struct {
+	secret []byte
+	// Path the cookie is scoped to.
+	path string
+	// Name of the form field holding the token.
+	Field string
+	// Name of the cookie holding the token.
+	Cookie string
+}
+
+// NewCSRF creates a CSRF protector. If secret is empty, a random one is generated,
+// so tokens won't survive a restart.
+func NewCSRF(secret, path string) (*CSRF, error) {
+	key := []byte(secret)
+	if len(key) == 0 {
+		key = make([]byte, 32)
+		if _, err := rand.Read(key); err != nil {
+			return nil, err
+		}
+	}
+	return &CSRF{secret: key, path: path, Field: "csrf_token", Cookie: csrfCookieName}, nil
+}
+
+func (c *CSRF) sign(value string) string {
+	mac := hmac.New(sha256.New, c.secret)
+	mac.Write([]byte(value))
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+func (c *CSRF) valid(token string) bool {
+	parts := strings.Split(token, ".")
+	return len(parts) == 2 && hmac.Equal([]byte(parts[1]), []byte(c.sign(parts[0])))
+}
+
+// Token returns the token to put in a form, setting the cookie if the request doesn't
+// already have a valid one.
+func (c *CSRF) Token(w http.ResponseWriter, r *http.Request) (string, error) {
+	if cookie, err := r.Cookie(c.Cookie); err == nil && c.valid(cookie.Value) {
+		return cookie.Value, nil
+	}
+
+	b := make([]byte, 18)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	value := base64.RawURLEncoding.EncodeToString(b)
+	token := value + "." + c.sign(value)
+
+	http.SetCookie(w, &http.Cookie{
+		Name:     c.Cookie,
+		Value:    token,
+		Path:     c.path,
+		HttpOnly: true,
+		SameSite: http.SameSiteStrictMode,
+	})
+	return token, nil
+}
+
+// Verify returns true if the form in a POST request has the token from its cookie.
+// The form must already be parsed.
+func (c *CSRF) Verify(r *http.Request) bool {
+	cookie, err := r.Cookie(c.Cookie)
+	if err != nil || !c.valid(cookie.Value) {
+		return false
+	}
+	return hmac.Equal([]byte(r.PostFormValue(c.Field)), []byte(cookie.Value))
+}
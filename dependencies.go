@@ -0,0 +1,208 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"github.com/dimfeld/glog"
+	"github.com/dimfeld/gocache"
+	"io/ioutil"
+	"os"
+	"sync"
+	"time"
+)
+
+// Dependencies that are shared by many pages.
+const (
+	// Pages that show the most recent posts, i.e. the index and the feed.
+	RecentDependency = "recent"
+	// Pages that show the tag and archive lists.
+	SidebarDependency = "sidebar"
+	// All pages rendered from any template. Used when a template file changes that
+	// isn't itself executed directly, since it may define templates used by any page.
+	TemplatesDependency = "templates"
+)
+
+func PostDependency(sourcePath string) string {
+	return "post:" + sourcePath
+}
+
+func MonthDependency(year, month string) string {
+	return "month:" + year + "/" + month
+}
+
+func TagDependency(tag string) string {
+	return "tag:" + tag
+}
+
+func TemplateDependency(name string) string {
+	return "template:" + name
+}
+
+// CommentsDependency is recorded only by a post's own page, since that is the only page
+// that shows its comments.
+func CommentsDependency(sourcePath string) string {
+	return "comments:" + sourcePath
+}
+
+// WebmentionsDependency is recorded only by a post's own page, like CommentsDependency.
+func WebmentionsDependency(sourcePath string) string {
+	return "webmentions:" + sourcePath
+}
+
+// DependencyTracker records which posts, tags, months, and templates were used to
+// build each rendered page, so that a change to one post only needs to remove the
+// pages that actually used it.
+type DependencyTracker struct {
+	lock sync.Mutex
+	// For each dependency, the set of cache keys that were built from it.
+	deps map[string]map[string]bool
+	// Timestamp of the oldest post on the pages that depend on RecentDependency.
+	// A post with a newer timestamp than this would show up on those pages.
+	recentCutoff time.Time
+}
+
+func NewDependencyTracker() *DependencyTracker {
+	return &DependencyTracker{deps: make(map[string]map[string]bool)}
+}
+
+// Record notes that the object stored at key was built using each of deps.
+// The key should be the base key, without any compression extension.
+func (dt *DependencyTracker) Record(key string, deps ...string) {
+	dt.lock.Lock()
+	defer dt.lock.Unlock()
+
+	for _, dep := range deps {
+		keys := dt.deps[dep]
+		if keys == nil {
+			keys = make(map[string]bool)
+			dt.deps[dep] = keys
+		}
+		keys[key] = true
+	}
+}
+
+// SetRecentCutoff sets the timestamp of the oldest post shown on the recent posts pages.
+func (dt *DependencyTracker) SetRecentCutoff(t time.Time) {
+	dt.lock.Lock()
+	dt.recentCutoff = t
+	dt.lock.Unlock()
+}
+
+// IsRecent returns true if a post with the given timestamp would be shown
+// on the recent posts pages.
+func (dt *DependencyTracker) IsRecent(t time.Time) bool {
+	dt.lock.Lock()
+	defer dt.lock.Unlock()
+	return !t.Before(dt.recentCutoff)
+}
+
+// HasDependents returns true if any cached object was built using dep.
+func (dt *DependencyTracker) HasDependents(dep string) bool {
+	dt.lock.Lock()
+	defer dt.lock.Unlock()
+	return len(dt.deps[dep]) != 0
+}
+
+// Invalidate removes every object built from any of deps from the cache, including
+// the compressed variants, and returns the base keys that were removed.
+func (dt *DependencyTracker) Invalidate(cache gocache.Cache, deps ...string) []string {
+	dt.lock.Lock()
+	keySet := make(map[string]bool)
+	for _, dep := range deps {
+		for key := range dt.deps[dep] {
+			keySet[key] = true
+		}
+		delete(dt.deps, dep)
+	}
+	dt.lock.Unlock()
+
+	keys := make([]string, 0, len(keySet))
+	for key := range keySet {
+		if glog.V(1) {
+			glog.Infoln("Invalidating", key)
+		}
+		for _, variant := range cacheKeyVariants(key) {
+			cache.Del(variant)
+		}
+		keys = append(keys, key)
+	}
+
+	return keys
+}
+
+// Reset forgets all recorded dependencies. This should be called whenever
+// the entire cache is cleared.
+func (dt *DependencyTracker) Reset() {
+	dt.lock.Lock()
+	dt.deps = make(map[string]map[string]bool)
+	dt.recentCutoff = time.Time{}
+	dt.lock.Unlock()
+}
+
+// dependencySnapshot is the form in which a DependencyTracker is saved at shutdown.
+type dependencySnapshot struct {
+	// Identifies the configuration and program that built the cached pages.
+	Version      string
+	Saved        time.Time
+	RecentCutoff time.Time
+	Deps         map[string][]string
+}
+
+// Save writes the recorded dependencies to path, so that the next run can keep using the
+// pages in the disk cache. version identifies what the pages were built with.
+func (dt *DependencyTracker) Save(path, version string) error {
+	dt.lock.Lock()
+	snapshot := dependencySnapshot{
+		Version:      version,
+		Saved:        time.Now(),
+		RecentCutoff: dt.recentCutoff,
+		Deps:         make(map[string][]string, len(dt.deps)),
+	}
+	for dep, keys := range dt.deps {
+		for key := range keys {
+			snapshot.Deps[dep] = append(snapshot.Deps[dep], key)
+		}
+	}
+	dt.lock.Unlock()
+
+	data, err := json.Marshal(snapshot)
+	if err != nil {
+		return err
+	}
+	tempPath := path + ".tmp"
+	if err := ioutil.WriteFile(tempPath, data, 0644); err != nil {
+		return err
+	}
+	return os.Rename(tempPath, path)
+}
+
+// LoadDependencyTracker reads the dependencies written by Save, and returns them with the
+// time they were saved. The file is removed, so that if this run doesn't shut down cleanly,
+// the next one starts from a clean cache instead of trusting dependencies that are out of
+// date. It fails if the dependencies were saved with a different version.
+func LoadDependencyTracker(path, version string) (*DependencyTracker, time.Time, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, time.Time{}, err
+	}
+	os.Remove(path)
+
+	var snapshot dependencySnapshot
+	if err := json.Unmarshal(data, &snapshot); err != nil {
+		return nil, time.Time{}, err
+	}
+	if snapshot.Version != version {
+		return nil, time.Time{}, errors.New("the configuration or program changed")
+	}
+
+	dt := NewDependencyTracker()
+	dt.recentCutoff = snapshot.RecentCutoff
+	for dep, keys := range snapshot.Deps {
+		keySet := make(map[string]bool, len(keys))
+		for _, key := range keys {
+			keySet[key] = true
+		}
+		dt.deps[dep] = keySet
+	}
+	return dt, snapshot.Saved, nil
+}
@@ -0,0 +1,248 @@
+package main
+
+import (
+	"errors"
+	"github.com/dimfeld/gocache"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"testing"
+	"time"
+)
+
+var errNotCached = errors.New("not cached")
+
+type failFiller struct{}
+
+func (f failFiller) Fill(cache gocache.Cache, key string) (gocache.Object, error) {
+	return gocache.Object{}, errNotCached
+}
+
+func isCached(cache gocache.Cache, key string) bool {
+	_, err := cache.Get(key, failFiller{})
+	return err == nil
+}
+
+func TestDependencyTracker(t *testing.T) {
+	cache := gocache.NewMemoryCache(1024*1024, 1024)
+	dt := NewDependencyTracker()
+
+	pages := map[string][]string{
+		"index.html":       {RecentDependency, SidebarDependency, PostDependency("a.md")},
+		"2014/05/a.md":     {SidebarDependency, PostDependency("a.md")},
+		"2014/05/b.md":     {SidebarDependency, PostDependency("b.md")},
+		"archive/2014-05":  {SidebarDependency, MonthDependency("2014", "05")},
+		"tags/Some Tag":    {SidebarDependency, TagDependency("Some Tag")},
+		"atom.xml":         {RecentDependency, PostDependency("a.md")},
+		"assets/style.css": nil,
+	}
+
+	for key, deps := range pages {
+		for _, variant := range cacheKeyVariants(key) {
+			cache.Set(variant, gocache.Object{Data: []byte(variant), ModTime: time.Now()})
+		}
+		dt.Record(key, deps...)
+	}
+
+	checkInvalidate := func(deps []string, expected []string) {
+		keys := dt.Invalidate(cache, deps...)
+		sort.Strings(keys)
+		sort.Strings(expected)
+		if len(keys) != len(expected) {
+			t.Fatalf("Invalidating %v: expected keys %v, saw %v", deps, expected, keys)
+		}
+		for i := range keys {
+			if keys[i] != expected[i] {
+				t.Errorf("Invalidating %v: expected keys %v, saw %v", deps, expected, keys)
+			}
+		}
+
+		for _, key := range keys {
+			for _, variant := range cacheKeyVariants(key) {
+				if isCached(cache, variant) {
+					t.Errorf("Invalidating %v: %s still in the cache", deps, variant)
+				}
+			}
+		}
+	}
+
+	checkInvalidate([]string{PostDependency("a.md")},
+		[]string{"index.html", "2014/05/a.md", "atom.xml"})
+
+	if !isCached(cache, "2014/05/b.md#gz") {
+		t.Error("Unrelated page was removed from the cache")
+	}
+
+	checkInvalidate([]string{TagDependency("Other Tag"), MonthDependency("2014", "05")},
+		[]string{"archive/2014-05"})
+
+	if dt.HasDependents(TagDependency("Other Tag")) {
+		t.Error("HasDependents returned true for unused dependency")
+	}
+	if !dt.HasDependents(SidebarDependency) {
+		t.Error("HasDependents returned false for sidebar")
+	}
+
+	// Keys that were already invalidated through another dependency may still be returned.
+	checkInvalidate([]string{SidebarDependency},
+		[]string{"index.html", "2014/05/a.md", "2014/05/b.md", "archive/2014-05", "tags/Some Tag"})
+
+	if !isCached(cache, "assets/style.css#gz") {
+		t.Error("Static asset was removed from the cache")
+	}
+
+	cutoff := time.Date(2014, 5, 1, 0, 0, 0, 0, time.UTC)
+	dt.SetRecentCutoff(cutoff)
+	if !dt.IsRecent(cutoff.Add(time.Hour)) || !dt.IsRecent(cutoff) {
+		t.Error("Post newer than cutoff was not recent")
+	}
+	if dt.IsRecent(cutoff.Add(-time.Hour)) {
+		t.Error("Post older than cutoff was recent")
+	}
+
+	dt.Reset()
+	if dt.HasDependents(RecentDependency) {
+		t.Error("Reset did not clear dependencies")
+	}
+}
+
+func TestDependencyTrackerSave(t *testing.T) {
+	dir, err := ioutil.TempDir("", "simpleblog-deps")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	depsPath := filepath.Join(dir, "dependencies.json")
+
+	dt := NewDependencyTracker()
+	dt.Record("2014/05/a.md", SidebarDependency, PostDependency("a.md"))
+	dt.Record("index.html", RecentDependency, PostDependency("a.md"))
+	cutoff := time.Date(2014, 5, 1, 0, 0, 0, 0, time.UTC)
+	dt.SetRecentCutoff(cutoff)
+	if err := dt.Save(depsPath, "v1"); err != nil {
+		t.Fatal(err)
+	}
+
+	loaded, saved, err := LoadDependencyTracker(depsPath, "v1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if saved.IsZero() || !loaded.IsRecent(cutoff) || loaded.IsRecent(cutoff.Add(-time.Hour)) {
+		t.Errorf("Saved time or recent cutoff was not loaded: %v", saved)
+	}
+	cache := gocache.NewMemoryCache(1024*1024, 1024)
+	cache.Set("index.html", gocache.Object{Data: []byte("index"), ModTime: time.Now()})
+	if keys := loaded.Invalidate(cache, PostDependency("a.md")); len(keys) != 2 {
+		t.Errorf("Expected both pages to depend on the post, saw %v", keys)
+	}
+	if isCached(cache, "index.html") {
+		t.Error("Loaded dependencies did not invalidate the page")
+	}
+
+	// The file is removed once loaded, so a run that doesn't save can't leave it behind.
+	if _, _, err := LoadDependencyTracker(depsPath, "v1"); !os.IsNotExist(err) {
+		t.Errorf("Expected the saved dependencies to be removed, saw %v", err)
+	}
+
+	dt.Save(depsPath, "v1")
+	if _, _, err := LoadDependencyTracker(depsPath, "v2"); err == nil {
+		t.Error("Expected an error for dependencies saved by another version")
+	}
+}
+
+func TestInvalidateChangedSince(t *testing.T) {
+	dir, err := ioutil.TempDir("", "simpleblog-changed")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	oldConfig := *config
+	defer func() { *config = oldConfig }()
+	config.PostsDir = filepath.Join(dir, "posts")
+	config.DataDir = filepath.Join(dir, "data")
+	config.TagsPath = filepath.Join(dir, "tags.json")
+	os.MkdirAll(config.DataDir, 0755)
+
+	writePost := func(key, content string) string {
+		sourcePath := filepath.Join(config.PostsDir, key+".md")
+		os.MkdirAll(filepath.Dir(sourcePath), 0755)
+		ioutil.WriteFile(sourcePath, []byte(key+"\n5/14/14 11:14PM -0500\ntag\n\n"+content), 0644)
+		return sourcePath
+	}
+	past := time.Now().Add(-time.Hour)
+	for _, key := range []string{"2014/05/a", "2014/05/b"} {
+		sourcePath := writePost(key, "Content")
+		os.Chtimes(sourcePath, past, past)
+	}
+	dataPath := filepath.Join(config.DataDir, "about.txt")
+	ioutil.WriteFile(dataPath, []byte("About"), 0644)
+	os.Chtimes(dataPath, past, past)
+	NewTags(config.TagsPath, config.PostsDir)
+
+	globalData := &GlobalData{
+		RWMutex:  &sync.RWMutex{},
+		cache:    gocache.NewMemoryCache(1024*1024, 1024),
+		deps:     NewDependencyTracker(),
+		notFound: NewNotFoundCache(time.Minute, 100),
+	}
+	fill := func() {
+		for _, key := range []string{"2014/05/a.md", "2014/05/b.md", "about.txt"} {
+			globalData.cache.Set(key, gocache.Object{Data: []byte(key), ModTime: time.Now()})
+			globalData.deps.Record(key, PostDependency(filepath.Join(config.PostsDir, key)))
+		}
+	}
+	fill()
+
+	saved := time.Now().Add(-time.Minute)
+	invalidateChangedSince(globalData, saved)
+	for _, key := range []string{"2014/05/a.md", "2014/05/b.md", "about.txt"} {
+		if !isCached(globalData.cache, key) {
+			t.Errorf("%s was removed, though nothing changed", key)
+		}
+	}
+
+	// A changed post or data file removes only the pages built from it.
+	writePost("2014/05/a", "Changed")
+	os.Chtimes(dataPath, time.Now(), time.Now())
+	invalidateChangedSince(globalData, saved)
+	if isCached(globalData.cache, "2014/05/a.md") || isCached(globalData.cache, "about.txt") {
+		t.Error("Changed post or data file was not invalidated")
+	}
+	if !isCached(globalData.cache, "2014/05/b.md") {
+		t.Error("Unchanged post was invalidated")
+	}
+
+	// Any other post may be listed on the pages of a removed one, so it clears everything.
+	fill()
+	os.Remove(filepath.Join(config.PostsDir, "2014/05/a.md"))
+	invalidateChangedSince(globalData, saved)
+	if isCached(globalData.cache, "2014/05/b.md") {
+		t.Error("Cache was not cleared after a post was removed")
+	}
+}
+
+func TestMonthFromPostPath(t *testing.T) {
+	tests := []struct {
+		path  string
+		year  string
+		month string
+		ok    bool
+	}{
+		{"2014/05/first-post.md", "2014", "05", true},
+		{"2014/05", "2014", "05", true},
+		{"2014", "", "", false},
+		{"page/about.md", "", "", false},
+		{"2014/abc/post.md", "", "", false},
+	}
+
+	for _, test := range tests {
+		year, month, ok := monthFromPostPath(test.path)
+		if year != test.year || month != test.month || ok != test.ok {
+			t.Errorf("monthFromPostPath(%s): expected %s, %s, %v, saw %s, %s, %v",
+				test.path, test.year, test.month, test.ok, year, month, ok)
+		}
+	}
+}
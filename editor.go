@@ -0,0 +1,583 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"github.com/dimfeld/glog"
+	"html/template"
+	"io"
+	"mime/multipart"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+	"unicode"
+)
+
+// Image types that can be uploaded from the editor. SVG is left out, since it can
+// contain scripts that would run on the public site.
+var uploadImageTypes = map[string]string{
+	".jpg":  "image/jpeg",
+	".jpeg": "image/jpeg",
+	".png":  "image/png",
+	".gif":  "image/gif",
+	".webp": "image/webp",
+}
+
+var errUnsupportedImage = errors.New("Only JPEG, PNG, GIF, and WebP images can be uploaded")
+
+// Editor serves the pages for writing posts in the admin area. It only changes files, and
+// the file system watcher takes care of updating the site.
+type Editor struct {
+	csrf *CSRF
+}
+
+// NewEditor creates an Editor whose forms are protected by csrf.
+func NewEditor(csrf *CSRF) *Editor {
+	return &Editor{csrf: csrf}
+}
+
+// EditorPost is a post in the editor's list.
+type EditorPost struct {
+	*Post
+	Key string
+	// Where the post appears on the public site.
+	URL string
+}
+
+// EditorForm is the template data for the edit page.
+type EditorForm struct {
+	// Key of the post being edited, or empty for a new post.
+	Original string
+	// URL of the post on the public site, once it exists.
+	URL   string
+	Title string
+	Date  string
+	Tags  string
+	Link  string
+	// Time zone to show the post's times in, if not the site's.
+	Timezone string
+	Content  string
+	// For new posts, the file name, and whether it's a custom page instead of a dated post.
+	Slug string
+	Page bool
+	// For edited posts, a note to add to the post's changelog.
+	Change string
+
+	Errors []string
+	Saved  bool
+	// Existing tags, for autocompletion.
+	TagNames  []string
+	CSRFField string
+	Token     string
+}
+
+// publicURL returns the path of a post on the public site.
+func publicURL(key string) string {
+	return "/" + strings.TrimPrefix(key, "page/")
+}
+
+// slugify turns a title into a file name.
+func slugify(title string) string {
+	slug := strings.Map(func(r rune) rune {
+		if unicode.IsLetter(r) || unicode.IsDigit(r) {
+			return unicode.ToLower(r)
+		}
+		return '-'
+	}, title)
+
+	parts := strings.FieldsFunc(slug, func(r rune) bool { return r == '-' })
+	return strings.Join(parts, "-")
+}
+
+// tagNames returns the tags used by any post, for autocompletion.
+func tagNames() []string {
+	return NewTags(config.TagsPath, config.PostsDir).TagsByName()
+}
+
+// post checks the form and returns the post it describes.
+func (f *EditorForm) post() (*Post, []string) {
+	problems := []string{}
+	p := &Post{
+		Title:    strings.Join(strings.Fields(f.Title), " "),
+		Link:     strings.TrimSpace(f.Link),
+		Timezone: strings.TrimSpace(f.Timezone),
+		Content:  []byte(strings.Replace(f.Content, "\r\n", "\n", -1)),
+	}
+
+	if p.Title == "" {
+		problems = append(problems, "The title is required.")
+	}
+
+	timestamp, err := time.Parse(PostTimeFormat, strings.TrimSpace(f.Date))
+	if err != nil {
+		problems = append(problems, "The date must look like "+siteTime(time.Now()).Format(PostTimeFormat)+".")
+	}
+	p.Timestamp = timestamp
+
+	for _, tag := range strings.Split(f.Tags, ",") {
+		if tag = strings.Join(strings.Fields(tag), " "); tag != "" {
+			p.Tags = append(p.Tags, tag)
+		}
+	}
+	// A tags line that looks like a link would be read as the link.
+	if len(p.Tags) != 0 && (strings.HasPrefix(p.Tags[0], "http://") || strings.HasPrefix(p.Tags[0], "https://")) {
+		problems = append(problems, "The first tag can't be a URL.")
+	}
+
+	if p.Timezone != "" {
+		if _, err := loadTimezone(p.Timezone); err != nil {
+			problems = append(problems, "The time zone must be a name like America/New_York.")
+		}
+	}
+
+	if p.Link != "" && ((!strings.HasPrefix(p.Link, "http://") && !strings.HasPrefix(p.Link, "https://")) ||
+		strings.ContainsAny(p.Link, " \t\r\n")) {
+		problems = append(problems, "The link must be an http or https URL.")
+	}
+
+	return p, problems
+}
+
+// newKey returns the key for a new post: its month directory and slug, or page/slug.
+func (f *EditorForm) newKey(timestamp time.Time) (string, error) {
+	slug := slugify(f.Slug)
+	if slug == "" {
+		slug = slugify(f.Title)
+	}
+	if slug == "" {
+		return "", errors.New("The file name must contain letters or digits.")
+	}
+
+	if f.Page {
+		return path.Join("page", slug), nil
+	}
+	return path.Join(timestamp.Format("2006"), timestamp.Format("01"), slug), nil
+}
+
+var editorListTemplate = template.Must(template.New("list").Funcs(templateFuncs).Parse(`<!DOCTYPE html>
+<html lang="en">
+<head><title>Posts</title></head>
+<body>
+<h1>Posts</h1>
+<p><a href="/admin/new">New post</a></p>
+<table>
+	{{range .}}
+	<tr>
+		<td><a href="/admin/edit/{{.Key}}">{{.Title}}</a></td>
+		<td>{{FormatTime .Timestamp}}</td>
+		<td>{{range $i, $tag := .Tags}}{{if $i}}, {{end}}{{$tag}}{{end}}</td>
+		<td><a href="{{.URL}}">{{.Key}}</a></td>
+	</tr>
+	{{else}}
+	<tr><td>There are no posts yet.</td></tr>
+	{{end}}
+</table>
+</body>
+</html>
+`))
+
+var editorTemplate = template.Must(template.New("edit").Funcs(templateFuncs).Parse(`<!DOCTYPE html>
+<html lang="en">
+<head>
+<title>{{if .Original}}Edit {{.Title}}{{else}}New post{{end}}</title>
+<style>
+	form.editor { display: flex; flex-direction: column; max-width: 50em; }
+	form.editor textarea { height: 30em; }
+	#preview { border: thin solid #C0C0C0; padding: 1em; max-width: 50em; }
+</style>
+</head>
+<body>
+<p><a href="/admin/">All posts</a>{{with .URL}} | <a href="{{.}}">View</a>{{end}}</p>
+{{if .Saved}}<p class="saved">Saved.</p>{{end}}
+{{with .Errors}}<ul class="errors">{{range .}}<li>{{.}}</li>{{end}}</ul>{{end}}
+
+<form class="editor" id="editor" method="post" action="/admin/save">
+	<input type="hidden" name="{{.CSRFField}}" value="{{.Token}}">
+	<input type="hidden" name="original" value="{{.Original}}">
+	<label>Title <input type="text" name="title" value="{{.Title}}" required></label>
+	<label>Date <input type="text" name="date" value="{{.Date}}" required></label>
+	<label>Tags <input type="text" name="tags" id="tags" value="{{.Tags}}" list="tag-names" autocomplete="off"></label>
+	<datalist id="tag-names">{{range .TagNames}}<option value="{{.}}">{{end}}</datalist>
+	<label>Link <input type="url" name="link" value="{{.Link}}"></label>
+	<label>Time zone <input type="text" name="timezone" value="{{.Timezone}}" placeholder="The site's time zone"></label>
+	{{if not .Original}}
+	<label>File name <input type="text" name="slug" value="{{.Slug}}" placeholder="From the title"></label>
+	<label><input type="checkbox" name="page" value="1"{{if .Page}} checked{{end}}> Custom page</label>
+	{{end}}
+	{{if .Original}}
+	<label>Changelog note <input type="text" name="change" value="{{.Change}}" placeholder="Leave empty for small fixes"></label>
+	{{end}}
+	<textarea name="content" id="content">{{.Content}}</textarea>
+	<label>Upload image <input type="file" id="image" accept="image/jpeg,image/png,image/gif,image/webp"></label>
+	<button type="submit">Save</button>
+</form>
+
+{{if .Original}}
+<form method="post" action="/admin/delete" onsubmit="return confirm('Delete this post?')">
+	<input type="hidden" name="{{.CSRFField}}" value="{{.Token}}">
+	<input type="hidden" name="post" value="{{.Original}}">
+	<button type="submit">Delete</button>
+</form>
+{{end}}
+
+<h2>Preview</h2>
+<div id="preview"></div>
+
+<script>
+(function() {
+	var form = document.getElementById("editor");
+	var content = document.getElementById("content");
+	var preview = document.getElementById("preview");
+	var timer = null;
+
+	function updatePreview() {
+		fetch("/admin/preview", {method: "POST", body: new FormData(form), credentials: "same-origin"})
+			.then(function(resp) { return resp.text(); })
+			.then(function(html) { preview.innerHTML = html; });
+	}
+	content.addEventListener("input", function() {
+		clearTimeout(timer);
+		timer = setTimeout(updatePreview, 300);
+	});
+	updatePreview();
+
+	// Complete the tag after the last comma, keeping the ones before it.
+	var tags = document.getElementById("tags");
+	var tagNames = document.getElementById("tag-names");
+	var names = Array.prototype.map.call(tagNames.options, function(o) { return o.value; });
+	tags.addEventListener("input", function() {
+		var i = tags.value.lastIndexOf(",");
+		var prefix = i == -1 ? "" : tags.value.slice(0, i + 1) + " ";
+		tagNames.innerHTML = "";
+		names.forEach(function(name) {
+			var option = document.createElement("option");
+			option.value = prefix + name;
+			tagNames.appendChild(option);
+		});
+	});
+
+	document.getElementById("image").addEventListener("change", function(e) {
+		var data = new FormData();
+		data.append("{{.CSRFField}}", "{{.Token}}");
+		data.append("date", form.elements.date.value);
+		data.append("image", e.target.files[0]);
+		fetch("/admin/images", {method: "POST", body: data, credentials: "same-origin"})
+			.then(function(resp) {
+				if (!resp.ok) { throw new Error("Upload failed"); }
+				return resp.json();
+			})
+			.then(function(result) {
+				var at = content.selectionStart;
+				content.value = content.value.slice(0, at) + result.Markdown + content.value.slice(at);
+				updatePreview();
+			})
+			.catch(function(err) { alert(err.message); });
+		e.target.value = "";
+	});
+})();
+</script>
+</body>
+</html>
+`))
+
+func sendAdminPage(w http.ResponseWriter, tmpl *template.Template, data interface{}, status int) {
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.Header().Set("Cache-Control", "no-store")
+	w.WriteHeader(status)
+	if err := tmpl.Execute(w, data); err != nil {
+		glog.Errorf("Could not render admin page %s: %s", tmpl.Name(), err)
+	}
+}
+
+// listHandler lists every post and page, newest first.
+func (e *Editor) listHandler(globalData *GlobalData, w http.ResponseWriter,
+	r *http.Request, urlParams map[string]string) {
+
+	tags := NewTags(config.TagsPath, config.PostsDir)
+	posts := make(PostList, 0, len(tags.Post))
+	for _, post := range tags.Post {
+		posts = append(posts, post)
+	}
+	sort.Sort(sort.Reverse(posts))
+
+	list := make([]EditorPost, len(posts))
+	for i, post := range posts {
+		key := postKey(post.SourcePath)
+		list[i] = EditorPost{Post: post, Key: key, URL: siteURL() + publicURL(key)}
+	}
+	sendAdminPage(w, editorListTemplate, list, http.StatusOK)
+}
+
+// renderEditor shows the edit page for a form.
+func (e *Editor) renderEditor(w http.ResponseWriter, r *http.Request, form *EditorForm, status int) {
+	token, err := e.csrf.Token(w, r)
+	if err != nil {
+		handleError(w, r, err)
+		return
+	}
+	form.CSRFField = e.csrf.Field
+	form.Token = token
+	form.TagNames = tagNames()
+	if form.Original != "" {
+		form.URL = siteURL() + publicURL(form.Original)
+	}
+	sendAdminPage(w, editorTemplate, form, status)
+}
+
+func (e *Editor) newHandler(globalData *GlobalData, w http.ResponseWriter,
+	r *http.Request, urlParams map[string]string) {
+
+	e.renderEditor(w, r, &EditorForm{Date: siteTime(time.Now()).Format(PostTimeFormat)}, http.StatusOK)
+}
+
+func (e *Editor) editHandler(globalData *GlobalData, w http.ResponseWriter,
+	r *http.Request, urlParams map[string]string) {
+
+	key := strings.TrimSuffix(strings.Trim(urlParams["post"], "/"), ".md")
+	if !validPostKey(key) {
+		error404(w, r)
+		return
+	}
+	post, err := NewPost(postSourcePath(key), true)
+	if err != nil {
+		handleError(w, r, err)
+		return
+	}
+
+	form := &EditorForm{
+		Original: key,
+		Title:    post.Title,
+		Date:     post.Timestamp.Format(PostTimeFormat),
+		Tags:     strings.Join(post.Tags, ", "),
+		Link:     post.Link,
+		Timezone: post.Timezone,
+		Content:  string(post.Content),
+		Saved:    r.URL.Query().Get("saved") != "",
+	}
+	e.renderEditor(w, r, form, http.StatusOK)
+}
+
+// saveHandler writes a new or edited post. An edited post stays in its file even if its
+// date changes, so that its URL doesn't change.
+func (e *Editor) saveHandler(globalData *GlobalData, w http.ResponseWriter,
+	r *http.Request, urlParams map[string]string) {
+
+	r.Body = http.MaxBytesReader(w, r.Body, 10*1024*1024)
+	if err := r.ParseForm(); err != nil {
+		http.Error(w, "Invalid form", http.StatusBadRequest)
+		return
+	}
+
+	form := &EditorForm{
+		Original: r.PostFormValue("original"),
+		Title:    r.PostFormValue("title"),
+		Date:     r.PostFormValue("date"),
+		Tags:     r.PostFormValue("tags"),
+		Link:     r.PostFormValue("link"),
+		Timezone: r.PostFormValue("timezone"),
+		Content:  r.PostFormValue("content"),
+		Slug:     r.PostFormValue("slug"),
+		Page:     r.PostFormValue("page") != "",
+		Change:   strings.TrimSpace(r.PostFormValue("change")),
+	}
+	if !e.csrf.Verify(r) {
+		form.Errors = []string{"The form has expired. Please save again."}
+		e.renderEditor(w, r, form, http.StatusForbidden)
+		return
+	}
+
+	post, problems := form.post()
+	if len(problems) != 0 {
+		form.Errors = problems
+		e.renderEditor(w, r, form, http.StatusBadRequest)
+		return
+	}
+
+	key := form.Original
+	if key == "" {
+		var err error
+		key, err = form.newKey(post.Timestamp)
+		if err != nil {
+			form.Errors = []string{err.Error()}
+			e.renderEditor(w, r, form, http.StatusBadRequest)
+			return
+		}
+		if _, err := os.Stat(postSourcePath(key)); err == nil {
+			form.Errors = []string{"There is already a post at " + key + ". Choose another file name."}
+			e.renderEditor(w, r, form, http.StatusConflict)
+			return
+		}
+	} else if !validPostKey(key) {
+		http.Error(w, "Invalid post", http.StatusBadRequest)
+		return
+	} else {
+		existing, err := NewPost(postSourcePath(key), false)
+		if err != nil {
+			handleError(w, r, err)
+			return
+		}
+		post.Changes = existing.Changes
+		if form.Change != "" {
+			post.Changes = append(post.Changes, PostChange{Time: time.Now(), Note: form.Change})
+		}
+	}
+
+	post.SourcePath = postSourcePath(key)
+	if err := savePost(post); err != nil {
+		handleError(w, r, err)
+		return
+	}
+	glog.Infoln("Editor saved", post.SourcePath)
+	http.Redirect(w, r, "/admin/edit/"+key+"?saved=1", http.StatusSeeOther)
+}
+
+func (e *Editor) deleteHandler(globalData *GlobalData, w http.ResponseWriter,
+	r *http.Request, urlParams map[string]string) {
+
+	if !e.csrf.Verify(r) {
+		http.Error(w, "Invalid CSRF token", http.StatusForbidden)
+		return
+	}
+
+	key := r.PostFormValue("post")
+	if !validPostKey(key) {
+		error404(w, r)
+		return
+	}
+	if err := os.Remove(postSourcePath(key)); err != nil {
+		handleError(w, r, err)
+		return
+	}
+	glog.Infoln("Editor deleted", postSourcePath(key))
+	http.Redirect(w, r, "/admin/", http.StatusSeeOther)
+}
+
+// previewHandler renders the Markdown in the content field the way it will appear on
+// the post's page.
+func (e *Editor) previewHandler(globalData *GlobalData, w http.ResponseWriter,
+	r *http.Request, urlParams map[string]string) {
+
+	r.Body = http.MaxBytesReader(w, r.Body, 10*1024*1024)
+	if !e.csrf.Verify(r) {
+		http.Error(w, "Invalid CSRF token", http.StatusForbidden)
+		return
+	}
+
+	post := &Post{Content: []byte(r.PostFormValue("content"))}
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.Header().Set("Cache-Control", "no-store")
+	io.WriteString(w, string(post.HTMLContent(false)))
+}
+
+// tagsHandler returns the existing tags as JSON.
+func (e *Editor) tagsHandler(globalData *GlobalData, w http.ResponseWriter,
+	r *http.Request, urlParams map[string]string) {
+
+	sendJSON(w, r, tagNames())
+}
+
+// saveUpload writes an uploaded image to DataDir/images/YYYY/MM, adding a number to the
+// name if needed so that no existing image is replaced. It returns the image's URL path.
+func saveUpload(name string, data io.Reader, timestamp time.Time) (string, error) {
+	ext := strings.ToLower(path.Ext(name))
+	stem := slugify(strings.TrimSuffix(path.Base(filepath.ToSlash(name)), path.Ext(name)))
+	if stem == "" {
+		stem = "image"
+	}
+
+	relDir := path.Join("images", timestamp.Format("2006"), timestamp.Format("01"))
+	dir := filepath.Join(config.DataDir, filepath.FromSlash(relDir))
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return "", err
+	}
+
+	for i := 1; ; i++ {
+		fileName := stem + ext
+		if i > 1 {
+			fileName = fmt.Sprintf("%s-%d%s", stem, i, ext)
+		}
+
+		f, err := os.OpenFile(filepath.Join(dir, fileName), os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0644)
+		if os.IsExist(err) {
+			continue
+		} else if err != nil {
+			return "", err
+		}
+
+		_, err = io.Copy(f, data)
+		if closeErr := f.Close(); err == nil {
+			err = closeErr
+		}
+		if err != nil {
+			os.Remove(f.Name())
+			return "", err
+		}
+		return "/" + path.Join(relDir, fileName), nil
+	}
+}
+
+// saveImageUpload checks that an uploaded file is an image of one of the allowed types,
+// and saves it with saveUpload.
+func saveImageUpload(file multipart.File, name string, timestamp time.Time) (string, error) {
+	// Check the contents as well as the name, since the file is served with the type
+	// its extension implies.
+	sniff := make([]byte, 512)
+	n, _ := io.ReadFull(file, sniff)
+	contentType, ok := uploadImageTypes[strings.ToLower(path.Ext(name))]
+	if !ok || http.DetectContentType(sniff[:n]) != contentType {
+		return "", errUnsupportedImage
+	}
+	if _, err := file.Seek(0, io.SeekStart); err != nil {
+		return "", err
+	}
+	return saveUpload(name, file, timestamp)
+}
+
+// imageUploadHandler stores an image uploaded from the editor, and returns its URL and
+// the Markdown to show it.
+func (e *Editor) imageUploadHandler(globalData *GlobalData, w http.ResponseWriter,
+	r *http.Request, urlParams map[string]string) {
+
+	r.Body = http.MaxBytesReader(w, r.Body, int64(config.ImageUploadMaxSize)+4096)
+	if err := r.ParseMultipartForm(1024 * 1024); err != nil {
+		http.Error(w, "Invalid upload", http.StatusBadRequest)
+		return
+	}
+	defer r.MultipartForm.RemoveAll()
+	if !e.csrf.Verify(r) {
+		http.Error(w, "Invalid CSRF token", http.StatusForbidden)
+		return
+	}
+
+	file, header, err := r.FormFile("image")
+	if err != nil {
+		http.Error(w, "Missing image", http.StatusBadRequest)
+		return
+	}
+	defer file.Close()
+
+	timestamp, err := time.Parse(PostTimeFormat, strings.TrimSpace(r.PostFormValue("date")))
+	if err != nil {
+		timestamp = time.Now()
+	}
+
+	url, err := saveImageUpload(file, header.Filename, timestamp)
+	if err == errUnsupportedImage {
+		http.Error(w, err.Error(), http.StatusUnsupportedMediaType)
+		return
+	} else if err != nil {
+		handleError(w, r, err)
+		return
+	}
+	glog.Infoln("Editor uploaded", url)
+
+	alt := strings.TrimSuffix(path.Base(header.Filename), path.Ext(header.Filename))
+	sendJSON(w, r, map[string]string{
+		"URL":      url,
+		"Markdown": fmt.Sprintf("![%s](%s)", strings.NewReplacer("[", "", "]", "").Replace(alt), url),
+	})
+}
@@ -0,0 +1,221 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestPostEncode(t *testing.T) {
+	dir, err := ioutil.TempDir("", "simpleblog-encode")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	timestamp, _ := time.Parse(PostTimeFormat, "5/14/14 11:14PM -0500")
+	post := &Post{
+		SourcePath: filepath.Join(dir, "2014", "05", "post.md"),
+		Title:      "A title",
+		Timestamp:  timestamp,
+		Tags:       []string{"one", "two words"},
+		Link:       "https://example.com/",
+		Content:    []byte("# Heading\n\nBody\n"),
+	}
+	if err := savePost(post); err != nil {
+		t.Fatal(err)
+	}
+
+	read, err := NewPost(post.SourcePath, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if read.Title != post.Title || !read.Timestamp.Equal(post.Timestamp) || read.Link != post.Link ||
+		string(read.Content) != string(post.Content) {
+		t.Errorf("Post changed when saved and read: %+v", read)
+	}
+	if len(read.Tags) != 2 || read.Tags[0] != "One" || read.Tags[1] != "Two Words" {
+		t.Errorf("Expected tags One and Two Words, saw %q", read.Tags)
+	}
+
+	post.Tags = nil
+	post.Link = ""
+	savePost(post)
+	if read, err := NewPost(post.SourcePath, true); err != nil || string(read.Content) != string(post.Content) {
+		t.Errorf("Post without tags or link did not read back: %v", err)
+	}
+}
+
+func TestSlugify(t *testing.T) {
+	tests := map[string]string{
+		"Hello, World!":     "hello-world",
+		"  --Go 1.2 Notes ": "go-1-2-notes",
+		"Crème brûlée":      "crème-brûlée",
+		"???":               "",
+	}
+	for title, expected := range tests {
+		if slug := slugify(title); slug != expected {
+			t.Errorf("slugify(%q): expected %q, saw %q", title, expected, slug)
+		}
+	}
+}
+
+func TestEditorHandlers(t *testing.T) {
+	dir, err := ioutil.TempDir("", "simpleblog-editor")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	oldConfig := *config
+	defer func() { *config = oldConfig }()
+	config.PostsDir = filepath.Join(dir, "posts")
+	config.DataDir = filepath.Join(dir, "data")
+	config.TagsPath = filepath.Join(dir, "tags.json")
+	config.ImageUploadMaxSize = 1024 * 1024
+	os.MkdirAll(config.PostsDir, 0755)
+
+	auth, err := NewAuth()
+	if err != nil {
+		t.Fatal(err)
+	}
+	editor := NewEditor(auth.csrf)
+
+	w := httptest.NewRecorder()
+	r, _ := http.NewRequest("GET", "/admin/new", nil)
+	editor.newHandler(nil, w, r, nil)
+	cookies := w.Result().Cookies()
+	match := regexp.MustCompile(`name="csrf_token" value="([^"]+)"`).FindStringSubmatch(w.Body.String())
+	if w.Code != http.StatusOK || len(cookies) != 1 || match == nil {
+		t.Fatalf("Expected the editor with a CSRF token, saw %d", w.Code)
+	}
+	token := match[1]
+
+	send := func(handler simpleBlogHandler, target, contentType string, body []byte,
+		csrf bool) *httptest.ResponseRecorder {
+
+		r, _ := http.NewRequest("POST", target, bytes.NewReader(body))
+		r.Header.Set("Content-Type", contentType)
+		if csrf {
+			r.AddCookie(cookies[0])
+		}
+		w := httptest.NewRecorder()
+		handler(nil, w, r, nil)
+		return w
+	}
+	save := func(form url.Values, csrf bool) *httptest.ResponseRecorder {
+		form.Set("csrf_token", token)
+		return send(editor.saveHandler, "/admin/save", "application/x-www-form-urlencoded",
+			[]byte(form.Encode()), csrf)
+	}
+
+	form := url.Values{"title": {"My New Post"}, "date": {"5/14/14 11:14PM -0500"},
+		"tags": {"go, web ,"}, "content": {"Hello *world*"}}
+	if w := save(form, false); w.Code != http.StatusForbidden {
+		t.Errorf("Expected 403 without the CSRF cookie, saw %d", w.Code)
+	}
+
+	w = save(form, true)
+	if w.Code != http.StatusSeeOther || w.Header().Get("Location") != "/admin/edit/2014/05/my-new-post?saved=1" {
+		t.Fatalf("Expected redirect to the new post, saw %d %s", w.Code, w.Header().Get("Location"))
+	}
+	sourcePath := filepath.Join(config.PostsDir, "2014", "05", "my-new-post.md")
+	post, err := NewPost(sourcePath, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if post.Title != "My New Post" || len(post.Tags) != 2 || string(post.Content) != "Hello *world*" {
+		t.Errorf("Saved post is wrong: %+v", post)
+	}
+
+	if w := save(form, true); w.Code != http.StatusConflict {
+		t.Errorf("Expected 409 for a new post at an existing path, saw %d", w.Code)
+	}
+	if w := save(url.Values{"title": {"Bad"}, "date": {"yesterday"}}, true); w.Code != http.StatusBadRequest {
+		t.Errorf("Expected 400 for an invalid date, saw %d", w.Code)
+	}
+
+	// Editing keeps the file where it is, even if the date moves.
+	form.Set("original", "2014/05/my-new-post")
+	form.Set("date", "6/1/14 9:00AM -0500")
+	form.Set("title", "Renamed")
+	if w := save(form, true); w.Code != http.StatusSeeOther {
+		t.Fatalf("Expected redirect after editing, saw %d", w.Code)
+	}
+	if post, _ := NewPost(sourcePath, true); post == nil || post.Title != "Renamed" {
+		t.Errorf("Edit was not saved: %+v", post)
+	}
+
+	form.Set("original", "../../outside")
+	if w := save(form, true); w.Code != http.StatusBadRequest {
+		t.Errorf("Expected 400 for a post outside PostsDir, saw %d", w.Code)
+	}
+
+	w = send(editor.previewHandler, "/admin/preview", "application/x-www-form-urlencoded",
+		[]byte(url.Values{"csrf_token": {token}, "content": {"Hello"}}.Encode()), true)
+	if w.Code != http.StatusOK || !strings.Contains(w.Body.String(), "Hello") {
+		t.Errorf("Expected the preview, saw %d %s", w.Code, w.Body.String())
+	}
+
+	upload := func(name string, data []byte) *httptest.ResponseRecorder {
+		body := &bytes.Buffer{}
+		mw := multipart.NewWriter(body)
+		mw.WriteField("csrf_token", token)
+		mw.WriteField("date", "5/14/14 11:14PM -0500")
+		part, _ := mw.CreateFormFile("image", name)
+		part.Write(data)
+		mw.Close()
+		return send(editor.imageUploadHandler, "/admin/images", mw.FormDataContentType(), body.Bytes(), true)
+	}
+
+	png := []byte("\x89PNG\r\n\x1a\n" + strings.Repeat("\x00", 32))
+	for _, expected := range []string{"/images/2014/05/my-photo.png", "/images/2014/05/my-photo-2.png"} {
+		w = upload("My Photo.PNG", png)
+		result := map[string]string{}
+		json.Unmarshal(w.Body.Bytes(), &result)
+		if w.Code != http.StatusOK || result["URL"] != expected {
+			t.Errorf("Expected upload at %s, saw %d %v", expected, w.Code, result)
+		}
+	}
+	if _, err := os.Stat(filepath.Join(config.DataDir, "images", "2014", "05", "my-photo-2.png")); err != nil {
+		t.Error("Uploaded image was not saved:", err)
+	}
+	if w := upload("script.png", []byte("<svg><script>alert(1)</script></svg>")); w.Code != http.StatusUnsupportedMediaType {
+		t.Errorf("Expected 415 for a file that isn't an image, saw %d", w.Code)
+	}
+
+	w = send(editor.deleteHandler, "/admin/delete", "application/x-www-form-urlencoded",
+		[]byte(url.Values{"csrf_token": {token}, "post": {"2014/05/my-new-post"}}.Encode()), true)
+	if w.Code != http.StatusSeeOther {
+		t.Errorf("Expected redirect after deleting, saw %d", w.Code)
+	}
+	if _, err := os.Stat(sourcePath); !os.IsNotExist(err) {
+		t.Error("Post was not deleted")
+	}
+}
+
+func TestEditorRequiresUsers(t *testing.T) {
+	_, globalData, cleanup := setupSiteTest(t, "editor-users")
+	defer cleanup()
+	config.EnableEditor = true
+	config.Users = nil
+
+	globalData.auth, _ = NewAuth()
+	router := setupAdminRouter(globalData)
+	r, _ := http.NewRequest("GET", "/admin/new", nil)
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, r)
+	if w.Code != http.StatusNotFound {
+		t.Errorf("Expected no editor without users, saw %d", w.Code)
+	}
+}
@@ -0,0 +1,164 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"github.com/andybalholm/brotli"
+	"github.com/dimfeld/gocache"
+	"github.com/klauspost/compress/zstd"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// ContentEncoding is a compression format that can be sent to clients.
+type ContentEncoding struct {
+	// Name used in the Accept-Encoding and Content-Encoding headers.
+	Name string
+	// Suffix added to cache keys for this encoding. The "#" can't be in the path of a
+	// request, so a file whose name ends in ".gz" isn't mistaken for a compressed variant.
+	KeySuffix string
+	compress  func([]byte) ([]byte, error)
+}
+
+// contentEncodings lists the supported encodings in order of preference, for when the
+// client accepts more than one equally.
+var contentEncodings = []ContentEncoding{
+	{"br", "#br", brotliCompress},
+	{"zstd", "#zst", zstdCompress},
+	{"gzip", "#gz", gzipCompress},
+}
+
+func gzipCompress(data []byte) ([]byte, error) {
+	return gzipCompressLevel(data, gzip.BestCompression)
+}
+
+func gzipCompressLevel(data []byte, level int) ([]byte, error) {
+	buf := &bytes.Buffer{}
+	w, err := gzip.NewWriterLevel(buf, level)
+	if err != nil {
+		return nil, err
+	}
+	w.Write(data)
+	err = w.Close()
+	return buf.Bytes(), err
+}
+
+// brotliLevel trades off compression against time. The variants are only generated once
+// per cache fill, but level 11 is slow enough to noticeably delay the first request.
+const brotliLevel = 9
+
+func brotliCompress(data []byte) ([]byte, error) {
+	buf := &bytes.Buffer{}
+	w := brotli.NewWriterLevel(buf, brotliLevel)
+	w.Write(data)
+	err := w.Close()
+	return buf.Bytes(), err
+}
+
+// zstdEncoder is safe to use concurrently through EncodeAll.
+var zstdEncoder, _ = zstd.NewWriter(nil, zstd.WithEncoderLevel(zstd.SpeedBestCompression))
+
+func zstdCompress(data []byte) ([]byte, error) {
+	return zstdEncoder.EncodeAll(data, make([]byte, 0, len(data)/2)), nil
+}
+
+// encodingForKey returns the encoding used for a cache key, based on its suffix.
+func encodingForKey(key string) (ContentEncoding, bool) {
+	for _, encoding := range contentEncodings {
+		if strings.HasSuffix(key, encoding.KeySuffix) {
+			return encoding, true
+		}
+	}
+	return ContentEncoding{}, false
+}
+
+// parseAcceptEncoding returns the q-value for each coding in the Accept-Encoding headers.
+func parseAcceptEncoding(headers []string) map[string]float64 {
+	accepted := make(map[string]float64)
+	for _, header := range headers {
+		for _, item := range strings.Split(header, ",") {
+			parts := strings.Split(item, ";")
+			coding := strings.ToLower(strings.TrimSpace(parts[0]))
+			if coding == "" {
+				continue
+			}
+			if coding == "x-gzip" {
+				coding = "gzip"
+			}
+
+			q := 1.0
+			for _, param := range parts[1:] {
+				param = strings.TrimSpace(param)
+				if strings.HasPrefix(param, "q=") || strings.HasPrefix(param, "Q=") {
+					value, err := strconv.ParseFloat(param[2:], 64)
+					if err != nil || value < 0 || value > 1 {
+						value = 0
+					}
+					q = value
+				}
+			}
+			accepted[coding] = q
+		}
+	}
+	return accepted
+}
+
+// negotiateEncoding picks the best supported encoding for the request, or returns
+// ok == false if the response should not be compressed.
+func negotiateEncoding(r *http.Request) (encoding ContentEncoding, ok bool) {
+	accepted := parseAcceptEncoding(r.Header["Accept-Encoding"])
+	wildcard, hasWildcard := accepted["*"]
+
+	best := 0.0
+	for _, candidate := range contentEncodings {
+		q, listed := accepted[candidate.Name]
+		if !listed && hasWildcard {
+			q = wildcard
+		}
+		// Strictly greater, so that ties go to the earlier, preferred encoding.
+		if q > best {
+			best = q
+			encoding = candidate
+			ok = true
+		}
+	}
+
+	return encoding, ok
+}
+
+// compressAndSetAll stores data and all of its compressed variants in the cache,
+// and returns the variant requested by key.
+func compressAndSetAll(cache gocache.Cache, key string, data []byte,
+	modTime time.Time) (gocache.Object, error) {
+
+	baseKey := baseCacheKey(key)
+	uncompressed := gocache.Object{Data: data, ModTime: modTime}
+	err := cache.Set(baseKey, uncompressed)
+	if err != nil {
+		return uncompressed, err
+	}
+	storeETag(baseKey, uncompressed)
+
+	result := uncompressed
+	for _, encoding := range contentEncodings {
+		compressed, err := encoding.compress(data)
+		if err != nil {
+			return gocache.Object{}, err
+		}
+
+		obj := gocache.Object{Data: compressed, ModTime: modTime}
+		err = cache.Set(baseKey+encoding.KeySuffix, obj)
+		if err != nil {
+			return gocache.Object{}, err
+		}
+		storeETag(baseKey+encoding.KeySuffix, obj)
+
+		if key == baseKey+encoding.KeySuffix {
+			result = obj
+		}
+	}
+
+	return result, nil
+}
@@ -0,0 +1,63 @@
+package main
+
+import (
+	"net/http"
+	"testing"
+)
+
+func TestNegotiateEncoding(t *testing.T) {
+	tests := []struct {
+		acceptEncoding string
+		expected       string
+	}{
+		{"", ""},
+		{"gzip", "gzip"},
+		{"x-gzip", "gzip"},
+		{"gzip, deflate", "gzip"},
+		{"gzip, deflate, br", "br"},
+		{"gzip, deflate, br, zstd", "br"},
+		{"gzip;q=1.0, br;q=0.5", "gzip"},
+		{"zstd, gzip;q=0.9", "zstd"},
+		{"br;q=0, gzip;q=0.1", "gzip"},
+		{"gzip;q=0", ""},
+		{"identity", ""},
+		{"*", "br"},
+		{"*;q=0.5, br;q=0, zstd;q=0.2", "gzip"},
+		{"GZIP;Q=0.5", "gzip"},
+		{"gzip;q=abc", ""},
+		{"deflate", ""},
+	}
+
+	for _, test := range tests {
+		r, _ := http.NewRequest("GET", "/", nil)
+		if test.acceptEncoding != "" {
+			r.Header.Set("Accept-Encoding", test.acceptEncoding)
+		}
+
+		encoding, ok := negotiateEncoding(r)
+		if ok != (test.expected != "") || (ok && encoding.Name != test.expected) {
+			t.Errorf("Accept-Encoding \"%s\": expected \"%s\", saw \"%s\"",
+				test.acceptEncoding, test.expected, encoding.Name)
+		}
+	}
+}
+
+func TestCacheKeyVariants(t *testing.T) {
+	variants := cacheKeyVariants("index.html")
+	if len(variants) != len(contentEncodings)+1 {
+		t.Fatalf("Expected %d variants, saw %v", len(contentEncodings)+1, variants)
+	}
+
+	for _, variant := range variants {
+		if base := baseCacheKey(variant); base != "index.html" {
+			t.Errorf("baseCacheKey(%s) returned %s", variant, base)
+		}
+	}
+
+	// Files whose names end in an encoding's extension are not variants.
+	for _, key := range []string{"images/archive.tar.gz", "tags/scala.br", "assets/data.zst"} {
+		if base := baseCacheKey(key); base != key {
+			t.Errorf("baseCacheKey(%s) returned %s", key, base)
+		}
+	}
+}
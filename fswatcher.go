@@ -1,12 +1,17 @@
 package main
 
 import (
+	"fmt"
 	"github.com/dimfeld/glog"
 	"github.com/dimfeld/treewatcher"
 	"github.com/howeyc/fsnotify"
+	"net/url"
 	"os"
+	"path"
 	"path/filepath"
+	"strconv"
 	"strings"
+	"time"
 )
 
 func watchFiles(globalData *GlobalData) {
@@ -29,6 +34,7 @@ func watchFiles(globalData *GlobalData) {
 		case event := <-tw.Event:
 			handleFileEvent(globalData, event)
 		case err := <-tw.Error:
+			globalData.metrics.CountFileEvent("error")
 			glog.Infoln("Fswatcher error:", err)
 		}
 	}
@@ -49,42 +55,345 @@ func handleFileEvent(globalData *GlobalData, event *fsnotify.FileEvent) {
 		}
 	}
 
-	// We just keep it simple and clear the entire cache when a post is updated, since it's likely
-	// that we need to update the tag list on every page, or something similar.
-	// Same for when a template is updated since that affects every page.
-	templateUpdate := strings.Contains(cachePath, "templates/")
-	if isPost || templateUpdate {
+	if isPost && globalData.git != nil && globalData.git.Pulled(fullPath) {
+		// The puller already invalidated the pages for this change.
 		if glog.V(1) {
-			glog.Infoln("FsWatcher clearing post data for update of", cachePath)
+			glog.Infoln("FsWatcher skipping pulled file", cachePath)
 		}
+	} else if isPost {
+		globalData.metrics.CountFileEvent("post")
+		handlePostEvents(globalData, []string{cachePath})
+	} else if strings.Contains(cachePath, "templates/") {
+		globalData.metrics.CountFileEvent("template")
+		handleTemplateEvent(globalData, cachePath)
+	} else if strings.HasPrefix(cachePath, "assets/") {
+		globalData.metrics.CountFileEvent("asset")
+		handleAssetEvent(globalData, cachePath)
+	} else {
+		globalData.metrics.CountFileEvent("data")
+		// It's some other data, so just invalidate that one object from the cache.
+		if glog.V(1) {
+			glog.Infoln("FsWatcher clearing data for", cachePath)
+		}
+		globalData.notFound.Del(cachePath)
+		for _, key := range cacheKeyVariants(cachePath) {
+			globalData.cache.Del(key)
+		}
+	}
+}
 
-		newArchiveList, err := NewArchiveSpecList(config.PostsDir)
-		if err != nil {
-			newArchiveList = nil
+// handlePostEvents invalidates the pages affected by changes to posts or directories
+// in the posts directory: each post's own page, its month, the tags it has or had,
+// the recent posts pages if it's new enough to appear on them, and every page with
+// a sidebar if the tag counts or archive list changed. The tags and archive list are
+// rebuilt once for all of the changes.
+func handlePostEvents(globalData *GlobalData, cachePaths []string) {
+	if glog.V(1) {
+		glog.Infoln("FsWatcher updating post data for", strings.Join(cachePaths, ", "))
+	}
+
+	oldTags := NewTags(config.TagsPath, config.PostsDir)
+	os.Remove(config.TagsPath)
+	newTags := NewTags(config.TagsPath, config.PostsDir)
+
+	newArchiveList, err := NewArchiveSpecList(config.PostsDir)
+	if err != nil {
+		newArchiveList = nil
+	}
+
+	globalData.Lock()
+	oldArchiveList := globalData.archive
+	globalData.archive = newArchiveList
+	globalData.tags = newTags
+	globalData.Unlock()
+
+	deps := []string{}
+	for _, cachePath := range cachePaths {
+		sourcePath := path.Join(config.PostsDir, cachePath)
+		clearNotFound(globalData, cachePath, newTags.Post[sourcePath])
+
+		if config.SendWebmentions && strings.HasSuffix(cachePath, ".md") {
+			if _, _, ok := monthFromPostPath(cachePath); ok {
+				globalData.webmentions.SendForPost(sourcePath)
+			}
+		}
+
+		deps = append(deps, PostDependency(sourcePath))
+
+		if year, month, ok := monthFromPostPath(cachePath); ok {
+			deps = append(deps, MonthDependency(year, month))
+		}
+
+		for _, post := range []*Post{oldTags.Post[sourcePath], newTags.Post[sourcePath]} {
+			if post == nil {
+				continue
+			}
+			for _, tag := range post.Tags {
+				deps = append(deps, TagDependency(tag))
+			}
+			// The post can be listed in another month than its directory's.
+			if year, month, ok := siteMonthOf(post); ok {
+				deps = append(deps, MonthDependency(year, month))
+			}
+			if globalData.deps.IsRecent(post.Timestamp) {
+				deps = append(deps, RecentDependency)
+			}
+		}
+	}
+
+	if !sameTagCounts(oldTags.TagsByPopularity(), newTags.TagsByPopularity()) ||
+		!sameArchiveList(oldArchiveList, newArchiveList) {
+		deps = append(deps, SidebarDependency)
+	}
+
+	keys := globalData.deps.Invalidate(globalData.cache, deps...)
+	if glog.V(1) {
+		glog.Infof("FsWatcher invalidated %d pages for update of %d posts", len(keys), len(cachePaths))
+	}
+
+	if len(keys) != 0 {
+		globalData.warmer.Warm()
+	}
+}
+
+// clearNotFound forgets the not found results for the pages that a new or changed post
+// could create: the post itself, or the custom page, its month, and its tags.
+func clearNotFound(globalData *GlobalData, cachePath string, post *Post) {
+	keys := []string{cachePath}
+	if strings.HasPrefix(cachePath, "page/") {
+		keys = append(keys, strings.TrimSuffix(strings.TrimPrefix(cachePath, "page/"), ".md"))
+	}
+	if year, month, ok := monthFromPostPath(cachePath); ok {
+		keys = append(keys, path.Join("archive", year+"-"+month))
+	}
+	if post != nil {
+		if year, month, ok := siteMonthOf(post); ok {
+			keys = append(keys, path.Join("archive", year+"-"+month))
+		}
+		for _, tag := range post.Tags {
+			// The tag in the key is however the client wrote it, so this can miss tags that
+			// are escaped differently. Those will expire normally.
+			keys = append(keys, path.Join("tags", tag), path.Join("tags", url.QueryEscape(tag)))
+		}
+	}
+
+	for _, key := range keys {
+		globalData.notFound.Del(key)
+	}
+}
+
+// handleTemplateEvent reloads the templates and invalidates the pages rendered from them.
+func handleTemplateEvent(globalData *GlobalData, cachePath string) {
+	if glog.V(1) {
+		glog.Infoln("FsWatcher reloading templates for update of", cachePath)
+	}
+
+	templates, err := createTemplates()
+	if err != nil {
+		glog.Infoln("Error parsing template:", err.Error())
+		return
+	}
+
+	modTime := templatesModTime()
+
+	globalData.Lock()
+	globalData.templates = templates
+	globalData.templatesModTime = modTime
+	globalData.Unlock()
+
+	dep := TemplateDependency(path.Base(cachePath))
+	if !globalData.deps.HasDependents(dep) {
+		// This template isn't executed directly, but it may define templates that
+		// are used by any page.
+		dep = TemplatesDependency
+	}
+	keys := globalData.deps.Invalidate(globalData.cache, dep)
+	if len(keys) != 0 {
+		globalData.warmer.Warm()
+	}
+}
+
+// handleAssetEvent refingerprints a changed asset. Since any page may link to the asset,
+// all rendered pages are invalidated when its fingerprint changes, along with the
+// bundles built from it.
+func handleAssetEvent(globalData *GlobalData, cachePath string) {
+	if glog.V(1) {
+		glog.Infoln("FsWatcher updating asset", cachePath)
+	}
+
+	globalData.notFound.Del(cachePath)
+	for _, key := range cacheKeyVariants(cachePath) {
+		globalData.cache.Del(key)
+	}
+
+	name := strings.TrimPrefix(filepath.ToSlash(cachePath), "assets/")
+	bundleKeys := bundleKeysWithSource(name)
+	if !assetManifest.Update(name) {
+		return
+	}
+
+	// The bundles built from the asset have new keys now, so the old ones won't be used again.
+	for _, key := range bundleKeys {
+		for _, variant := range cacheKeyVariants(key) {
+			globalData.cache.Del(variant)
+		}
+	}
+
+	keys := globalData.deps.Invalidate(globalData.cache, TemplatesDependency)
+	if len(keys) != 0 {
+		globalData.warmer.Warm()
+	}
+}
+
+// invalidateChangedSince brings a disk cache kept from an earlier run up to date with the
+// files changed after t, while nothing was watching them. A changed post only invalidates
+// the pages it's on, as it would have while running. Added, removed, or moved posts,
+// and changed templates or assets, clear the whole cache.
+func invalidateChangedSince(globalData *GlobalData, t time.Time) {
+	clearAll := false
+	changedPosts := []string{}
+	changedData := []string{}
+
+	// The tags file left by the last run lists the posts the cached pages were built from.
+	if _, err := os.Stat(config.TagsPath); err != nil {
+		clearAll = true
+	}
+	oldTags := NewTags(config.TagsPath, config.PostsDir)
+
+	seen := make(map[string]bool)
+	filepath.Walk(config.PostsDir, func(filePath string, info os.FileInfo, err error) error {
+		if err != nil || info.IsDir() || path.Base(filePath)[0] == '.' ||
+			!strings.HasSuffix(filePath, ".md") {
+			return nil
+		}
+		seen[filePath] = true
+		if clearAll || !info.ModTime().After(t) {
+			return nil
 		}
 
-		templates, err := createTemplates()
+		oldPost := oldTags.Post[filePath]
+		post, err := NewPost(filePath, false)
+		if oldPost == nil || err != nil {
+			clearAll = true
+			return nil
+		}
+		// A new timestamp can move the post to another month in the archive list.
+		oldYear, oldMonth, _ := siteMonthOf(oldPost)
+		year, month, _ := siteMonthOf(post)
+		if oldYear != year || oldMonth != month {
+			clearAll = true
+			return nil
+		}
+
+		cachePath, _ := filepath.Rel(config.PostsDir, filePath)
+		changedPosts = append(changedPosts, cachePath)
+		return nil
+	})
+	for sourcePath := range oldTags.Post {
+		if !seen[sourcePath] {
+			clearAll = true
+		}
+	}
+
+	filepath.Walk(config.DataDir, func(filePath string, info os.FileInfo, err error) error {
 		if err != nil {
-			glog.Infoln("Error parsing template:", err.Error())
+			return nil
+		}
+		if info.IsDir() {
+			if filePath == filepath.Clean(config.PostsDir) || filePath == filepath.Clean(config.CacheDir) {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if clearAll || !info.ModTime().After(t) || filePath == config.TagsPath {
+			return nil
 		}
 
-		globalData.Lock()
-		globalData.archive = newArchiveList
-		if templateUpdate {
-			globalData.templates = templates
+		cachePath, _ := filepath.Rel(config.DataDir, filePath)
+		if strings.Contains(cachePath, "templates/") || strings.HasPrefix(cachePath, "assets/") {
+			clearAll = true
+		} else {
+			changedData = append(changedData, cachePath)
 		}
-		globalData.Unlock()
+		return nil
+	})
 
+	if clearAll {
+		glog.Infoln("Clearing the disk cache, since posts, templates, or assets changed while stopped")
+		globalData.cache.Del("*")
+		globalData.deps.Reset()
 		os.Remove(config.TagsPath)
+		return
+	}
 
-		globalData.cache.Del("*")
+	for _, cachePath := range changedData {
+		for _, key := range cacheKeyVariants(cachePath) {
+			globalData.cache.Del(key)
+		}
+	}
+	if len(changedPosts) != 0 {
+		handlePostEvents(globalData, changedPosts)
+	}
+}
 
-	} else {
-		// It's some other data, so just invalidate that one object from the cache.
-		if glog.V(1) {
-			glog.Infoln("FsWatcher clearing data for", cachePath)
+// siteMonthOf returns the post's SiteMonth, formatted like the month directories. ok is
+// false for custom pages.
+func siteMonthOf(post *Post) (year, month string, ok bool) {
+	if _, _, ok := post.ArchiveMonth(); !ok {
+		return "", "", false
+	}
+	y, m := post.SiteMonth()
+	return strconv.Itoa(y), fmt.Sprintf("%02d", int(m)), true
+}
+
+// monthFromPostPath returns the year and month directories for a post path relative to
+// the posts directory, or for a month directory itself.
+func monthFromPostPath(cachePath string) (year, month string, ok bool) {
+	dir := filepath.ToSlash(cachePath)
+	if strings.HasSuffix(dir, ".md") {
+		dir = path.Dir(dir)
+	}
+
+	parts := strings.Split(dir, "/")
+	if len(parts) != 2 {
+		return "", "", false
+	}
+
+	for _, part := range parts {
+		if _, err := strconv.Atoi(part); err != nil {
+			return "", "", false
+		}
+	}
+
+	return parts[0], parts[1], true
+}
+
+func sameTagCounts(a, b TagPopularity) bool {
+	if len(a) != len(b) {
+		return false
+	}
+
+	counts := make(map[string]int, len(a))
+	for _, tc := range a {
+		counts[tc.Tag] = tc.Count
+	}
+	for _, tc := range b {
+		if count, ok := counts[tc.Tag]; !ok || count != tc.Count {
+			return false
+		}
+	}
+	return true
+}
+
+func sameArchiveList(a, b ArchiveSpecList) bool {
+	if len(a) != len(b) {
+		return false
+	}
+
+	for i := range a {
+		if !time.Time(a[i]).Equal(time.Time(b[i])) {
+			return false
 		}
-		globalData.cache.Del(cachePath)
-		globalData.cache.Del(cachePath + ".gz")
 	}
+	return true
 }
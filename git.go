@@ -0,0 +1,309 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/dimfeld/glog"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Route type for git webhook requests.
+const RouteGitWebhook = "git"
+
+// Longest a git command can run before it is killed.
+const gitTimeout = 2 * time.Minute
+
+// Maximum number of revisions in a post's history.
+const gitHistoryLimit = 100
+
+// Revision is a commit that changed a post.
+type Revision struct {
+	Hash      string
+	ShortHash string
+	Author    string
+	Date      time.Time
+	Subject   string
+}
+
+// PostHistory is the commit history of a post, newest first.
+type PostHistory struct {
+	Revisions []Revision
+	// Date of the newest commit.
+	LastModified time.Time
+}
+
+// GitRepo runs the git binary on the working tree in PostsDir, to pull new posts and read
+// their history.
+type GitRepo struct {
+	dir    string
+	remote string
+	branch string
+	secret []byte
+	// Receives a value when a pull is requested. It holds at most one, so pushes that
+	// arrive during a pull are handled by a single pull after it.
+	trigger chan struct{}
+
+	lock sync.Mutex
+	// History of each post, by source path, loaded when it is first needed.
+	history map[string]*PostHistory
+	// Modification times of the files the last pull changed, by path, or the zero time
+	// for files it removed. The file system watcher skips the changes in it, since the
+	// puller already handled them.
+	pulled map[string]time.Time
+}
+
+// NewGitRepo checks that PostsDir is a git working tree.
+func NewGitRepo() (*GitRepo, error) {
+	if config.GitWebhookSecret == "" {
+		return nil, errors.New("GitWebhookSecret is required")
+	}
+	if config.GitBranch == "" || strings.HasPrefix(config.GitBranch, "-") ||
+		strings.HasPrefix(config.GitRemote, "-") {
+		return nil, errors.New("invalid GitRemote or GitBranch")
+	}
+
+	g := &GitRepo{
+		dir:     config.PostsDir,
+		remote:  config.GitRemote,
+		branch:  config.GitBranch,
+		secret:  []byte(config.GitWebhookSecret),
+		trigger: make(chan struct{}, 1),
+		history: make(map[string]*PostHistory),
+		pulled:  make(map[string]time.Time),
+	}
+	out, err := g.git("rev-parse", "--is-inside-work-tree")
+	if err != nil {
+		return nil, err
+	}
+	if strings.TrimSpace(string(out)) != "true" {
+		return nil, fmt.Errorf("%s is not a git working tree", g.dir)
+	}
+	return g, nil
+}
+
+// git runs a git command in the posts directory and returns its output.
+func (g *GitRepo) git(args ...string) ([]byte, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), gitTimeout)
+	defer cancel()
+
+	cmd := exec.CommandContext(ctx, "git", args...)
+	cmd.Dir = g.dir
+	// Fail instead of waiting for a password that will never come.
+	cmd.Env = append(os.Environ(), "GIT_TERMINAL_PROMPT=0")
+	stderr := &bytes.Buffer{}
+	cmd.Stderr = stderr
+
+	out, err := cmd.Output()
+	if err != nil {
+		return nil, fmt.Errorf("git %s: %s: %s", args[0], err, strings.TrimSpace(stderr.String()))
+	}
+	return out, nil
+}
+
+func (g *GitRepo) revision() (string, error) {
+	out, err := g.git("rev-parse", "HEAD")
+	return strings.TrimSpace(string(out)), err
+}
+
+// Pull fetches the branch from the remote and checks it out. It returns the files that
+// changed, relative to the posts directory. Local changes to files that the new commits
+// don't touch are kept, and checking out fails instead of overwriting the others.
+func (g *GitRepo) Pull() ([]string, error) {
+	old, err := g.revision()
+	if err != nil {
+		return nil, err
+	}
+	if _, err := g.git("fetch", "--quiet", g.remote, g.branch); err != nil {
+		return nil, err
+	}
+	if _, err := g.git("checkout", "--quiet", "-B", g.branch, "FETCH_HEAD"); err != nil {
+		return nil, err
+	}
+	current, err := g.revision()
+	if err != nil || current == old {
+		return nil, err
+	}
+
+	out, err := g.git("diff", "--name-only", "--relative", "-z", old, current)
+	if err != nil {
+		return nil, err
+	}
+	changed := []string{}
+	for _, name := range strings.Split(string(out), "\x00") {
+		if name != "" {
+			changed = append(changed, filepath.FromSlash(name))
+		}
+	}
+
+	pulled := make(map[string]time.Time, len(changed))
+	for _, name := range changed {
+		pulled[filepath.Join(g.dir, name)] = fileModTime(filepath.Join(g.dir, name))
+	}
+
+	g.lock.Lock()
+	for _, name := range changed {
+		delete(g.history, filepath.Join(g.dir, name))
+	}
+	g.pulled = pulled
+	g.lock.Unlock()
+
+	glog.Infof("Pulled %s from %s/%s, %d files changed", current, g.remote, g.branch, len(changed))
+	return changed, nil
+}
+
+// Pulled returns true if the file at fullPath is as the last pull left it.
+func (g *GitRepo) Pulled(fullPath string) bool {
+	g.lock.Lock()
+	modTime, ok := g.pulled[fullPath]
+	g.lock.Unlock()
+	return ok && fileModTime(fullPath).Equal(modTime)
+}
+
+// fileModTime returns the modification time of a file, or the zero time if it doesn't
+// exist.
+func fileModTime(fullPath string) time.Time {
+	info, err := os.Stat(fullPath)
+	if err != nil {
+		return time.Time{}
+	}
+	return info.ModTime()
+}
+
+// History returns the commit history of a post, or nil if it has none.
+func (g *GitRepo) History(sourcePath string) (*PostHistory, error) {
+	g.lock.Lock()
+	history, ok := g.history[sourcePath]
+	g.lock.Unlock()
+	if ok {
+		return history, nil
+	}
+
+	rel, err := filepath.Rel(g.dir, sourcePath)
+	if err != nil {
+		return nil, err
+	}
+	out, err := g.git("log", "--follow", fmt.Sprintf("--max-count=%d", gitHistoryLimit),
+		"--format=%H%x00%h%x00%an%x00%aI%x00%s", "--", rel)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, line := range strings.Split(strings.TrimSpace(string(out)), "\n") {
+		fields := strings.Split(line, "\x00")
+		if len(fields) != 5 {
+			continue
+		}
+		date, err := time.Parse(time.RFC3339, fields[3])
+		if err != nil {
+			continue
+		}
+		if history == nil {
+			history = &PostHistory{LastModified: date}
+		}
+		history.Revisions = append(history.Revisions, Revision{
+			Hash:      fields[0],
+			ShortHash: fields[1],
+			Author:    fields[2],
+			Date:      date,
+			Subject:   fields[4],
+		})
+	}
+
+	g.lock.Lock()
+	g.history[sourcePath] = history
+	g.lock.Unlock()
+	return history, nil
+}
+
+// Trigger asks for a pull, without waiting for it.
+func (g *GitRepo) Trigger() {
+	select {
+	case g.trigger <- struct{}{}:
+	default:
+	}
+}
+
+// runPuller pulls whenever it is triggered, and invalidates the pages for the files
+// that changed, all at once. The file system watcher would notice them too, but git can
+// replace files in ways that it misses, such as renaming directories, so the watcher
+// skips the files that are as the pull left them instead.
+func (g *GitRepo) runPuller(globalData *GlobalData) {
+	for range g.trigger {
+		changed, err := g.Pull()
+		if err != nil {
+			glog.Errorln("Git pull failed:", err)
+			continue
+		}
+		if len(changed) != 0 {
+			handlePostEvents(globalData, changed)
+		}
+	}
+}
+
+// validSignature checks the HMAC-SHA256 signature of a webhook body, as sent by GitHub
+// in X-Hub-Signature-256, and by Gitea and Gogs in their own headers.
+func (g *GitRepo) validSignature(r *http.Request, body []byte) bool {
+	signature := strings.TrimPrefix(r.Header.Get("X-Hub-Signature-256"), "sha256=")
+	for _, header := range []string{"X-Gitea-Signature", "X-Gogs-Signature"} {
+		if signature == "" {
+			signature = r.Header.Get(header)
+		}
+	}
+	if signature == "" {
+		return false
+	}
+
+	mac := hmac.New(sha256.New, g.secret)
+	mac.Write(body)
+	expected := hex.EncodeToString(mac.Sum(nil))
+	return hmac.Equal([]byte(strings.ToLower(signature)), []byte(expected))
+}
+
+// gitWebhookHandler starts a pull when the repository's host reports a push to the branch.
+func gitWebhookHandler(globalData *GlobalData, w http.ResponseWriter,
+	r *http.Request, urlParams map[string]string) {
+
+	g := globalData.git
+	body, err := ioutil.ReadAll(http.MaxBytesReader(w, r.Body, 10*1024*1024))
+	if err != nil {
+		http.Error(w, "Request too large", http.StatusRequestEntityTooLarge)
+		return
+	}
+	if !g.validSignature(r, body) {
+		http.Error(w, "Invalid signature", http.StatusForbidden)
+		return
+	}
+
+	if r.Header.Get("X-GitHub-Event") == "ping" {
+		w.Write([]byte("pong\n"))
+		return
+	}
+
+	// Pushes to other branches don't change the site. Payloads without a ref, such as
+	// manual triggers, always pull.
+	var push struct {
+		Ref string `json:"ref"`
+	}
+	if json.Unmarshal(body, &push) == nil && push.Ref != "" && push.Ref != "refs/heads/"+g.branch {
+		fmt.Fprintf(w, "Ignored push to %s\n", push.Ref)
+		return
+	}
+
+	glog.Infoln("Git webhook requested a pull")
+	g.Trigger()
+	w.WriteHeader(http.StatusAccepted)
+	w.Write([]byte("Pulling\n"))
+}
@@ -0,0 +1,179 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"github.com/howeyc/fsnotify"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// runGit runs git in dir for the tests, with a fixed identity.
+func runGit(t *testing.T, dir string, args ...string) {
+	cmd := exec.Command("git", args...)
+	cmd.Dir = dir
+	cmd.Env = append(os.Environ(), "GIT_AUTHOR_NAME=Alice", "GIT_AUTHOR_EMAIL=alice@example.com",
+		"GIT_COMMITTER_NAME=Alice", "GIT_COMMITTER_EMAIL=alice@example.com")
+	if out, err := cmd.CombinedOutput(); err != nil {
+		t.Fatalf("git %s failed: %s\n%s", strings.Join(args, " "), err, out)
+	}
+}
+
+// commitPost writes a post in the upstream working tree and pushes it.
+func commitPost(t *testing.T, upstream, key, title, message string) {
+	timestamp, _ := time.Parse(PostTimeFormat, "5/14/14 11:14PM -0500")
+	post := &Post{
+		SourcePath: filepath.Join(upstream, filepath.FromSlash(key)+".md"),
+		Title:      title,
+		Timestamp:  timestamp,
+		Content:    []byte("Content of " + title),
+	}
+	if err := savePost(post); err != nil {
+		t.Fatal(err)
+	}
+	runGit(t, upstream, "add", "-A")
+	runGit(t, upstream, "commit", "-q", "-m", message)
+	runGit(t, upstream, "push", "-q", "origin", "HEAD:master")
+}
+
+func setupGitTest(t *testing.T) (upstream string, globalData *GlobalData, cleanup func()) {
+	if _, err := exec.LookPath("git"); err != nil {
+		t.Skip("git is not installed")
+	}
+
+	dir, globalData, cleanup := setupSiteTest(t, "git")
+	origin := filepath.Join(dir, "origin.git")
+	upstream = filepath.Join(dir, "upstream")
+	os.MkdirAll(upstream, 0755)
+	runGit(t, dir, "init", "-q", "--bare", origin)
+	runGit(t, upstream, "init", "-q")
+	runGit(t, upstream, "remote", "add", "origin", origin)
+	commitPost(t, upstream, "2014/05/first", "First", "Add the first post")
+	runGit(t, dir, "clone", "-q", "-b", "master", origin, "posts")
+
+	config.PostsDir = filepath.Join(dir, "posts")
+	config.GitRemote = "origin"
+	config.GitBranch = "master"
+	config.GitWebhookSecret = "webhook secret"
+	git, err := NewGitRepo()
+	if err != nil {
+		cleanup()
+		t.Fatal(err)
+	}
+	globalData.git = git
+	return upstream, globalData, cleanup
+}
+
+func TestGitPull(t *testing.T) {
+	upstream, globalData, cleanup := setupGitTest(t)
+	defer cleanup()
+	g := globalData.git
+
+	firstPath := filepath.Join(config.PostsDir, "2014", "05", "first.md")
+	history, err := g.History(firstPath)
+	if err != nil || history == nil || len(history.Revisions) != 1 ||
+		history.Revisions[0].Subject != "Add the first post" || history.Revisions[0].Author != "Alice" {
+		t.Fatalf("Expected one revision, saw %+v %v", history, err)
+	}
+
+	if changed, err := g.Pull(); err != nil || len(changed) != 0 {
+		t.Errorf("Expected no changes pulling again, saw %v %v", changed, err)
+	}
+
+	commitPost(t, upstream, "2014/05/first", "First, edited", "Edit the first post")
+	commitPost(t, upstream, "2014/06/second", "Second", "Add the second post")
+	changed, err := g.Pull()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(changed) != 2 || changed[0] != filepath.Join("2014", "05", "first.md") ||
+		changed[1] != filepath.Join("2014", "06", "second.md") {
+		t.Errorf("Expected both posts to change, saw %v", changed)
+	}
+
+	if post, err := NewPost(firstPath, true); err != nil || post.Title != "First, edited" {
+		t.Errorf("Pulled post was not checked out: %+v %v", post, err)
+	}
+
+	// The file system watcher skips the pulled files until they change again.
+	postEvents := func() uint64 {
+		return globalData.metrics.fsEvents[labels("type", "post")]
+	}
+	handleFileEvent(globalData, &fsnotify.FileEvent{Name: firstPath})
+	if !g.Pulled(firstPath) || postEvents() != 0 {
+		t.Errorf("Expected the watcher to skip the pulled file, saw %d events", postEvents())
+	}
+	later := time.Now().Add(time.Minute)
+	os.Chtimes(firstPath, later, later)
+	handleFileEvent(globalData, &fsnotify.FileEvent{Name: firstPath})
+	if g.Pulled(firstPath) || postEvents() != 1 {
+		t.Errorf("Expected the watcher to handle a later change, saw %d events", postEvents())
+	}
+	history, _ = g.History(firstPath)
+	if history == nil || len(history.Revisions) != 2 || history.Revisions[0].Subject != "Edit the first post" ||
+		!history.LastModified.Equal(history.Revisions[0].Date) {
+		t.Errorf("Expected the history to be reloaded newest first, saw %+v", history)
+	}
+
+	if history, err := g.History(filepath.Join(config.PostsDir, "untracked.md")); err != nil || history != nil {
+		t.Errorf("Expected no history for an untracked file, saw %+v %v", history, err)
+	}
+}
+
+func TestGitWebhook(t *testing.T) {
+	_, globalData, cleanup := setupGitTest(t)
+	defer cleanup()
+	g := globalData.git
+
+	send := func(body, signature string, headers map[string]string) int {
+		r, _ := http.NewRequest("POST", "/git/webhook", strings.NewReader(body))
+		if signature != "" {
+			r.Header.Set("X-Hub-Signature-256", "sha256="+signature)
+		}
+		for key, value := range headers {
+			r.Header.Set(key, value)
+		}
+		w := httptest.NewRecorder()
+		gitWebhookHandler(globalData, w, r, nil)
+		return w.Code
+	}
+	sign := func(body string) string {
+		mac := hmac.New(sha256.New, []byte("webhook secret"))
+		mac.Write([]byte(body))
+		return hex.EncodeToString(mac.Sum(nil))
+	}
+
+	push := `{"ref": "refs/heads/master"}`
+	if code := send(push, "", nil); code != http.StatusForbidden {
+		t.Errorf("Expected 403 without a signature, saw %d", code)
+	}
+	if code := send(push, sign("something else"), nil); code != http.StatusForbidden {
+		t.Errorf("Expected 403 for a wrong signature, saw %d", code)
+	}
+
+	other := `{"ref": "refs/heads/drafts"}`
+	if code := send(other, sign(other), nil); code != http.StatusOK || len(g.trigger) != 0 {
+		t.Errorf("Expected a push to another branch to be ignored, saw %d", code)
+	}
+	if code := send(push, sign(push), map[string]string{"X-GitHub-Event": "ping"}); code != http.StatusOK ||
+		len(g.trigger) != 0 {
+		t.Errorf("Expected a ping to be answered, saw %d", code)
+	}
+
+	if code := send(push, sign(push), nil); code != http.StatusAccepted || len(g.trigger) != 1 {
+		t.Errorf("Expected a pull to be triggered, saw %d", code)
+	}
+	// Gitea signs with a bare hex digest. A second push while one is waiting doesn't
+	// queue another pull.
+	if code := send(push, "", map[string]string{"X-Gitea-Signature": sign(push)}); code != http.StatusAccepted ||
+		len(g.trigger) != 1 {
+		t.Errorf("Expected the Gitea signature to be accepted, saw %d", code)
+	}
+}
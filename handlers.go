@@ -2,13 +2,18 @@ package main
 
 import (
 	"bytes"
+	"fmt"
 	"github.com/dimfeld/glog"
 	"github.com/dimfeld/gocache"
+	"github.com/dimfeld/simpleblog/lru"
+	"hash/fnv"
+	"mime"
 	"net/http"
+	"net/url"
 	"os"
 	"path"
+	"strconv"
 	"strings"
-	"time"
 )
 
 func error404(w http.ResponseWriter, r *http.Request) {
@@ -21,7 +26,10 @@ func error500(w http.ResponseWriter, r *http.Request) {
 }
 
 func handleError(w http.ResponseWriter, r *http.Request, err error) {
-	if os.IsNotExist(err) {
+	if err == errCachedNotFound {
+		// This was already logged when it was first not found.
+		error404(w, r)
+	} else if os.IsNotExist(err) {
 		glog.Warningf("%s from %s, referrer %s: err %s",
 			r.URL.Path, r.RemoteAddr, r.Referer(), err)
 		error404(w, r)
@@ -31,44 +39,62 @@ func handleError(w http.ResponseWriter, r *http.Request, err error) {
 	}
 }
 
-// determineCompression figures out if compression can be used, and adds a .gz extension so that
-// we get the compressed version of the file instead.
+// determineCompression figures out which content encoding, if any, to use for the response,
+// and adds the encoding's key suffix so that we get the compressed version of the file instead.
+// encoding is empty if the response should not be compressed.
+// Range requests apply to the selected variant, which has its own ETag, so they don't
+// need to be treated specially here.
 func determineCompression(w http.ResponseWriter, r *http.Request, path string) (outPath string,
-	compression bool) {
+	encoding string) {
 
-	if _, ok := r.Header["Range"]; ok {
-		// No compression if the user passed a range request, since returning a slice of the
-		// compressed version from the cache would then return invalid data.
-		return path, false
+	if requestNonce(r) != "" {
+		// The nonce is added to the uncompressed page, which is then compressed with gzip,
+		// when it's sent.
+		return path, ""
 	}
 
-	encodings := r.Header["Accept-Encoding"]
-	outPath = path
-	for index := range encodings {
-		if strings.Contains(encodings[index], "gzip") {
-			// Use the gzipped version.
-			return path + ".gz", true
-		}
+	selected, ok := negotiateEncoding(r)
+	if !ok {
+		return path, ""
 	}
 
-	return path, false
+	return path + selected.KeySuffix, selected.Name
+}
+
+// cacheKeyVariants returns all the cache keys that may be stored for a base key.
+func cacheKeyVariants(key string) []string {
+	keys := []string{key}
+	for _, encoding := range contentEncodings {
+		keys = append(keys, key+encoding.KeySuffix)
+	}
+	return keys
+}
+
+// baseCacheKey strips the suffix added for a compressed variant from a cache key.
+func baseCacheKey(key string) string {
+	if encoding, ok := encodingForKey(key); ok {
+		return strings.TrimSuffix(key, encoding.KeySuffix)
+	}
+	return key
 }
 
 func postHandler(globalData *GlobalData, w http.ResponseWriter,
 	r *http.Request, urlParams map[string]string) {
 
 	filePath := path.Join(urlParams["year"], urlParams["month"], urlParams["post"]) + ".md"
-	filePath, compression := determineCompression(w, r, filePath)
+	filePath, encoding := determineCompression(w, r, filePath)
 
-	data, err := globalData.cache.Get(filePath,
-		PageSpec{globalData: globalData, customPage: false,
+	data, err := globalData.cacheGet(RoutePost, globalData.cache, filePath,
+		PageSpec{globalData: globalData, route: RoutePost, customPage: false,
 			generator: generatePostPage, params: urlParams})
 	if err != nil {
 		handleError(w, r, err)
 		return
 	}
 
-	sendData(w, r, urlParams["post"]+".html", compression, data)
+	setCacheHeaders(w, RoutePost)
+	setPageHashes(w, r, globalData.cache, filePath, data)
+	sendData(w, r, filePath, urlParams["post"]+".html", encoding, data)
 }
 
 func archiveHandler(globalData *GlobalData, w http.ResponseWriter,
@@ -84,51 +110,65 @@ func archiveHandler(globalData *GlobalData, w http.ResponseWriter,
 	}
 	filename := year + "-" + month
 	filePath := path.Join("archive", filename)
-	filePath, compression := determineCompression(w, r, filePath)
+	filePath, encoding := determineCompression(w, r, filePath)
 
-	data, err := globalData.cache.Get(filePath,
-		PageSpec{globalData: globalData, customPage: false,
-			generator: generateArchivePage, params: urlParams})
+	data, err := globalData.cacheGet(RouteArchive, globalData.cache, filePath,
+		PageSpec{globalData: globalData, route: RouteArchive, customPage: false,
+			generator: generateArchivePage, params: urlParams,
+			dependencies: []string{MonthDependency(year, month)}})
 	if err != nil {
 		handleError(w, r, err)
 		return
 	}
 
-	sendData(w, r, filename+".html", compression, data)
+	setCacheHeaders(w, RouteArchive)
+	setPageHashes(w, r, globalData.cache, filePath, data)
+	sendData(w, r, filePath, filename+".html", encoding, data)
 }
 
 func tagHandler(globalData *GlobalData, w http.ResponseWriter,
 	r *http.Request, urlParams map[string]string) {
 
 	filePath := path.Join("tags", urlParams["tag"])
-	filePath, compression := determineCompression(w, r, filePath)
+	filePath, encoding := determineCompression(w, r, filePath)
 
-	data, err := globalData.cache.Get(filePath,
-		PageSpec{globalData: globalData, customPage: false,
-			generator: generateTagsPage, params: urlParams})
+	var dependencies []string
+	if tagName, err := url.QueryUnescape(urlParams["tag"]); err == nil {
+		dependencies = []string{TagDependency(tagName)}
+	}
+
+	data, err := globalData.cacheGet(RouteTag, globalData.cache, filePath,
+		PageSpec{globalData: globalData, route: RouteTag, customPage: false,
+			generator: generateTagsPage, params: urlParams,
+			dependencies: dependencies})
 	if err != nil {
 		handleError(w, r, err)
 		return
 	}
 
-	sendData(w, r, urlParams["tag"]+".html", compression, data)
+	setCacheHeaders(w, RouteTag)
+	setPageHashes(w, r, globalData.cache, filePath, data)
+	sendData(w, r, filePath, urlParams["tag"]+".html", encoding, data)
 }
 
 func indexHandler(globalData *GlobalData, w http.ResponseWriter,
 	r *http.Request, urlParams map[string]string) {
 
 	filename := "index.html"
-	filePath, compression := determineCompression(w, r, filename)
+	filePath, encoding := determineCompression(w, r, filename)
 
-	data, err := globalData.cache.Get(filePath,
-		PageSpec{globalData: globalData, customPage: false,
-			generator: generateIndexPage, params: urlParams})
+	data, err := globalData.cacheGet(RouteIndex, globalData.cache, filePath,
+		PageSpec{globalData: globalData, route: RouteIndex, customPage: false,
+			generator: generateIndexPage, params: urlParams,
+			dependencies: []string{RecentDependency}})
 	if err != nil {
 		handleError(w, r, err)
 		return
 	}
 
-	sendData(w, r, filename, compression, data)
+	setCacheHeaders(w, RouteIndex)
+	setPageHashes(w, r, globalData.cache, filePath, data)
+	sendData(w, r, filePath, filename, encoding, data)
 }
 
 func pageHandler(globalData *GlobalData, w http.ResponseWriter,
@@ -136,107 +176,300 @@ func pageHandler(globalData *GlobalData, w http.ResponseWriter,
 
 	page := urlParams["page"]
 
-	filePath, compression := determineCompression(w, r, page)
-	object, err := globalData.cache.Get(filePath,
-		PageSpec{globalData: globalData, customPage: true,
+	filePath, encoding := determineCompression(w, r, page)
+	object, err := globalData.cacheGet(RoutePage, globalData.cache, filePath,
+		PageSpec{globalData: globalData, route: RoutePage, customPage: true,
 			generator: generateCustomPage, params: urlParams})
 	if err != nil {
 		handleError(w, r, err)
 		return
 	}
 
-	sendData(w, r, urlParams["page"]+".html", compression, object)
+	setCacheHeaders(w, RoutePage)
+	setPageHashes(w, r, globalData.cache, filePath, object)
+	sendData(w, r, filePath, urlParams["page"]+".html", encoding, object)
 }
 
 func atomHandler(globalData *GlobalData, w http.ResponseWriter,
 	r *http.Request, urlParams map[string]string) {
 
 	filename := "atom.xml"
-	filePath, compression := determineCompression(w, r, filename)
+	filePath, encoding := determineCompression(w, r, filename)
 
-	object, err := globalData.cache.Get(filePath,
-		PageSpec{globalData: globalData, customTemplate: "atom.tmpl.html",
-			generator: generateIndexPage, params: urlParams})
+	object, err := globalData.cacheGet(RouteFeed, globalData.cache, filePath,
+		PageSpec{globalData: globalData, route: RouteFeed, customTemplate: "atom.tmpl.html",
+			generator: generateIndexPage, params: urlParams,
+			dependencies: []string{RecentDependency}})
 	if err != nil {
 		handleError(w, r, err)
 		return
 	}
 
-	sendData(w, r, filename, compression, object)
+	setCacheHeaders(w, RouteFeed)
+	sendData(w, r, filePath, filename, encoding, object)
 }
 
-func staticCompressHandler(globalData *GlobalData, w http.ResponseWriter,
-	r *http.Request, urlParams map[string]string) {
-	filePath := urlParams["file"]
-	filePath, compression := determineCompression(w, r, filePath)
+// renderCommentForm renders the page that confirms a comment, with a CSRF token.
+func renderCommentForm(globalData *GlobalData, w http.ResponseWriter, r *http.Request,
+	form *CommentForm, status int) {
 
-	if glog.V(1) {
-		glog.Infoln("Getting path", filePath)
-	}
-	object, err := globalData.cache.Get(filePath,
-		DirectCacheFiller{globalData, true})
+	forms := globalData.commentForms
+	token, err := forms.csrf.Token(w, r)
 	if err != nil {
 		handleError(w, r, err)
 		return
 	}
+	form.CSRFField = forms.csrf.Field
+	form.Token = token
+	form.Honeypot = honeypotField
+	form.Moderated = config.CommentsModeration
 
-	setStaticAssetHeaders(w)
-	sendData(w, r, urlParams["file"], compression, object)
+	renderDynamicPage(globalData, w, r, TemplateData{WindowTitle: "Post a comment", CommentForm: form},
+		status)
 }
 
-func staticNoCompressHandler(globalData *GlobalData, w http.ResponseWriter,
+// commentPostHandler stores a comment submitted from a post's page, then sends the reader
+// back to the post. Comments without a CSRF token, including every one sent from the
+// cached post page, are shown on a form to post them again with one.
+func commentPostHandler(globalData *GlobalData, w http.ResponseWriter,
 	r *http.Request, urlParams map[string]string) {
-	filePath := urlParams["file"]
 
-	// Only read from the memCache, not the disk cache, since we aren't generating
-	// compressed versions.
-	object, err := globalData.memCache.Get(filePath,
-		DirectCacheFiller{globalData, false})
-	if err != nil {
+	post := path.Join(urlParams["year"], urlParams["month"], urlParams["post"])
+	if !validPostKey(post) {
+		error404(w, r)
+		return
+	}
+	sourcePath := postSourcePath(post)
+	if _, err := os.Stat(sourcePath); err != nil {
 		handleError(w, r, err)
 		return
 	}
 
-	setStaticAssetHeaders(w)
-	sendData(w, r, filePath, false, object)
+	r.Body = http.MaxBytesReader(w, r.Body, int64(config.CommentMaxLength)+4096)
+	if err := r.ParseForm(); err != nil {
+		http.Error(w, "Invalid form", http.StatusBadRequest)
+		return
+	}
+
+	comment := &Comment{
+		Post:     post,
+		ParentID: r.PostFormValue("parent"),
+		Author:   strings.TrimSpace(r.PostFormValue("author")),
+		Email:    strings.TrimSpace(r.PostFormValue("email")),
+		URL:      strings.TrimSpace(r.PostFormValue("url")),
+		Body:     strings.TrimSpace(r.PostFormValue("body")),
+		Approved: !config.CommentsModeration,
+	}
+
+	if comment.Author == "" || comment.Body == "" {
+		http.Error(w, "A name and a comment are required", http.StatusBadRequest)
+		return
+	}
+	if len(comment.Body) > config.CommentMaxLength || len(comment.Author) > 100 ||
+		len(comment.Email) > 254 || len(comment.URL) > 2000 {
+		http.Error(w, "Comment is too long", http.StatusBadRequest)
+		return
+	}
+	if comment.URL != "" && !strings.HasPrefix(comment.URL, "http://") &&
+		!strings.HasPrefix(comment.URL, "https://") {
+		http.Error(w, "Website must be an http or https URL", http.StatusBadRequest)
+		return
+	}
+
+	if r.PostFormValue(honeypotField) != "" {
+		// Pretend it worked, so the bot has no reason to try again.
+		glog.Infoln("Dropped comment with the honeypot filled in from", r.RemoteAddr)
+		http.Redirect(w, r, "/"+post+"#comments", http.StatusSeeOther)
+		return
+	}
+
+	form := &CommentForm{
+		Action:   "/" + post + "/comments",
+		ParentID: comment.ParentID,
+		Author:   comment.Author,
+		Email:    comment.Email,
+		URL:      comment.URL,
+		Body:     comment.Body,
+	}
+	forms := globalData.commentForms
+	if !forms.csrf.Verify(r) {
+		renderCommentForm(globalData, w, r, form, http.StatusOK)
+		return
+	}
+
+	client := globalData.proxies.ClientIP(r)
+	if forms.limiter != nil && !forms.limiter.Take(client) {
+		w.Header().Set("Retry-After", fmt.Sprintf("%.0f", forms.limiter.RetryAfter(client).Seconds()+1))
+		form.Errors = []string{"You have posted too many comments. Please try again later."}
+		renderCommentForm(globalData, w, r, form, http.StatusTooManyRequests)
+		return
+	}
+
+	err := globalData.comments.Add(comment)
+	if err == ErrInvalidComment {
+		http.Error(w, "Invalid comment", http.StatusBadRequest)
+		return
+	} else if err != nil {
+		handleError(w, r, err)
+		return
+	}
+
+	anchor := "#comments"
+	if comment.Approved {
+		globalData.deps.Invalidate(globalData.cache, CommentsDependency(sourcePath))
+		anchor = "#comment-" + comment.ID
+	}
+	http.Redirect(w, r, "/"+post+anchor, http.StatusSeeOther)
+}
+
+// compressible returns false if the content type of the named file matches
+// config.NoCompressTypes, meaning that it is already compressed.
+func compressible(name string) bool {
+	contentType := mime.TypeByExtension(path.Ext(name))
+	if i := strings.Index(contentType, ";"); i != -1 {
+		contentType = contentType[0:i]
+	}
+	contentType = strings.ToLower(strings.TrimSpace(contentType))
+	if contentType == "" {
+		return true
+	}
+
+	for _, pattern := range strings.Split(config.NoCompressTypes, ",") {
+		pattern = strings.ToLower(strings.TrimSpace(pattern))
+		if pattern == "" {
+			continue
+		}
+		if pattern == contentType ||
+			(strings.HasSuffix(pattern, "/*") && strings.HasPrefix(contentType, pattern[0:len(pattern)-1])) {
+			return false
+		}
+	}
+	return true
+}
+
+// staticHandler returns a handler that serves files from the data directory,
+// counting cache statistics under the given route type.
+func staticHandler(route string) simpleBlogHandler {
+	return func(globalData *GlobalData, w http.ResponseWriter,
+		r *http.Request, urlParams map[string]string) {
+
+		filePath := urlParams["file"]
+		fingerprint := ""
+		var bundle []string
+		if route == RouteAsset {
+			filePath, fingerprint, _ = parseFingerprint(filePath)
+			bundle = config.Bundles[strings.TrimPrefix(filePath, "assets/")]
+		}
+
+		encoding := ""
+		cache := globalData.cache
+		canCompress := compressible(filePath)
+		var filler gocache.Filler = DirectCacheFiller{globalData, canCompress}
+		cacheKey := filePath
+		if bundle != nil {
+			name := strings.TrimPrefix(filePath, "assets/")
+			var ok bool
+			cacheKey, ok = bundleCacheKey(name)
+			if !ok {
+				handleError(w, r, os.ErrNotExist)
+				return
+			}
+			filler = BundleFiller{name, bundle, canCompress}
+		}
+
+		if canCompress {
+			cacheKey, encoding = determineCompression(w, r, cacheKey)
+		} else {
+			// Only read from the memCache, not the disk cache, since we aren't generating
+			// compressed versions.
+			cache = globalData.memCache
+		}
+
+		if glog.V(1) {
+			glog.Infoln("Getting path", cacheKey)
+		}
+		object, err := globalData.cacheGet(route, cache, cacheKey, filler)
+		if err != nil {
+			handleError(w, r, err)
+			return
+		}
+
+		policyRoute := route
+		if fingerprint != "" {
+			// If the fingerprint is out of date, the page linking to it is probably stale.
+			// Send the current file, but don't let it be cached forever.
+			current, ok := assetManifest.Fingerprint(strings.TrimPrefix(filePath, "assets/"))
+			if ok && current == fingerprint {
+				policyRoute = RouteFingerprinted
+			}
+		}
+
+		setCacheHeaders(w, policyRoute)
+		sendData(w, r, cacheKey, urlParams["file"], encoding, object)
+	}
 }
 
-func setStaticAssetHeaders(w http.ResponseWriter) {
-	w.Header().Set("Expires", time.Now().AddDate(0, 0, 1).String())
-	// One day in seconds
-	w.Header().Set("Cache-Control", "public, max-age=86400")
+// etags remembers the hash of each cached object's data, which is computed when the object
+// is filled so that requests don't hash it again. Entries are keyed by the object's size and
+// modification time along with its cache key, so they are never used for other data.
+var etags = lru.New(0, 0, 50000, 0)
+
+func etagKey(key string, object gocache.Object) string {
+	return key + "\x00" + strconv.Itoa(len(object.Data)) + "\x00" +
+		strconv.FormatInt(object.ModTime.UnixNano(), 36)
+}
+
+// storeETag hashes the data of an object stored at key, and remembers the hash for
+// objectETag. An empty key hashes the data without remembering it.
+func storeETag(key string, object gocache.Object) string {
+	hash := fnv.New64a()
+	hash.Write(object.Data)
+	tag := strconv.FormatUint(hash.Sum64(), 36)
+	if key != "" {
+		etags.Set(etagKey(key, object), gocache.Object{Data: []byte(tag)})
+	}
+	return tag
+}
+
+// objectETag returns a strong ETag for the object stored at key, sent with the given
+// content encoding. The encoding is included so that the compressed and uncompressed
+// variants of an object are always distinguishable.
+func objectETag(key string, object gocache.Object, encoding string) string {
+	var tag string
+	if stored, err := etags.Get(etagKey(key, object), nil); key != "" && err == nil {
+		tag = string(stored.Data)
+	} else {
+		tag = storeETag(key, object)
+	}
+	if encoding != "" {
+		tag += "-" + encoding
+	}
+	return `"` + tag + `"`
 }
 
 // sendData returns a file to the user, handling relevant headers in the request and response.
-func sendData(w http.ResponseWriter, r *http.Request, name string,
-	compression bool, object gocache.Object) {
+// key is the cache key that object was stored at.
+func sendData(w http.ResponseWriter, r *http.Request, key, name string,
+	encoding string, object gocache.Object) {
 
 	header := w.Header()
 	header.Add("Vary", "Accept-Encoding")
-	// 5 minutes in seconds
-	if _, ok := header["Cache-Control"]; !ok {
-		header.Set("Cache-Control", "public, max-age=300")
-	}
-	if _, ok := header["Expires"]; !ok {
-		header.Set("Expires", time.Now().Add(300*time.Second).String())
+
+	if nonce := requestNonce(r); nonce != "" && encoding == "" {
+		object, encoding = applyNonce(r, nonce, object)
+		// The object is only sent to this request.
+		key = ""
 	}
 
-	if compression {
-		w.Header().Set("Content-Encoding", "gzip")
+	if encoding != "" {
+		w.Header().Set("Content-Encoding", encoding)
 	}
 
+	// ServeContent uses the ETag to handle If-None-Match and If-Range.
+	header.Set("ETag", objectETag(key, object, encoding))
+
 	if glog.V(1) {
-		glog.Infof("Sending data for %s%s [%d]\n",
-			name,
-			func() string {
-				if compression {
-					return ".gz"
-				} else {
-					return ""
-				}
-			}(),
-			len(object.Data),
-		)
+		glog.Infof("Sending data for %s [%s] [%d]\n", name, encoding, len(object.Data))
 	}
 
 	reader := bytes.NewReader(object.Data)
@@ -248,12 +481,12 @@ type DirectCacheFiller struct {
 	canCompress bool
 }
 
-func (d DirectCacheFiller) Fill(cacheObj gocache.Cache, pathStr string) (gocache.Object, error) {
-	compressed := false
-	if d.canCompress && strings.HasSuffix(pathStr, ".gz") {
-		// Get the path without .gz at the end since we start with the uncompresed version.
-		pathStr = pathStr[0 : len(pathStr)-3]
-		compressed = true
+func (d DirectCacheFiller) Fill(cacheObj gocache.Cache, key string) (gocache.Object, error) {
+	pathStr := key
+	if d.canCompress {
+		// Get the path without the compression extension since we start with the
+		// uncompressed version.
+		pathStr = baseCacheKey(key)
 	}
 
 	f, err := http.Dir(config.DataDir).Open(pathStr)
@@ -273,20 +506,20 @@ func (d DirectCacheFiller) Fill(cacheObj gocache.Cache, pathStr string) (gocache
 		return gocache.Object{}, err
 	}
 
+	if config.MinifyAssets && strings.HasPrefix(pathStr, "assets/") {
+		data = minifyData(pathStr, data)
+	}
+
 	if d.canCompress {
-		uncompressedObj, compressedObj, err := gocache.CompressAndSet(cacheObj, pathStr, data, fstat.ModTime())
+		obj, err := compressAndSetAll(cacheObj, key, data, fstat.ModTime())
 		if glog.V(2) {
-			glog.Infof("%s: compressed %d, uncompressed %d",
-				pathStr, len(compressedObj.Data), len(uncompressedObj.Data))
-		}
-		if compressed {
-			return compressedObj, err
-		} else {
-			return uncompressedObj, err
+			glog.Infof("%s: sending %d, uncompressed %d", key, len(obj.Data), len(data))
 		}
+		return obj, err
 	} else {
 		obj := gocache.Object{Data: data, ModTime: fstat.ModTime()}
 		cacheObj.Set(pathStr, obj)
+		storeETag(pathStr, obj)
 		return obj, nil
 	}
 }
@@ -0,0 +1,187 @@
+package main
+
+import (
+	"github.com/dimfeld/gocache"
+	"github.com/dimfeld/simpleblog/lru"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+)
+
+// setupSiteTest points the configuration at the test site in testdata, with the tags file
+// in a temporary directory, and returns a GlobalData that can render its pages. Tests
+// change the configuration and add the parts they use. cleanup restores the configuration
+// and removes the directory.
+func setupSiteTest(t *testing.T, name string) (dir string, globalData *GlobalData, cleanup func()) {
+	dir, err := ioutil.TempDir("", "simpleblog-"+name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	oldConfig := *config
+	cleanup = func() {
+		*config = oldConfig
+		os.RemoveAll(dir)
+	}
+
+	config.Domain = "example.com"
+	config.DataDir = "testdata"
+	config.PostsDir = "testdata/posts"
+	config.TagsPath = filepath.Join(dir, "tags.json")
+	config.IndexPosts = 5
+
+	templates, err := createTemplates()
+	if err != nil {
+		cleanup()
+		t.Fatal(err)
+	}
+	memCache := lru.New(0, 0, 0, 0)
+	globalData = &GlobalData{
+		RWMutex:   &sync.RWMutex{},
+		cache:     memCache,
+		memCache:  memCache,
+		deps:      NewDependencyTracker(),
+		notFound:  NewNotFoundCache(time.Minute, 100),
+		stats:     NewCacheStats(memCache, lru.New(0, 0, 0, 0)),
+		metrics:   NewMetrics(),
+		templates: templates,
+	}
+	return dir, globalData, cleanup
+}
+
+func TestSendDataConditional(t *testing.T) {
+	modTime := time.Date(2014, 5, 14, 23, 14, 0, 0, time.UTC)
+	object := gocache.Object{Data: []byte("<html>Some page</html>"), ModTime: modTime}
+
+	send := func(encoding string, header map[string]string) *httptest.ResponseRecorder {
+		r, _ := http.NewRequest("GET", "/2014/05/first-post", nil)
+		for k, v := range header {
+			r.Header.Set(k, v)
+		}
+		w := httptest.NewRecorder()
+		sendData(w, r, "2014/05/first-post.md", "first-post.html", encoding, object)
+		return w
+	}
+
+	w := send("", nil)
+	etag := w.Header().Get("ETag")
+	if w.Code != http.StatusOK || etag == "" {
+		t.Fatalf("Expected 200 with an ETag, saw %d with ETag %s", w.Code, etag)
+	}
+	if lastModified := w.Header().Get("Last-Modified"); lastModified != modTime.Format(http.TimeFormat) {
+		t.Errorf("Expected Last-Modified %s, saw %s", modTime.Format(http.TimeFormat), lastModified)
+	}
+
+	gzipETag := send("gzip", nil).Header().Get("ETag")
+	if gzipETag == etag {
+		t.Error("Compressed and uncompressed variants have the same ETag")
+	}
+
+	w = send("", map[string]string{"If-None-Match": etag})
+	if w.Code != http.StatusNotModified {
+		t.Errorf("Expected 304 for matching If-None-Match, saw %d", w.Code)
+	}
+
+	w = send("", map[string]string{"If-None-Match": gzipETag})
+	if w.Code != http.StatusOK {
+		t.Errorf("Expected 200 for If-None-Match with another variant's ETag, saw %d", w.Code)
+	}
+
+	w = send("", map[string]string{"If-Modified-Since": modTime.Format(http.TimeFormat)})
+	if w.Code != http.StatusNotModified {
+		t.Errorf("Expected 304 for If-Modified-Since, saw %d", w.Code)
+	}
+}
+
+func TestSendDataRange(t *testing.T) {
+	plain := gocache.Object{Data: []byte("0123456789"), ModTime: time.Now()}
+	compressed := gocache.Object{Data: []byte("abcdefghij"), ModTime: time.Now()}
+
+	send := func(encoding string, object gocache.Object, header map[string]string) *httptest.ResponseRecorder {
+		r, _ := http.NewRequest("GET", "/assets/file.css", nil)
+		for k, v := range header {
+			r.Header.Set(k, v)
+		}
+		w := httptest.NewRecorder()
+		sendData(w, r, "assets/file.css", "file.css", encoding, object)
+		return w
+	}
+
+	w := send("gzip", compressed, map[string]string{"Range": "bytes=2-4"})
+	if w.Code != http.StatusPartialContent {
+		t.Fatalf("Expected 206, saw %d", w.Code)
+	}
+	if w.Header().Get("Content-Encoding") != "gzip" {
+		t.Error("Range response was not sent with the selected encoding")
+	}
+	if body := w.Body.String(); body != "cde" {
+		t.Errorf("Expected range of the compressed variant \"cde\", saw \"%s\"", body)
+	}
+
+	gzipETag := w.Header().Get("ETag")
+	plainETag := send("", plain, nil).Header().Get("ETag")
+
+	w = send("gzip", compressed, map[string]string{"Range": "bytes=2-4", "If-Range": gzipETag})
+	if w.Code != http.StatusPartialContent {
+		t.Errorf("Expected 206 for If-Range with matching ETag, saw %d", w.Code)
+	}
+
+	// A client resuming a download of a different variant must get the whole thing.
+	w = send("gzip", compressed, map[string]string{"Range": "bytes=2-4", "If-Range": plainETag})
+	if w.Code != http.StatusOK || w.Body.String() != "abcdefghij" {
+		t.Errorf("Expected full response for If-Range with another variant's ETag, saw %d %s",
+			w.Code, w.Body.String())
+	}
+}
+
+func TestCompressible(t *testing.T) {
+	config.NoCompressTypes = "image/*, application/zip,font/woff2"
+	defer func() { config.NoCompressTypes = "" }()
+
+	tests := map[string]bool{
+		"assets/style.css":            true,
+		"assets/script.js":            true,
+		"robots.txt":                  true,
+		"images/2014/04/photo.jpg":    false,
+		"images/2014/04/diagram.PNG":  false,
+		"assets/archive.zip":          false,
+		"assets/font.woff2":           false,
+		"assets/file-with-no-ext":     true,
+		"assets/unknown.extension123": true,
+	}
+
+	for name, expected := range tests {
+		if compressible(name) != expected {
+			t.Errorf("compressible(%s): expected %v", name, expected)
+		}
+	}
+}
+
+func TestObjectETag(t *testing.T) {
+	modTime := time.Date(2014, 5, 14, 23, 14, 0, 0, time.UTC)
+	object := gocache.Object{Data: []byte("<p>Hello</p>"), ModTime: modTime}
+
+	tag := storeETag("etag-test.html", object)
+	if etag := objectETag("etag-test.html", object, "br"); etag != `"`+tag+`-br"` {
+		t.Errorf("Expected the stored hash with the encoding, saw %s", etag)
+	}
+
+	// The hash stored at fill time is used instead of hashing the data again.
+	etags.Set(etagKey("etag-test.html", object), gocache.Object{Data: []byte("stored")})
+	if etag := objectETag("etag-test.html", object, ""); etag != `"stored"` {
+		t.Errorf("Expected the stored hash, saw %s", etag)
+	}
+
+	// New data at the same key isn't given the old hash.
+	changed := gocache.Object{Data: []byte("<p>Hello</p>"), ModTime: modTime.Add(time.Second)}
+	if etag := objectETag("etag-test.html", changed, ""); etag != `"`+tag+`"` {
+		t.Errorf("Expected the hash of the new object, saw %s", etag)
+	}
+	if etag := objectETag("", object, ""); etag != `"`+tag+`"` {
+		t.Errorf("Expected the hash of an object without a key, saw %s", etag)
+	}
+}
@@ -0,0 +1,214 @@
+package main
+
+import (
+	"fmt"
+	"html/template"
+	"strings"
+	"sync"
+	"time"
+)
+
+// timeLocale holds the names and layouts used to show times in a language.
+type timeLocale struct {
+	months      [12]string
+	shortMonths [12]string
+	days        [7]string
+	shortDays   [7]string
+	// Layouts used by FormatTime, FormatDate, and the archive list, in the format taken
+	// by time.Format. Month and day names are replaced with the locale's.
+	timeLayout  string
+	dateLayout  string
+	monthLayout string
+}
+
+var timeLocales = map[string]*timeLocale{
+	"en": {
+		months: [12]string{"January", "February", "March", "April", "May", "June", "July",
+			"August", "September", "October", "November", "December"},
+		shortMonths: [12]string{"Jan", "Feb", "Mar", "Apr", "May", "Jun", "Jul", "Aug", "Sep", "Oct", "Nov", "Dec"},
+		days:        [7]string{"Sunday", "Monday", "Tuesday", "Wednesday", "Thursday", "Friday", "Saturday"},
+		shortDays:   [7]string{"Sun", "Mon", "Tue", "Wed", "Thu", "Fri", "Sat"},
+		timeLayout:  "January 2, 2006 3:04PM",
+		dateLayout:  "January 2, 2006",
+		monthLayout: "Jan 2006",
+	},
+	"de": {
+		months: [12]string{"Januar", "Februar", "März", "April", "Mai", "Juni", "Juli",
+			"August", "September", "Oktober", "November", "Dezember"},
+		shortMonths: [12]string{"Jan", "Feb", "Mär", "Apr", "Mai", "Jun", "Jul", "Aug", "Sep", "Okt", "Nov", "Dez"},
+		days:        [7]string{"Sonntag", "Montag", "Dienstag", "Mittwoch", "Donnerstag", "Freitag", "Samstag"},
+		shortDays:   [7]string{"So", "Mo", "Di", "Mi", "Do", "Fr", "Sa"},
+		timeLayout:  "2. January 2006, 15:04",
+		dateLayout:  "2. January 2006",
+		monthLayout: "January 2006",
+	},
+	"es": {
+		months: [12]string{"enero", "febrero", "marzo", "abril", "mayo", "junio", "julio",
+			"agosto", "septiembre", "octubre", "noviembre", "diciembre"},
+		shortMonths: [12]string{"ene", "feb", "mar", "abr", "may", "jun", "jul", "ago", "sept", "oct", "nov", "dic"},
+		days:        [7]string{"domingo", "lunes", "martes", "miércoles", "jueves", "viernes", "sábado"},
+		shortDays:   [7]string{"dom", "lun", "mar", "mié", "jue", "vie", "sáb"},
+		timeLayout:  "2 de January de 2006, 15:04",
+		dateLayout:  "2 de January de 2006",
+		monthLayout: "January de 2006",
+	},
+	"fr": {
+		months: [12]string{"janvier", "février", "mars", "avril", "mai", "juin", "juillet",
+			"août", "septembre", "octobre", "novembre", "décembre"},
+		shortMonths: [12]string{"janv.", "févr.", "mars", "avr.", "mai", "juin", "juil.", "août", "sept.",
+			"oct.", "nov.", "déc."},
+		days:        [7]string{"dimanche", "lundi", "mardi", "mercredi", "jeudi", "vendredi", "samedi"},
+		shortDays:   [7]string{"dim.", "lun.", "mar.", "mer.", "jeu.", "ven.", "sam."},
+		timeLayout:  "2 January 2006 15:04",
+		dateLayout:  "2 January 2006",
+		monthLayout: "January 2006",
+	},
+	"it": {
+		months: [12]string{"gennaio", "febbraio", "marzo", "aprile", "maggio", "giugno", "luglio",
+			"agosto", "settembre", "ottobre", "novembre", "dicembre"},
+		shortMonths: [12]string{"gen", "feb", "mar", "apr", "mag", "giu", "lug", "ago", "set", "ott", "nov", "dic"},
+		days:        [7]string{"domenica", "lunedì", "martedì", "mercoledì", "giovedì", "venerdì", "sabato"},
+		shortDays:   [7]string{"dom", "lun", "mar", "mer", "gio", "ven", "sab"},
+		timeLayout:  "2 January 2006 15:04",
+		dateLayout:  "2 January 2006",
+		monthLayout: "January 2006",
+	},
+	"nl": {
+		months: [12]string{"januari", "februari", "maart", "april", "mei", "juni", "juli",
+			"augustus", "september", "oktober", "november", "december"},
+		shortMonths: [12]string{"jan", "feb", "mrt", "apr", "mei", "jun", "jul", "aug", "sep", "okt", "nov", "dec"},
+		days:        [7]string{"zondag", "maandag", "dinsdag", "woensdag", "donderdag", "vrijdag", "zaterdag"},
+		shortDays:   [7]string{"zo", "ma", "di", "wo", "do", "vr", "za"},
+		timeLayout:  "2 January 2006 15:04",
+		dateLayout:  "2 January 2006",
+		monthLayout: "January 2006",
+	},
+	"pt": {
+		months: [12]string{"janeiro", "fevereiro", "março", "abril", "maio", "junho", "julho",
+			"agosto", "setembro", "outubro", "novembro", "dezembro"},
+		shortMonths: [12]string{"jan", "fev", "mar", "abr", "mai", "jun", "jul", "ago", "set", "out", "nov", "dez"},
+		days: [7]string{"domingo", "segunda-feira", "terça-feira", "quarta-feira", "quinta-feira",
+			"sexta-feira", "sábado"},
+		shortDays:   [7]string{"dom", "seg", "ter", "qua", "qui", "sex", "sáb"},
+		timeLayout:  "2 de January de 2006, 15:04",
+		dateLayout:  "2 de January de 2006",
+		monthLayout: "January de 2006",
+	},
+}
+
+// lookupLocale finds the locale for a language tag such as "de" or "pt-BR". Only the
+// language is used.
+func lookupLocale(tag string) (*timeLocale, bool) {
+	lang := strings.ToLower(strings.TrimSpace(tag))
+	if i := strings.IndexAny(lang, "-_"); i != -1 {
+		lang = lang[:i]
+	}
+	if lang == "" {
+		lang = "en"
+	}
+	locale, ok := timeLocales[lang]
+	return locale, ok
+}
+
+// siteLocale returns the locale in config.Locale, or English if it isn't known.
+func siteLocale() *timeLocale {
+	if locale, ok := lookupLocale(config.Locale); ok {
+		return locale
+	}
+	return timeLocales["en"]
+}
+
+// format is like time.Format, but with the locale's month and day names.
+func (l *timeLocale) format(t time.Time, layout string) string {
+	if l == timeLocales["en"] {
+		return t.Format(layout)
+	}
+
+	// Format the layout in pieces, replacing the names between them. The names are
+	// checked in the same order that time.Format checks for them, so the layout is
+	// split the same way it would be.
+	buf := &strings.Builder{}
+	start := 0
+	for i := 0; i < len(layout); i++ {
+		var name string
+		var length int
+		switch {
+		case strings.HasPrefix(layout[i:], "January"):
+			name, length = l.months[t.Month()-1], len("January")
+		case strings.HasPrefix(layout[i:], "Jan"):
+			name, length = l.shortMonths[t.Month()-1], len("Jan")
+		case strings.HasPrefix(layout[i:], "Monday"):
+			name, length = l.days[t.Weekday()], len("Monday")
+		case strings.HasPrefix(layout[i:], "Mon"):
+			name, length = l.shortDays[t.Weekday()], len("Mon")
+		default:
+			continue
+		}
+		buf.WriteString(t.Format(layout[start:i]))
+		buf.WriteString(name)
+		i += length - 1
+		start = i + 1
+	}
+	buf.WriteString(t.Format(layout[start:]))
+	return buf.String()
+}
+
+// Time zones loaded so far, by name.
+var timezones sync.Map
+
+// loadTimezone returns the time zone with an IANA name such as "Europe/Berlin".
+func loadTimezone(name string) (*time.Location, error) {
+	if loc, ok := timezones.Load(name); ok {
+		return loc.(*time.Location), nil
+	}
+	loc, err := time.LoadLocation(name)
+	if err != nil {
+		return nil, fmt.Errorf("Unknown time zone %q", name)
+	}
+	timezones.Store(name, loc)
+	return loc, nil
+}
+
+// inTimezone returns t in the named time zone, or with no name, in the site's time zone.
+func inTimezone(t time.Time, name string) time.Time {
+	if name == "" {
+		name = config.Timezone
+	}
+	if name == "" {
+		return t
+	}
+	loc, err := loadTimezone(name)
+	if err != nil {
+		return t
+	}
+	return t.In(loc)
+}
+
+// siteTime returns t in the site's time zone. If none is configured, t keeps the offset
+// it was written with.
+func siteTime(t time.Time) time.Time {
+	return inTimezone(t, "")
+}
+
+// checkTimeConfig checks the time zone and locale in the configuration.
+func checkTimeConfig() error {
+	if config.Timezone != "" {
+		if _, err := loadTimezone(config.Timezone); err != nil {
+			return fmt.Errorf("Timezone: %s", err)
+		}
+	}
+	if _, ok := lookupLocale(config.Locale); !ok {
+		return fmt.Errorf("Locale: unsupported language %q", config.Locale)
+	}
+	return nil
+}
+
+// formatInZone formats t with the locale's names, in the time zone named by the optional
+// zone argument or else the site's time zone.
+func formatInZone(t time.Time, layout string, zone []string) template.HTML {
+	name := ""
+	if len(zone) != 0 {
+		name = zone[0]
+	}
+	return template.HTML(siteLocale().format(inTimezone(t, name), layout))
+}
@@ -0,0 +1,183 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestTimeLocaleFormat(t *testing.T) {
+	oldConfig := *config
+	defer func() { *config = oldConfig }()
+
+	timestamp, _ := time.Parse(PostTimeFormat, "3/2/14 4:05PM -0500")
+	tests := []struct {
+		locale, layout, expected string
+	}{
+		{"", "", "March 2, 2014 4:05PM"},
+		{"en-US", "Mon Jan 2", "Sun Mar 2"},
+		{"de", "", "2. März 2014, 16:05"},
+		{"de_DE", "Monday, 2. Jan 2006", "Sonntag, 2. Mär 2014"},
+		{"fr", "", "2 mars 2014 16:05"},
+		{"es", "Monday 2 de January", "domingo 2 de marzo"},
+		{"pt-BR", "Mon, Jan 2006", "dom, mar 2014"},
+	}
+	for _, test := range tests {
+		config.Locale = test.locale
+		var formatted string
+		if test.layout == "" {
+			formatted = string(FormatTime(timestamp))
+		} else {
+			formatted = string(FormatTimeLayout(test.layout, timestamp))
+		}
+		if formatted != test.expected {
+			t.Errorf("Locale %q: expected %q, saw %q", test.locale, test.expected, formatted)
+		}
+	}
+
+	config.Locale = "nl"
+	if text := ArchiveSpec(timestamp).String(); text != "maart 2014" {
+		t.Errorf("Expected the archive month in Dutch, saw %q", text)
+	}
+	if date := FormatDate(timestamp); date != "2 maart 2014" {
+		t.Errorf("Expected the date in Dutch, saw %q", date)
+	}
+
+	config.Locale = "xx"
+	if err := checkTimeConfig(); err == nil {
+		t.Error("Expected an error for an unknown locale")
+	}
+}
+
+func TestTimezone(t *testing.T) {
+	if _, err := loadTimezone("Europe/Berlin"); err != nil {
+		t.Skip("Time zone data is not installed")
+	}
+	oldConfig := *config
+	defer func() { *config = oldConfig }()
+
+	timestamp, _ := time.Parse(PostTimeFormat, "6/30/14 11:30PM -0500")
+	config.Timezone = ""
+	if formatted := FormatTime(timestamp); formatted != "June 30, 2014 11:30PM" {
+		t.Errorf("Expected the time as written without a site time zone, saw %s", formatted)
+	}
+
+	config.Timezone = "Europe/Berlin"
+	if formatted := FormatTime(timestamp); formatted != "July 1, 2014 6:30AM" {
+		t.Errorf("Expected the time in the site's time zone, saw %s", formatted)
+	}
+	if formatted := FormatTime(timestamp, "America/Los_Angeles"); formatted != "June 30, 2014 9:30PM" {
+		t.Errorf("Expected the time in the post's time zone, saw %s", formatted)
+	}
+
+	config.Timezone = "Mars/Olympus_Mons"
+	if err := checkTimeConfig(); err == nil {
+		t.Error("Expected an error for an unknown time zone")
+	}
+}
+
+func TestPostTimezone(t *testing.T) {
+	dir, err := ioutil.TempDir("", "simpleblog-timezone")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	filePath := filepath.Join(dir, "post.md")
+	ioutil.WriteFile(filePath, []byte("Title\n6/30/14 11:30PM -0500\ntag1\nhttp://example.com\n"+
+		"timezone: UTC\nUpdated: 7/1/14 9:00AM -0500\n\nContent"), 0644)
+	post, err := NewPost(filePath, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if post.Timezone != "UTC" || post.Link != "http://example.com" || len(post.Changes) != 1 {
+		t.Errorf("Timezone header was not read: %+v", post)
+	}
+
+	savePost(post)
+	if saved, _ := ioutil.ReadFile(filePath); !strings.Contains(string(saved),
+		"http://example.com\nTimezone: UTC\nUpdated:") {
+		t.Errorf("Timezone was not encoded, saw %s", saved)
+	}
+
+	// An unknown time zone falls back to the site's.
+	ioutil.WriteFile(filePath, []byte("Title\n6/30/14 11:30PM -0500\nTimezone: Nowhere/Special\n\n"), 0644)
+	if post, err := NewPost(filePath, false); err != nil || post.Timezone != "" {
+		t.Errorf("Expected the site's time zone for an unknown time zone, saw %+v %v", post, err)
+	}
+}
+
+func TestArchiveTimezone(t *testing.T) {
+	oldConfig := *config
+	defer func() { *config = oldConfig }()
+
+	dir, err := ioutil.TempDir("", "simpleblog-archive")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	config.PostsDir = dir
+
+	for key, date := range map[string]string{
+		"2014/06/early": "6/1/14 9:00AM -0500",
+		"2014/06/late":  "6/30/14 11:30PM -0500",
+		"2014/08/other": "8/14/14 9:00AM -0500",
+	} {
+		timestamp, _ := time.Parse(PostTimeFormat, date)
+		savePost(&Post{SourcePath: postSourcePath(key), Title: key, Timestamp: timestamp})
+	}
+
+	checkMonth := func(month time.Month, expected ...string) {
+		posts, err := LoadArchiveMonth(2014, month, false)
+		if err != nil {
+			t.Errorf("Month %s: %s", month, err)
+		}
+		keys := []string{}
+		for _, post := range posts {
+			keys = append(keys, postKey(post.SourcePath))
+		}
+		if strings.Join(keys, " ") != strings.Join(expected, " ") {
+			t.Errorf("Month %s: expected %v, saw %v", month, expected, keys)
+		}
+	}
+	checkSpecs := func(expected ...string) {
+		specs, err := NewArchiveSpecList(dir)
+		if err != nil {
+			t.Fatal(err)
+		}
+		hrefs := []string{}
+		for _, spec := range specs {
+			hrefs = append(hrefs, spec.Href())
+		}
+		if strings.Join(hrefs, " ") != strings.Join(expected, " ") {
+			t.Errorf("Expected archive months %v, saw %v", expected, hrefs)
+		}
+	}
+
+	// Without a site time zone, the directories are the months.
+	config.Timezone = ""
+	config.ArchiveListNewestFirst = false
+	checkSpecs("/2014/06", "/2014/08")
+	checkMonth(time.June, "2014/06/early", "2014/06/late")
+
+	config.Timezone = "UTC"
+	checkSpecs("/2014/06", "/2014/07", "/2014/08")
+	checkMonth(time.June, "2014/06/early")
+	checkMonth(time.July, "2014/06/late")
+	checkMonth(time.August, "2014/08/other")
+
+	posts, title, err := generateArchivePage(nil, map[string]string{"year": "2014", "month": "07"})
+	if err != nil || len(posts) != 1 || title != "Jul 2014" {
+		t.Errorf("Expected the late June post on the July page, saw %v %q %v", posts, title, err)
+	}
+
+	// The months are cached until a post's file changes.
+	timestamp, _ := time.Parse(PostTimeFormat, "8/31/14 11:30PM -0500")
+	savePost(&Post{SourcePath: postSourcePath("2014/08/other"), Title: "other", Timestamp: timestamp})
+	later := time.Now().Add(time.Minute)
+	os.Chtimes(postSourcePath("2014/08/other"), later, later)
+	checkSpecs("/2014/06", "/2014/07", "/2014/09")
+}
@@ -1,7 +1,266 @@
+// Package lru implements a concurrent, size-limited LRU cache that
+// satisfies the gocache.Cache interface.
 package lru
 
-//import "container/list"
+import (
+	"container/list"
+	"errors"
+	"github.com/dimfeld/gocache"
+	"sync"
+	"time"
+)
 
+// ErrNotFound is returned by Get when the key is not in the cache and no Filler was given.
+var ErrNotFound = errors.New("lru: key not found")
+
+// ErrFillPanicked is returned to the callers waiting on a Fill that panicked.
+var ErrFillPanicked = errors.New("lru: Fill panicked")
+
+// Stats holds counters describing the cache's behavior since it was created.
+type Stats struct {
+	Hits        uint64
+	Misses      uint64
+	Fills       uint64
+	FillErrors  uint64
+	Evictions   uint64
+	Expirations uint64
+	// Total time spent in Filler.Fill.
+	FillTime time.Duration
+
+	// Current number of entries and total size of their data.
+	Entries int
+	Size    int
+}
+
+type entry struct {
+	key     string
+	object  gocache.Object
+	expires time.Time
+}
+
+// fillCall tracks an in-progress Fill, so that concurrent misses for the same key
+// wait for the first one instead of running their own.
+type fillCall struct {
+	done   chan struct{}
+	object gocache.Object
+	err    error
+	// Set if the key was deleted while the fill was running, in which case the
+	// result is returned to the waiters but not kept in the cache.
+	invalidated bool
+}
+
+// AsyncLRU is an LRU cache that can be limited by total data size and by number
+// of entries. Concurrent misses for the same key share a single call to the Filler.
+// A Filler must not call Get on the same cache for the key it's filling, or it will deadlock.
 type AsyncLRU struct {
-	// Need a list and a map here
+	lock    sync.Mutex
+	list    *list.List
+	items   map[string]*list.Element
+	filling map[string]*fillCall
+
+	maxSize       int
+	maxObjectSize int
+	maxEntries    int
+	ttl           time.Duration
+
+	size  int
+	stats Stats
+
+	// Called with keys that were deleted while they were being filled.
+	invalidateHook func(key string)
+
+	// Returns the current time. Replaced in tests.
+	now func() time.Time
+}
+
+// New creates an AsyncLRU. maxSize is the maximum total size of the objects' data,
+// maxObjectSize is the size of the largest object that will be stored, and maxEntries is the
+// maximum number of objects. ttl is how long an object stays valid after it is set.
+// A value of 0 for any of these means no limit.
+func New(maxSize, maxObjectSize, maxEntries int, ttl time.Duration) *AsyncLRU {
+	return &AsyncLRU{
+		list:          list.New(),
+		items:         make(map[string]*list.Element),
+		filling:       make(map[string]*fillCall),
+		maxSize:       maxSize,
+		maxObjectSize: maxObjectSize,
+		maxEntries:    maxEntries,
+		ttl:           ttl,
+		now:           time.Now,
+	}
+}
+
+// SetInvalidateHook sets a function to call when a key that was deleted while it was being
+// filled finishes filling. The key itself is not stored, but the Filler may have stored
+// other objects along with it, such as compressed versions, which the hook can remove.
+// It is called without the cache's lock held, so it may use the cache.
+func (c *AsyncLRU) SetInvalidateHook(hook func(key string)) {
+	c.lock.Lock()
+	c.invalidateHook = hook
+	c.lock.Unlock()
+}
+
+// Get returns the object stored at key. If it isn't present, filler is called to
+// generate it and the result is stored in the cache.
+func (c *AsyncLRU) Get(key string, filler gocache.Filler) (gocache.Object, error) {
+	c.lock.Lock()
+
+	if obj, ok := c.getLocked(key); ok {
+		c.stats.Hits++
+		c.lock.Unlock()
+		return obj, nil
+	}
+
+	c.stats.Misses++
+	if filler == nil {
+		c.lock.Unlock()
+		return gocache.Object{}, ErrNotFound
+	}
+
+	if call, ok := c.filling[key]; ok {
+		// Someone else is already filling this key, so wait for them.
+		c.lock.Unlock()
+		<-call.done
+		return call.object, call.err
+	}
+
+	call := &fillCall{done: make(chan struct{})}
+	c.filling[key] = call
+	c.lock.Unlock()
+
+	start := c.now()
+	// Finish the call even if the filler panics, so the waiters aren't stuck.
+	panicked := true
+	defer func() {
+		if panicked {
+			call.err = ErrFillPanicked
+		}
+		c.finishFill(key, call, c.now().Sub(start))
+	}()
+	call.object, call.err = filler.Fill(c, key)
+	panicked = false
+	return call.object, call.err
+}
+
+// finishFill stores the result of a fill and wakes up the callers waiting on it.
+func (c *AsyncLRU) finishFill(key string, call *fillCall, fillTime time.Duration) {
+	var hook func(key string)
+	c.lock.Lock()
+	delete(c.filling, key)
+	c.stats.Fills++
+	c.stats.FillTime += fillTime
+	if call.err != nil {
+		c.stats.FillErrors++
+	} else if call.invalidated {
+		// The filler may have set the key itself.
+		c.removeKeyLocked(key)
+		hook = c.invalidateHook
+	} else {
+		c.setLocked(key, call.object, c.ttl)
+	}
+	c.lock.Unlock()
+
+	if hook != nil {
+		hook(key)
+	}
+	close(call.done)
+}
+
+// Set stores object at key using the cache's default TTL. Objects larger than the
+// maximum object size are silently not stored.
+func (c *AsyncLRU) Set(key string, object gocache.Object) error {
+	return c.SetWithTTL(key, object, c.ttl)
+}
+
+// SetWithTTL stores object at key, expiring it after ttl. A ttl of 0 means
+// the object does not expire.
+func (c *AsyncLRU) SetWithTTL(key string, object gocache.Object, ttl time.Duration) error {
+	c.lock.Lock()
+	c.setLocked(key, object, ttl)
+	c.lock.Unlock()
+	return nil
+}
+
+// Del removes key from the cache. A key of "*" removes everything.
+func (c *AsyncLRU) Del(key string) error {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	if key == "*" {
+		c.list.Init()
+		c.items = make(map[string]*list.Element)
+		c.size = 0
+		for _, call := range c.filling {
+			call.invalidated = true
+		}
+		return nil
+	}
+
+	c.removeKeyLocked(key)
+	if call, ok := c.filling[key]; ok {
+		call.invalidated = true
+	}
+	return nil
+}
+
+// Stats returns a snapshot of the cache's statistics.
+func (c *AsyncLRU) Stats() Stats {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	stats := c.stats
+	stats.Entries = c.list.Len()
+	stats.Size = c.size
+	return stats
+}
+
+func (c *AsyncLRU) getLocked(key string) (gocache.Object, bool) {
+	element, ok := c.items[key]
+	if !ok {
+		return gocache.Object{}, false
+	}
+
+	e := element.Value.(*entry)
+	if !e.expires.IsZero() && !c.now().Before(e.expires) {
+		c.removeElementLocked(element)
+		c.stats.Expirations++
+		return gocache.Object{}, false
+	}
+
+	c.list.MoveToFront(element)
+	return e.object, true
+}
+
+func (c *AsyncLRU) setLocked(key string, object gocache.Object, ttl time.Duration) {
+	c.removeKeyLocked(key)
+
+	size := len(object.Data)
+	if (c.maxObjectSize > 0 && size > c.maxObjectSize) || (c.maxSize > 0 && size > c.maxSize) {
+		return
+	}
+
+	e := &entry{key: key, object: object}
+	if ttl > 0 {
+		e.expires = c.now().Add(ttl)
+	}
+
+	c.items[key] = c.list.PushFront(e)
+	c.size += size
+
+	for (c.maxSize > 0 && c.size > c.maxSize) || (c.maxEntries > 0 && c.list.Len() > c.maxEntries) {
+		c.removeElementLocked(c.list.Back())
+		c.stats.Evictions++
+	}
+}
+
+func (c *AsyncLRU) removeKeyLocked(key string) {
+	if element, ok := c.items[key]; ok {
+		c.removeElementLocked(element)
+	}
+}
+
+func (c *AsyncLRU) removeElementLocked(element *list.Element) {
+	e := c.list.Remove(element).(*entry)
+	delete(c.items, e.key)
+	c.size -= len(e.object.Data)
 }
@@ -0,0 +1,258 @@
+package lru
+
+import (
+	"errors"
+	"github.com/dimfeld/gocache"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+type countingFiller struct {
+	calls int32
+	// If set, Fill waits for this channel to close before returning.
+	wait chan struct{}
+	err  error
+	// If set, Fill also stores a variant of the key with this suffix.
+	variant string
+}
+
+func (f *countingFiller) Fill(cache gocache.Cache, key string) (gocache.Object, error) {
+	atomic.AddInt32(&f.calls, 1)
+	if f.wait != nil {
+		<-f.wait
+	}
+	if f.err != nil {
+		return gocache.Object{}, f.err
+	}
+	if f.variant != "" {
+		cache.Set(key+f.variant, gocache.Object{Data: []byte("variant for " + key)})
+	}
+	return gocache.Object{Data: []byte("data for " + key)}, nil
+}
+
+func obj(size int) gocache.Object {
+	return gocache.Object{Data: make([]byte, size), ModTime: time.Now()}
+}
+
+func TestGetAndFill(t *testing.T) {
+	c := New(0, 0, 0, 0)
+	filler := &countingFiller{}
+
+	for i := 0; i < 3; i++ {
+		o, err := c.Get("abc", filler)
+		if err != nil {
+			t.Fatal("Get returned error", err)
+		}
+		if string(o.Data) != "data for abc" {
+			t.Errorf("Expected data \"data for abc\", saw \"%s\"", string(o.Data))
+		}
+	}
+
+	if filler.calls != 1 {
+		t.Errorf("Expected 1 call to Fill, saw %d", filler.calls)
+	}
+
+	stats := c.Stats()
+	if stats.Hits != 2 || stats.Misses != 1 || stats.Fills != 1 || stats.Entries != 1 {
+		t.Errorf("Unexpected stats %+v", stats)
+	}
+
+	if _, err := c.Get("def", nil); err != ErrNotFound {
+		t.Errorf("Expected ErrNotFound with nil filler, saw %v", err)
+	}
+
+	fillErr := errors.New("fill failed")
+	if _, err := c.Get("def", &countingFiller{err: fillErr}); err != fillErr {
+		t.Errorf("Expected fill error, saw %v", err)
+	}
+	if c.Stats().FillErrors != 1 {
+		t.Error("Fill error was not counted")
+	}
+	if _, err := c.Get("def", nil); err != ErrNotFound {
+		t.Error("Failed fill was stored in the cache")
+	}
+}
+
+func TestSingleFlight(t *testing.T) {
+	c := New(0, 0, 0, 0)
+	filler := &countingFiller{wait: make(chan struct{})}
+
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			o, err := c.Get("key", filler)
+			if err != nil || string(o.Data) != "data for key" {
+				t.Errorf("Unexpected result %s, %v", string(o.Data), err)
+			}
+		}()
+	}
+
+	// Give the goroutines a chance to pile up behind the first fill.
+	time.Sleep(10 * time.Millisecond)
+	close(filler.wait)
+	wg.Wait()
+
+	if filler.calls != 1 {
+		t.Errorf("Expected 1 call to Fill, saw %d", filler.calls)
+	}
+}
+
+func TestDelDuringFill(t *testing.T) {
+	c := New(0, 0, 0, 0)
+	c.SetInvalidateHook(func(key string) { c.Del(key + ".gz") })
+	filler := &countingFiller{wait: make(chan struct{}), variant: ".gz"}
+
+	done := make(chan struct{})
+	go func() {
+		c.Get("key", filler)
+		close(done)
+	}()
+
+	for atomic.LoadInt32(&filler.calls) == 0 {
+		time.Sleep(time.Millisecond)
+	}
+	c.Del("key")
+	close(filler.wait)
+	<-done
+
+	if _, err := c.Get("key", nil); err != ErrNotFound {
+		t.Error("Object filled before Del was kept in the cache")
+	}
+	if _, err := c.Get("key.gz", nil); err != ErrNotFound {
+		t.Error("Variant filled before Del was kept in the cache")
+	}
+}
+
+type panicFiller struct {
+	wait chan struct{}
+}
+
+func (f panicFiller) Fill(cache gocache.Cache, key string) (gocache.Object, error) {
+	<-f.wait
+	panic("fill failed")
+}
+
+func TestPanicDuringFill(t *testing.T) {
+	c := New(0, 0, 0, 0)
+	filler := panicFiller{wait: make(chan struct{})}
+
+	recovered := make(chan interface{})
+	go func() {
+		defer func() { recovered <- recover() }()
+		c.Get("key", filler)
+	}()
+
+	// Wait for the fill to start, then add a caller that waits on it.
+	for {
+		c.lock.Lock()
+		_, filling := c.filling["key"]
+		c.lock.Unlock()
+		if filling {
+			break
+		}
+		time.Sleep(time.Millisecond)
+	}
+	waiter := make(chan error)
+	go func() {
+		_, err := c.Get("key", &countingFiller{})
+		waiter <- err
+	}()
+	time.Sleep(10 * time.Millisecond)
+	close(filler.wait)
+
+	if r := <-recovered; r == nil {
+		t.Error("Expected the panic to reach the caller that ran the fill")
+	}
+	select {
+	case err := <-waiter:
+		if err != ErrFillPanicked {
+			t.Errorf("Expected ErrFillPanicked, saw %v", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("Waiter was stuck after the fill panicked")
+	}
+
+	if _, err := c.Get("key", &countingFiller{}); err != nil {
+		t.Errorf("Key could not be filled again after a panic: %v", err)
+	}
+}
+
+func TestLimits(t *testing.T) {
+	t.Log("Size limit")
+	c := New(100, 50, 0, 0)
+	for i := 0; i < 5; i++ {
+		c.Set(strconv.Itoa(i), obj(30))
+	}
+	stats := c.Stats()
+	if stats.Entries != 3 || stats.Size != 90 || stats.Evictions != 2 {
+		t.Errorf("Unexpected stats %+v", stats)
+	}
+	if _, err := c.Get("0", nil); err != ErrNotFound {
+		t.Error("Oldest entry was not evicted")
+	}
+
+	// Touch 2 so that 3 is the least recently used.
+	c.Get("2", nil)
+	c.Set("5", obj(30))
+	if _, err := c.Get("3", nil); err != ErrNotFound {
+		t.Error("Least recently used entry was not evicted")
+	}
+	if _, err := c.Get("2", nil); err != nil {
+		t.Error("Recently used entry was evicted")
+	}
+
+	c.Set("big", obj(51))
+	if _, err := c.Get("big", nil); err != ErrNotFound {
+		t.Error("Object over the object size limit was stored")
+	}
+
+	t.Log("Entry limit")
+	c = New(0, 0, 2, 0)
+	c.Set("a", obj(1))
+	c.Set("b", obj(1))
+	c.Set("c", obj(1))
+	if c.Stats().Entries != 2 {
+		t.Errorf("Expected 2 entries, saw %d", c.Stats().Entries)
+	}
+
+	c.Del("*")
+	stats = c.Stats()
+	if stats.Entries != 0 || stats.Size != 0 {
+		t.Errorf("Del(\"*\") left entries: %+v", stats)
+	}
+}
+
+func TestTTL(t *testing.T) {
+	now := time.Now()
+	c := New(0, 0, 0, time.Minute)
+	c.now = func() time.Time { return now }
+
+	c.Set("a", obj(1))
+	c.SetWithTTL("b", obj(1), time.Hour)
+	c.SetWithTTL("c", obj(1), 0)
+
+	now = now.Add(2 * time.Minute)
+	if _, err := c.Get("a", nil); err != ErrNotFound {
+		t.Error("Entry with default TTL did not expire")
+	}
+	if _, err := c.Get("b", nil); err != nil {
+		t.Error("Entry with longer TTL expired")
+	}
+
+	now = now.Add(24 * time.Hour)
+	if _, err := c.Get("b", nil); err != ErrNotFound {
+		t.Error("Entry with longer TTL did not expire")
+	}
+	if _, err := c.Get("c", nil); err != nil {
+		t.Error("Entry with no TTL expired")
+	}
+
+	if c.Stats().Expirations != 2 {
+		t.Errorf("Expected 2 expirations, saw %d", c.Stats().Expirations)
+	}
+}
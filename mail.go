@@ -0,0 +1,84 @@
+package main
+
+import (
+	"crypto/tls"
+	"net"
+	"net/smtp"
+	"strings"
+	"time"
+)
+
+// Mailer sends email through the configured SMTP server.
+type Mailer struct {
+	addr    string
+	auth    smtp.Auth
+	timeout time.Duration
+}
+
+// NewMailer creates a mailer using the SMTP settings from the configuration.
+func NewMailer() (*Mailer, error) {
+	m := &Mailer{addr: config.SMTPAddr, timeout: 30 * time.Second}
+	if config.SMTPUsername != "" {
+		host, _, err := net.SplitHostPort(m.addr)
+		if err != nil {
+			return nil, err
+		}
+		m.auth = smtp.PlainAuth("", config.SMTPUsername, config.SMTPPassword, host)
+	}
+	return m, nil
+}
+
+// headerValue removes line breaks, so a value can't add its own headers to a message.
+func headerValue(s string) string {
+	return strings.Join(strings.Fields(s), " ")
+}
+
+// Send delivers a message to the SMTP server, using TLS if the server supports it.
+func (m *Mailer) Send(from string, to []string, msg []byte) error {
+	conn, err := net.DialTimeout("tcp", m.addr, m.timeout)
+	if err != nil {
+		return err
+	}
+	// A server that stops responding shouldn't tie up the caller forever.
+	conn.SetDeadline(time.Now().Add(m.timeout))
+
+	host, _, _ := net.SplitHostPort(m.addr)
+	c, err := smtp.NewClient(conn, host)
+	if err != nil {
+		conn.Close()
+		return err
+	}
+	defer c.Close()
+
+	if ok, _ := c.Extension("STARTTLS"); ok {
+		if err := c.StartTLS(&tls.Config{ServerName: host}); err != nil {
+			return err
+		}
+	}
+	if m.auth != nil {
+		if err := c.Auth(m.auth); err != nil {
+			return err
+		}
+	}
+
+	if err := c.Mail(from); err != nil {
+		return err
+	}
+	for _, addr := range to {
+		if err := c.Rcpt(addr); err != nil {
+			return err
+		}
+	}
+
+	w, err := c.Data()
+	if err != nil {
+		return err
+	}
+	if _, err := w.Write(msg); err != nil {
+		return err
+	}
+	if err := w.Close(); err != nil {
+		return err
+	}
+	return c.Quit()
+}
@@ -0,0 +1,240 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Route names used only for the request metrics. The other route names are
+// shared with the cache statistics. Requests refused by the rate limits are
+// counted under RouteRateLimit.
+const (
+	RouteAdmin     = "admin"
+	RouteMetrics   = "metrics"
+	RouteRateLimit = "ratelimit"
+)
+
+// Upper bounds, in seconds, of the buckets for the duration histograms.
+var durationBuckets = []float64{0.0005, 0.001, 0.0025, 0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5}
+
+type histogram struct {
+	// Count of observations in each bucket, with one extra for +Inf.
+	counts []uint64
+	sum    float64
+	count  uint64
+}
+
+func newHistogram() *histogram {
+	return &histogram{counts: make([]uint64, len(durationBuckets)+1)}
+}
+
+func (h *histogram) observe(d time.Duration) {
+	seconds := d.Seconds()
+	i := sort.SearchFloat64s(durationBuckets, seconds)
+	h.counts[i]++
+	h.sum += seconds
+	h.count++
+}
+
+// labelSet is a set of Prometheus labels in the form `a="b",c="d"`.
+type labelSet string
+
+func labels(pairs ...string) labelSet {
+	parts := make([]string, 0, len(pairs)/2)
+	for i := 0; i+1 < len(pairs); i += 2 {
+		parts = append(parts, pairs[i]+"="+strconv.Quote(pairs[i+1]))
+	}
+	return labelSet(strings.Join(parts, ","))
+}
+
+// Metrics collects statistics about the server in a form that can be
+// scraped by Prometheus.
+type Metrics struct {
+	lock sync.Mutex
+
+	requests        map[labelSet]uint64
+	requestDuration map[labelSet]*histogram
+	renderDuration  map[labelSet]*histogram
+	fsEvents        map[labelSet]uint64
+}
+
+func NewMetrics() *Metrics {
+	return &Metrics{
+		requests:        make(map[labelSet]uint64),
+		requestDuration: make(map[labelSet]*histogram),
+		renderDuration:  make(map[labelSet]*histogram),
+		fsEvents:        make(map[labelSet]uint64),
+	}
+}
+
+func observe(m map[labelSet]*histogram, l labelSet, d time.Duration) {
+	h := m[l]
+	if h == nil {
+		h = newHistogram()
+		m[l] = h
+	}
+	h.observe(d)
+}
+
+// ObserveRequest records a handled request.
+func (m *Metrics) ObserveRequest(route string, status int, d time.Duration) {
+	l := labels("route", route, "status", strconv.Itoa(status))
+	m.lock.Lock()
+	m.requests[l]++
+	observe(m.requestDuration, l, d)
+	m.lock.Unlock()
+}
+
+// ObserveRender records the time taken to render a page.
+func (m *Metrics) ObserveRender(route string, d time.Duration) {
+	m.lock.Lock()
+	observe(m.renderDuration, labels("route", route), d)
+	m.lock.Unlock()
+}
+
+// CountFileEvent records an event from the file system watcher.
+func (m *Metrics) CountFileEvent(eventType string) {
+	m.lock.Lock()
+	m.fsEvents[labels("type", eventType)]++
+	m.lock.Unlock()
+}
+
+func sortLabels(keys []labelSet) {
+	sort.Slice(keys, func(i, j int) bool { return keys[i] < keys[j] })
+}
+
+func writeHeader(w *bufio.Writer, name, metricType, help string) {
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", name, help, name, metricType)
+}
+
+func writeSample(w *bufio.Writer, name string, l labelSet, value interface{}) {
+	if l == "" {
+		fmt.Fprintf(w, "%s %v\n", name, value)
+	} else {
+		fmt.Fprintf(w, "%s{%s} %v\n", name, l, value)
+	}
+}
+
+func writeCounters(w *bufio.Writer, name, help string, m map[labelSet]uint64) {
+	writeHeader(w, name, "counter", help)
+	keys := make([]labelSet, 0, len(m))
+	for l := range m {
+		keys = append(keys, l)
+	}
+	sortLabels(keys)
+	for _, l := range keys {
+		writeSample(w, name, l, m[l])
+	}
+}
+
+func writeHistograms(w *bufio.Writer, name, help string, m map[labelSet]*histogram) {
+	writeHeader(w, name, "histogram", help)
+	keys := make([]labelSet, 0, len(m))
+	for l := range m {
+		keys = append(keys, l)
+	}
+	sortLabels(keys)
+
+	for _, l := range keys {
+		h := m[l]
+		prefix := string(l)
+		if prefix != "" {
+			prefix += ","
+		}
+
+		cumulative := uint64(0)
+		for i, bound := range durationBuckets {
+			cumulative += h.counts[i]
+			writeSample(w, name+"_bucket",
+				labelSet(prefix+`le="`+strconv.FormatFloat(bound, 'g', -1, 64)+`"`), cumulative)
+		}
+		writeSample(w, name+"_bucket", labelSet(prefix+`le="+Inf"`), h.count)
+		writeSample(w, name+"_sum", l, h.sum)
+		writeSample(w, name+"_count", l, h.count)
+	}
+}
+
+func writeCacheMetrics(w *bufio.Writer, labelName string, snapshots map[string]CacheCounterSnapshot) {
+	prefix := "simpleblog_cache_"
+	if labelName == "route" {
+		prefix = "simpleblog_route_cache_"
+	}
+
+	names := make([]string, 0, len(snapshots))
+	for name := range snapshots {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	writeHeader(w, prefix+"hits_total", "counter", "Cache hits by "+labelName+".")
+	for _, name := range names {
+		writeSample(w, prefix+"hits_total", labels(labelName, name), snapshots[name].Hits)
+	}
+	writeHeader(w, prefix+"misses_total", "counter", "Cache misses by "+labelName+".")
+	for _, name := range names {
+		writeSample(w, prefix+"misses_total", labels(labelName, name), snapshots[name].Misses)
+	}
+	writeHeader(w, prefix+"hit_ratio", "gauge", "Ratio of cache hits to lookups by "+labelName+".")
+	for _, name := range names {
+		writeSample(w, prefix+"hit_ratio", labels(labelName, name), snapshots[name].HitRatio)
+	}
+}
+
+// WriteMetrics writes all the metrics in the Prometheus text exposition format.
+func (m *Metrics) WriteMetrics(w *bufio.Writer, globalData *GlobalData) {
+	m.lock.Lock()
+	writeCounters(w, "simpleblog_http_requests_total", "HTTP requests by route and status.",
+		m.requests)
+	writeHistograms(w, "simpleblog_http_request_duration_seconds",
+		"Time taken to handle HTTP requests by route and status.", m.requestDuration)
+	writeHistograms(w, "simpleblog_render_duration_seconds",
+		"Time taken to render pages by route.", m.renderDuration)
+	writeCounters(w, "simpleblog_fswatcher_events_total",
+		"File system watcher events by type.", m.fsEvents)
+	m.lock.Unlock()
+
+	stats := globalData.stats.Snapshot()
+	writeCacheMetrics(w, "level", stats.Levels)
+	writeCacheMetrics(w, "route", stats.Routes)
+
+	notFoundEntries, notFoundHits := globalData.notFound.Stats()
+	writeHeader(w, "simpleblog_not_found_cache_entries", "gauge",
+		"Number of keys remembered as not found.")
+	writeSample(w, "simpleblog_not_found_cache_entries", "", notFoundEntries)
+	writeHeader(w, "simpleblog_not_found_cache_hits_total", "counter",
+		"Lookups answered with a remembered not found result.")
+	writeSample(w, "simpleblog_not_found_cache_hits_total", "", notFoundHits)
+
+	posts, tagCount := 0, 0
+	globalData.RLock()
+	if tags := globalData.tags; tags != nil {
+		for _, post := range tags.Post {
+			if _, _, ok := post.ArchiveMonth(); ok {
+				posts++
+			}
+		}
+		tagCount = len(tags.Tag)
+	}
+	globalData.RUnlock()
+
+	writeHeader(w, "simpleblog_posts", "gauge", "Number of posts.")
+	writeSample(w, "simpleblog_posts", "", posts)
+	writeHeader(w, "simpleblog_tags", "gauge", "Number of distinct tags.")
+	writeSample(w, "simpleblog_tags", "", tagCount)
+}
+
+func metricsHandler(globalData *GlobalData, w http.ResponseWriter,
+	r *http.Request, urlParams map[string]string) {
+
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	w.Header().Set("Cache-Control", "no-cache")
+	buf := bufio.NewWriter(w)
+	globalData.metrics.WriteMetrics(buf, globalData)
+	buf.Flush()
+}
@@ -0,0 +1,80 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"regexp"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestMetricsHandler(t *testing.T) {
+	_, globalData, cleanup := setupSiteTest(t, "metrics")
+	defer cleanup()
+
+	globalData.metrics.ObserveRequest(RoutePost, http.StatusOK, 3*time.Millisecond)
+	globalData.metrics.ObserveRequest(RoutePost, http.StatusOK, 2*time.Second)
+	globalData.metrics.ObserveRequest(RouteTag, http.StatusNotFound, time.Millisecond)
+	globalData.metrics.ObserveRender(RoutePost, 20*time.Millisecond)
+	globalData.metrics.CountFileEvent("post")
+	globalData.tags = NewTags(config.TagsPath, config.PostsDir)
+
+	w := httptest.NewRecorder()
+	r, _ := http.NewRequest("GET", "/metrics", nil)
+	metricsHandler(globalData, w, r, nil)
+	if contentType := w.Header().Get("Content-Type"); contentType != "text/plain; version=0.0.4" {
+		t.Errorf("Expected the Prometheus text format, saw %s", contentType)
+	}
+	body := w.Body.String()
+
+	for _, line := range []string{
+		"# TYPE simpleblog_http_requests_total counter",
+		`simpleblog_http_requests_total{route="post",status="200"} 2`,
+		`simpleblog_http_requests_total{route="tag",status="404"} 1`,
+		"# TYPE simpleblog_http_request_duration_seconds histogram",
+		`simpleblog_http_request_duration_seconds_bucket{route="post",status="200",le="0.0025"} 0`,
+		`simpleblog_http_request_duration_seconds_bucket{route="post",status="200",le="0.005"} 1`,
+		`simpleblog_http_request_duration_seconds_bucket{route="post",status="200",le="2.5"} 2`,
+		`simpleblog_http_request_duration_seconds_bucket{route="post",status="200",le="+Inf"} 2`,
+		`simpleblog_http_request_duration_seconds_sum{route="post",status="200"} 2.003`,
+		`simpleblog_http_request_duration_seconds_count{route="post",status="200"} 2`,
+		`simpleblog_render_duration_seconds_count{route="post"} 1`,
+		`simpleblog_fswatcher_events_total{type="post"} 1`,
+		`simpleblog_cache_hits_total{level="disk"} 0`,
+		`simpleblog_route_cache_misses_total{route="index"} 0`,
+		"simpleblog_not_found_cache_entries 0",
+		"simpleblog_posts 4",
+	} {
+		if !strings.Contains(body, "\n"+line+"\n") {
+			t.Errorf("Expected line %s", line)
+		}
+	}
+
+	// Every line is a comment or a sample, and each metric's samples follow its TYPE.
+	sample := regexp.MustCompile(`^([a-z_]+)(\{[^}]*\})? [0-9.e+-]+$`)
+	typed := map[string]bool{}
+	for _, line := range strings.Split(strings.TrimSuffix(body, "\n"), "\n") {
+		if strings.HasPrefix(line, "# TYPE ") {
+			typed[strings.Fields(line)[2]] = true
+			continue
+		} else if strings.HasPrefix(line, "# HELP ") {
+			continue
+		}
+
+		match := sample.FindStringSubmatch(line)
+		if match == nil {
+			t.Errorf("Malformed line %q", line)
+			continue
+		}
+		name := match[1]
+		for _, suffix := range []string{"_bucket", "_sum", "_count"} {
+			if base := strings.TrimSuffix(name, suffix); base != name && typed[base] {
+				name = base
+			}
+		}
+		if !typed[name] {
+			t.Errorf("Sample %s has no TYPE line before it", match[1])
+		}
+	}
+}
@@ -0,0 +1,632 @@
+package main
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/dimfeld/glog"
+	"mime"
+	"mime/multipart"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Route type for Micropub requests.
+const RouteMicropub = "micropub"
+
+// Scopes that can be granted to Micropub tokens.
+const (
+	micropubCreate = "create"
+	micropubUpdate = "update"
+	micropubDelete = "delete"
+	micropubMedia  = "media"
+)
+
+// errMicropubRequest is returned for requests that can't be carried out. The message is
+// sent to the client.
+type errMicropubRequest string
+
+func (e errMicropubRequest) Error() string {
+	return string(e)
+}
+
+// Micropub lets Micropub clients create, update, and delete posts, and upload images.
+// Clients authenticate with bearer tokens from config.MicropubTokens.
+type Micropub struct {
+	// Scopes granted to each token.
+	tokens map[string][]string
+	// Held while choosing a new post's file name and writing it.
+	lock sync.Mutex
+}
+
+func NewMicropub() (*Micropub, error) {
+	if len(config.MicropubTokens) == 0 {
+		return nil, errors.New("no MicropubTokens are configured")
+	}
+
+	tokens := make(map[string][]string)
+	for token, scopes := range config.MicropubTokens {
+		if len(token) < 20 {
+			return nil, errors.New("Micropub tokens must be at least 20 characters long")
+		}
+		tokens[token] = strings.Fields(scopes)
+	}
+	return &Micropub{tokens: tokens}, nil
+}
+
+// micropubError sends an error response in the format from the Micropub specification.
+func micropubError(w http.ResponseWriter, status int, code, description string) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(map[string]string{"error": code, "error_description": description})
+}
+
+// authorize checks the request's token, which comes from the Authorization header or the
+// access_token form field. If the token doesn't have one of the scopes, it sends an error
+// and returns false. With no scopes, any valid token is accepted.
+func (m *Micropub) authorize(w http.ResponseWriter, r *http.Request, scopes ...string) bool {
+	token := r.Header.Get("Authorization")
+	if len(token) > 7 && strings.EqualFold(token[:7], "Bearer ") {
+		token = strings.TrimSpace(token[7:])
+	} else {
+		token = r.PostFormValue("access_token")
+	}
+	if token == "" {
+		micropubError(w, http.StatusUnauthorized, "unauthorized", "An access token is required.")
+		return false
+	}
+
+	var granted []string
+	found := false
+	for candidate, candidateScopes := range m.tokens {
+		if subtle.ConstantTimeCompare([]byte(candidate), []byte(token)) == 1 {
+			granted = candidateScopes
+			found = true
+		}
+	}
+	if !found {
+		micropubError(w, http.StatusForbidden, "forbidden", "The access token is not valid.")
+		return false
+	}
+
+	if len(scopes) == 0 {
+		return true
+	}
+	for _, scope := range scopes {
+		for _, g := range granted {
+			if g == scope {
+				return true
+			}
+		}
+	}
+	micropubError(w, http.StatusForbidden, "insufficient_scope",
+		"The access token does not allow "+strings.Join(scopes, " or ")+".")
+	return false
+}
+
+// micropubRequest is a create, update, or delete request, parsed from a form or JSON.
+// Every property is a list of values, which are strings, or objects for structured
+// values such as {"html": "..."}.
+type micropubRequest struct {
+	Action     string                   `json:"action"`
+	URL        string                   `json:"url"`
+	Type       []string                 `json:"type"`
+	Properties map[string][]interface{} `json:"properties"`
+	Replace    map[string][]interface{} `json:"replace"`
+	Add        map[string][]interface{} `json:"add"`
+	// Either a list of property names, or property values to remove.
+	Delete interface{} `json:"delete"`
+	// Photos uploaded with a multipart form. They are saved once the post is known to be
+	// valid.
+	uploads []*multipart.FileHeader
+}
+
+// micropubValue returns the text of a property value, which is a string or an object
+// with an html or value field.
+func micropubValue(value interface{}) string {
+	switch v := value.(type) {
+	case string:
+		return v
+	case map[string]interface{}:
+		for _, key := range []string{"html", "value"} {
+			if s, ok := v[key].(string); ok {
+				return s
+			}
+		}
+	}
+	return ""
+}
+
+// micropubFirst returns the text of a property's first value.
+func micropubFirst(values []interface{}) string {
+	if len(values) == 0 {
+		return ""
+	}
+	return micropubValue(values[0])
+}
+
+// micropubTags returns the categories that can be tags. Categories that are URLs, such as
+// people tagged in a post, are skipped.
+func micropubTags(values []interface{}) []string {
+	tags := []string{}
+	for _, value := range values {
+		tag := strings.Join(strings.Fields(micropubValue(value)), " ")
+		if tag != "" && !strings.Contains(tag, "://") && !strings.Contains(tag, ",") {
+			tags = append(tags, tag)
+		}
+	}
+	return tags
+}
+
+// micropubTitle makes a title from the start of a note, for posts without a name.
+func micropubTitle(content string) string {
+	words := strings.Fields(content)
+	title := ""
+	for i, word := range words {
+		if i != 0 && len(title)+len(word) >= 60 {
+			return title + "..."
+		}
+		title = strings.TrimSpace(title + " " + word)
+	}
+	if runes := []rune(title); len(runes) > 60 {
+		return string(runes[:60]) + "..."
+	}
+	return title
+}
+
+// micropubPhotos returns the Markdown for the photo property, which holds URLs, or objects
+// with the URL in value and alt text in alt.
+func micropubPhotos(values []interface{}) string {
+	markdown := ""
+	for _, value := range values {
+		alt := ""
+		if v, ok := value.(map[string]interface{}); ok {
+			alt, _ = v["alt"].(string)
+		}
+		if url := micropubValue(value); url != "" {
+			alt = strings.NewReplacer("[", "", "]", "").Replace(alt)
+			url = strings.NewReplacer(" ", "%20", "(", "%28", ")", "%29").Replace(url)
+			markdown += fmt.Sprintf("\n\n![%s](%s)", alt, url)
+		}
+	}
+	return markdown
+}
+
+// setProperty changes a field of the editor form to a property's values. Properties that
+// posts can't hold return an error.
+func setProperty(form *EditorForm, name string, values []interface{}) error {
+	switch name {
+	case "name":
+		form.Title = micropubFirst(values)
+	case "content":
+		form.Content = micropubFirst(values)
+	case "category":
+		form.Tags = strings.Join(micropubTags(values), ", ")
+	case "bookmark-of":
+		form.Link = micropubFirst(values)
+	case "published":
+		published, err := time.Parse(time.RFC3339, micropubFirst(values))
+		if err != nil {
+			return errMicropubRequest("published must be an RFC 3339 date.")
+		}
+		form.Date = published.Format(PostTimeFormat)
+	default:
+		return errMicropubRequest("Posts can't have the property " + name + ".")
+	}
+	return nil
+}
+
+// createForm returns the editor form for a new post. Properties that posts can't hold are
+// ignored, since clients send many that only apply to other kinds of sites.
+func createForm(req *micropubRequest, now time.Time) (*EditorForm, error) {
+	form := &EditorForm{Date: now.Format(PostTimeFormat)}
+	for name, values := range req.Properties {
+		switch name {
+		case "mp-slug":
+			form.Slug = micropubFirst(values)
+		case "name", "content", "category", "bookmark-of", "published":
+			if err := setProperty(form, name, values); err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	if strings.TrimSpace(form.Title) == "" {
+		form.Title = micropubTitle(form.Content)
+	}
+	photos := micropubPhotos(req.Properties["photo"])
+	if form.Title == "" && (photos != "" || len(req.uploads) != 0) {
+		form.Title = "Photo"
+	}
+	form.Content = strings.TrimLeft(form.Content+photos, "\n")
+	return form, nil
+}
+
+// updateForm applies the changes in an update request to the editor form for a post.
+func updateForm(form *EditorForm, req *micropubRequest) error {
+	for name, values := range req.Replace {
+		if err := setProperty(form, name, values); err != nil {
+			return err
+		}
+	}
+
+	for name, values := range req.Add {
+		switch name {
+		case "category":
+			tags := form.Tags
+			for _, tag := range micropubTags(values) {
+				if tags != "" {
+					tags += ", "
+				}
+				tags += tag
+			}
+			form.Tags = tags
+		case "photo":
+			form.Content += micropubPhotos(values)
+		default:
+			if err := setProperty(form, name, values); err != nil {
+				return err
+			}
+		}
+	}
+
+	switch del := req.Delete.(type) {
+	case nil:
+	case []interface{}:
+		for _, value := range del {
+			switch name, _ := value.(string); name {
+			case "category":
+				form.Tags = ""
+			case "bookmark-of":
+				form.Link = ""
+			default:
+				return errMicropubRequest("The property " + name + " can't be deleted.")
+			}
+		}
+	case map[string]interface{}:
+		for name, values := range del {
+			list, ok := values.([]interface{})
+			if name != "category" || !ok {
+				return errMicropubRequest("Only category values can be deleted.")
+			}
+			remove := map[string]bool{}
+			for _, tag := range micropubTags(list) {
+				remove[strings.ToLower(tag)] = true
+			}
+			tags := []string{}
+			for _, tag := range strings.Split(form.Tags, ",") {
+				if tag = strings.TrimSpace(tag); tag != "" && !remove[strings.ToLower(tag)] {
+					tags = append(tags, tag)
+				}
+			}
+			form.Tags = strings.Join(tags, ", ")
+		}
+	default:
+		return errMicropubRequest("delete must be a list of properties or an object of values.")
+	}
+	return nil
+}
+
+// parseMicropubRequest reads a create, update, or delete request from a form or JSON.
+// Photos uploaded with a multipart form are kept in uploads, but not saved.
+func parseMicropubRequest(r *http.Request) (*micropubRequest, error) {
+	mediaType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	req := &micropubRequest{}
+
+	if mediaType == "application/json" {
+		if err := json.NewDecoder(r.Body).Decode(req); err != nil {
+			return nil, errMicropubRequest("Invalid JSON.")
+		}
+		if req.Action == "" && (len(req.Type) != 1 || req.Type[0] != "h-entry") {
+			return nil, errMicropubRequest("Only h-entry posts can be created.")
+		}
+		return req, nil
+	}
+
+	if err := r.ParseMultipartForm(1024 * 1024); err != nil && err != http.ErrNotMultipart {
+		return nil, errMicropubRequest("Invalid form.")
+	}
+
+	req.Action = r.PostFormValue("action")
+	req.URL = r.PostFormValue("url")
+	if req.Action == "" && r.PostFormValue("h") != "entry" {
+		return nil, errMicropubRequest("Only h=entry posts can be created.")
+	}
+
+	req.Properties = make(map[string][]interface{})
+	for name, values := range r.PostForm {
+		switch name {
+		case "access_token", "h", "action", "url":
+			continue
+		}
+		name = strings.TrimSuffix(name, "[]")
+		for _, value := range values {
+			req.Properties[name] = append(req.Properties[name], value)
+		}
+	}
+
+	if r.MultipartForm != nil {
+		for _, field := range []string{"photo", "photo[]"} {
+			req.uploads = append(req.uploads, r.MultipartForm.File[field]...)
+		}
+	}
+
+	return req, nil
+}
+
+// saveUploads saves the photos uploaded with a request, and returns their URLs.
+func saveUploads(uploads []*multipart.FileHeader) ([]interface{}, error) {
+	urls := []interface{}{}
+	for _, header := range uploads {
+		file, err := header.Open()
+		if err != nil {
+			return nil, err
+		}
+		url, err := saveImageUpload(file, header.Filename, time.Now())
+		file.Close()
+		if err == errUnsupportedImage {
+			return nil, errMicropubRequest(err.Error())
+		} else if err != nil {
+			return nil, err
+		}
+		glog.Infoln("Micropub uploaded", url)
+		urls = append(urls, siteURL()+url)
+	}
+	return urls, nil
+}
+
+// micropubPostKey returns the key of the post at a URL on this site.
+func micropubPostKey(url string) (string, error) {
+	key, ok := postKeyFromURL(url)
+	if !ok {
+		return "", errMicropubRequest("The url is not a post on this site.")
+	}
+	return key, nil
+}
+
+// create writes a new post, and returns its key. If the post's file name is taken, a
+// number is added to it, since clients can't choose another. Uploaded photos are saved
+// after the post is checked, so a request that fails leaves nothing behind.
+func (m *Micropub) create(req *micropubRequest) (string, error) {
+	form, err := createForm(req, siteTime(time.Now()))
+	if err != nil {
+		return "", err
+	}
+	post, problems := form.post()
+	if len(problems) != 0 {
+		return "", errMicropubRequest(strings.Join(problems, " "))
+	}
+	base, err := form.newKey(post.Timestamp)
+	if err != nil {
+		return "", errMicropubRequest(err.Error())
+	}
+
+	if len(req.uploads) != 0 {
+		urls, err := saveUploads(req.uploads)
+		if err != nil {
+			return "", err
+		}
+		post.Content = []byte(strings.TrimLeft(string(post.Content)+micropubPhotos(urls), "\n"))
+	}
+
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	key := base
+	for i := 2; ; i++ {
+		if _, err := os.Stat(postSourcePath(key)); os.IsNotExist(err) {
+			break
+		}
+		key = fmt.Sprintf("%s-%d", base, i)
+	}
+
+	post.SourcePath = postSourcePath(key)
+	return key, savePost(post)
+}
+
+// update changes an existing post. Its file stays where it is.
+func (m *Micropub) update(req *micropubRequest) error {
+	key, err := micropubPostKey(req.URL)
+	if err != nil {
+		return err
+	}
+
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	post, err := NewPost(postSourcePath(key), true)
+	if err != nil {
+		return err
+	}
+
+	form := &EditorForm{
+		Title:    post.Title,
+		Date:     post.Timestamp.Format(PostTimeFormat),
+		Tags:     strings.Join(post.Tags, ", "),
+		Link:     post.Link,
+		Timezone: post.Timezone,
+		Content:  string(post.Content),
+	}
+	if err := updateForm(form, req); err != nil {
+		return err
+	}
+
+	updated, problems := form.post()
+	if len(problems) != 0 {
+		return errMicropubRequest(strings.Join(problems, " "))
+	}
+	updated.SourcePath = post.SourcePath
+	updated.Changes = post.Changes
+	return savePost(updated)
+}
+
+func micropubHandler(globalData *GlobalData, w http.ResponseWriter,
+	r *http.Request, urlParams map[string]string) {
+
+	limit := int64(10 * 1024 * 1024)
+	if upload := int64(config.ImageUploadMaxSize) + 4096; upload > limit {
+		limit = upload
+	}
+	r.Body = http.MaxBytesReader(w, r.Body, limit)
+
+	m := globalData.micropub
+	defer func() {
+		if r.MultipartForm != nil {
+			r.MultipartForm.RemoveAll()
+		}
+	}()
+	mediaType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	bearer := strings.HasPrefix(strings.ToLower(r.Header.Get("Authorization")), "bearer ")
+	if !bearer && (mediaType == "multipart/form-data" || mediaType == "application/x-www-form-urlencoded") {
+		// Without an Authorization header the token is in the form, so parse it first.
+		// Otherwise uploads are only read once the token has been checked.
+		r.ParseMultipartForm(1024 * 1024)
+	}
+	if !m.authorize(w, r) {
+		return
+	}
+
+	req, err := parseMicropubRequest(r)
+	if err == nil {
+		scope := req.Action
+		if scope == "" {
+			scope = micropubCreate
+		}
+		if scope != micropubCreate && scope != micropubUpdate && scope != micropubDelete {
+			micropubError(w, http.StatusBadRequest, "invalid_request", "Unsupported action "+scope+".")
+			return
+		}
+		if !m.authorize(w, r, scope) {
+			return
+		}
+	}
+
+	var key string
+	if err == nil {
+		switch req.Action {
+		case "":
+			key, err = m.create(req)
+		case micropubUpdate:
+			err = m.update(req)
+		case micropubDelete:
+			if key, err = micropubPostKey(req.URL); err == nil {
+				err = os.Remove(postSourcePath(key))
+			}
+		}
+	}
+
+	if e, ok := err.(errMicropubRequest); ok {
+		micropubError(w, http.StatusBadRequest, "invalid_request", string(e))
+		return
+	} else if err != nil {
+		handleError(w, r, err)
+		return
+	}
+
+	switch req.Action {
+	case "":
+		glog.Infoln("Micropub created", postSourcePath(key))
+		w.Header().Set("Location", siteURL()+publicURL(key))
+		w.WriteHeader(http.StatusCreated)
+	case micropubUpdate:
+		glog.Infoln("Micropub updated", req.URL)
+		w.WriteHeader(http.StatusNoContent)
+	case micropubDelete:
+		glog.Infoln("Micropub deleted", postSourcePath(key))
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
+
+// micropubQueryHandler answers the q=config, q=source, q=category, and q=syndicate-to
+// queries.
+func micropubQueryHandler(globalData *GlobalData, w http.ResponseWriter,
+	r *http.Request, urlParams map[string]string) {
+
+	if !globalData.micropub.authorize(w, r) {
+		return
+	}
+
+	switch q := r.FormValue("q"); q {
+	case "config":
+		sendJSON(w, r, map[string]interface{}{
+			"media-endpoint": siteURL() + "/micropub/media",
+			"syndicate-to":   []string{},
+			"q":              []string{"config", "source", "category", "syndicate-to"},
+		})
+
+	case "syndicate-to":
+		sendJSON(w, r, map[string][]string{"syndicate-to": {}})
+
+	case "category":
+		sendJSON(w, r, map[string][]string{"categories": tagNames()})
+
+	case "source":
+		key, err := micropubPostKey(r.FormValue("url"))
+		if err != nil {
+			micropubError(w, http.StatusBadRequest, "invalid_request", err.Error())
+			return
+		}
+		post, err := NewPost(postSourcePath(key), true)
+		if err != nil {
+			handleError(w, r, err)
+			return
+		}
+
+		tags := post.Tags
+		if tags == nil {
+			tags = []string{}
+		}
+		properties := map[string][]string{
+			"name":      {post.Title},
+			"content":   {string(post.Content)},
+			"published": {post.Timestamp.Format(time.RFC3339)},
+			"category":  tags,
+		}
+		if post.Link != "" {
+			properties["bookmark-of"] = []string{post.Link}
+		}
+		sendJSON(w, r, map[string]interface{}{"type": []string{"h-entry"}, "properties": properties})
+
+	default:
+		micropubError(w, http.StatusBadRequest, "invalid_request", "Unsupported query "+q+".")
+	}
+}
+
+// micropubMediaHandler stores an image from the file field of a multipart form, and
+// returns its URL in the Location header.
+func micropubMediaHandler(globalData *GlobalData, w http.ResponseWriter,
+	r *http.Request, urlParams map[string]string) {
+
+	r.Body = http.MaxBytesReader(w, r.Body, int64(config.ImageUploadMaxSize)+4096)
+	if !globalData.micropub.authorize(w, r, micropubMedia, micropubCreate) {
+		return
+	}
+	if err := r.ParseMultipartForm(1024 * 1024); err != nil {
+		micropubError(w, http.StatusBadRequest, "invalid_request", "The upload must be a multipart form.")
+		return
+	}
+	defer r.MultipartForm.RemoveAll()
+
+	file, header, err := r.FormFile("file")
+	if err != nil {
+		micropubError(w, http.StatusBadRequest, "invalid_request", "The file field is missing.")
+		return
+	}
+	defer file.Close()
+
+	url, err := saveImageUpload(file, header.Filename, time.Now())
+	if err == errUnsupportedImage {
+		micropubError(w, http.StatusUnsupportedMediaType, "invalid_request", err.Error())
+		return
+	} else if err != nil {
+		handleError(w, r, err)
+		return
+	}
+
+	glog.Infoln("Micropub uploaded", url)
+	w.Header().Set("Location", siteURL()+url)
+	w.WriteHeader(http.StatusCreated)
+}
@@ -0,0 +1,275 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+const (
+	micropubToken    = "full-access-token-0123456789"
+	micropubTokenNew = "create-only-token-0123456789"
+)
+
+func setupMicropubTest(t *testing.T) (*GlobalData, func()) {
+	dir, globalData, cleanup := setupSiteTest(t, "micropub")
+	config.PostsDir = filepath.Join(dir, "posts")
+	config.DataDir = filepath.Join(dir, "data")
+	config.ImageUploadMaxSize = 1024 * 1024
+	config.MicropubTokens = map[string]string{
+		micropubToken:    "create update delete media",
+		micropubTokenNew: "create",
+	}
+	os.MkdirAll(config.PostsDir, 0755)
+
+	micropub, err := NewMicropub()
+	if err != nil {
+		cleanup()
+		t.Fatal(err)
+	}
+	globalData.micropub = micropub
+	return globalData, cleanup
+}
+
+func TestMicropub(t *testing.T) {
+	globalData, cleanup := setupMicropubTest(t)
+	defer cleanup()
+
+	request := func(handler simpleBlogHandler, method, target, token, contentType string,
+		body io.Reader) *httptest.ResponseRecorder {
+
+		r, _ := http.NewRequest(method, target, body)
+		if token != "" {
+			r.Header.Set("Authorization", "Bearer "+token)
+		}
+		if contentType != "" {
+			r.Header.Set("Content-Type", contentType)
+		}
+		w := httptest.NewRecorder()
+		handler(globalData, w, r, nil)
+		return w
+	}
+	postForm := func(token string, form url.Values) *httptest.ResponseRecorder {
+		return request(micropubHandler, "POST", "/micropub", token, "application/x-www-form-urlencoded",
+			strings.NewReader(form.Encode()))
+	}
+	postJSON := func(token string, body interface{}) *httptest.ResponseRecorder {
+		data, _ := json.Marshal(body)
+		return request(micropubHandler, "POST", "/micropub", token, "application/json", bytes.NewReader(data))
+	}
+	readPost := func(key string) *Post {
+		post, err := NewPost(postSourcePath(key), true)
+		if err != nil {
+			t.Fatalf("Could not read %s: %s", key, err)
+		}
+		return post
+	}
+
+	create := url.Values{"h": {"entry"}, "name": {"Hello World"}, "content": {"Hello from my phone"},
+		"category[]": {"phones", "go"}, "published": {"2014-05-14T23:14:00-05:00"}}
+	if w := postForm("", create); w.Code != http.StatusUnauthorized {
+		t.Errorf("Expected 401 without a token, saw %d", w.Code)
+	}
+	if w := postForm("wrong-token-0123456789", create); w.Code != http.StatusForbidden {
+		t.Errorf("Expected 403 for an unknown token, saw %d", w.Code)
+	}
+
+	w := postForm(micropubTokenNew, create)
+	if w.Code != http.StatusCreated || w.Header().Get("Location") != "http://example.com/2014/05/hello-world" {
+		t.Fatalf("Expected the new post's URL, saw %d %s %s", w.Code, w.Header().Get("Location"), w.Body.String())
+	}
+	post := readPost("2014/05/hello-world")
+	if post.Title != "Hello World" || string(post.Content) != "Hello from my phone" ||
+		len(post.Tags) != 2 || post.Tags[0] != "Phones" {
+		t.Errorf("Created post is wrong: %+v", post)
+	}
+
+	// The token in the form works too, and a taken name gets a number.
+	create.Set("access_token", micropubTokenNew)
+	if w := postForm("", create); w.Header().Get("Location") != "http://example.com/2014/05/hello-world-2" {
+		t.Errorf("Expected a numbered name for a taken slug, saw %d %s", w.Code, w.Header().Get("Location"))
+	}
+
+	// A JSON note without a name gets its title from the content.
+	w = postJSON(micropubToken, map[string]interface{}{
+		"type": []string{"h-entry"},
+		"properties": map[string]interface{}{
+			"content":   []interface{}{map[string]string{"html": "<p>Just a <em>short</em> note</p>"}},
+			"photo":     []interface{}{map[string]string{"value": "https://example.com/a.jpg", "alt": "A [photo]"}},
+			"published": []string{"2014-06-01T09:00:00Z"},
+			"mp-slug":   []string{"my-note"},
+		},
+	})
+	if w.Code != http.StatusCreated || w.Header().Get("Location") != "http://example.com/2014/06/my-note" {
+		t.Fatalf("Expected the JSON post to be created, saw %d %s", w.Code, w.Body.String())
+	}
+	note := readPost("2014/06/my-note")
+	if note.Title != "<p>Just a <em>short</em> note</p>" ||
+		!strings.HasSuffix(string(note.Content), "\n\n![A photo](https://example.com/a.jpg)") {
+		t.Errorf("JSON post is wrong: %q %q", note.Title, note.Content)
+	}
+
+	if w := postJSON(micropubToken, map[string]interface{}{"type": []string{"h-entry"},
+		"properties": map[string]interface{}{"published": []string{"yesterday"}, "name": []string{"x"}}}); w.Code != http.StatusBadRequest {
+		t.Errorf("Expected 400 for an invalid date, saw %d", w.Code)
+	}
+
+	// Updates.
+	postURL := "http://example.com/2014/05/hello-world"
+	if w := postJSON(micropubTokenNew, map[string]interface{}{"action": "update", "url": postURL,
+		"replace": map[string][]string{"content": {"x"}}}); w.Code != http.StatusForbidden {
+		t.Errorf("Expected 403 updating without the update scope, saw %d", w.Code)
+	}
+	w = postJSON(micropubToken, map[string]interface{}{
+		"action":  "update",
+		"url":     postURL,
+		"replace": map[string][]string{"content": {"Edited"}},
+		"add":     map[string][]string{"category": {"mobile"}},
+		"delete":  map[string][]string{"category": {"go"}},
+	})
+	if w.Code != http.StatusNoContent {
+		t.Fatalf("Expected 204 for an update, saw %d %s", w.Code, w.Body.String())
+	}
+	post = readPost("2014/05/hello-world")
+	if string(post.Content) != "Edited" || post.Title != "Hello World" || len(post.Tags) != 2 ||
+		post.Tags[0] != "Phones" || post.Tags[1] != "Mobile" {
+		t.Errorf("Updated post is wrong: %+v", post)
+	}
+	if w := postJSON(micropubToken, map[string]interface{}{"action": "update", "url": postURL,
+		"replace": map[string][]string{"syndication": {"x"}}}); w.Code != http.StatusBadRequest {
+		t.Errorf("Expected 400 replacing an unsupported property, saw %d", w.Code)
+	}
+	if w := postJSON(micropubToken, map[string]interface{}{"action": "update",
+		"url": "http://elsewhere.example.com/2014/05/hello-world"}); w.Code != http.StatusBadRequest {
+		t.Errorf("Expected 400 updating a post on another site, saw %d", w.Code)
+	}
+
+	// Queries.
+	w = request(micropubQueryHandler, "GET", "/micropub?q=source&url="+url.QueryEscape(postURL),
+		micropubTokenNew, "", nil)
+	source := struct {
+		Properties map[string][]string
+	}{}
+	json.Unmarshal(w.Body.Bytes(), &source)
+	if w.Code != http.StatusOK || source.Properties["name"][0] != "Hello World" ||
+		source.Properties["published"][0] != "2014-05-14T23:14:00-05:00" {
+		t.Errorf("Expected the post's source, saw %d %s", w.Code, w.Body.String())
+	}
+	w = request(micropubQueryHandler, "GET", "/micropub?q=config", micropubToken, "", nil)
+	if w.Code != http.StatusOK || !strings.Contains(w.Body.String(), `"http://example.com/micropub/media"`) {
+		t.Errorf("Expected the media endpoint in the config, saw %d %s", w.Code, w.Body.String())
+	}
+
+	// Deletes.
+	if w := postForm(micropubTokenNew, url.Values{"action": {"delete"}, "url": {postURL}}); w.Code != http.StatusForbidden {
+		t.Errorf("Expected 403 deleting without the delete scope, saw %d", w.Code)
+	}
+	if w := postForm(micropubToken, url.Values{"action": {"delete"}, "url": {postURL}}); w.Code != http.StatusNoContent {
+		t.Errorf("Expected 204 for a delete, saw %d %s", w.Code, w.Body.String())
+	}
+	if _, err := os.Stat(postSourcePath("2014/05/hello-world")); !os.IsNotExist(err) {
+		t.Error("Post was not deleted")
+	}
+}
+
+func TestMicropubMedia(t *testing.T) {
+	globalData, cleanup := setupMicropubTest(t)
+	defer cleanup()
+
+	png := []byte("\x89PNG\r\n\x1a\n" + strings.Repeat("\x00", 32))
+	upload := func(handler simpleBlogHandler, target, field, name string, data []byte,
+		fields map[string]string) *httptest.ResponseRecorder {
+
+		body := &bytes.Buffer{}
+		mw := multipart.NewWriter(body)
+		for key, value := range fields {
+			mw.WriteField(key, value)
+		}
+		part, _ := mw.CreateFormFile(field, name)
+		part.Write(data)
+		mw.Close()
+
+		r, _ := http.NewRequest("POST", target, body)
+		r.Header.Set("Content-Type", mw.FormDataContentType())
+		r.Header.Set("Authorization", "Bearer "+micropubTokenNew)
+		w := httptest.NewRecorder()
+		handler(globalData, w, r, nil)
+		return w
+	}
+
+	w := upload(micropubMediaHandler, "/micropub/media", "file", "Photo.png", png, nil)
+	location := w.Header().Get("Location")
+	if w.Code != http.StatusCreated || !strings.HasPrefix(location, "http://example.com/images/") ||
+		!strings.HasSuffix(location, "/photo.png") {
+		t.Fatalf("Expected the image's URL, saw %d %s", w.Code, location)
+	}
+	imagePath := filepath.Join(config.DataDir, filepath.FromSlash(strings.TrimPrefix(location, "http://example.com/")))
+	if _, err := os.Stat(imagePath); err != nil {
+		t.Error("Uploaded image was not saved:", err)
+	}
+
+	if w := upload(micropubMediaHandler, "/micropub/media", "file", "x.png", []byte("<svg></svg>"), nil); w.Code != http.StatusUnsupportedMediaType {
+		t.Errorf("Expected 415 for a file that isn't an image, saw %d", w.Code)
+	}
+
+	// Photos can also be sent with the post itself.
+	w = upload(micropubHandler, "/micropub", "photo", "Cat.png", png,
+		map[string]string{"h": "entry", "content": "My cat", "published": "2014-05-14T23:14:00-05:00"})
+	if w.Code != http.StatusCreated {
+		t.Fatalf("Expected the post to be created, saw %d %s", w.Code, w.Body.String())
+	}
+	post, err := NewPost(postSourcePath("2014/05/my-cat"), true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(string(post.Content), "](http://example.com/images/") {
+		t.Errorf("Expected the photo in the post, saw %q", post.Content)
+	}
+
+	// Photos sent with a request that is refused are not saved.
+	images := func() int {
+		count := 0
+		filepath.Walk(filepath.Join(config.DataDir, "images"), func(path string, info os.FileInfo, err error) error {
+			if err == nil && !info.IsDir() {
+				count++
+			}
+			return nil
+		})
+		return count
+	}
+	saved := images()
+	w = upload(micropubHandler, "/micropub", "photo", "Dog.png", png,
+		map[string]string{"action": "delete", "url": "http://example.com/2014/05/my-cat"})
+	if w.Code != http.StatusForbidden {
+		t.Errorf("Expected 403 for a token without the delete scope, saw %d", w.Code)
+	}
+	w = upload(micropubHandler, "/micropub", "photo", "Dog.png", png,
+		map[string]string{"h": "entry", "content": "My dog", "published": "yesterday"})
+	if w.Code != http.StatusBadRequest {
+		t.Errorf("Expected 400 for an invalid post, saw %d", w.Code)
+	}
+	// Uploads with a token that isn't valid are refused before the form is read.
+	body := &bytes.Buffer{}
+	mw := multipart.NewWriter(body)
+	mw.WriteField("h", "entry")
+	mw.Close()
+	r, _ := http.NewRequest("POST", "/micropub", body)
+	r.Header.Set("Content-Type", mw.FormDataContentType())
+	r.Header.Set("Authorization", "Bearer not-a-token")
+	w = httptest.NewRecorder()
+	micropubHandler(globalData, w, r, nil)
+	if w.Code != http.StatusForbidden || r.MultipartForm != nil {
+		t.Errorf("Expected 403 without parsing the form, saw %d with form %v", w.Code, r.MultipartForm)
+	}
+	if count := images(); count != saved {
+		t.Errorf("Expected %d saved images after the refused requests, saw %d", saved, count)
+	}
+}
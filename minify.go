@@ -0,0 +1,144 @@
+package main
+
+import (
+	"bytes"
+	"github.com/dimfeld/glog"
+	"github.com/dimfeld/gocache"
+	"github.com/tdewolff/minify/v2"
+	"github.com/tdewolff/minify/v2/css"
+	"github.com/tdewolff/minify/v2/html"
+	"github.com/tdewolff/minify/v2/js"
+	"github.com/tdewolff/minify/v2/svg"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// Media types to minify, by file extension.
+var minifyTypes = map[string]string{
+	".css":  "text/css",
+	".js":   "application/javascript",
+	".svg":  "image/svg+xml",
+	".html": "text/html",
+}
+
+var minifier = newMinifier()
+
+func newMinifier() *minify.M {
+	m := minify.New()
+	m.AddFunc("text/css", css.Minify)
+	m.AddFunc("application/javascript", js.Minify)
+	m.AddFunc("image/svg+xml", svg.Minify)
+	m.AddFunc("text/html", html.Minify)
+	return m
+}
+
+// minifyData minifies data according to the extension of name. Data of other types,
+// or that fails to minify, is returned unchanged.
+func minifyData(name string, data []byte) []byte {
+	mediaType, ok := minifyTypes[strings.ToLower(path.Ext(name))]
+	if !ok {
+		return data
+	}
+
+	minified, err := minifier.Bytes(mediaType, data)
+	if err != nil {
+		glog.Errorf("Could not minify %s: %s", name, err)
+		return data
+	}
+	return minified
+}
+
+// bundleSeparator returns the text placed between the files of a bundle.
+func bundleSeparator(name string) []byte {
+	if path.Ext(name) == ".js" {
+		// Guard against a file that ends without a semicolon.
+		return []byte(";\n")
+	}
+	return []byte("\n")
+}
+
+// bundleSourcePaths returns the file paths of a bundle's sources.
+func bundleSourcePaths(sources []string) []string {
+	paths := make([]string, len(sources))
+	for i, source := range sources {
+		paths[i] = filepath.Join(config.DataDir, "assets", filepath.FromSlash(source))
+	}
+	return paths
+}
+
+// bundleCacheKey returns the cache key for the current version of a bundle. The key includes
+// the bundle's fingerprint, so a changed source results in a new key rather than serving the
+// stale bundle. The file system watcher keeps the fingerprints up to date, so no files are
+// read here. ok is false if a source is missing.
+func bundleCacheKey(name string) (key string, ok bool) {
+	fingerprint, ok := assetManifest.Fingerprint(name)
+	if !ok {
+		return "", false
+	}
+	return path.Join("bundles", fingerprint, name), true
+}
+
+// bundleKeysWithSource returns the current cache keys of the bundles that include an asset,
+// by bundle name.
+func bundleKeysWithSource(source string) map[string]string {
+	keys := make(map[string]string)
+	for name, sources := range config.Bundles {
+		for _, s := range sources {
+			if s != source {
+				continue
+			}
+			if key, ok := bundleCacheKey(name); ok {
+				keys[name] = key
+			}
+			break
+		}
+	}
+	return keys
+}
+
+// BundleFiller builds a bundle by concatenating its sources, minifying each one
+// if MinifyAssets is set.
+type BundleFiller struct {
+	name        string
+	sources     []string
+	canCompress bool
+}
+
+func (b BundleFiller) Fill(cacheObj gocache.Cache, key string) (gocache.Object, error) {
+	buf := &bytes.Buffer{}
+	modTime := time.Time{}
+	for i, sourcePath := range bundleSourcePaths(b.sources) {
+		stat, err := os.Stat(sourcePath)
+		if err != nil {
+			return gocache.Object{}, err
+		}
+		if stat.ModTime().After(modTime) {
+			modTime = stat.ModTime()
+		}
+
+		data, err := ioutil.ReadFile(sourcePath)
+		if err != nil {
+			return gocache.Object{}, err
+		}
+		if config.MinifyAssets {
+			data = minifyData(sourcePath, data)
+		}
+
+		if i != 0 {
+			buf.Write(bundleSeparator(b.name))
+		}
+		buf.Write(data)
+	}
+
+	if b.canCompress {
+		return compressAndSetAll(cacheObj, key, buf.Bytes(), modTime)
+	}
+	obj := gocache.Object{Data: buf.Bytes(), ModTime: modTime}
+	cacheObj.Set(key, obj)
+	storeETag(key, obj)
+	return obj, nil
+}
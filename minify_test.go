@@ -0,0 +1,126 @@
+package main
+
+import (
+	"github.com/dimfeld/gocache"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestBundle(t *testing.T) {
+	dir, err := ioutil.TempDir("", "simpleblog-bundle")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	oldDataDir := config.DataDir
+	config.DataDir = dir
+	config.Bundles = map[string][]string{"all.js": {"a.js", "lib/b.js"}}
+	defer func() {
+		config.DataDir = oldDataDir
+		config.Bundles = nil
+	}()
+
+	os.MkdirAll(filepath.Join(dir, "assets", "lib"), 0755)
+	aPath := filepath.Join(dir, "assets", "a.js")
+	ioutil.WriteFile(aPath, []byte("var a = 1"), 0644)
+	ioutil.WriteFile(filepath.Join(dir, "assets", "lib", "b.js"), []byte("var b = 2;"), 0644)
+
+	manifest := NewAssetManifest(filepath.Join(dir, "assets"))
+	manifest.Scan()
+	oldManifest := assetManifest
+	assetManifest = manifest
+	defer func() { assetManifest = oldManifest }()
+
+	sources := config.Bundles["all.js"]
+	key, ok := bundleCacheKey("all.js")
+	if !ok {
+		t.Fatal("Bundle has no cache key")
+	}
+	if keys := bundleKeysWithSource("lib/b.js"); keys["all.js"] != key || len(keys) != 1 {
+		t.Errorf("Expected the bundle's key for its source, saw %v", keys)
+	}
+
+	cache := gocache.NewMemoryCache(1<<20, 1<<20)
+	obj, err := cache.Get(key, BundleFiller{"all.js", sources, false})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(obj.Data) != "var a = 1;\nvar b = 2;" {
+		t.Errorf("Unexpected bundle contents %q", obj.Data)
+	}
+
+	// The key only changes once the manifest sees the change to the source.
+	ioutil.WriteFile(aPath, []byte("var a = 3;"), 0644)
+	if newKey, _ := bundleCacheKey("all.js"); newKey != key {
+		t.Errorf("Bundle cache key changed before the manifest was updated, saw %s", newKey)
+	}
+	manifest.Update("a.js")
+	if newKey, ok := bundleCacheKey("all.js"); !ok || newKey == key {
+		t.Errorf("Bundle cache key did not change with its source, saw %s", newKey)
+	}
+
+	os.Remove(aPath)
+	manifest.Update("a.js")
+	if _, ok := bundleCacheKey("all.js"); ok {
+		t.Error("Bundle with a missing source still has a cache key")
+	}
+}
+
+func TestBundleAssetEvent(t *testing.T) {
+	dir, globalData, cleanup := setupSiteTest(t, "bundle-event")
+	defer cleanup()
+	config.DataDir = dir
+	config.Bundles = map[string][]string{"all.js": {"a.js"}, "other.js": {"b.js"}}
+	os.MkdirAll(filepath.Join(dir, "assets"), 0755)
+	aPath := filepath.Join(dir, "assets", "a.js")
+	ioutil.WriteFile(aPath, []byte("var a = 1;"), 0644)
+	ioutil.WriteFile(filepath.Join(dir, "assets", "b.js"), []byte("var b = 1;"), 0644)
+
+	oldManifest := assetManifest
+	assetManifest = NewAssetManifest(filepath.Join(dir, "assets"))
+	assetManifest.Scan()
+	defer func() { assetManifest = oldManifest }()
+
+	key, _ := bundleCacheKey("all.js")
+	otherKey, _ := bundleCacheKey("other.js")
+	for _, k := range append(cacheKeyVariants(key), otherKey) {
+		globalData.cache.Set(k, gocache.Object{Data: []byte(k), ModTime: time.Now()})
+	}
+
+	ioutil.WriteFile(aPath, []byte("var a = 2;"), 0644)
+	handleAssetEvent(globalData, "assets/a.js")
+	for _, k := range cacheKeyVariants(key) {
+		if isCached(globalData.cache, k) {
+			t.Errorf("Old bundle %s is still cached", k)
+		}
+	}
+	if !isCached(globalData.cache, otherKey) {
+		t.Error("Bundle without the changed source was removed")
+	}
+}
+
+func TestMinifyHTMLPages(t *testing.T) {
+	_, globalData, cleanup := setupSiteTest(t, "minify-html")
+	defer cleanup()
+	config.MinifyHTML = true
+
+	get := func(handler simpleBlogHandler) string {
+		r, _ := http.NewRequest("GET", "/", nil)
+		w := httptest.NewRecorder()
+		handler(globalData, w, r, map[string]string{})
+		return w.Body.String()
+	}
+	if body := get(indexHandler); strings.Contains(body, "\n") {
+		t.Errorf("Expected the index page to be minified, saw %.60q", body)
+	}
+	if body := get(atomHandler); !strings.Contains(body, "\n") || !strings.Contains(body, "</feed>") {
+		t.Errorf("Expected the feed not to be minified, saw %.60q", body)
+	}
+}
@@ -0,0 +1,761 @@
+package main
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"github.com/dimfeld/glog"
+	"html/template"
+	"io/ioutil"
+	"mime"
+	"mime/multipart"
+	"net/http"
+	"net/mail"
+	"net/textproto"
+	"net/url"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"syscall"
+	texttemplate "text/template"
+	"time"
+)
+
+// Route type for the newsletter pages.
+const RouteNewsletter = "newsletter"
+
+var sendDigestFlag = flag.Bool("send-digest", false,
+	"Email the newsletter digest of new posts to subscribers, then exit")
+
+var ErrSubscriberNotFound = errors.New("Subscriber not found")
+
+// Subscriptions that aren't confirmed within this time are forgotten.
+const pendingSubscriberTTL = 7 * 24 * time.Hour
+
+// Subscriber is someone who receives the newsletter.
+type Subscriber struct {
+	Email string
+	// Sent in the confirmation email. Empty once the subscription is confirmed.
+	ConfirmToken string `json:",omitempty"`
+	// Sent in every digest, to let the subscriber leave.
+	UnsubscribeToken string
+	Created          time.Time
+	// Zero until the subscription is confirmed.
+	Confirmed time.Time
+	// Posts up to this time have been sent to the subscriber.
+	LastDigest time.Time
+}
+
+func newToken() (string, error) {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
+
+func tokenEqual(a, b string) bool {
+	return a != "" && subtle.ConstantTimeCompare([]byte(a), []byte(b)) == 1
+}
+
+// SubscriberStore keeps the subscribers in a JSON file. Running with -send-digest changes
+// the file while the server is running, so it is locked and read again for every change
+// and lookup.
+type SubscriberStore struct {
+	lock        sync.Mutex
+	filePath    string
+	subscribers []*Subscriber
+}
+
+func NewSubscriberStore(filePath string) (*SubscriberStore, error) {
+	if err := os.MkdirAll(filepath.Dir(filePath), 0755); err != nil {
+		return nil, err
+	}
+
+	store := &SubscriberStore{filePath: filePath, subscribers: []*Subscriber{}}
+	fileLock, err := store.load()
+	if err != nil {
+		return nil, err
+	}
+	fileLock.Close()
+	return store, nil
+}
+
+// lockFile takes an exclusive lock on a file shared with other processes, creating it if
+// needed. Closing the file releases the lock.
+func lockFile(filePath string) (*os.File, error) {
+	f, err := os.OpenFile(filePath, os.O_RDWR|os.O_CREATE, 0600)
+	if err != nil {
+		return nil, err
+	}
+	if err := syscall.Flock(int(f.Fd()), syscall.LOCK_EX); err != nil {
+		f.Close()
+		return nil, err
+	}
+	return f, nil
+}
+
+// load locks the subscribers file and reads it. The lock must be held. Closing the
+// returned file releases the file lock.
+func (ss *SubscriberStore) load() (*os.File, error) {
+	fileLock, err := lockFile(ss.filePath + ".lock")
+	if err != nil {
+		return nil, err
+	}
+
+	subscribers := []*Subscriber{}
+	data, err := ioutil.ReadFile(ss.filePath)
+	if err == nil {
+		err = json.Unmarshal(data, &subscribers)
+	} else if os.IsNotExist(err) {
+		err = nil
+	}
+	if err != nil {
+		fileLock.Close()
+		return nil, err
+	}
+	ss.subscribers = subscribers
+	return fileLock, nil
+}
+
+// reload reads the subscribers file again for a lookup. If it can't be read, the
+// subscribers read before are used. The lock must be held.
+func (ss *SubscriberStore) reload() {
+	fileLock, err := ss.load()
+	if err != nil {
+		glog.Errorln("Could not read subscribers:", err)
+		return
+	}
+	fileLock.Close()
+}
+
+// save writes the subscribers, replacing the file atomically. The lock and the file lock
+// must be held.
+func (ss *SubscriberStore) save(subscribers []*Subscriber) error {
+	data, err := json.MarshalIndent(subscribers, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	tempPath := ss.filePath + ".tmp"
+	if err := ioutil.WriteFile(tempPath, data, 0600); err != nil {
+		return err
+	}
+	if err := os.Rename(tempPath, ss.filePath); err != nil {
+		return err
+	}
+
+	ss.subscribers = subscribers
+	return nil
+}
+
+// update reads the subscribers, applies fn to them, and saves the result.
+func (ss *SubscriberStore) update(fn func([]*Subscriber) ([]*Subscriber, error)) error {
+	ss.lock.Lock()
+	defer ss.lock.Unlock()
+	fileLock, err := ss.load()
+	if err != nil {
+		return err
+	}
+	defer fileLock.Close()
+
+	subscribers := make([]*Subscriber, len(ss.subscribers))
+	copy(subscribers, ss.subscribers)
+	subscribers, err = fn(subscribers)
+	if err != nil {
+		return err
+	}
+	return ss.save(subscribers)
+}
+
+// Subscribe adds a pending subscription for an email address, and returns the subscriber.
+// If the address is already confirmed, nothing changes and sendConfirmation is false.
+func (ss *SubscriberStore) Subscribe(email string) (subscriber Subscriber, sendConfirmation bool, err error) {
+	now := time.Now()
+	err = ss.update(func(subscribers []*Subscriber) ([]*Subscriber, error) {
+		kept := subscribers[:0]
+		for _, s := range subscribers {
+			if !s.Confirmed.IsZero() || now.Sub(s.Created) < pendingSubscriberTTL {
+				kept = append(kept, s)
+			}
+		}
+
+		for i, s := range kept {
+			if !strings.EqualFold(s.Email, email) {
+				continue
+			}
+			if !s.Confirmed.IsZero() {
+				subscriber = *s
+				return kept, nil
+			}
+			// Send the same link again, but give it the full time to be used.
+			updated := *s
+			updated.Created = now
+			kept[i] = &updated
+			subscriber, sendConfirmation = updated, true
+			return kept, nil
+		}
+
+		confirmToken, err := newToken()
+		if err != nil {
+			return nil, err
+		}
+		unsubscribeToken, err := newToken()
+		if err != nil {
+			return nil, err
+		}
+		subscriber = Subscriber{
+			Email:            email,
+			ConfirmToken:     confirmToken,
+			UnsubscribeToken: unsubscribeToken,
+			Created:          now,
+		}
+		sendConfirmation = true
+		return append(kept, &subscriber), nil
+	})
+	return subscriber, sendConfirmation, err
+}
+
+// Confirm completes the subscription with the given confirmation token.
+func (ss *SubscriberStore) Confirm(token string) (subscriber Subscriber, err error) {
+	err = ss.update(func(subscribers []*Subscriber) ([]*Subscriber, error) {
+		for i, s := range subscribers {
+			if tokenEqual(token, s.ConfirmToken) && time.Since(s.Created) < pendingSubscriberTTL {
+				subscriber = *s
+				subscriber.ConfirmToken = ""
+				subscriber.Confirmed = time.Now()
+				subscribers[i] = &subscriber
+				return subscribers, nil
+			}
+		}
+		return nil, ErrSubscriberNotFound
+	})
+	return subscriber, err
+}
+
+// FindPending returns the unconfirmed subscriber with the given confirmation token.
+func (ss *SubscriberStore) FindPending(confirmToken string) (Subscriber, error) {
+	ss.lock.Lock()
+	defer ss.lock.Unlock()
+	ss.reload()
+	for _, s := range ss.subscribers {
+		if tokenEqual(confirmToken, s.ConfirmToken) && time.Since(s.Created) < pendingSubscriberTTL {
+			return *s, nil
+		}
+	}
+	return Subscriber{}, ErrSubscriberNotFound
+}
+
+// Find returns the subscriber with the given unsubscribe token.
+func (ss *SubscriberStore) Find(unsubscribeToken string) (Subscriber, error) {
+	ss.lock.Lock()
+	defer ss.lock.Unlock()
+	ss.reload()
+	for _, s := range ss.subscribers {
+		if tokenEqual(unsubscribeToken, s.UnsubscribeToken) {
+			return *s, nil
+		}
+	}
+	return Subscriber{}, ErrSubscriberNotFound
+}
+
+// Unsubscribe removes the subscriber with the given unsubscribe token.
+func (ss *SubscriberStore) Unsubscribe(unsubscribeToken string) error {
+	return ss.update(func(subscribers []*Subscriber) ([]*Subscriber, error) {
+		for i, s := range subscribers {
+			if tokenEqual(unsubscribeToken, s.UnsubscribeToken) {
+				return append(subscribers[:i], subscribers[i+1:]...), nil
+			}
+		}
+		return nil, ErrSubscriberNotFound
+	})
+}
+
+// Confirmed returns the subscribers who have confirmed their subscriptions.
+func (ss *SubscriberStore) Confirmed() []Subscriber {
+	ss.lock.Lock()
+	defer ss.lock.Unlock()
+	ss.reload()
+
+	confirmed := []Subscriber{}
+	for _, s := range ss.subscribers {
+		if !s.Confirmed.IsZero() {
+			confirmed = append(confirmed, *s)
+		}
+	}
+	return confirmed
+}
+
+// MarkSent records that posts up to the given time have been sent to a subscriber.
+func (ss *SubscriberStore) MarkSent(unsubscribeToken string, until time.Time) error {
+	return ss.update(func(subscribers []*Subscriber) ([]*Subscriber, error) {
+		for i, s := range subscribers {
+			if tokenEqual(unsubscribeToken, s.UnsubscribeToken) {
+				updated := *s
+				updated.LastDigest = until
+				subscribers[i] = &updated
+				return subscribers, nil
+			}
+		}
+		return nil, ErrSubscriberNotFound
+	})
+}
+
+// postsBetween returns the posts published after since and no later than until,
+// newest first.
+func postsBetween(since, until time.Time) PostList {
+	posts := PostList{}
+	// Posts are stored by the month in their own time zone, so look at the months on
+	// either side too.
+	month := time.Date(since.Year(), since.Month(), 1, 0, 0, 0, 0, time.UTC).AddDate(0, -1, 0)
+	for !month.After(until.AddDate(0, 1, 0)) {
+		postPath := PostPath(config.PostsDir, month.Year(), month.Month())
+		monthPosts, err := LoadPostsFromPath(postPath, true)
+		if err != nil && !os.IsNotExist(err) {
+			// The posts that could be parsed are still returned.
+			glog.Errorf("Error loading posts from %s for the digest: %s", postPath, err)
+		}
+		for _, post := range monthPosts {
+			if post.Timestamp.After(since) && !post.Timestamp.After(until) {
+				posts = append(posts, post)
+			}
+		}
+		month = month.AddDate(0, 1, 0)
+	}
+
+	sort.Sort(sort.Reverse(posts))
+	return posts
+}
+
+// DigestData is the template data for the digest email.
+type DigestData struct {
+	Posts          PostList
+	Domain         string
+	SiteURL        string
+	UnsubscribeURL string
+	Since          time.Time
+}
+
+// NewsletterPage is the template data for the newsletter pages.
+type NewsletterPage struct {
+	// One of "subscribe", "pending", "confirm", "confirmed", "unsubscribe", "unsubscribed",
+	// or "invalid".
+	State    string
+	Action   string
+	Email    string
+	Honeypot string
+	Errors   []string
+	// True if the confirmation email could not be sent.
+	Failed bool
+}
+
+// Newsletter manages subscriptions and emails digests of new posts.
+type Newsletter struct {
+	// Held while sending a digest, so two are never sent at once.
+	lock      sync.Mutex
+	store     *SubscriberStore
+	mailer    *Mailer
+	limiter   *RateLimiter
+	statePath string
+}
+
+// digestState records when the scheduler last sent a digest.
+type digestState struct {
+	LastRun time.Time
+}
+
+// NewNewsletter sets up the newsletter from the configuration.
+func NewNewsletter() (*Newsletter, error) {
+	store, err := NewSubscriberStore(filepath.Join(config.NewsletterDir, "subscribers.json"))
+	if err != nil {
+		return nil, err
+	}
+	mailer, err := NewMailer()
+	if err != nil {
+		return nil, err
+	}
+
+	nl := &Newsletter{
+		store:     store,
+		mailer:    mailer,
+		statePath: filepath.Join(config.NewsletterDir, "digest.json"),
+	}
+	if config.NewsletterRateLimit > 0 {
+		nl.limiter = NewRateLimiter(float64(config.NewsletterRateLimit)/3600, config.NewsletterRateLimit)
+	}
+	return nl, nil
+}
+
+func (nl *Newsletter) unsubscribeURL(s Subscriber) string {
+	return siteURL() + "/newsletter/unsubscribe?token=" + url.QueryEscape(s.UnsubscribeToken)
+}
+
+// messageHeader writes the headers common to every newsletter email.
+func messageHeader(buf *bytes.Buffer, to, subject string) {
+	fmt.Fprintf(buf, "From: %s\r\n", config.NewsletterFrom)
+	fmt.Fprintf(buf, "To: %s\r\n", to)
+	fmt.Fprintf(buf, "Subject: %s\r\n", mime.QEncoding.Encode("utf-8", headerValue(subject)))
+	fmt.Fprintf(buf, "Date: %s\r\n", time.Now().Format(time.RFC1123Z))
+	buf.WriteString("MIME-Version: 1.0\r\n")
+}
+
+// SendConfirmation emails the link that confirms a subscription.
+func (nl *Newsletter) SendConfirmation(s Subscriber) error {
+	buf := &bytes.Buffer{}
+	messageHeader(buf, s.Email, "Confirm your subscription to "+config.Domain)
+	buf.WriteString("Content-Type: text/plain; charset=utf-8\r\n\r\n")
+	fmt.Fprintf(buf, "Please confirm that you want to receive new posts from %s by email:\r\n\r\n", config.Domain)
+	fmt.Fprintf(buf, "%s/newsletter/confirm?token=%s\r\n\r\n", siteURL(), url.QueryEscape(s.ConfirmToken))
+	buf.WriteString("If you didn't ask for this, you can ignore this email.\r\n")
+	return nl.mailer.Send(config.NewsletterFrom, []string{s.Email}, buf.Bytes())
+}
+
+// Attributes holding a site-relative URL, up to the slash that starts the path.
+var siteRelativeURLRegexp = regexp.MustCompile(`(?i)(\s(?:src|href)\s*=\s*["']?)/([^/])`)
+
+// AbsoluteURLs makes the site-relative URLs in links and images absolute, so that they
+// work in an email. base is the URL of the site, with no trailing slash.
+func AbsoluteURLs(content template.HTML, base string) template.HTML {
+	replacement := "${1}" + strings.Replace(base, "$", "$$", -1) + "/${2}"
+	return template.HTML(siteRelativeURLRegexp.ReplaceAllString(string(content), replacement))
+}
+
+// composeDigest renders the digest for one subscriber as a message with HTML and plain
+// text parts.
+func (nl *Newsletter) composeDigest(templates *template.Template, textTemplate *texttemplate.Template,
+	s Subscriber, data DigestData) ([]byte, error) {
+
+	htmlPart := &bytes.Buffer{}
+	if err := templates.ExecuteTemplate(htmlPart, "digest.tmpl.html", data); err != nil {
+		return nil, err
+	}
+	textPart := &bytes.Buffer{}
+	if err := textTemplate.Execute(textPart, data); err != nil {
+		return nil, err
+	}
+
+	body := &bytes.Buffer{}
+	parts := multipart.NewWriter(body)
+	for _, part := range []struct {
+		contentType string
+		data        []byte
+	}{
+		// The last part is preferred, so the plain text goes first.
+		{"text/plain; charset=utf-8", textPart.Bytes()},
+		{"text/html; charset=utf-8", htmlPart.Bytes()},
+	} {
+		w, err := parts.CreatePart(textproto.MIMEHeader{
+			"Content-Type":              {part.contentType},
+			"Content-Transfer-Encoding": {"8bit"},
+		})
+		if err != nil {
+			return nil, err
+		}
+		w.Write(bytes.Replace(bytes.Replace(part.data, []byte("\r\n"), []byte("\n"), -1),
+			[]byte("\n"), []byte("\r\n"), -1))
+	}
+	parts.Close()
+
+	msg := &bytes.Buffer{}
+	subject := fmt.Sprintf("New posts on %s", config.Domain)
+	if len(data.Posts) == 1 {
+		subject = fmt.Sprintf("New post on %s: %s", config.Domain, data.Posts[0].Title)
+	}
+	messageHeader(msg, s.Email, subject)
+	fmt.Fprintf(msg, "List-Unsubscribe: <%s>\r\n", data.UnsubscribeURL)
+	msg.WriteString("List-Unsubscribe-Post: List-Unsubscribe=One-Click\r\n")
+	fmt.Fprintf(msg, "Content-Type: multipart/alternative; boundary=%s\r\n\r\n", parts.Boundary())
+	msg.Write(body.Bytes())
+	return msg.Bytes(), nil
+}
+
+// SendDigest emails each confirmed subscriber the posts published since the last digest
+// they received, up to now. Subscribers with nothing new are skipped, and subscribers whose
+// digest can't be sent get those posts in the next one. It returns the number of emails sent.
+// A file lock keeps the server and -send-digest from sending at the same time.
+func (nl *Newsletter) SendDigest(templates *template.Template, now time.Time) (int, error) {
+	nl.lock.Lock()
+	defer nl.lock.Unlock()
+	fileLock, err := lockFile(nl.statePath + ".lock")
+	if err != nil {
+		return 0, err
+	}
+	defer fileLock.Close()
+
+	textTemplate, err := texttemplate.New("digest.tmpl.txt").Funcs(texttemplate.FuncMap{
+		"HrefFromPostPath": HrefFromPostPath,
+		"FormatTime":       FormatTime,
+	}).ParseFiles(filepath.Join(config.DataDir, "templates", "digest.tmpl.txt"))
+	if err != nil {
+		return 0, err
+	}
+
+	// Most subscribers got their last digest at the same time, so share the post lists.
+	postsSince := make(map[time.Time]PostList)
+	sent := 0
+	var firstErr error
+	for _, s := range nl.store.Confirmed() {
+		since := s.LastDigest
+		if since.IsZero() {
+			since = s.Confirmed
+		}
+
+		posts, ok := postsSince[since]
+		if !ok {
+			posts = postsBetween(since, now)
+			postsSince[since] = posts
+		}
+		if len(posts) == 0 {
+			continue
+		}
+
+		data := DigestData{
+			Posts:          posts,
+			Domain:         config.Domain,
+			SiteURL:        siteURL(),
+			UnsubscribeURL: nl.unsubscribeURL(s),
+			Since:          since,
+		}
+		msg, err := nl.composeDigest(templates, textTemplate, s, data)
+		if err != nil {
+			return sent, err
+		}
+
+		if err := nl.mailer.Send(config.NewsletterFrom, []string{s.Email}, msg); err != nil {
+			glog.Errorf("Could not send digest to %s: %s", s.Email, err)
+			if firstErr == nil {
+				firstErr = err
+			}
+			continue
+		}
+		sent++
+		if err := nl.store.MarkSent(s.UnsubscribeToken, now); err != nil && err != ErrSubscriberNotFound {
+			return sent, err
+		}
+	}
+	return sent, firstErr
+}
+
+func (nl *Newsletter) loadState() digestState {
+	state := digestState{}
+	data, err := ioutil.ReadFile(nl.statePath)
+	if err == nil {
+		err = json.Unmarshal(data, &state)
+	}
+	if err != nil && !os.IsNotExist(err) {
+		glog.Errorln("Could not read digest state:", err)
+	}
+	return state
+}
+
+func (nl *Newsletter) saveState(state digestState) error {
+	data, err := json.Marshal(state)
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(nl.statePath, data, 0644)
+}
+
+// runDigestScheduler sends a digest every config.NewsletterInterval hours. The time of the
+// last digest is saved, so restarting doesn't change the schedule.
+func (nl *Newsletter) runDigestScheduler(globalData *GlobalData) {
+	interval := time.Duration(config.NewsletterInterval) * time.Hour
+	check := func(now time.Time) {
+		state := nl.loadState()
+		switch {
+		case state.LastRun.IsZero():
+			// Start the schedule from the first run.
+			state.LastRun = now
+		case now.Sub(state.LastRun) >= interval:
+			globalData.RLock()
+			templates := globalData.templates
+			globalData.RUnlock()
+
+			sent, err := nl.SendDigest(templates, now)
+			glog.Infof("Sent newsletter digest to %d subscribers", sent)
+			if err != nil {
+				glog.Errorln("Error sending newsletter digest:", err)
+			}
+			state.LastRun = now
+		default:
+			return
+		}
+
+		if err := nl.saveState(state); err != nil {
+			glog.Errorln("Could not save digest state:", err)
+		}
+	}
+
+	check(time.Now())
+	for now := range time.Tick(time.Minute) {
+		check(now)
+	}
+}
+
+// sendDigestCommand sends the digest immediately for the -send-digest flag, and returns
+// the exit code.
+func sendDigestCommand() int {
+	templates, err := createTemplates()
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "Error parsing templates:", err)
+		return 1
+	}
+	nl, err := NewNewsletter()
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "Could not set up newsletter:", err)
+		return 1
+	}
+
+	now := time.Now()
+	sent, err := nl.SendDigest(templates, now)
+	fmt.Printf("Sent newsletter digest to %d subscribers\n", sent)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "Error sending digest:", err)
+		return 1
+	}
+	if err := nl.saveState(digestState{LastRun: now}); err != nil {
+		fmt.Fprintln(os.Stderr, "Could not save digest state:", err)
+		return 1
+	}
+	return 0
+}
+
+func renderNewsletterPage(globalData *GlobalData, w http.ResponseWriter, r *http.Request,
+	page *NewsletterPage, status int) {
+
+	page.Action = "/newsletter"
+	page.Honeypot = honeypotField
+	renderDynamicPage(globalData, w, r, TemplateData{WindowTitle: "Newsletter", Newsletter: page}, status)
+}
+
+func newsletterFormHandler(globalData *GlobalData, w http.ResponseWriter,
+	r *http.Request, urlParams map[string]string) {
+
+	renderNewsletterPage(globalData, w, r, &NewsletterPage{State: "subscribe"}, http.StatusOK)
+}
+
+// newsletterSubscribeHandler starts a subscription. Whether or not the address is already
+// subscribed, the reader is told to check their email, so the page doesn't reveal who
+// the subscribers are.
+func newsletterSubscribeHandler(globalData *GlobalData, w http.ResponseWriter,
+	r *http.Request, urlParams map[string]string) {
+
+	r.Body = http.MaxBytesReader(w, r.Body, 4096)
+	if err := r.ParseForm(); err != nil {
+		http.Error(w, "Invalid form", http.StatusBadRequest)
+		return
+	}
+
+	page := &NewsletterPage{State: "subscribe", Email: strings.TrimSpace(r.PostFormValue("email"))}
+	if r.PostFormValue(honeypotField) != "" {
+		page.State = "pending"
+		renderNewsletterPage(globalData, w, r, page, http.StatusOK)
+		return
+	}
+
+	address, err := mail.ParseAddress(page.Email)
+	if err != nil || address.Address != page.Email || len(page.Email) > 254 {
+		page.Errors = []string{"Please enter a valid email address."}
+		renderNewsletterPage(globalData, w, r, page, http.StatusBadRequest)
+		return
+	}
+
+	nl := globalData.newsletter
+	client := globalData.proxies.ClientIP(r)
+	if nl.limiter != nil && !nl.limiter.Take(client) {
+		w.Header().Set("Retry-After", fmt.Sprintf("%.0f", nl.limiter.RetryAfter(client).Seconds()+1))
+		page.Errors = []string{"Too many subscription requests. Please try again later."}
+		renderNewsletterPage(globalData, w, r, page, http.StatusTooManyRequests)
+		return
+	}
+
+	subscriber, sendConfirmation, err := nl.store.Subscribe(page.Email)
+	if err != nil {
+		handleError(w, r, err)
+		return
+	}
+	if sendConfirmation {
+		if err := nl.SendConfirmation(subscriber); err != nil {
+			glog.Errorf("Could not send newsletter confirmation to %s: %s", page.Email, err)
+			page.Failed = true
+			renderNewsletterPage(globalData, w, r, page, http.StatusInternalServerError)
+			return
+		}
+	}
+
+	page.State = "pending"
+	renderNewsletterPage(globalData, w, r, page, http.StatusOK)
+}
+
+// newsletterConfirmFormHandler asks the reader to confirm their subscription, with a form
+// that posts back to the same URL, since mail scanners follow the link in the email too.
+func newsletterConfirmFormHandler(globalData *GlobalData, w http.ResponseWriter,
+	r *http.Request, urlParams map[string]string) {
+
+	subscriber, err := globalData.newsletter.store.FindPending(r.URL.Query().Get("token"))
+	if err != nil {
+		renderNewsletterPage(globalData, w, r, &NewsletterPage{State: "invalid"}, http.StatusNotFound)
+		return
+	}
+
+	page := &NewsletterPage{State: "confirm", Email: subscriber.Email}
+	renderNewsletterPage(globalData, w, r, page, http.StatusOK)
+}
+
+func newsletterConfirmHandler(globalData *GlobalData, w http.ResponseWriter,
+	r *http.Request, urlParams map[string]string) {
+
+	subscriber, err := globalData.newsletter.store.Confirm(r.URL.Query().Get("token"))
+	if err == ErrSubscriberNotFound {
+		renderNewsletterPage(globalData, w, r, &NewsletterPage{State: "invalid"}, http.StatusNotFound)
+		return
+	} else if err != nil {
+		handleError(w, r, err)
+		return
+	}
+
+	page := &NewsletterPage{State: "confirmed", Email: subscriber.Email}
+	renderNewsletterPage(globalData, w, r, page, http.StatusOK)
+}
+
+// newsletterUnsubscribeFormHandler asks the subscriber to confirm that they want to leave,
+// with a form that posts back to the same URL. Mail scanners follow the links in emails,
+// so a GET never unsubscribes anyone.
+func newsletterUnsubscribeFormHandler(globalData *GlobalData, w http.ResponseWriter,
+	r *http.Request, urlParams map[string]string) {
+
+	token := r.URL.Query().Get("token")
+	subscriber, err := globalData.newsletter.store.Find(token)
+	if err != nil {
+		renderNewsletterPage(globalData, w, r, &NewsletterPage{State: "invalid"}, http.StatusNotFound)
+		return
+	}
+
+	page := &NewsletterPage{State: "unsubscribe", Email: subscriber.Email}
+	renderNewsletterPage(globalData, w, r, page, http.StatusOK)
+}
+
+// newsletterUnsubscribeHandler removes a subscriber. This is also the target of one-click
+// unsubscribe requests from mail clients.
+func newsletterUnsubscribeHandler(globalData *GlobalData, w http.ResponseWriter,
+	r *http.Request, urlParams map[string]string) {
+
+	err := globalData.newsletter.store.Unsubscribe(r.URL.Query().Get("token"))
+	if err == ErrSubscriberNotFound {
+		renderNewsletterPage(globalData, w, r, &NewsletterPage{State: "invalid"}, http.StatusNotFound)
+		return
+	} else if err != nil {
+		handleError(w, r, err)
+		return
+	}
+
+	renderNewsletterPage(globalData, w, r, &NewsletterPage{State: "unsubscribed"}, http.StatusOK)
+}
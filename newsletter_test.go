@@ -0,0 +1,224 @@
+package main
+
+import (
+	"html/template"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+)
+
+func setupNewsletterTest(t *testing.T, smtpAddr string) (*GlobalData, func()) {
+	dir, globalData, cleanup := setupSiteTest(t, "newsletter")
+	config.SMTPAddr = smtpAddr
+	config.NewsletterDir = dir
+	config.NewsletterFrom = "blog@example.com"
+	config.NewsletterRateLimit = 0
+
+	newsletter, err := NewNewsletter()
+	if err != nil {
+		cleanup()
+		t.Fatal(err)
+	}
+	globalData.newsletter = newsletter
+	return globalData, cleanup
+}
+
+func TestSubscriberStore(t *testing.T) {
+	globalData, cleanup := setupNewsletterTest(t, "127.0.0.1:0")
+	defer cleanup()
+	store := globalData.newsletter.store
+
+	pending, send, err := store.Subscribe("alice@example.com")
+	if err != nil || !send || pending.ConfirmToken == "" {
+		t.Fatalf("Expected a pending subscription with a confirmation, saw %+v %v %v", pending, send, err)
+	}
+	if len(store.Confirmed()) != 0 {
+		t.Error("Subscriber was confirmed before following the link")
+	}
+
+	again, send, _ := store.Subscribe("Alice@example.com")
+	if !send || again.ConfirmToken != pending.ConfirmToken {
+		t.Error("Subscribing again did not resend the same confirmation")
+	}
+
+	if _, err := store.Confirm("wrong"); err != ErrSubscriberNotFound {
+		t.Errorf("Expected ErrSubscriberNotFound for a wrong token, saw %v", err)
+	}
+	confirmed, err := store.Confirm(pending.ConfirmToken)
+	if err != nil || confirmed.Confirmed.IsZero() {
+		t.Fatalf("Confirm failed: %v", err)
+	}
+	if _, err := store.Confirm(pending.ConfirmToken); err != ErrSubscriberNotFound {
+		t.Error("Confirmation token worked twice")
+	}
+	if _, send, _ := store.Subscribe("alice@example.com"); send {
+		t.Error("Subscribing a confirmed address sent another confirmation")
+	}
+
+	// The subscribers are saved, and survive a restart.
+	reloaded, err := NewSubscriberStore(store.filePath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if subscribers := reloaded.Confirmed(); len(subscribers) != 1 || subscribers[0].Email != "alice@example.com" {
+		t.Errorf("Expected alice after reloading, saw %+v", subscribers)
+	}
+
+	// Changes saved by another process, such as -send-digest, are seen and kept.
+	sentAt := time.Date(2014, 5, 1, 0, 0, 0, 0, time.UTC)
+	if err := reloaded.MarkSent(confirmed.UnsubscribeToken, sentAt); err != nil {
+		t.Fatal(err)
+	}
+	if subscribers := store.Confirmed(); len(subscribers) != 1 || !subscribers[0].LastDigest.Equal(sentAt) {
+		t.Errorf("Expected the digest sent by the other store, saw %+v", subscribers)
+	}
+	store.Subscribe("bob@example.com")
+	if subscribers := reloaded.Confirmed(); len(subscribers) != 1 || !subscribers[0].LastDigest.Equal(sentAt) {
+		t.Errorf("Subscribing overwrote the digest sent by the other store, saw %+v", subscribers)
+	}
+
+	if err := store.Unsubscribe(confirmed.UnsubscribeToken); err != nil {
+		t.Fatal(err)
+	}
+	if len(store.Confirmed()) != 0 {
+		t.Error("Subscriber remained after unsubscribing")
+	}
+	if err := store.Unsubscribe(confirmed.UnsubscribeToken); err != ErrSubscriberNotFound {
+		t.Errorf("Expected ErrSubscriberNotFound unsubscribing twice, saw %v", err)
+	}
+}
+
+func TestSendDigest(t *testing.T) {
+	server := newFakeSMTPServer(t)
+	defer server.Close()
+	globalData, cleanup := setupNewsletterTest(t, server.Addr())
+	defer cleanup()
+	nl := globalData.newsletter
+
+	pending, _, _ := nl.store.Subscribe("alice@example.com")
+	subscriber, _ := nl.store.Confirm(pending.ConfirmToken)
+	nl.store.MarkSent(subscriber.UnsubscribeToken, time.Date(2014, 5, 1, 0, 0, 0, 0, time.UTC))
+	// Never confirmed, so never sent anything.
+	nl.store.Subscribe("bob@example.com")
+
+	now := time.Date(2014, 5, 20, 0, 0, 0, 0, time.UTC)
+	sent, err := nl.SendDigest(globalData.templates, now)
+	if err != nil || sent != 1 {
+		t.Fatalf("Expected 1 digest, saw %d with error %v", sent, err)
+	}
+
+	messages := server.Messages()
+	if len(messages) != 1 {
+		t.Fatalf("Expected 1 message, saw %d", len(messages))
+	}
+	msg := messages[0]
+	for _, expected := range []string{
+		"To: alice@example.com\r\n",
+		"List-Unsubscribe: <http://example.com/newsletter/unsubscribe?token=" + subscriber.UnsubscribeToken + ">",
+		"Content-Type: multipart/alternative",
+		"Content-Type: text/plain",
+		"Content-Type: text/html",
+		"Second Post",
+		"http://example.com/2014/05/first-post",
+	} {
+		if !strings.Contains(msg, expected) {
+			t.Errorf("Expected digest to contain %q, saw\n%s", expected, msg)
+		}
+	}
+	if strings.Contains(msg, "April Showers") {
+		t.Error("Digest contained a post that was already sent")
+	}
+	if strings.Index(msg, "Second Post") > strings.Index(msg, "Test Post 1") {
+		t.Error("Digest posts are not newest first")
+	}
+
+	sent, err = nl.SendDigest(globalData.templates, now.Add(time.Hour))
+	if err != nil || sent != 0 {
+		t.Errorf("Expected no digest without new posts, saw %d with error %v", sent, err)
+	}
+}
+
+func TestAbsoluteURLs(t *testing.T) {
+	content := template.HTML(`<a href="/2014/05/first-post">A</a> <img src='/images/a.jpg'> ` +
+		`<a href="//cdn.example/x">B</a> <a href="http://other.example/">C</a> <p>/not/a/url</p>`)
+	expected := `<a href="https://example.com/2014/05/first-post">A</a> ` +
+		`<img src='https://example.com/images/a.jpg'> <a href="//cdn.example/x">B</a> ` +
+		`<a href="http://other.example/">C</a> <p>/not/a/url</p>`
+	if result := AbsoluteURLs(content, "https://example.com"); string(result) != expected {
+		t.Errorf("Expected %s, saw %s", expected, result)
+	}
+}
+
+func TestNewsletterHandlers(t *testing.T) {
+	server := newFakeSMTPServer(t)
+	defer server.Close()
+	globalData, cleanup := setupNewsletterTest(t, server.Addr())
+	defer cleanup()
+
+	request := func(method, target string, form url.Values,
+		handler simpleBlogHandler) *httptest.ResponseRecorder {
+
+		r, _ := http.NewRequest(method, target, strings.NewReader(form.Encode()))
+		r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		w := httptest.NewRecorder()
+		handler(globalData, w, r, nil)
+		return w
+	}
+
+	w := request("POST", "/newsletter", url.Values{"email": {"not an address"}}, newsletterSubscribeHandler)
+	if w.Code != http.StatusBadRequest {
+		t.Errorf("Expected 400 for an invalid address, saw %d", w.Code)
+	}
+
+	w = request("POST", "/newsletter", url.Values{"email": {"alice@example.com"}, honeypotField: {"x"}},
+		newsletterSubscribeHandler)
+	if w.Code != http.StatusOK || len(server.Messages()) != 0 {
+		t.Errorf("Expected the honeypot to be silently ignored, saw %d", w.Code)
+	}
+
+	w = request("POST", "/newsletter", url.Values{"email": {"alice@example.com"}}, newsletterSubscribeHandler)
+	if w.Code != http.StatusOK || !strings.Contains(w.Body.String(), "Check your email") {
+		t.Fatalf("Expected the check your email page, saw %d", w.Code)
+	}
+	messages := server.Messages()
+	if len(messages) != 1 {
+		t.Fatalf("Expected a confirmation email, saw %d messages", len(messages))
+	}
+	start := strings.Index(messages[0], "/newsletter/confirm?")
+	end := strings.Index(messages[0][start:], "\r\n")
+	confirmURL := messages[0][start : start+end]
+
+	// Following the link only shows a form, in case a mail scanner followed it.
+	w = request("GET", confirmURL, nil, newsletterConfirmFormHandler)
+	if w.Code != http.StatusOK || !strings.Contains(w.Body.String(), `<form method="post">`) ||
+		len(globalData.newsletter.store.Confirmed()) != 0 {
+		t.Fatalf("Expected GET to only show the confirmation form, saw %d", w.Code)
+	}
+	w = request("POST", confirmURL, nil, newsletterConfirmHandler)
+	if w.Code != http.StatusOK || !strings.Contains(w.Body.String(), "subscribed") {
+		t.Fatalf("Expected confirmation to succeed, saw %d", w.Code)
+	}
+	if w = request("GET", confirmURL, nil, newsletterConfirmFormHandler); w.Code != http.StatusNotFound {
+		t.Errorf("Expected 404 for a used confirmation link, saw %d", w.Code)
+	}
+	if w = request("POST", confirmURL, nil, newsletterConfirmHandler); w.Code != http.StatusNotFound {
+		t.Errorf("Expected 404 confirming twice, saw %d", w.Code)
+	}
+
+	unsubscribeURL := "/newsletter/unsubscribe?token=" +
+		globalData.newsletter.store.Confirmed()[0].UnsubscribeToken
+	w = request("GET", unsubscribeURL, nil, newsletterUnsubscribeFormHandler)
+	if w.Code != http.StatusOK || len(globalData.newsletter.store.Confirmed()) != 1 {
+		t.Errorf("Expected GET to only show the unsubscribe form, saw %d", w.Code)
+	}
+
+	// One-click unsubscribe from a mail client.
+	w = request("POST", unsubscribeURL, url.Values{"List-Unsubscribe": {"One-Click"}},
+		newsletterUnsubscribeHandler)
+	if w.Code != http.StatusOK || len(globalData.newsletter.store.Confirmed()) != 0 {
+		t.Errorf("Expected POST to unsubscribe, saw %d", w.Code)
+	}
+}
@@ -0,0 +1,110 @@
+package main
+
+import (
+	"github.com/dimfeld/gocache"
+	"os"
+	"sync"
+	"time"
+)
+
+// NotFoundCache remembers cache keys whose fill failed because the file did not exist,
+// so that repeated requests for them can be answered without looking on disk again.
+type NotFoundCache struct {
+	lock       sync.Mutex
+	ttl        time.Duration
+	maxEntries int
+	// Expiration time of each key.
+	entries map[string]time.Time
+	hits    uint64
+
+	// Replaced by tests.
+	now func() time.Time
+}
+
+func NewNotFoundCache(ttl time.Duration, maxEntries int) *NotFoundCache {
+	return &NotFoundCache{
+		ttl:        ttl,
+		maxEntries: maxEntries,
+		entries:    make(map[string]time.Time),
+		now:        time.Now,
+	}
+}
+
+// Add records that key was not found.
+func (nf *NotFoundCache) Add(key string) {
+	if nf.ttl <= 0 {
+		return
+	}
+
+	nf.lock.Lock()
+	defer nf.lock.Unlock()
+
+	now := nf.now()
+	if len(nf.entries) >= nf.maxEntries {
+		for k, expires := range nf.entries {
+			if !now.Before(expires) {
+				delete(nf.entries, k)
+			}
+		}
+		if len(nf.entries) >= nf.maxEntries {
+			// Still full, so just forget everything rather than tracking age order.
+			nf.entries = make(map[string]time.Time)
+		}
+	}
+	nf.entries[key] = now.Add(nf.ttl)
+}
+
+// Contains returns true if key was recently not found.
+func (nf *NotFoundCache) Contains(key string) bool {
+	nf.lock.Lock()
+	defer nf.lock.Unlock()
+
+	expires, ok := nf.entries[key]
+	if !ok {
+		return false
+	}
+	if !nf.now().Before(expires) {
+		delete(nf.entries, key)
+		return false
+	}
+	nf.hits++
+	return true
+}
+
+// Stats returns the number of keys remembered and the number of lookups answered from them.
+func (nf *NotFoundCache) Stats() (entries int, hits uint64) {
+	nf.lock.Lock()
+	defer nf.lock.Unlock()
+	return len(nf.entries), nf.hits
+}
+
+// Del forgets key, or every key if key is "*".
+func (nf *NotFoundCache) Del(key string) {
+	nf.lock.Lock()
+	defer nf.lock.Unlock()
+	if key == "*" {
+		nf.entries = make(map[string]time.Time)
+	} else {
+		delete(nf.entries, key)
+	}
+}
+
+// errCachedNotFound is returned for keys in the NotFoundCache. It satisfies os.IsNotExist.
+var errCachedNotFound = &os.PathError{Op: "lookup", Path: "cached not found", Err: os.ErrNotExist}
+
+// cacheGet looks up key in cache through the cache statistics, returning a not found error
+// without calling the filler if the key was recently not found.
+func (globalData *GlobalData) cacheGet(route string, cache gocache.Cache, key string,
+	filler gocache.Filler) (gocache.Object, error) {
+
+	baseKey := baseCacheKey(key)
+	if globalData.notFound.Contains(baseKey) {
+		return gocache.Object{}, errCachedNotFound
+	}
+
+	object, err := globalData.stats.Get(route, cache, key, filler)
+	if err != nil && os.IsNotExist(err) {
+		globalData.notFound.Add(baseKey)
+	}
+	return object, err
+}
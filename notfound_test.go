@@ -0,0 +1,98 @@
+package main
+
+import (
+	"github.com/dimfeld/gocache"
+	"os"
+	"testing"
+	"time"
+)
+
+type countingNotFoundFiller struct {
+	fills *int
+}
+
+func (f countingNotFoundFiller) Fill(cache gocache.Cache, key string) (gocache.Object, error) {
+	*f.fills++
+	return gocache.Object{}, os.ErrNotExist
+}
+
+func TestNotFoundCache(t *testing.T) {
+	now := time.Now()
+	nf := NewNotFoundCache(time.Minute, 2)
+	nf.now = func() time.Time { return now }
+
+	nf.Add("tags/missing")
+	if !nf.Contains("tags/missing") {
+		t.Fatal("Added key was not found")
+	}
+	if nf.Contains("tags/other") {
+		t.Error("Key that was never added was found")
+	}
+
+	now = now.Add(time.Minute)
+	if nf.Contains("tags/missing") {
+		t.Error("Expired key was found")
+	}
+
+	nf.Add("a")
+	nf.Add("b")
+	nf.Add("c")
+	if len(nf.entries) > 2 {
+		t.Errorf("Cache grew past its limit to %d entries", len(nf.entries))
+	}
+	if !nf.Contains("c") {
+		t.Error("Newest key was not kept")
+	}
+
+	nf.Del("c")
+	if nf.Contains("c") {
+		t.Error("Deleted key was found")
+	}
+	nf.Add("d")
+	nf.Del("*")
+	if nf.Contains("d") {
+		t.Error("Key was found after deleting everything")
+	}
+}
+
+func TestCacheGetNotFound(t *testing.T) {
+	globalData := &GlobalData{
+		notFound: NewNotFoundCache(time.Minute, 100),
+		stats:    NewCacheStats(nil, nil),
+	}
+	cache := gocache.NewMemoryCache(1024*1024, 1024)
+
+	fills := 0
+	filler := countingNotFoundFiller{&fills}
+	for i := 0; i < 3; i++ {
+		_, err := globalData.cacheGet(RouteTag, cache, "tags/missing#gz", filler)
+		if !os.IsNotExist(err) {
+			t.Fatalf("Expected not found error, saw %v", err)
+		}
+	}
+	if fills != 1 {
+		t.Errorf("Expected 1 fill for a missing key, saw %d", fills)
+	}
+
+	// The other encodings of the page share the not found result.
+	globalData.cacheGet(RouteTag, cache, "tags/missing", filler)
+	if fills != 1 {
+		t.Errorf("Uncompressed variant was filled after compressed variant was not found")
+	}
+
+	tagPost := &Post{Tags: []string{"new tag"}}
+	globalData.notFound.Add("tags/new+tag")
+	globalData.notFound.Add("archive/2014-05")
+	globalData.notFound.Add("2014/05/new-post.md")
+	globalData.notFound.Add("about")
+	clearNotFound(globalData, "2014/05/new-post.md", tagPost)
+	clearNotFound(globalData, "page/about.md", nil)
+	for _, key := range []string{"tags/new+tag", "archive/2014-05", "2014/05/new-post.md", "about"} {
+		if globalData.notFound.Contains(key) {
+			t.Errorf("Key %s was not cleared when its file appeared", key)
+		}
+	}
+	if !globalData.notFound.Contains("tags/missing") {
+		t.Error("Unrelated key was cleared")
+	}
+}
@@ -6,11 +6,13 @@ import (
 	"github.com/dimfeld/glog"
 	"github.com/dimfeld/gocache"
 	"html/template"
+	"net/http"
 	"net/url"
 	"os"
 	"path"
 	"path/filepath"
 	"sort"
+	"strconv"
 	"strings"
 	"time"
 )
@@ -18,11 +20,16 @@ import (
 type PageGenerator func(*GlobalData, map[string]string) (posts PostList, title string, err error)
 
 type PageSpec struct {
-	globalData     *GlobalData
+	globalData *GlobalData
+	// Route type used for the render metrics.
+	route          string
 	customPage     bool
 	customTemplate string
 	generator      PageGenerator
 	params         map[string]string
+	// Dependencies of the page beyond the posts, templates, and sidebar,
+	// which are added automatically.
+	dependencies []string
 }
 
 type ArchiveSpec time.Time
@@ -36,7 +43,33 @@ type TemplateData struct {
 	Tags        TagPopularity
 	Archives    ArchiveSpecList
 	Domain      string
-	globalData  *GlobalData
+	// Set on a post's page when comments are enabled.
+	Comments *PostComments
+	// Set on the page that confirms a comment.
+	CommentForm *CommentForm
+	// Set on a post's page when webmentions are enabled.
+	Webmentions []*Webmention
+	// Set on a post's page when PostsDir is a git working tree and the post has commits.
+	History *PostHistory
+	// URL that receives webmentions, if enabled.
+	WebmentionEndpoint string
+	// URL of the Micropub endpoint, if enabled.
+	MicropubEndpoint string
+	// Set on the contact page.
+	Contact *ContactForm
+	// Set on the newsletter pages.
+	Newsletter *NewsletterPage
+	globalData *GlobalData
+}
+
+// PostComments holds the comments shown on a post's page.
+type PostComments struct {
+	Threads []*CommentThread
+	// URL that new comments are posted to.
+	Action string
+	// True if new comments are held for moderation.
+	Moderated bool
+	Honeypot  string
 }
 
 func HrefFromPostPath(p string) template.HTML {
@@ -47,8 +80,21 @@ func HrefFromPostPath(p string) template.HTML {
 	return template.HTML("/" + relPath[:len(relPath)-3])
 }
 
-func FormatTime(timestamp time.Time) template.HTML {
-	return template.HTML(timestamp.Format("January 2, 2006 3:04PM"))
+// FormatTime shows a date and time in the site's language and time zone. The optional
+// zone is the name of a time zone to use instead, such as a post's Timezone.
+func FormatTime(timestamp time.Time, zone ...string) template.HTML {
+	return formatInZone(timestamp, siteLocale().timeLayout, zone)
+}
+
+// FormatDate is like FormatTime, without the time of day.
+func FormatDate(timestamp time.Time, zone ...string) template.HTML {
+	return formatInZone(timestamp, siteLocale().dateLayout, zone)
+}
+
+// FormatTimeLayout is like FormatTime, with a layout in the format taken by time.Format.
+// Month and day names in the layout are shown in the site's language.
+func FormatTimeLayout(layout string, timestamp time.Time, zone ...string) template.HTML {
+	return formatInZone(timestamp, layout, zone)
 }
 
 func AtomTime(timestamp time.Time) template.HTML {
@@ -77,11 +123,17 @@ func XMLEncoding() template.HTML {
 var templateFuncs = template.FuncMap{
 	"HrefFromPostPath": HrefFromPostPath,
 	"FormatTime":       FormatTime,
+	"FormatDate":       FormatDate,
+	"FormatTimeLayout": FormatTimeLayout,
 	"AtomTime":         AtomTime,
 	"AtomNow":          AtomNow,
 	"AtomFeedRef":      AtomFeedRef,
 	"AtomPostRef":      AtomPostRef,
 	"XMLEncoding":      XMLEncoding,
+	"AbsoluteURLs":     AbsoluteURLs,
+	"ContactURL":       ContactURL,
+	"asset":            AssetURL,
+	"nonce":            NoncePlaceholder,
 	"mod":              func(i, div int) int { return i % div },
 	"noescape":         func(s string) template.HTML { return template.HTML(s) },
 	// Open and closing double brace, for when these are needed in the template.
@@ -89,12 +141,30 @@ var templateFuncs = template.FuncMap{
 	"cdb": func() template.HTML { return template.HTML("}}") },
 }
 
+func templatesGlob() string {
+	return path.Join(config.DataDir, "templates/*.tmpl.html")
+}
+
 func createTemplates() (*template.Template, error) {
 	tem := template.New("main").Funcs(templateFuncs)
-	return tem.ParseGlob(path.Join(config.DataDir, "templates/*.tmpl.html"))
+	return tem.ParseGlob(templatesGlob())
+}
+
+// templatesModTime returns the modification time of the newest template file.
+func templatesModTime() time.Time {
+	newest := time.Time{}
+	files, _ := filepath.Glob(templatesGlob())
+	for _, file := range files {
+		stat, err := os.Stat(file)
+		if err == nil && stat.ModTime().After(newest) {
+			newest = stat.ModTime()
+		}
+	}
+	return newest
 }
 
 func (ps PageSpec) Fill(cacheObj gocache.Cache, key string) (gocache.Object, error) {
+	startTime := time.Now()
 	ps.globalData.RLock()
 	archive := ps.globalData.archive
 	ps.globalData.RUnlock()
@@ -132,6 +202,44 @@ func (ps PageSpec) Fill(cacheObj gocache.Cache, key string) (gocache.Object, err
 		templateData.Posts = posts
 	}
 
+	if ps.route == RoutePost && ps.globalData.comments != nil {
+		post := postKey(posts[0].SourcePath)
+		threads, err := ps.globalData.comments.Threads(post)
+		if err != nil {
+			glog.Errorf("Could not load comments for %s: %s", post, err)
+		}
+		templateData.Comments = &PostComments{
+			Threads:   threads,
+			Action:    "/" + post + "/comments",
+			Moderated: config.CommentsModeration,
+			Honeypot:  honeypotField,
+		}
+	}
+
+	if ps.route == RoutePost && ps.globalData.git != nil {
+		history, err := ps.globalData.git.History(posts[0].SourcePath)
+		if err != nil {
+			glog.Errorf("Could not load history for %s: %s", posts[0].SourcePath, err)
+		}
+		templateData.History = history
+	}
+
+	if config.EnableMicropub {
+		templateData.MicropubEndpoint = siteURL() + "/micropub"
+	}
+
+	if config.EnableWebmentions {
+		templateData.WebmentionEndpoint = siteURL() + "/webmention"
+		if ps.route == RoutePost {
+			post := postKey(posts[0].SourcePath)
+			mentions, err := ps.globalData.webmentions.store.Mentions(post)
+			if err != nil {
+				glog.Errorf("Could not load webmentions for %s: %s", post, err)
+			}
+			templateData.Webmentions = mentions
+		}
+	}
+
 	templateData.Archives = ps.globalData.archive
 	tags := NewTags(config.TagsPath, config.PostsDir)
 	templateData.Tags = tags.TagsByPopularity()
@@ -143,6 +251,7 @@ func (ps PageSpec) Fill(cacheObj gocache.Cache, key string) (gocache.Object, err
 	buf := &bytes.Buffer{}
 	ps.globalData.RLock()
 	templates := ps.globalData.templates
+	modTime := ps.globalData.templatesModTime
 	ps.globalData.RUnlock()
 
 	templateName := ps.customTemplate
@@ -150,13 +259,118 @@ func (ps PageSpec) Fill(cacheObj gocache.Cache, key string) (gocache.Object, err
 		templateName = "main.tmpl.html"
 	}
 	templates.ExecuteTemplate(buf, templateName, templateData)
+	ps.globalData.metrics.ObserveRender(ps.route, time.Since(startTime))
 
-	uncompressed, compressed, err := gocache.CompressAndSet(cacheObj, key, buf.Bytes(), time.Now())
-	if strings.HasSuffix(key, ".gz") {
-		return compressed, err
-	} else {
-		return uncompressed, err
+	ps.recordDependencies(key, templateName, posts)
+
+	// The page only changes when one of its posts or the templates change, so use the newest of
+	// those as the modification time instead of the render time.
+	for _, post := range posts {
+		stat, err := os.Stat(post.SourcePath)
+		if err == nil && stat.ModTime().After(modTime) {
+			modTime = stat.ModTime()
+		}
+	}
+	if modTime.IsZero() {
+		modTime = time.Now()
+	}
+
+	data := buf.Bytes()
+	// The feed's template is named .html too, but it renders XML, which the HTML minifier
+	// would corrupt.
+	if config.MinifyHTML && ps.route != RouteFeed {
+		data = minifyData(templateName, data)
+	}
+	if ps.route != RouteFeed {
+		storeInlineHashes(key, data)
 	}
+
+	if routeUsesNonce(ps.route) && key == baseCacheKey(key) {
+		// Each response gets its own nonce and is compressed as it's sent, so compressed
+		// variants would never be used.
+		object := gocache.Object{Data: data, ModTime: modTime}
+		if err := cacheObj.Set(key, object); err != nil {
+			return object, err
+		}
+		storeETag(key, object)
+		return object, nil
+	}
+	return compressAndSetAll(cacheObj, key, data, modTime)
+}
+
+// renderDynamicPage renders a page that depends on the request, such as a form with a
+// CSRF token, inside the main template. Unlike other pages it is never cached.
+func renderDynamicPage(globalData *GlobalData, w http.ResponseWriter, r *http.Request,
+	templateData TemplateData, status int) {
+
+	globalData.RLock()
+	templates := globalData.templates
+	templateData.globalData = globalData
+	templateData.Archives = globalData.archive
+	globalData.RUnlock()
+	templateData.Domain = config.Domain
+	templateData.Tags = NewTags(config.TagsPath, config.PostsDir).TagsByPopularity()
+
+	buf := &bytes.Buffer{}
+	if err := templates.ExecuteTemplate(buf, "main.tmpl.html", templateData); err != nil {
+		handleError(w, r, err)
+		return
+	}
+	data := buf.Bytes()
+	if config.MinifyHTML {
+		data = minifyData("main.tmpl.html", data)
+	}
+
+	header := w.Header()
+	header.Set("Content-Type", "text/html; charset=utf-8")
+	header.Set("Cache-Control", "no-store")
+	header.Add("Vary", "Accept-Encoding")
+	setPolicyHashes(w, r, inlineHashSources(data))
+	if nonce := requestNonce(r); nonce != "" {
+		object, encoding := applyNonce(r, nonce, gocache.Object{Data: data})
+		data = object.Data
+		if encoding != "" {
+			header.Set("Content-Encoding", encoding)
+		}
+	}
+	w.WriteHeader(status)
+	w.Write(data)
+}
+
+// recordDependencies notes everything that was used to build the page at key, so that
+// the page can be invalidated when any of them change.
+func (ps PageSpec) recordDependencies(key string, templateName string, posts PostList) {
+	deps := make([]string, 0, len(ps.dependencies)+len(posts)+3)
+	deps = append(deps, ps.dependencies...)
+	deps = append(deps, SidebarDependency, TemplatesDependency, TemplateDependency(templateName))
+
+	oldest := time.Time{}
+	for i, post := range posts {
+		deps = append(deps, PostDependency(post.SourcePath))
+		if ps.route == RoutePost && ps.globalData.comments != nil {
+			deps = append(deps, CommentsDependency(post.SourcePath))
+		}
+		if ps.route == RoutePost && config.EnableWebmentions {
+			deps = append(deps, WebmentionsDependency(post.SourcePath))
+		}
+		if i == 0 || post.Timestamp.Before(oldest) {
+			oldest = post.Timestamp
+		}
+	}
+
+	if len(posts) < config.IndexPosts {
+		// There aren't enough posts to fill the page, so any post would appear on it.
+		oldest = time.Time{}
+	}
+
+	for _, dep := range ps.dependencies {
+		if dep == RecentDependency {
+			ps.globalData.deps.SetRecentCutoff(oldest)
+			break
+		}
+	}
+
+	ps.globalData.deps.Record(baseCacheKey(key), deps...)
 }
 
 func generatePostPage(globalData *GlobalData, params map[string]string) (PostList, string, error) {
@@ -171,14 +385,25 @@ func generatePostPage(globalData *GlobalData, params map[string]string) (PostLis
 }
 
 func generateArchivePage(globalData *GlobalData, params map[string]string) (PostList, string, error) {
-	archivePath := path.Join(config.PostsDir, params["year"], params["month"])
-	posts, err := LoadPostsFromPath(archivePath, true)
+	year, err := strconv.Atoi(params["year"])
+	if err != nil {
+		return nil, "", os.ErrNotExist
+	}
+	if year < 100 {
+		year += 2000
+	}
+	month, err := strconv.Atoi(params["month"])
+	if err != nil || month < 1 || month > 12 {
+		return nil, "", os.ErrNotExist
+	}
+
+	posts, err := LoadArchiveMonth(year, time.Month(month), true)
 	if err != nil && len(posts) == 0 {
 		return nil, "", err
 	}
 	sort.Sort(posts)
 
-	title := posts[0].Timestamp.Format("Jan 2006")
+	title := ArchiveSpec(time.Date(year, time.Month(month), 1, 1, 1, 1, 1, time.UTC)).String()
 	return posts, title, nil
 }
 
@@ -219,11 +444,10 @@ func generateIndexPage(globalData *GlobalData, params map[string]string) (PostLi
 
 	for i := startArchive; i != endArchive; i += increment {
 		current := globalData.archive[i]
-		postPath := PostPath(config.PostsDir, current.Year(), current.Month())
-		monthPosts, _ := LoadPostsFromPath(postPath, true)
+		monthPosts, _ := LoadArchiveMonth(current.Year(), current.Month(), true)
 
 		if glog.V(1) {
-			glog.Infof("generateIndexPage: Loaded %d posts from %s", len(monthPosts), postPath)
+			glog.Infof("generateIndexPage: Loaded %d posts for %s", len(monthPosts), current.Href())
 		}
 		if len(monthPosts) != 0 {
 			postList = append(postList, monthPosts...)
@@ -273,7 +497,7 @@ func (a ArchiveSpec) Href() string {
 }
 
 func (a ArchiveSpec) String() string {
-	return time.Time(a).Format("Jan 2006")
+	return siteLocale().format(time.Time(a), siteLocale().monthLayout)
 }
 
 func (a ArchiveSpec) Month() time.Month {
@@ -9,17 +9,26 @@ import (
 	"github.com/dimfeld/glog"
 	"hash/fnv"
 	"html/template"
+	"io/ioutil"
 	"os"
 	"path"
 	"path/filepath"
 	"sort"
 	"strconv"
 	"strings"
+	"sync"
 	"time"
 )
 
 const PostTimeFormat string = "1/2/06 3:04PM -0700"
 
+// Prefixes of the header lines that record when a post was changed, and the time zone
+// to show its times in.
+const (
+	updatedPrefix  = "updated:"
+	timezonePrefix = "timezone:"
+)
+
 type PostList []*Post
 
 type Post struct {
@@ -29,6 +38,43 @@ type Post struct {
 	Tags       []string
 	Link       string
 	Content    []byte
+	// When the post last changed: the newest Updated header, or if there are none, the
+	// file's modification time if it is after Timestamp.
+	Updated time.Time
+	// The Updated headers, oldest first.
+	Changes []PostChange
+	// Time zone to show the post's times in instead of the site's, from a Timezone header.
+	Timezone string
+}
+
+// PostChange is an entry in a post's changelog.
+type PostChange struct {
+	Time time.Time
+	// What changed. May be empty.
+	Note string
+}
+
+// parseChange parses an Updated header line, such as
+// "Updated: 5/20/14 9:00AM -0500 Fixed the example".
+func parseChange(line string) (PostChange, bool) {
+	if !hasHeaderPrefix(line, updatedPrefix) {
+		return PostChange{}, false
+	}
+
+	fields := strings.Fields(line[len(updatedPrefix):])
+	if len(fields) < 3 {
+		return PostChange{}, false
+	}
+	t, err := time.Parse(PostTimeFormat, strings.Join(fields[:3], " "))
+	if err != nil {
+		return PostChange{}, false
+	}
+	return PostChange{Time: t, Note: strings.Join(fields[3:], " ")}, true
+}
+
+// hasHeaderPrefix returns true if line starts with prefix, ignoring case.
+func hasHeaderPrefix(line, prefix string) bool {
+	return len(line) >= len(prefix) && strings.EqualFold(line[:len(prefix)], prefix)
 }
 
 func (p *Post) parseTags(line string) {
@@ -56,9 +102,10 @@ func (p *Post) readHeader(reader *bufio.Reader) (err error) {
 		return
 	}
 
-	// Read up to 2 optional lines
+	// Read the optional lines: tags, a link, a time zone, and any number of Updated lines.
 	p.Tags = []string{}
-	for i := 0; i < 2; i++ {
+	lines := 0
+	for {
 		line, err = reader.ReadString('\n')
 		if err != nil {
 			return
@@ -69,7 +116,28 @@ func (p *Post) readHeader(reader *bufio.Reader) (err error) {
 			return nil
 		}
 
-		if strings.HasPrefix(line, "http://") {
+		if change, ok := parseChange(line); ok {
+			p.Changes = append(p.Changes, change)
+			continue
+		}
+		if hasHeaderPrefix(line, timezonePrefix) {
+			if p.Timezone != "" {
+				return errors.New("More than one timezone in header")
+			}
+			p.Timezone = strings.TrimSpace(line[len(timezonePrefix):])
+			if _, err := loadTimezone(p.Timezone); err != nil {
+				// Show the post in the site's time zone rather than not at all.
+				glog.Warningf("%s: %s, using the site's time zone", p.SourcePath, err)
+				p.Timezone = ""
+			}
+			continue
+		}
+
+		if lines == 2 {
+			return fmt.Errorf("Unexpected input after header: %s", line)
+		}
+		lines++
+		if strings.HasPrefix(line, "http://") || strings.HasPrefix(line, "https://") {
 			if p.Link != "" {
 				return errors.New("More than one link in header")
 			}
@@ -81,16 +149,22 @@ func (p *Post) readHeader(reader *bufio.Reader) (err error) {
 			p.parseTags(line)
 		}
 	}
+}
 
-	line, err = reader.ReadString('\n')
-	if err != nil {
-		return
-	}
-	if len(line) != 1 {
-		return fmt.Errorf("Unexpected input after header: %s", string(line))
-	}
+// setUpdated fills in Updated from the changes, or from the file's modification time.
+func (p *Post) setUpdated(modTime time.Time) {
+	sort.SliceStable(p.Changes, func(i, j int) bool {
+		return p.Changes[i].Time.Before(p.Changes[j].Time)
+	})
 
-	return nil
+	p.Updated = p.Timestamp
+	if len(p.Changes) != 0 {
+		if last := p.Changes[len(p.Changes)-1].Time; last.After(p.Updated) {
+			p.Updated = last
+		}
+	} else if modTime.After(p.Updated) {
+		p.Updated = modTime
+	}
 }
 
 // NewPost reads a post from disk and returns a Post containing its data.
@@ -100,6 +174,8 @@ func (p *Post) readHeader(reader *bufio.Reader) (err error) {
 // Date/Time
 // Tags - optional
 // Link - optional
+// Timezone: Name - optional
+// Updated: Date/Time Note - optional, and may be repeated
 //
 // Markdown Content
 func NewPost(filePath string, readContent bool) (p *Post, err error) {
@@ -120,6 +196,12 @@ func NewPost(filePath string, readContent bool) (p *Post, err error) {
 		return
 	}
 
+	modTime := time.Time{}
+	if stat, err := f.Stat(); err == nil {
+		modTime = stat.ModTime()
+	}
+	p.setUpdated(modTime)
+
 	if readContent {
 		buf := &bytes.Buffer{}
 		_, err = buf.ReadFrom(reader)
@@ -132,6 +214,48 @@ func NewPost(filePath string, readContent bool) (p *Post, err error) {
 	return
 }
 
+// Encode returns the post in the format read by NewPost.
+func (p *Post) Encode() []byte {
+	buf := &bytes.Buffer{}
+	buf.WriteString(p.Title + "\n")
+	buf.WriteString(p.Timestamp.Format(PostTimeFormat) + "\n")
+	if len(p.Tags) != 0 {
+		buf.WriteString(strings.Join(p.Tags, ", ") + "\n")
+	}
+	if p.Link != "" {
+		buf.WriteString(p.Link + "\n")
+	}
+	if p.Timezone != "" {
+		buf.WriteString("Timezone: " + p.Timezone + "\n")
+	}
+	for _, change := range p.Changes {
+		line := "Updated: " + change.Time.Format(PostTimeFormat)
+		if note := strings.Join(strings.Fields(change.Note), " "); note != "" {
+			line += " " + note
+		}
+		buf.WriteString(line + "\n")
+	}
+	buf.WriteString("\n")
+	buf.Write(p.Content)
+	return buf.Bytes()
+}
+
+// savePost writes a post to its SourcePath, replacing any existing file atomically so that
+// the file system watcher never sees a partly written post.
+func savePost(p *Post) error {
+	dir := filepath.Dir(p.SourcePath)
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return err
+	}
+
+	// LoadPostsFromPath skips files starting with a dot.
+	tempPath := filepath.Join(dir, "."+filepath.Base(p.SourcePath)+".tmp")
+	if err := ioutil.WriteFile(tempPath, p.Encode(), 0644); err != nil {
+		return err
+	}
+	return os.Rename(tempPath, p.SourcePath)
+}
+
 func (p *Post) HTMLContent(atom bool) template.HTML {
 	htmlFlags := 0
 	htmlFlags |= blackfriday.HTML_USE_XHTML
@@ -161,6 +285,13 @@ func (p *Post) HTMLContent(atom bool) template.HTML {
 		FootnoteReturnLinkContents: `&#8617;`,
 	}
 
+	return template.HTML(renderMarkdown(p.Content, htmlFlags, parameters))
+}
+
+// renderMarkdown renders Markdown with the extensions used for posts.
+func renderMarkdown(content []byte, htmlFlags int,
+	parameters blackfriday.HtmlRendererParameters) []byte {
+
 	renderer := blackfriday.HtmlRendererWithParameters(htmlFlags, "", "", parameters)
 
 	// set up the parser
@@ -174,9 +305,17 @@ func (p *Post) HTMLContent(atom bool) template.HTML {
 	extensions |= blackfriday.EXTENSION_HEADER_IDS
 	extensions |= blackfriday.EXTENSION_FOOTNOTES
 
-	content := blackfriday.Markdown(p.Content, renderer, extensions)
+	return blackfriday.Markdown(content, renderer, extensions)
+}
 
-	return template.HTML(content)
+// ArchiveMonth returns the year and month directories that the post is in. If the post
+// is not in a month directory, such as a custom page, ok is false.
+func (p *Post) ArchiveMonth() (year, month string, ok bool) {
+	relPath, err := filepath.Rel(config.PostsDir, p.SourcePath)
+	if err != nil {
+		return "", "", false
+	}
+	return monthFromPostPath(relPath)
 }
 
 func LoadPostsFromPath(postPath string, readContent bool) (PostList, error) {
@@ -237,6 +376,14 @@ func NewArchiveSpecList(postBase string) (ArchiveSpecList, error) {
 	}
 
 	list := make(ArchiveSpecList, 0)
+	seen := make(map[ArchiveSpec]bool)
+	add := func(year int, month time.Month) {
+		spec := ArchiveSpec(time.Date(year, month, 1, 1, 1, 1, 1, time.UTC))
+		if !seen[spec] {
+			seen[spec] = true
+			list = append(list, spec)
+		}
+	}
 
 	for _, yearDirStat := range yearDirs {
 		if !yearDirStat.IsDir() {
@@ -273,8 +420,27 @@ func NewArchiveSpecList(postBase string) (ArchiveSpecList, error) {
 				continue
 			}
 
-			spec := time.Date(yearInt, time.Month(monthInt), 1, 1, 1, 1, 1, time.UTC)
-			list = append(list, ArchiveSpec(spec))
+			if config.Timezone == "" {
+				add(yearInt, time.Month(monthInt))
+				continue
+			}
+
+			// Posts near the start or end of the month may be in another month in the
+			// site's time zone.
+			filepath.Walk(path.Join(yearDirPath, monthDirSpec.Name()),
+				func(filePath string, info os.FileInfo, err error) error {
+					if err != nil || info.IsDir() || path.Base(filePath)[0] == '.' ||
+						!strings.HasSuffix(filePath, ".md") {
+						return nil
+					}
+					year, month, err := fileSiteMonth(filePath, info)
+					if err != nil {
+						glog.Errorf("Failed parsing post at %s: %s", filePath, err)
+						return nil
+					}
+					add(year, month)
+					return nil
+				})
 		}
 	}
 
@@ -287,10 +453,73 @@ func NewArchiveSpecList(postBase string) (ArchiveSpecList, error) {
 	return list, nil
 }
 
+// Site months of the posts read by NewArchiveSpecList, by source path. An entry is used
+// while the file's modification time and the site's time zone are unchanged.
+var siteMonths sync.Map
+
+type siteMonthEntry struct {
+	modTime  time.Time
+	timezone string
+	year     int
+	month    time.Month
+}
+
+// fileSiteMonth returns the SiteMonth of the post in a file, reading its header only
+// when the file has changed since it was last read.
+func fileSiteMonth(filePath string, info os.FileInfo) (int, time.Month, error) {
+	if cached, ok := siteMonths.Load(filePath); ok {
+		entry := cached.(siteMonthEntry)
+		if entry.modTime.Equal(info.ModTime()) && entry.timezone == config.Timezone {
+			return entry.year, entry.month, nil
+		}
+	}
+
+	post, err := NewPost(filePath, false)
+	if err != nil {
+		return 0, 0, err
+	}
+	year, month := post.SiteMonth()
+	siteMonths.Store(filePath, siteMonthEntry{info.ModTime(), config.Timezone, year, month})
+	return year, month, nil
+}
+
 func PostPath(base string, year int, month time.Month) string {
 	return path.Join(base, strconv.Itoa(year), fmt.Sprintf("%02d", int(month)))
 }
 
+// SiteMonth returns the month that the post is listed under in the archive: the month of
+// its timestamp in the site's time zone.
+func (p *Post) SiteMonth() (int, time.Month) {
+	t := siteTime(p.Timestamp)
+	return t.Year(), t.Month()
+}
+
+// LoadArchiveMonth loads the posts in a month of the archive. Without a site time zone,
+// these are the posts in the month's directory. Otherwise they are the posts whose
+// SiteMonth is the month, which can include posts from the directories of the months
+// before and after it.
+func LoadArchiveMonth(year int, month time.Month, readContent bool) (PostList, error) {
+	if config.Timezone == "" {
+		return LoadPostsFromPath(PostPath(config.PostsDir, year, month), readContent)
+	}
+
+	postList := PostList{}
+	var outerErr error
+	for offset := -1; offset <= 1; offset++ {
+		dirMonth := time.Date(year, month+time.Month(offset), 1, 0, 0, 0, 0, time.UTC)
+		posts, err := LoadPostsFromPath(PostPath(config.PostsDir, dirMonth.Year(), dirMonth.Month()), readContent)
+		if err != nil && !os.IsNotExist(err) && outerErr == nil {
+			outerErr = err
+		}
+		for _, post := range posts {
+			if postYear, postMonth := post.SiteMonth(); postYear == year && postMonth == month {
+				postList = append(postList, post)
+			}
+		}
+	}
+	return postList, outerErr
+}
+
 func (l PostList) Less(i, j int) bool {
 	return l[i].Timestamp.Before(l[j].Timestamp)
 }
@@ -302,3 +531,24 @@ func (l PostList) Len() int {
 func (l PostList) Swap(i, j int) {
 	l[i], l[j] = l[j], l[i]
 }
+
+// postKey returns the path of a post relative to PostsDir, without the extension.
+// This identifies the post in URLs and in the comment and webmention stores.
+func postKey(sourcePath string) string {
+	relPath, err := filepath.Rel(config.PostsDir, sourcePath)
+	if err != nil {
+		relPath = sourcePath
+	}
+	return strings.TrimSuffix(filepath.ToSlash(relPath), ".md")
+}
+
+// postSourcePath reverses postKey.
+func postSourcePath(post string) string {
+	return path.Join(config.PostsDir, post) + ".md"
+}
+
+// validPostKey returns false if the key could refer to a file outside the directory.
+func validPostKey(post string) bool {
+	return post != "" && path.Clean(post) == post && !path.IsAbs(post) &&
+		!strings.HasPrefix(post, "..")
+}
@@ -232,6 +232,62 @@ func TestNewPost(t *testing.T) {
 
 }
 
+func TestPostUpdated(t *testing.T) {
+	dir, err := ioutil.TempDir("", "simpleblog-updated")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	published, _ := time.Parse(PostTimeFormat, "5/14/14 11:14PM -0500")
+	fixed, _ := time.Parse(PostTimeFormat, "5/20/14 9:00AM -0500")
+	later, _ := time.Parse(PostTimeFormat, "6/1/14 10:30AM -0500")
+
+	filePath := path.Join(dir, "post.md")
+	ioutil.WriteFile(filePath, []byte("Title\n5/14/14 11:14PM -0500\ntag1\n"+
+		"updated: 6/1/14 10:30AM -0500\nUpdated: 5/20/14 9:00AM -0500 Fixed   the example\n\nContent"), 0644)
+	post, err := NewPost(filePath, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(post.Changes) != 2 || !post.Changes[0].Time.Equal(fixed) || post.Changes[0].Note != "Fixed the example" ||
+		!post.Changes[1].Time.Equal(later) || post.Changes[1].Note != "" {
+		t.Errorf("Expected two changes, oldest first, saw %+v", post.Changes)
+	}
+	if !post.Updated.Equal(later) {
+		t.Errorf("Expected Updated to be the newest change, saw %s", post.Updated)
+	}
+	if len(post.Tags) != 1 || post.Tags[0] != "Tag1" || string(post.Content) != "Content" {
+		t.Errorf("Updated lines changed the rest of the post: %+v", post)
+	}
+
+	post.Changes[0].Note = "Fixed\nthe example"
+	savePost(post)
+	if saved, _ := ioutil.ReadFile(filePath); !strings.Contains(string(saved),
+		"\nUpdated: 5/20/14 9:00AM -0500 Fixed the example\nUpdated: 6/1/14 10:30AM -0500\n\n") {
+		t.Errorf("Changes were not encoded, saw %s", saved)
+	}
+
+	// Without Updated lines, the modification time is used if it's after the timestamp.
+	post.Changes = nil
+	savePost(post)
+	modified := published.Add(48 * time.Hour)
+	os.Chtimes(filePath, modified, modified)
+	if post, _ := NewPost(filePath, false); post == nil || !post.Updated.Equal(modified) {
+		t.Errorf("Expected Updated to be the modification time, saw %+v", post)
+	}
+	os.Chtimes(filePath, published.Add(-time.Hour), published.Add(-time.Hour))
+	if post, _ := NewPost(filePath, false); post == nil || !post.Updated.Equal(published) {
+		t.Errorf("Expected Updated to be the timestamp for an older file, saw %+v", post)
+	}
+
+	// A third line that isn't an update is still an error.
+	ioutil.WriteFile(filePath, []byte("Title\n5/14/14 11:14PM -0500\ntag1\nhttp://example.com\nmore\n\n"), 0644)
+	if _, err := NewPost(filePath, false); err == nil {
+		t.Error("Expected an error for a third optional line")
+	}
+}
+
 var testPosts []*Post
 
 func createTestPosts(t *testing.T) {
@@ -247,7 +303,8 @@ func createTestPosts(t *testing.T) {
 		postTime,
 		[]string{"tag1", "tag2"},
 		"http://www.google.com",
-		[]byte("content")}
+		[]byte("content"),
+		time.Time{}, nil, ""}
 
 	postTime, err = time.Parse(PostTimeFormat, "1/3/14 4:15PM -0700")
 	if err != nil {
@@ -258,7 +315,8 @@ func createTestPosts(t *testing.T) {
 		postTime,
 		[]string{"tag1"},
 		"http://www.github.com",
-		[]byte("content")}
+		[]byte("content"),
+		time.Time{}, nil, ""}
 
 	postTime, err = time.Parse(PostTimeFormat, "1/2/12 4:15PM -0700")
 	if err != nil {
@@ -269,7 +327,8 @@ func createTestPosts(t *testing.T) {
 		postTime,
 		[]string{"tag2"},
 		"http://www.golang.org",
-		[]byte("content")}
+		[]byte("content"),
+		time.Time{}, nil, ""}
 }
 
 func writePost(t *testing.T, postPath string, post *Post) {
@@ -347,7 +406,8 @@ func TestLoadPostsFromPath(t *testing.T) {
 		time.Now(),
 		[]string{"tag2"},
 		"http://www.anandtech.com",
-		[]byte("content")}
+		[]byte("content"),
+		time.Time{}, nil, ""}
 	writePost(t, dir, nonMdPost)
 	nonMdPost.SourcePath = "2012/02/.somepost.md"
 	writePost(t, dir, nonMdPost)
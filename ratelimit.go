@@ -0,0 +1,185 @@
+package main
+
+import (
+	"math"
+	"net"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+type tokenBucket struct {
+	tokens float64
+	last   time.Time
+}
+
+// RateLimiter is a set of token buckets, one for each client.
+type RateLimiter struct {
+	lock sync.Mutex
+	// Tokens added to each bucket per second.
+	rate float64
+	// Capacity of each bucket.
+	burst     float64
+	buckets   map[string]*tokenBucket
+	lastPrune time.Time
+
+	// Replaced by tests.
+	now func() time.Time
+}
+
+func NewRateLimiter(rate float64, burst int) *RateLimiter {
+	return &RateLimiter{
+		rate:    rate,
+		burst:   float64(burst),
+		buckets: make(map[string]*tokenBucket),
+		now:     time.Now,
+	}
+}
+
+// bucket returns the client's bucket, refilled for the time since it was last used.
+// The lock must be held.
+func (rl *RateLimiter) bucket(client string, now time.Time) *tokenBucket {
+	b, ok := rl.buckets[client]
+	if !ok {
+		b = &tokenBucket{tokens: rl.burst, last: now}
+		rl.buckets[client] = b
+		return b
+	}
+
+	b.tokens = math.Min(rl.burst, b.tokens+now.Sub(b.last).Seconds()*rl.rate)
+	b.last = now
+	return b
+}
+
+// prune removes the buckets that have refilled completely, since they are no different
+// from a new bucket. The lock must be held.
+func (rl *RateLimiter) prune(now time.Time) {
+	refillTime := time.Duration(rl.burst / rl.rate * float64(time.Second))
+	if now.Sub(rl.lastPrune) < refillTime {
+		return
+	}
+	rl.lastPrune = now
+
+	for client, b := range rl.buckets {
+		if now.Sub(b.last) >= refillTime {
+			delete(rl.buckets, client)
+		}
+	}
+}
+
+// Take removes a token from the client's bucket, returning false if it was empty.
+func (rl *RateLimiter) Take(client string) bool {
+	rl.lock.Lock()
+	defer rl.lock.Unlock()
+
+	now := rl.now()
+	rl.prune(now)
+	b := rl.bucket(client, now)
+	if b.tokens < 1 {
+		return false
+	}
+	b.tokens--
+	return true
+}
+
+// Refund puts back a token taken by Take, for a request that turned out not to count
+// against the limit.
+func (rl *RateLimiter) Refund(client string) {
+	rl.lock.Lock()
+	defer rl.lock.Unlock()
+	b := rl.bucket(client, rl.now())
+	b.tokens = math.Min(rl.burst, b.tokens+1)
+}
+
+// Ready returns true if the client's bucket has a token, without taking it.
+func (rl *RateLimiter) Ready(client string) bool {
+	rl.lock.Lock()
+	defer rl.lock.Unlock()
+	return rl.bucket(client, rl.now()).tokens >= 1
+}
+
+// RetryAfter returns the time until the client's bucket has a token again.
+func (rl *RateLimiter) RetryAfter(client string) time.Duration {
+	rl.lock.Lock()
+	defer rl.lock.Unlock()
+	b := rl.bucket(client, rl.now())
+	if b.tokens >= 1 {
+		return 0
+	}
+	return time.Duration((1 - b.tokens) / rl.rate * float64(time.Second))
+}
+
+// RateLimitHandler limits the requests each client can make to the wrapped handler.
+// Every request takes a token from the client's request bucket. Requests that result in
+// a 404 also take a token from the much smaller not found bucket, since they can't be
+// served from the cache, and once that is empty the client is refused until it refills.
+type RateLimitHandler struct {
+	handler    http.Handler
+	proxies    TrustedProxies
+	exempt     TrustedProxies
+	requests   *RateLimiter
+	notFound   *RateLimiter
+	globalData *GlobalData
+}
+
+// NewRateLimitHandler wraps handler with the rate limits from the configuration.
+// Clients are identified using proxies, and clients in exempt are never limited.
+// Refused requests are recorded in globalData's metrics and access log.
+func NewRateLimitHandler(handler http.Handler, proxies, exempt TrustedProxies,
+	globalData *GlobalData) *RateLimitHandler {
+
+	h := &RateLimitHandler{handler: handler, proxies: proxies, exempt: exempt, globalData: globalData}
+	if config.RateLimit > 0 {
+		h.requests = NewRateLimiter(config.RateLimit, config.RateLimitBurst)
+	}
+	if config.RateLimitNotFound > 0 {
+		h.notFound = NewRateLimiter(config.RateLimitNotFound, config.RateLimitNotFoundBurst)
+	}
+	return h
+}
+
+func tooManyRequests(w http.ResponseWriter, retryAfter time.Duration) {
+	seconds := int(math.Ceil(retryAfter.Seconds()))
+	if seconds < 1 {
+		seconds = 1
+	}
+	w.Header().Set("Retry-After", strconv.Itoa(seconds))
+	http.Error(w, "Too many requests", http.StatusTooManyRequests)
+}
+
+// refuse sends a 429 response and records it.
+func (h *RateLimitHandler) refuse(w http.ResponseWriter, r *http.Request, retryAfter time.Duration) {
+	startTime := time.Now()
+	sw := &statusWriter{ResponseWriter: w}
+	tooManyRequests(sw, retryAfter)
+	recordRequest(h.globalData, RouteRateLimit, r, sw, startTime)
+}
+
+func (h *RateLimitHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	client := h.proxies.ClientIP(r)
+	if ip := net.ParseIP(client); ip != nil && h.exempt.Contains(ip) {
+		h.handler.ServeHTTP(w, r)
+		return
+	}
+
+	if h.notFound != nil && !h.notFound.Ready(client) {
+		h.refuse(w, r, h.notFound.RetryAfter(client))
+		return
+	}
+	if h.requests != nil && !h.requests.Take(client) {
+		h.refuse(w, r, h.requests.RetryAfter(client))
+		return
+	}
+
+	if h.notFound == nil {
+		h.handler.ServeHTTP(w, r)
+		return
+	}
+
+	sw := &statusWriter{ResponseWriter: w}
+	h.handler.ServeHTTP(sw, r)
+	if sw.status == http.StatusNotFound {
+		h.notFound.Take(client)
+	}
+}
@@ -0,0 +1,106 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestRateLimiter(t *testing.T) {
+	now := time.Date(2014, 5, 14, 12, 0, 0, 0, time.UTC)
+	rl := NewRateLimiter(2, 3)
+	rl.now = func() time.Time { return now }
+
+	for i := 0; i < 3; i++ {
+		if !rl.Take("1.2.3.4") {
+			t.Fatalf("Request %d within the burst was refused", i)
+		}
+	}
+	if rl.Take("1.2.3.4") {
+		t.Error("Request beyond the burst was allowed")
+	}
+	if !rl.Take("5.6.7.8") {
+		t.Error("Another client was limited")
+	}
+
+	if retry := rl.RetryAfter("1.2.3.4"); retry != 500*time.Millisecond {
+		t.Errorf("Expected retry after 500ms, saw %s", retry)
+	}
+
+	now = now.Add(500 * time.Millisecond)
+	if !rl.Ready("1.2.3.4") || !rl.Take("1.2.3.4") {
+		t.Error("Bucket did not refill")
+	}
+	if rl.Take("1.2.3.4") {
+		t.Error("Bucket refilled too much")
+	}
+	rl.Refund("1.2.3.4")
+	if !rl.Take("1.2.3.4") {
+		t.Error("Refunded token was not available")
+	}
+	rl.Refund("5.6.7.8")
+	rl.Refund("5.6.7.8")
+	if rl.buckets["5.6.7.8"].tokens != 3 {
+		t.Errorf("Refunds overfilled the bucket to %f", rl.buckets["5.6.7.8"].tokens)
+	}
+
+	now = now.Add(time.Hour)
+	rl.Take("9.9.9.9")
+	if _, ok := rl.buckets["5.6.7.8"]; ok {
+		t.Error("Full bucket was not pruned")
+	}
+}
+
+func TestRateLimitHandler(t *testing.T) {
+	oldConfig := *config
+	defer func() { *config = oldConfig }()
+	config.RateLimit = 0
+	config.RateLimitNotFound = 1
+	config.RateLimitNotFoundBurst = 2
+
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/" {
+			http.NotFound(w, r)
+		}
+	})
+	exempt, _ := ParseTrustedProxies("10.0.0.1")
+	globalData := &GlobalData{metrics: NewMetrics()}
+	h := NewRateLimitHandler(handler, nil, exempt, globalData)
+	now := time.Now()
+	h.notFound.now = func() time.Time { return now }
+
+	get := func(path, remoteAddr string) int {
+		r, _ := http.NewRequest("GET", path, nil)
+		r.RemoteAddr = remoteAddr
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, r)
+		return w.Code
+	}
+
+	for i := 0; i < 2; i++ {
+		if code := get("/missing", "1.2.3.4:5000"); code != http.StatusNotFound {
+			t.Fatalf("Expected 404, saw %d", code)
+		}
+	}
+	if code := get("/", "1.2.3.4:5000"); code != http.StatusTooManyRequests {
+		t.Errorf("Expected 429 after too many 404s, saw %d", code)
+	}
+	if refused := globalData.metrics.requests[labels("route", RouteRateLimit, "status", "429")]; refused != 1 {
+		t.Errorf("Expected the refused request in the metrics, saw %d", refused)
+	}
+	if code := get("/", "5.6.7.8:5000"); code != http.StatusOK {
+		t.Errorf("Another client was limited with %d", code)
+	}
+
+	for i := 0; i < 5; i++ {
+		if code := get("/missing", "10.0.0.1:5000"); code != http.StatusNotFound {
+			t.Fatalf("Exempt client was limited with %d", code)
+		}
+	}
+
+	now = now.Add(time.Second)
+	if code := get("/", "1.2.3.4:5000"); code != http.StatusOK {
+		t.Errorf("Client was still limited after waiting, saw %d", code)
+	}
+}
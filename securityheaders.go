@@ -0,0 +1,313 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"github.com/dimfeld/glog"
+	"github.com/dimfeld/gocache"
+	"github.com/dimfeld/httptreemux"
+	"github.com/dimfeld/simpleblog/lru"
+	"net/http"
+	"regexp"
+	"strings"
+	"time"
+)
+
+// SecurityHeaders holds the values of the security headers sent with a response.
+// An empty value in a per-route override inherits the default, and "-" omits the header.
+type SecurityHeaders struct {
+	// Content-Security-Policy. On page routes, {hashes} is replaced with the hashes of the
+	// page's inline scripts and styles, and {nonce} with a nonce generated for each request,
+	// which templates can add to inline scripts and styles with the nonce function. A nonce
+	// makes every response different, so pages are compressed for each request instead of
+	// being sent from the cache. Source expressions containing either token are removed
+	// where they don't apply.
+	ContentSecurityPolicy string
+	// X-Content-Type-Options
+	ContentTypeOptions string
+	ReferrerPolicy     string
+	PermissionsPolicy  string
+	// X-Frame-Options
+	FrameOptions string
+}
+
+// SecurityHeadersConfig holds the default security headers and the overrides for
+// each class of route.
+type SecurityHeadersConfig struct {
+	Default SecurityHeaders
+	Feeds   SecurityHeaders
+	Images  SecurityHeaders
+}
+
+func defaultSecurityHeaders() SecurityHeadersConfig {
+	return SecurityHeadersConfig{
+		Default: SecurityHeaders{
+			ContentTypeOptions: "nosniff",
+			ReferrerPolicy:     "strict-origin-when-cross-origin",
+			PermissionsPolicy:  "camera=(), microphone=(), geolocation=()",
+			FrameOptions:       "SAMEORIGIN",
+		},
+	}
+}
+
+// merge returns the headers in sh, with any empty fields taken from defaults.
+func (sh SecurityHeaders) merge(defaults SecurityHeaders) SecurityHeaders {
+	pick := func(value, def string) string {
+		if value == "" {
+			return def
+		}
+		return value
+	}
+
+	return SecurityHeaders{
+		ContentSecurityPolicy: pick(sh.ContentSecurityPolicy, defaults.ContentSecurityPolicy),
+		ContentTypeOptions:    pick(sh.ContentTypeOptions, defaults.ContentTypeOptions),
+		ReferrerPolicy:        pick(sh.ReferrerPolicy, defaults.ReferrerPolicy),
+		PermissionsPolicy:     pick(sh.PermissionsPolicy, defaults.PermissionsPolicy),
+		FrameOptions:          pick(sh.FrameOptions, defaults.FrameOptions),
+	}
+}
+
+// securityHeaders returns the configured security headers for a route type.
+func securityHeaders(route string) SecurityHeaders {
+	headers := config.SecurityHeaders
+	switch route {
+	case RouteFeed:
+		return headers.Feeds.merge(headers.Default)
+	case RouteImage:
+		return headers.Images.merge(headers.Default)
+	}
+	return headers.Default
+}
+
+// Routes that render templates, and so can use a CSP nonce.
+var nonceRoutes = map[string]bool{
+	RoutePost:       true,
+	RouteArchive:    true,
+	RouteTag:        true,
+	RouteIndex:      true,
+	RoutePage:       true,
+	RouteContact:    true,
+	RouteNewsletter: true,
+}
+
+const (
+	nonceToken  = "{nonce}"
+	hashesToken = "{hashes}"
+)
+
+// noncePlaceholder is rendered by the nonce template function. Rendered pages are cached,
+// so the placeholder is replaced with the request's nonce as each response is sent.
+const noncePlaceholder = "__simpleblog_csp_nonce__"
+
+// NoncePlaceholder is the nonce template function. It renders nothing unless the pages'
+// Content-Security-Policy uses a nonce, since the placeholder would never be replaced.
+func NoncePlaceholder() string {
+	if !strings.Contains(config.SecurityHeaders.Default.ContentSecurityPolicy, nonceToken) {
+		return ""
+	}
+	return noncePlaceholder
+}
+
+type nonceKey struct{}
+
+// policyKey holds the Content-Security-Policy of a request whose policy uses {hashes}, to be
+// completed when the page is sent.
+type policyKey struct{}
+
+// routeUsesNonce returns true if the pages of a route get a new nonce in each response.
+func routeUsesNonce(route string) bool {
+	return nonceRoutes[route] && strings.Contains(securityHeaders(route).ContentSecurityPolicy, nonceToken)
+}
+
+// requestNonce returns the CSP nonce for the request, or an empty string if it has none.
+func requestNonce(r *http.Request) string {
+	nonce, _ := r.Context().Value(nonceKey{}).(string)
+	return nonce
+}
+
+func generateNonce() (string, error) {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return base64.StdEncoding.EncodeToString(b), nil
+}
+
+// removeSources removes the source expressions that contain token from a
+// Content-Security-Policy.
+func removeSources(policy string, token string) string {
+	directives := strings.Split(policy, ";")
+	for i, directive := range directives {
+		fields := strings.Fields(directive)
+		kept := fields[:0]
+		for _, field := range fields {
+			if !strings.Contains(field, token) {
+				kept = append(kept, field)
+			}
+		}
+		directives[i] = strings.Join(kept, " ")
+	}
+	return strings.Join(directives, "; ")
+}
+
+// securityHeadersWrapper adds the configured security headers for the route type
+// to every response. If the Content-Security-Policy for a page route uses a nonce,
+// a new one is generated and attached to the request.
+func securityHeadersWrapper(route string, handler httptreemux.HandlerFunc) httptreemux.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request, urlParams map[string]string) {
+		headers := securityHeaders(route)
+		header := w.Header()
+
+		if csp := headers.ContentSecurityPolicy; csp != "" && csp != "-" {
+			if strings.Contains(csp, nonceToken) {
+				nonce := ""
+				if nonceRoutes[route] {
+					var err error
+					nonce, err = generateNonce()
+					if err != nil {
+						glog.Errorln("Could not generate CSP nonce:", err)
+					}
+				}
+
+				if nonce != "" {
+					csp = strings.Replace(csp, nonceToken, nonce, -1)
+					r = r.WithContext(context.WithValue(r.Context(), nonceKey{}, nonce))
+				} else {
+					csp = removeSources(csp, nonceToken)
+				}
+			}
+
+			if strings.Contains(csp, hashesToken) {
+				// Until the page supplies its hashes, no inline scripts are allowed.
+				if nonceRoutes[route] {
+					r = r.WithContext(context.WithValue(r.Context(), policyKey{}, csp))
+				}
+				csp = removeSources(csp, hashesToken)
+			}
+			header.Set("Content-Security-Policy", csp)
+		}
+
+		set := func(name, value string) {
+			if value != "" && value != "-" {
+				header.Set(name, value)
+			}
+		}
+		set("X-Content-Type-Options", headers.ContentTypeOptions)
+		set("Referrer-Policy", headers.ReferrerPolicy)
+		set("Permissions-Policy", headers.PermissionsPolicy)
+		set("X-Frame-Options", headers.FrameOptions)
+
+		handler(w, r, urlParams)
+	}
+}
+
+// applyNonce replaces the nonce placeholder in an uncompressed page with the request's nonce,
+// then compresses the result with gzip if the client accepts it. It returns the object to
+// send and its content encoding.
+//
+// Every response is compressed separately, so this uses gzip at its default level, which
+// is much faster than the brotli and zstd levels used for the cached variants of other
+// pages. Pages with a nonce are larger on the wire in exchange.
+func applyNonce(r *http.Request, nonce string, object gocache.Object) (gocache.Object, string) {
+	// Each response is different, so don't let a client revalidate a copy that has
+	// another request's nonce.
+	object.ModTime = time.Time{}
+
+	placeholder := []byte(noncePlaceholder)
+	if bytes.Contains(object.Data, placeholder) {
+		object.Data = bytes.Replace(object.Data, placeholder, []byte(nonce), -1)
+	}
+
+	accepted := parseAcceptEncoding(r.Header["Accept-Encoding"])
+	q, listed := accepted["gzip"]
+	if !listed {
+		q = accepted["*"]
+	}
+	if q <= 0 {
+		return object, ""
+	}
+
+	compressed, err := gzipCompressLevel(object.Data, gzip.DefaultCompression)
+	if err != nil {
+		glog.Errorln("Could not compress page:", err)
+		return object, ""
+	}
+	return gocache.Object{Data: compressed}, "gzip"
+}
+
+// Inline script and style elements. Scripts with a src attribute aren't inline.
+var (
+	inlineElementRegexp = regexp.MustCompile(`(?is)<(script|style)\b([^>]*)>(.*?)</(?:script|style)\s*>`)
+	srcAttributeRegexp  = regexp.MustCompile(`(?i)(^|\s)src\s*=`)
+)
+
+// inlineHashSources returns the CSP hash sources for the inline scripts and styles in an
+// HTML page, separated by spaces.
+func inlineHashSources(data []byte) string {
+	sources := []string{}
+	seen := map[string]bool{}
+	for _, match := range inlineElementRegexp.FindAllSubmatch(data, -1) {
+		if strings.EqualFold(string(match[1]), "script") && srcAttributeRegexp.Match(match[2]) {
+			continue
+		}
+		sum := sha256.Sum256(match[3])
+		source := "'sha256-" + base64.StdEncoding.EncodeToString(sum[:]) + "'"
+		if !seen[source] {
+			seen[source] = true
+			sources = append(sources, source)
+		}
+	}
+	return strings.Join(sources, " ")
+}
+
+// inlineHashes remembers the hash sources of each cached page, which are found when the page
+// is filled so that the compressed variants can be sent without looking inside them.
+var inlineHashes = lru.New(0, 0, 50000, 0)
+
+// storeInlineHashes finds the hash sources for the page stored at key.
+func storeInlineHashes(key string, data []byte) string {
+	sources := inlineHashSources(data)
+	inlineHashes.Set(baseCacheKey(key), gocache.Object{Data: []byte(sources)})
+	return sources
+}
+
+// setPolicyHashes completes a Content-Security-Policy that uses {hashes} with the hash sources
+// of the page being sent.
+func setPolicyHashes(w http.ResponseWriter, r *http.Request, sources string) {
+	policy, _ := r.Context().Value(policyKey{}).(string)
+	if policy == "" || sources == "" {
+		return
+	}
+	w.Header().Set("Content-Security-Policy", strings.Replace(policy, hashesToken, sources, -1))
+}
+
+// setPageHashes completes the request's Content-Security-Policy with the hash sources for
+// the page cached at key. If they were forgotten, they are found again in the uncompressed
+// page.
+func setPageHashes(w http.ResponseWriter, r *http.Request, cache gocache.Cache, key string,
+	object gocache.Object) {
+
+	if r.Context().Value(policyKey{}) == nil {
+		return
+	}
+
+	baseKey := baseCacheKey(key)
+	if stored, err := inlineHashes.Get(baseKey, nil); err == nil {
+		setPolicyHashes(w, r, string(stored.Data))
+		return
+	}
+
+	if key != baseKey {
+		var err error
+		object, err = cache.Get(baseKey, nil)
+		if err != nil {
+			return
+		}
+	}
+	setPolicyHashes(w, r, storeInlineHashes(baseKey, object.Data))
+}
@@ -0,0 +1,154 @@
+package main
+
+import (
+	"github.com/dimfeld/gocache"
+	"github.com/dimfeld/simpleblog/lru"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestSecurityHeaders(t *testing.T) {
+	oldHeaders := config.SecurityHeaders
+	defer func() { config.SecurityHeaders = oldHeaders }()
+
+	config.SecurityHeaders = defaultSecurityHeaders()
+	config.SecurityHeaders.Default.ContentSecurityPolicy = "default-src 'self'; script-src 'self' 'nonce-{nonce}'"
+	config.SecurityHeaders.Feeds.FrameOptions = "-"
+	config.SecurityHeaders.Images.ReferrerPolicy = "no-referrer"
+
+	page := gocache.Object{
+		Data:    []byte(`<script nonce="` + noncePlaceholder + `">x()</script>`),
+		ModTime: time.Now(),
+	}
+	send := func(route string) (*httptest.ResponseRecorder, string) {
+		nonce := ""
+		handler := securityHeadersWrapper(route,
+			func(w http.ResponseWriter, r *http.Request, urlParams map[string]string) {
+				nonce = requestNonce(r)
+				sendData(w, r, "", "page.html", "", page)
+			})
+
+		r, _ := http.NewRequest("GET", "/", nil)
+		w := httptest.NewRecorder()
+		handler(w, r, nil)
+		return w, nonce
+	}
+
+	w, nonce := send(RoutePost)
+	if nonce == "" {
+		t.Fatal("No nonce was generated for a page route")
+	}
+	if csp := w.Header().Get("Content-Security-Policy"); csp != "default-src 'self'; script-src 'self' 'nonce-"+nonce+"'" {
+		t.Errorf("Unexpected Content-Security-Policy %s", csp)
+	}
+	if body := w.Body.String(); body != `<script nonce="`+nonce+`">x()</script>` {
+		t.Errorf("Nonce was not applied to the page, saw %s", body)
+	}
+	if w.Header().Get("Last-Modified") != "" {
+		t.Error("Page with a nonce was sent with Last-Modified")
+	}
+	if w.Header().Get("X-Content-Type-Options") != "nosniff" || w.Header().Get("X-Frame-Options") != "SAMEORIGIN" {
+		t.Errorf("Missing default headers: %v", w.Header())
+	}
+
+	if _, nonce2 := send(RoutePost); nonce2 == nonce {
+		t.Error("Two requests received the same nonce")
+	}
+
+	// Pages with a nonce are compressed as they're sent, and only with gzip.
+	handler := securityHeadersWrapper(RoutePost,
+		func(w http.ResponseWriter, r *http.Request, urlParams map[string]string) {
+			sendData(w, r, "", "page.html", "", page)
+		})
+	r, _ := http.NewRequest("GET", "/", nil)
+	r.Header.Set("Accept-Encoding", "br, zstd, gzip")
+	w = httptest.NewRecorder()
+	handler(w, r, nil)
+	if encoding := w.Header().Get("Content-Encoding"); encoding != "gzip" {
+		t.Errorf("Expected a page with a nonce to be sent with gzip, saw %q", encoding)
+	}
+	if !routeUsesNonce(RoutePost) || routeUsesNonce(RouteFeed) {
+		t.Error("Expected only page routes to use the nonce")
+	}
+
+	w, nonce = send(RouteFeed)
+	if nonce != "" {
+		t.Error("Nonce was generated for the feed")
+	}
+	if csp := w.Header().Get("Content-Security-Policy"); csp != "default-src 'self'; script-src 'self'" {
+		t.Errorf("Nonce source was not removed from the feed's policy: %s", csp)
+	}
+	if _, ok := w.Header()["X-Frame-Options"]; ok {
+		t.Error("Feed override did not omit X-Frame-Options")
+	}
+	if w.Header().Get("Referrer-Policy") != "strict-origin-when-cross-origin" {
+		t.Error("Feed override did not inherit Referrer-Policy")
+	}
+
+	w, _ = send(RouteImage)
+	if w.Header().Get("Referrer-Policy") != "no-referrer" {
+		t.Error("Image override was not applied")
+	}
+	if !strings.Contains(w.Header().Get("X-Frame-Options"), "SAMEORIGIN") {
+		t.Error("Image override did not inherit X-Frame-Options")
+	}
+}
+
+func TestInlineHashes(t *testing.T) {
+	oldHeaders := config.SecurityHeaders
+	defer func() { config.SecurityHeaders = oldHeaders }()
+
+	config.SecurityHeaders = defaultSecurityHeaders()
+	config.SecurityHeaders.Default.ContentSecurityPolicy = "script-src 'self' {hashes}"
+
+	page := []byte(`<script>x()</script><script src="/a.js"></script><style>p{}</style><script>x()</script>`)
+	sources := inlineHashSources(page)
+	if sources != "'sha256-D6IGS8VMvCoyaR/l0h9tERrBTATY01CoPS7l6xDv0kI=' "+
+		"'sha256-gG2yISYereRMiG2lMXrbiUgi0Ubw9p7QCeWcroOvy9Y='" {
+		t.Errorf("Unexpected hash sources %s", sources)
+	}
+	if NoncePlaceholder() != "" {
+		t.Error("Nonce placeholder was rendered without a nonce in the policy")
+	}
+
+	cache := lru.New(0, 0, 1000, 0)
+	compressAndSetAll(cache, "hashes.html", page, time.Now())
+	storeInlineHashes("hashes.html", page)
+
+	send := func(route string, forget bool) *httptest.ResponseRecorder {
+		if forget {
+			inlineHashes.Del("hashes.html")
+		}
+		handler := securityHeadersWrapper(route,
+			func(w http.ResponseWriter, r *http.Request, urlParams map[string]string) {
+				key, encoding := determineCompression(w, r, "hashes.html")
+				object, _ := cache.Get(key, nil)
+				setPageHashes(w, r, cache, key, object)
+				sendData(w, r, key, "hashes.html", encoding, object)
+			})
+
+		r, _ := http.NewRequest("GET", "/", nil)
+		r.Header.Set("Accept-Encoding", "gzip")
+		w := httptest.NewRecorder()
+		handler(w, r, nil)
+		return w
+	}
+
+	for _, forget := range []bool{false, true} {
+		w := send(RoutePost, forget)
+		if csp := w.Header().Get("Content-Security-Policy"); csp != "script-src 'self' "+sources {
+			t.Errorf("Forgotten %v: hashes were not added to the policy: %s", forget, csp)
+		}
+		if w.Header().Get("Content-Encoding") != "gzip" || w.Header().Get("Last-Modified") == "" {
+			t.Errorf("Forgotten %v: the cached compressed page was not sent: %v", forget, w.Header())
+		}
+	}
+
+	w := send(RouteFeed, false)
+	if csp := w.Header().Get("Content-Security-Policy"); csp != "script-src 'self'" {
+		t.Errorf("Hash sources were not removed from the feed's policy: %s", csp)
+	}
+}
@@ -1,6 +1,7 @@
 package main
 
 import (
+	"encoding/json"
 	"flag"
 	"fmt"
 	"github.com/dimfeld/glog"
@@ -8,6 +9,8 @@ import (
 	"github.com/dimfeld/goconfig"
 	"github.com/dimfeld/httppath"
 	"github.com/dimfeld/httptreemux"
+	"github.com/dimfeld/simpleblog/lru"
+	"hash/fnv"
 	"html/template"
 	"io"
 	"net"
@@ -28,10 +31,10 @@ var (
 
 func catchSIGINT(f func(), quit bool) {
 	c := make(chan os.Signal, 1)
-	signal.Notify(c, os.Interrupt)
+	signal.Notify(c, os.Interrupt, syscall.SIGTERM)
 	go func() {
-		for _ = range c {
-			glog.Infoln("SIGINT received...")
+		for sig := range c {
+			glog.Infof("Signal received: %s...", sig)
 			f()
 			if quit {
 				os.Exit(1)
@@ -46,9 +49,37 @@ type GlobalData struct {
 	// General cache
 	cache    gocache.Cache
 	memCache gocache.Cache
-
-	archive   ArchiveSpecList
+	// Tracks what each rendered page was built from.
+	deps *DependencyTracker
+	// Keys that were recently not found.
+	notFound *NotFoundCache
+	// nil if comments are disabled.
+	comments     *CommentStore
+	commentForms *CommentForms
+	// nil if webmentions are neither sent nor received.
+	webmentions *Webmentions
+	// nil if the contact form is disabled.
+	contact *Contact
+	// nil if the newsletter is disabled.
+	newsletter *Newsletter
+	// nil if Micropub is disabled.
+	micropub *Micropub
+	// nil unless PostsDir is a git working tree.
+	git     *GitRepo
+	auth    *Auth
+	stats   *CacheStats
+	metrics *Metrics
+	warmer  *CacheWarmer
+
+	accessLog *AccessLog
+	proxies   TrustedProxies
+
+	archive ArchiveSpecList
+	// Tags of the posts, replaced when a post changes.
+	tags      *Tags
 	templates *template.Template
+	// Modification time of the newest template file.
+	templatesModTime time.Time
 }
 
 type Config struct {
@@ -58,6 +89,12 @@ type Config struct {
 	TagsPageNewestFirst bool
 	// True if archive list at the bottom should start with the latest month.
 	ArchiveListNewestFirst bool
+	// IANA name of the time zone that times are shown in and that posts are grouped into
+	// months by, such as "America/New_York". If empty, times are shown with the offset
+	// they were written with, and posts are grouped by their directories.
+	Timezone string
+	// Language of the month and day names in dates, such as "de" or "fr". English if empty.
+	Locale string
 
 	// Directory to search for posts.
 	PostsDir string
@@ -70,9 +107,123 @@ type Config struct {
 
 	LogDir string
 
+	// Format of the access log in LogDir: "combined" for the Apache Combined format,
+	// "json" for one JSON object per line, or "none" to disable it.
+	AccessLogFormat string
+	// Rotate the access log when it reaches this many bytes. 0 means no limit.
+	AccessLogMaxSize int
+	// Rotate the access log after this many hours. 0 means no limit.
+	AccessLogMaxAge int
+	// Number of rotated access logs to keep. 0 keeps them all.
+	AccessLogMaxFiles int
+	// Comma-separated list of proxy addresses or CIDR networks whose
+	// X-Forwarded-For headers are trusted to give the client's address.
+	TrustedProxies string
+
 	Domain string
 	Port   int
 
+	// Address for the admin endpoints, such as "localhost:8081". This should not be
+	// reachable from the public internet. If empty, the admin endpoints are disabled.
+	AdminAddr string
+	// Accounts that can sign in to the admin endpoints, keyed by user name. If there are
+	// none, the admin endpoints that only read are open to anyone who can reach AdminAddr,
+	// and the rest are not served.
+	Users map[string]UserConfig
+	// Hours until a user has to sign in again.
+	SessionTTL int
+	// Only send the session cookie over HTTPS. Set this when a TLS proxy is in front
+	// of the admin address.
+	SecureCookies bool
+	// Serve a post editor at /admin on the admin address. Posts are written to PostsDir,
+	// and uploaded images to DataDir/images. The editor requires Users to be configured.
+	EnableEditor bool
+	// Maximum size of an uploaded image, in bytes.
+	ImageUploadMaxSize int
+	// Treat PostsDir as a git working tree. A push reported to the webhook at /git/webhook
+	// fetches GitBranch from GitRemote and checks it out, and each post's commit history
+	// is available to templates.
+	EnableGit bool
+	GitRemote string
+	GitBranch string
+	// Secret for the HMAC-SHA256 signature on webhook requests.
+	GitWebhookSecret string
+	// Accept posts from Micropub clients at /micropub on the public port, with images
+	// uploaded to /micropub/media.
+	EnableMicropub bool
+	// Access tokens for Micropub clients, each with a space-separated list of the scopes
+	// it is granted: create, update, delete, and media.
+	MicropubTokens map[string]string
+	// Serve Prometheus metrics at /metrics on the public port. They are always
+	// available on the admin port. If Users are configured, fetching them requires
+	// HTTP basic authentication.
+	EnableMetrics bool
+
+	// Requests per second allowed from each client, and the number that can be made at once.
+	// 0, the default, disables the limit. Behind a proxy, set TrustedProxies so that each
+	// client has its own limit.
+	RateLimit      float64
+	RateLimitBurst int
+	// Requests per second resulting in a 404 allowed from each client. Once a client uses
+	// up its burst, all its requests are refused until it has waited. 0, the default, disables
+	// the limit.
+	RateLimitNotFound      float64
+	RateLimitNotFoundBurst int
+	// Comma-separated list of IP addresses and CIDR networks that are never rate limited,
+	// such as proxies that don't send X-Forwarded-For.
+	RateLimitExempt string
+	// Number of seconds to remember that a page or file was not found. 0 disables it.
+	NotFoundCacheTTL int
+
+	// Accept comments on posts, storing them in CommentsDir.
+	EnableComments bool
+	CommentsDir    string
+	// Hold new comments for approval in the admin interface before showing them.
+	CommentsModeration bool
+	// Maximum length of a comment, in bytes.
+	CommentMaxLength int
+	// Comments per hour from each client. 0 disables the limit.
+	CommentRateLimit int
+	// Key for signing CSRF tokens. If empty, a random key is generated at startup, and forms
+	// that were loaded before a restart have to be submitted again.
+	CSRFSecret string
+
+	// Accept webmentions at /webmention, storing them in WebmentionsDir.
+	EnableWebmentions bool
+	WebmentionsDir    string
+	// Notify the sites that posts link to when the posts are created or changed. The links
+	// last notified for each post are kept in WebmentionsDir/sent.json.
+	SendWebmentions bool
+
+	// Serve a contact form at /contact that emails messages to ContactTo.
+	EnableContact bool
+	// SMTP server that delivers the messages, as host:port.
+	SMTPAddr string
+	// SMTP credentials. Authentication is skipped if SMTPUsername is empty.
+	SMTPUsername string
+	SMTPPassword string
+	// Address the messages are sent from, and a comma-separated list of addresses to send them to.
+	ContactFrom string
+	ContactTo   string
+	// Directory for messages that could not be delivered. Sending them is retried every few minutes.
+	ContactSpoolDir string
+	// Messages per hour each client can send. 0 disables the limit.
+	ContactRateLimit int
+	// Maximum length of a message, in bytes.
+	ContactMaxLength int
+
+	// Let readers subscribe at /newsletter to get new posts by email, storing the
+	// subscribers in NewsletterDir. Messages are sent through the SMTP server above.
+	EnableNewsletter bool
+	NewsletterDir    string
+	// Address the newsletter is sent from.
+	NewsletterFrom string
+	// Hours between digests. 0 disables the scheduler, so digests are only sent by
+	// running with -send-digest.
+	NewsletterInterval int
+	// Subscription requests per hour each client can make. 0 disables the limit.
+	NewsletterRateLimit int
+
 	// After starting the listener, switch to running as this user.
 	// In current versions of Go this doesn't work right, since it only switches the
 	// calling thread and not the other threads. This can screw up the disk cache
@@ -86,19 +237,123 @@ type Config struct {
 	SmallMemCacheLimit       int
 	LargeMemCacheObjectLimit int
 	SmallMemCacheObjectLimit int
+	// Maximum number of objects in each memory cache. 0 means no limit.
+	LargeMemCacheEntryLimit int
+	SmallMemCacheEntryLimit int
+	// Number of seconds an object stays in the memory cache. 0 means no limit.
+	MemCacheTTL int
+
+	// Comma-separated list of content types that are never compressed, because they are
+	// already compressed. A type ending in /* matches every subtype.
+	NoCompressTypes string
+
+	// Caching headers for each class of route.
+	CacheControl CacheControlConfig
+	// Security headers sent with every response, with overrides for feeds and images.
+	SecurityHeaders SecurityHeadersConfig
+
+	// Minify CSS, JavaScript, and SVG files in the assets directory.
+	MinifyAssets bool
+	// Minify the HTML of rendered pages.
+	MinifyHTML bool
+	// Files served from /assets that are built by concatenating other assets, in order.
+	// Names are relative to the assets directory.
+	Bundles map[string][]string
+
+	// Pages to render in the background after startup and after the cache is invalidated.
+	CacheWarmIndex bool
+	CacheWarmFeed  bool
+	// Number of the newest posts to render.
+	CacheWarmPosts int
+	// Number of the most popular tag pages to render.
+	CacheWarmTags int
+	// Maximum number of pages to render at once.
+	CacheWarmConcurrency int
+}
+
+// redacted returns a copy of the configuration with its secrets masked, so that it can
+// be logged.
+func (c *Config) redacted() *Config {
+	mask := func(secret string) string {
+		if secret == "" {
+			return ""
+		}
+		return "[redacted]"
+	}
+
+	r := *c
+	r.SMTPPassword = mask(c.SMTPPassword)
+	r.CSRFSecret = mask(c.CSRFSecret)
+	r.Users = make(map[string]UserConfig, len(c.Users))
+	for name, user := range c.Users {
+		r.Users[name] = UserConfig{PasswordHash: mask(user.PasswordHash), TOTPSecret: mask(user.TOTPSecret)}
+	}
+	r.MicropubTokens = make(map[string]string, len(c.MicropubTokens))
+	for _, scopes := range c.MicropubTokens {
+		r.MicropubTokens[fmt.Sprintf("[redacted %d]", len(r.MicropubTokens)+1)] = scopes
+	}
+	r.GitWebhookSecret = mask(c.GitWebhookSecret)
+	return &r
 }
 
 type simpleBlogHandler func(*GlobalData, http.ResponseWriter, *http.Request, map[string]string)
 
-func handlerWrapper(handler simpleBlogHandler, globalData *GlobalData) httptreemux.HandlerFunc {
+// statusWriter records the status code and size of a response.
+type statusWriter struct {
+	http.ResponseWriter
+	status int
+	bytes  int
+}
+
+func (w *statusWriter) WriteHeader(status int) {
+	w.status = status
+	w.ResponseWriter.WriteHeader(status)
+}
+
+func (w *statusWriter) Write(b []byte) (int, error) {
+	if w.status == 0 {
+		w.status = http.StatusOK
+	}
+	n, err := w.ResponseWriter.Write(b)
+	w.bytes += n
+	return n, err
+}
+
+// handlerWrapper adapts a simpleBlogHandler to the router, logging each request and
+// recording its metrics under the given route name.
+func handlerWrapper(route string, handler simpleBlogHandler, globalData *GlobalData) httptreemux.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request, urlParams map[string]string) {
-		glog.Infof("%s %s", r.Method, r.RequestURI)
+		if glog.V(1) {
+			glog.Infof("%s %s", r.Method, r.RequestURI)
+		}
 		startTime := time.Now()
-		handler(globalData, w, r, urlParams)
-		endTime := time.Now()
-		duration := endTime.Sub(startTime)
+		sw := &statusWriter{ResponseWriter: w}
+		handler(globalData, sw, r, urlParams)
+		recordRequest(globalData, route, r, sw, startTime)
+	}
+}
+
+// recordRequest adds a request that has been handled to the metrics and the access log.
+func recordRequest(globalData *GlobalData, route string, r *http.Request, sw *statusWriter,
+	startTime time.Time) {
+
+	duration := time.Since(startTime)
+	if glog.V(1) {
 		glog.Infof("   Handled in %d us", duration/time.Microsecond)
 	}
+
+	if sw.status == 0 {
+		sw.status = http.StatusOK
+	}
+	globalData.metrics.ObserveRequest(route, sw.status, duration)
+
+	if globalData.accessLog != nil {
+		entry := NewAccessLogEntry(r, globalData.proxies.ClientIP(r), startTime, duration,
+			sw.status, sw.bytes)
+		if err := globalData.accessLog.Log(entry); err != nil {
+			glog.Errorln("Failed to write access log:", err)
+		}
+	}
 }
 
 func fileWrapper(filename string, handler httptreemux.HandlerFunc) httptreemux.HandlerFunc {
@@ -126,6 +381,20 @@ func isDirectory(dirPath string) bool {
 	return true
 }
 
+// cacheVersion identifies the configuration and program that pages are built with, since
+// a change to either can change every page.
+func cacheVersion() string {
+	hash := fnv.New64a()
+	data, _ := json.Marshal(config)
+	hash.Write(data)
+	if exe, err := os.Executable(); err == nil {
+		if stat, err := os.Stat(exe); err == nil {
+			fmt.Fprintf(hash, "%d %d", stat.Size(), stat.ModTime().UnixNano())
+		}
+	}
+	return fmt.Sprintf("%x", hash.Sum(nil))
+}
+
 func runAs(username string) error {
 	u, err := user.Lookup(username)
 	if err != nil {
@@ -156,8 +425,12 @@ func runAs(username string) error {
 	return nil
 }
 
-func setup() (router *httptreemux.TreeMux, listener net.Listener, cleanup func()) {
+func setup() (handler http.Handler, listener net.Listener, cleanup func()) {
 	flag.Parse()
+	if *hashPasswordFlag {
+		os.Exit(hashPasswordCommand(os.Stdin, os.Stdout))
+	}
+
 	config = &Config{
 		Port: 80,
 		// Large memory cache uses 64 MiB at most, with the largest object being 8 MiB.
@@ -166,6 +439,49 @@ func setup() (router *httptreemux.TreeMux, listener net.Listener, cleanup func()
 		// Small memory cache uses 16 MiB at most, with the largest object being 16KiB.
 		SmallMemCacheLimit:       16 * 1024 * 1024,
 		SmallMemCacheObjectLimit: 16 * 1024,
+
+		AccessLogFormat:   AccessLogCombined,
+		AccessLogMaxSize:  64 * 1024 * 1024,
+		AccessLogMaxAge:   24,
+		AccessLogMaxFiles: 14,
+
+		NoCompressTypes: "image/*,video/*,audio/*,font/woff,font/woff2,application/zip," +
+			"application/gzip,application/x-gzip,application/x-bzip2,application/x-xz," +
+			"application/x-7z-compressed,application/pdf",
+
+		CacheControl:    defaultCacheControl(),
+		SecurityHeaders: defaultSecurityHeaders(),
+
+		RateLimitBurst:         100,
+		RateLimitNotFoundBurst: 30,
+		NotFoundCacheTTL:       60,
+
+		CommentsDir:        "comments",
+		CommentsModeration: true,
+		CommentMaxLength:   5000,
+		CommentRateLimit:   10,
+
+		WebmentionsDir: "webmentions",
+
+		SessionTTL:         12,
+		GitRemote:          "origin",
+		GitBranch:          "master",
+		ImageUploadMaxSize: 20 * 1024 * 1024,
+
+		SMTPAddr:         "localhost:25",
+		ContactSpoolDir:  "spool",
+		ContactRateLimit: 5,
+		ContactMaxLength: 10000,
+
+		NewsletterDir:       "newsletter",
+		NewsletterInterval:  168,
+		NewsletterRateLimit: 5,
+
+		CacheWarmIndex:       true,
+		CacheWarmFeed:        true,
+		CacheWarmPosts:       5,
+		CacheWarmTags:        5,
+		CacheWarmConcurrency: 2,
 	}
 	confFile := os.Getenv("SIMPLEBLOG_CONF")
 	if confFile == "" && flag.NArg() != 0 {
@@ -192,6 +508,14 @@ func setup() (router *httptreemux.TreeMux, listener net.Listener, cleanup func()
 		fmt.Fprintf(os.Stderr, "Error loading config: %s\n", err)
 		os.Exit(1)
 	}
+	if err := checkTimeConfig(); err != nil {
+		fmt.Fprintf(os.Stderr, "Error loading config: %s\n", err)
+		os.Exit(1)
+	}
+
+	if *sendDigestFlag {
+		os.Exit(sendDigestCommand())
+	}
 
 	listener, err = net.Listen("tcp", ":"+strconv.Itoa(config.Port))
 	if err != nil {
@@ -199,6 +523,15 @@ func setup() (router *httptreemux.TreeMux, listener net.Listener, cleanup func()
 		os.Exit(1)
 	}
 
+	var adminListener net.Listener
+	if config.AdminAddr != "" {
+		adminListener, err = net.Listen("tcp", config.AdminAddr)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Could not listen on admin address %s: %s\n", config.AdminAddr, err)
+			os.Exit(1)
+		}
+	}
+
 	// Downgrade privileges, if configured, so we're not running as root.
 	if config.RunAs != "" {
 		err = runAs(config.RunAs)
@@ -225,12 +558,50 @@ func setup() (router *httptreemux.TreeMux, listener net.Listener, cleanup func()
 		}
 	}
 
+	proxies, err := ParseTrustedProxies(config.TrustedProxies)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error loading config: %s\n", err)
+		os.Exit(1)
+	}
+
+	rateLimitExempt, err := ParseTrustedProxies(config.RateLimitExempt)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error loading config: RateLimitExempt: %s\n", err)
+		os.Exit(1)
+	}
+
+	var accessLog *AccessLog
+	if config.AccessLogFormat != "none" {
+		logDir := config.LogDir
+		if logDir == "" {
+			logDir = "."
+		}
+		accessLog, err = NewAccessLog(filepath.Join(logDir, "access.log"), config.AccessLogFormat,
+			int64(config.AccessLogMaxSize), time.Duration(config.AccessLogMaxAge)*time.Hour,
+			config.AccessLogMaxFiles)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Could not open access log: %s\n", err)
+			os.Exit(1)
+		}
+	}
+
+	var globalData *GlobalData
+	dependenciesPath := filepath.Join(config.CacheDir, "dependencies.json")
+
 	closer := func() {
 		glog.Infoln("Shutting down...")
+		if globalData != nil {
+			if err := globalData.deps.Save(dependenciesPath, cacheVersion()); err != nil {
+				glog.Errorln("Could not save cache dependencies:", err)
+			}
+		}
 		glog.Flush()
+		if accessLog != nil {
+			accessLog.Close()
+		}
 	}
 
-	glog.Infof("Starting with config\n%+v\n", config)
+	glog.Infof("Starting with config\n%+v\n", config.redacted())
 
 	if config.Port != 80 {
 		config.Domain = fmt.Sprintf("%s:%d", config.Domain, config.Port)
@@ -257,13 +628,15 @@ func setup() (router *httptreemux.TreeMux, listener net.Listener, cleanup func()
 		glog.Fatal("Could not find assets directory ", filepath.Join(config.DataDir, "images"))
 	}
 
+	memCacheTTL := time.Duration(config.MemCacheTTL) * time.Second
+
 	largeObjectLimit := config.LargeMemCacheObjectLimit
-	largeMemCache := gocache.NewMemoryCache(
-		config.LargeMemCacheLimit, largeObjectLimit)
+	largeMemCache := lru.New(config.LargeMemCacheLimit, largeObjectLimit,
+		config.LargeMemCacheEntryLimit, memCacheTTL)
 
 	smallObjectLimit := config.SmallMemCacheObjectLimit
-	smallMemCache := gocache.NewMemoryCache(
-		config.SmallMemCacheLimit, smallObjectLimit)
+	smallMemCache := lru.New(config.SmallMemCacheLimit, smallObjectLimit,
+		config.SmallMemCacheEntryLimit, memCacheTTL)
 
 	// Create a split cache, putting all objects smaller than 16 KiB into the small cache.
 	// This split cache prevents a few large objects from evicting all the smaller objects.
@@ -271,19 +644,120 @@ func setup() (router *httptreemux.TreeMux, listener net.Listener, cleanup func()
 		gocache.SplitSizeChild{MaxSize: smallObjectLimit, Cache: smallMemCache},
 		gocache.SplitSizeChild{MaxSize: largeObjectLimit, Cache: largeMemCache})
 
-	multiLevelCache := gocache.MultiLevel{0: memCache, 1: diskCache}
+	stats := NewCacheStats(smallMemCache, largeMemCache)
+	multiLevelCache := gocache.MultiLevel{0: memCache, 1: stats.WrapDiskCache(diskCache)}
+
+	// A page deleted while it was being rendered may still have had its compressed versions
+	// stored, in either memory cache or on disk.
+	removeVariants := func(key string) {
+		for _, variant := range cacheKeyVariants(baseCacheKey(key)) {
+			multiLevelCache.Del(variant)
+		}
+	}
+	smallMemCache.SetInvalidateHook(removeVariants)
+	largeMemCache.SetInvalidateHook(removeVariants)
+	// Pages left in the disk cache by the previous run can only be invalidated if it saved
+	// the dependencies they were built from. Otherwise, start from a clean cache.
+	deps, depsSaved, err := LoadDependencyTracker(dependenciesPath, cacheVersion())
+	if err != nil {
+		if !os.IsNotExist(err) {
+			glog.Infoln("Clearing the disk cache:", err)
+		}
+		deps = NewDependencyTracker()
+		multiLevelCache.Del("*")
+		os.Remove(config.TagsPath)
+	}
 
 	templates, err := createTemplates()
 	if err != nil {
 		glog.Fatal("Error parsing template: ", err.Error())
 	}
 
-	os.Remove(config.TagsPath)
-	globalData := &GlobalData{
+	globalData = &GlobalData{
 		RWMutex:   &sync.RWMutex{},
 		cache:     multiLevelCache,
 		memCache:  memCache,
+		deps:      deps,
+		notFound:  NewNotFoundCache(time.Duration(config.NotFoundCacheTTL)*time.Second, 10000),
+		stats:     stats,
+		metrics:   NewMetrics(),
+		accessLog: accessLog,
+		proxies:   proxies,
 		templates: templates,
+
+		templatesModTime: templatesModTime(),
+	}
+
+	assetManifest = NewAssetManifest(filepath.Join(config.DataDir, "assets"))
+	if err := assetManifest.Scan(); err != nil {
+		glog.Errorln("Could not fingerprint assets:", err)
+	}
+
+	if config.EnableComments {
+		globalData.comments, err = NewCommentStore(config.CommentsDir)
+		if err != nil {
+			glog.Fatal("Could not open comment store: ", err)
+		}
+		globalData.commentForms, err = NewCommentForms()
+		if err != nil {
+			glog.Fatal("Could not set up comment forms: ", err)
+		}
+	}
+
+	if config.EnableWebmentions || config.SendWebmentions {
+		var store *WebmentionStore
+		if config.EnableWebmentions {
+			store, err = NewWebmentionStore(config.WebmentionsDir)
+			if err != nil {
+				glog.Fatal("Could not open webmention store: ", err)
+			}
+		}
+
+		sentPath := filepath.Join(config.WebmentionsDir, "sent.json")
+		globalData.webmentions = NewWebmentions(store, sentPath, newWebmentionClient(), func(post string) {
+			globalData.deps.Invalidate(globalData.cache, WebmentionsDependency(postSourcePath(post)))
+		})
+	}
+
+	if config.EnableContact {
+		globalData.contact, err = NewContact()
+		if err != nil {
+			glog.Fatal("Could not set up contact form: ", err)
+		}
+		go globalData.contact.mailer.retrySpoolEvery(5 * time.Minute)
+	}
+
+	if config.EnableNewsletter {
+		globalData.newsletter, err = NewNewsletter()
+		if err != nil {
+			glog.Fatal("Could not set up newsletter: ", err)
+		}
+		if config.NewsletterInterval > 0 {
+			go globalData.newsletter.runDigestScheduler(globalData)
+		}
+	}
+
+	if config.EnableGit {
+		globalData.git, err = NewGitRepo()
+		if err != nil {
+			glog.Fatal("Could not set up git: ", err)
+		}
+		go globalData.git.runPuller(globalData)
+	}
+
+	if config.EnableMicropub {
+		globalData.micropub, err = NewMicropub()
+		if err != nil {
+			glog.Fatal("Could not set up Micropub: ", err)
+		}
+	}
+
+	globalData.auth, err = NewAuth()
+	if err != nil {
+		glog.Fatal("Could not set up authentication: ", err)
+	}
+	if !globalData.auth.Enabled() && adminListener != nil {
+		glog.Warningln("No Users are configured, so the admin endpoints are not password protected")
 	}
 
 	archive, err := NewArchiveSpecList(config.PostsDir)
@@ -291,38 +765,93 @@ func setup() (router *httptreemux.TreeMux, listener net.Listener, cleanup func()
 		glog.Fatal("Could not create archive list: ", err)
 	}
 	globalData.archive = archive
+	globalData.warmer = NewCacheWarmer(globalData)
+
+	if !depsSaved.IsZero() {
+		invalidateChangedSince(globalData, depsSaved)
+	}
+	tags := NewTags(config.TagsPath, config.PostsDir)
+	globalData.Lock()
+	globalData.tags = tags
+	globalData.Unlock()
 
 	go watchFiles(globalData)
 
-	router = httptreemux.New()
+	router := httptreemux.New()
 	router.PanicHandler = httptreemux.ShowErrorsPanicHandler
 
-	router.GET("/", handlerWrapper(indexHandler, globalData))
-	router.GET("/:year/:month/", handlerWrapper(archiveHandler, globalData))
-	router.GET("/:year/:month/:post", handlerWrapper(postHandler, globalData))
+	// wrap adds the logging and security headers middleware around a handler.
+	wrap := func(route string, handler simpleBlogHandler) httptreemux.HandlerFunc {
+		return securityHeadersWrapper(route, handlerWrapper(route, handler, globalData))
+	}
+
+	router.GET("/", wrap(RouteIndex, indexHandler))
+	router.GET("/:year/:month/", wrap(RouteArchive, archiveHandler))
+	router.GET("/:year/:month/:post", wrap(RoutePost, postHandler))
+	if globalData.comments != nil {
+		router.POST("/:year/:month/:post/comments", wrap(RouteComment, commentPostHandler))
+	}
+	if config.EnableWebmentions {
+		router.POST("/webmention", wrap(RouteWebmention, webmentionHandler))
+	}
+	if globalData.contact != nil {
+		router.GET("/contact", wrap(RouteContact, contactFormHandler))
+		router.POST("/contact", wrap(RouteContact, contactPostHandler))
+	}
+	if globalData.newsletter != nil {
+		router.GET("/newsletter", wrap(RouteNewsletter, newsletterFormHandler))
+		router.POST("/newsletter", wrap(RouteNewsletter, newsletterSubscribeHandler))
+		router.GET("/newsletter/confirm", wrap(RouteNewsletter, newsletterConfirmFormHandler))
+		router.POST("/newsletter/confirm", wrap(RouteNewsletter, newsletterConfirmHandler))
+		router.GET("/newsletter/unsubscribe", wrap(RouteNewsletter, newsletterUnsubscribeFormHandler))
+		router.POST("/newsletter/unsubscribe", wrap(RouteNewsletter, newsletterUnsubscribeHandler))
+	}
+
+	if globalData.git != nil {
+		router.POST("/git/webhook", wrap(RouteGitWebhook, gitWebhookHandler))
+	}
+	if globalData.micropub != nil {
+		router.GET("/micropub", wrap(RouteMicropub, micropubQueryHandler))
+		router.POST("/micropub", wrap(RouteMicropub, micropubHandler))
+		router.POST("/micropub/media", wrap(RouteMicropub, micropubMediaHandler))
+	}
+
+	router.GET("/images/*file", filePrefixWrapper("images", wrap(RouteImage, staticHandler(RouteImage))))
+	router.GET("/assets/*file", filePrefixWrapper("assets", wrap(RouteAsset, staticHandler(RouteAsset))))
+
+	router.GET("/tag/:tag", wrap(RouteTag, tagHandler))
+
+	router.GET("/:page", wrap(RoutePage, pageHandler))
+	router.GET("/favicon.ico", fileWrapper("assets/favicon.ico", wrap(RouteAsset, staticHandler(RouteAsset))))
+	router.GET("/robots.txt", fileWrapper("assets/robots.txt", wrap(RouteAsset, staticHandler(RouteAsset))))
+	router.GET("/feed", wrap(RouteFeed, atomHandler))
 
-	router.GET("/images/*file", filePrefixWrapper("images",
-		handlerWrapper(staticNoCompressHandler, globalData)))
-	router.GET("/assets/*file", filePrefixWrapper("assets",
-		handlerWrapper(staticCompressHandler, globalData)))
+	if config.EnableMetrics {
+		router.GET("/metrics", wrap(RouteMetrics, globalData.auth.Protect("", metricsHandler)))
+	}
+
+	if adminListener != nil {
+		glog.Infoln("Serving admin endpoints on", config.AdminAddr)
+		go func() {
+			glog.Infoln(http.Serve(adminListener, setupAdminRouter(globalData)))
+		}()
+	}
 
-	router.GET("/tag/:tag", handlerWrapper(tagHandler, globalData))
+	globalData.warmer.Warm()
 
-	router.GET("/:page", handlerWrapper(pageHandler, globalData))
-	router.GET("/favicon.ico", fileWrapper("assets/favicon.ico",
-		handlerWrapper(staticCompressHandler, globalData)))
-	router.GET("/robots.txt", fileWrapper("assets/robots.txt",
-		handlerWrapper(staticNoCompressHandler, globalData)))
-	router.GET("/feed", handlerWrapper(atomHandler, globalData))
+	if (config.RateLimit > 0 || config.RateLimitNotFound > 0) && len(proxies) == 0 {
+		glog.Warningln("Rate limits are enabled without TrustedProxies. If simpleblog is behind " +
+			"a proxy, every client will share the proxy's limit.")
+	}
 
-	return router, listener, closer
+	return NewRateLimitHandler(router, proxies, rateLimitExempt, globalData), listener, closer
 }
 
 func main() {
-	router, listener, closer := setup()
+	handler, listener, closer := setup()
 
 	catchSIGINT(closer, true)
 	defer closer()
 
-	glog.Infoln(http.Serve(listener, router))
+	glog.Infoln(http.Serve(listener, handler))
 }
@@ -125,6 +125,7 @@ func (tags *Tags) TagsByName() []string {
 	i := 0
 	for tag, _ := range tags.Tag {
 		s[i] = tag
+		i++
 	}
 
 	sort.Strings(s)
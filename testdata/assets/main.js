@@ -0,0 +1,9 @@
+// Opens links to other sites in a new tab.
+document.addEventListener("DOMContentLoaded", function() {
+	var links = document.querySelectorAll("a[href^=\"http\"]");
+	for (var i = 0; i < links.length; i++) {
+		if (links[i].host != location.host) {
+			links[i].target = "_blank";
+		}
+	}
+});
@@ -0,0 +1,9 @@
+// Toggles the navigation menu on small screens.
+document.addEventListener("DOMContentLoaded", function() {
+	var button = document.querySelector(".menu-toggle");
+	if (button) {
+		button.addEventListener("click", function() {
+			document.body.classList.toggle("menu-open");
+		});
+	}
+});
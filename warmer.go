@@ -0,0 +1,220 @@
+package main
+
+import (
+	"github.com/dimfeld/glog"
+	"net/http"
+	"net/url"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// warmRoute is a page to render in the background.
+type warmRoute struct {
+	path string
+	// Route type, which decides the security headers.
+	route     string
+	handler   simpleBlogHandler
+	urlParams map[string]string
+}
+
+// CacheWarmer renders the most commonly requested pages in the background, so that
+// the first visitors after startup or after an invalidation don't pay for rendering them.
+type CacheWarmer struct {
+	globalData *GlobalData
+
+	lock    sync.Mutex
+	running bool
+	// Set if Warm was called while a run was in progress, so another run is needed
+	// to pick up whatever was invalidated in the meantime.
+	pending bool
+}
+
+func NewCacheWarmer(globalData *GlobalData) *CacheWarmer {
+	return &CacheWarmer{globalData: globalData}
+}
+
+// Warm starts warming the cache in the background. If a run is already in progress,
+// another one will start when it finishes.
+func (cw *CacheWarmer) Warm() {
+	if !config.CacheWarmIndex && !config.CacheWarmFeed &&
+		config.CacheWarmPosts == 0 && config.CacheWarmTags == 0 {
+		return
+	}
+
+	cw.lock.Lock()
+	defer cw.lock.Unlock()
+	if cw.running {
+		cw.pending = true
+		return
+	}
+	cw.running = true
+
+	go cw.run()
+}
+
+func (cw *CacheWarmer) run() {
+	for {
+		cw.warmRoutes(cw.routes())
+
+		cw.lock.Lock()
+		if !cw.pending {
+			cw.running = false
+			cw.lock.Unlock()
+			return
+		}
+		cw.pending = false
+		cw.lock.Unlock()
+	}
+}
+
+// routes returns the configured set of pages to warm.
+func (cw *CacheWarmer) routes() []warmRoute {
+	routes := []warmRoute{}
+
+	if config.CacheWarmIndex {
+		routes = append(routes, warmRoute{"/", RouteIndex, indexHandler, map[string]string{}})
+	}
+
+	if config.CacheWarmFeed {
+		routes = append(routes, warmRoute{"/feed", RouteFeed, atomHandler, map[string]string{}})
+	}
+
+	if config.CacheWarmPosts == 0 && config.CacheWarmTags == 0 {
+		return routes
+	}
+
+	tags := NewTags(config.TagsPath, config.PostsDir)
+
+	if config.CacheWarmPosts > 0 {
+		posts := make(PostList, 0, len(tags.Post))
+		for _, post := range tags.Post {
+			posts = append(posts, post)
+		}
+		sort.Sort(sort.Reverse(posts))
+
+		count := 0
+		for _, post := range posts {
+			if count == config.CacheWarmPosts {
+				break
+			}
+
+			year, month, ok := post.ArchiveMonth()
+			if !ok {
+				// Custom pages aren't posts.
+				continue
+			}
+
+			name := strings.TrimSuffix(filepath.Base(post.SourcePath), ".md")
+			routes = append(routes, warmRoute{
+				"/" + year + "/" + month + "/" + name,
+				RoutePost,
+				postHandler,
+				map[string]string{"year": year, "month": month, "post": name},
+			})
+			count++
+		}
+	}
+
+	popularTags := tags.TagsByPopularity()
+	if len(popularTags) > config.CacheWarmTags {
+		popularTags = popularTags[0:config.CacheWarmTags]
+	}
+	for _, tc := range popularTags {
+		// Match the escaping used by urlquery in the templates.
+		tag := url.QueryEscape(tc.Tag)
+		routes = append(routes, warmRoute{"/tag/" + tag, RouteTag, tagHandler,
+			map[string]string{"tag": tag}})
+	}
+
+	return routes
+}
+
+// warmEncodings returns the Accept-Encoding values used to warm each variant of a route's
+// pages. Pages with a nonce are only cached uncompressed.
+func warmEncodings(route string) []string {
+	encodings := []string{""}
+	if routeUsesNonce(route) {
+		return encodings
+	}
+	for _, encoding := range contentEncodings {
+		encodings = append(encodings, encoding.Name)
+	}
+	return encodings
+}
+
+// warmRoutes renders each route in its plain and compressed forms, running at most
+// config.CacheWarmConcurrency requests at once.
+func (cw *CacheWarmer) warmRoutes(routes []warmRoute) {
+	concurrency := config.CacheWarmConcurrency
+	if concurrency < 1 {
+		concurrency = 1
+	}
+
+	if glog.V(1) {
+		glog.Infof("Warming cache with %d routes", len(routes))
+	}
+
+	sem := make(chan struct{}, concurrency)
+	wg := &sync.WaitGroup{}
+	for _, route := range routes {
+		for _, encoding := range warmEncodings(route.route) {
+			wg.Add(1)
+			sem <- struct{}{}
+			go func(route warmRoute, encoding string) {
+				defer func() {
+					<-sem
+					wg.Done()
+				}()
+				cw.warmRoute(route, encoding)
+			}(route, encoding)
+		}
+	}
+	wg.Wait()
+}
+
+func (cw *CacheWarmer) warmRoute(route warmRoute, encoding string) {
+	r, err := http.NewRequest("GET", route.path, nil)
+	if err != nil {
+		glog.Errorf("Cache warmer could not create request for %s: %s", route.path, err)
+		return
+	}
+	if encoding != "" {
+		r.Header.Set("Accept-Encoding", encoding)
+	}
+
+	// Copy the parameters since the handlers may modify them.
+	urlParams := make(map[string]string, len(route.urlParams))
+	for k, v := range route.urlParams {
+		urlParams[k] = v
+	}
+
+	w := &discardResponseWriter{header: make(http.Header)}
+	route.handler(cw.globalData, w, r, urlParams)
+
+	if glog.V(2) {
+		glog.Infof("Warmed %s [%s]: status %d", route.path, encoding, w.status)
+	}
+}
+
+// discardResponseWriter is an http.ResponseWriter that throws away the response.
+type discardResponseWriter struct {
+	header http.Header
+	status int
+}
+
+func (w *discardResponseWriter) Header() http.Header {
+	return w.header
+}
+
+func (w *discardResponseWriter) Write(b []byte) (int, error) {
+	if w.status == 0 {
+		w.status = http.StatusOK
+	}
+	return len(b), nil
+}
+
+func (w *discardResponseWriter) WriteHeader(status int) {
+	w.status = status
+}
@@ -0,0 +1,83 @@
+package main
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+// waitForWarmer waits for the warmer's runs to finish.
+func waitForWarmer(t *testing.T, cw *CacheWarmer) {
+	for i := 0; i < 500; i++ {
+		cw.lock.Lock()
+		running := cw.running
+		cw.lock.Unlock()
+		if !running {
+			return
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Fatal("Cache warmer did not finish")
+}
+
+func TestCacheWarmer(t *testing.T) {
+	_, globalData, cleanup := setupSiteTest(t, "warmer")
+	defer cleanup()
+	config.CacheWarmIndex = true
+	config.CacheWarmFeed = true
+	config.CacheWarmPosts = 2
+	config.CacheWarmTags = 1
+	config.CacheWarmConcurrency = 2
+	globalData.warmer = NewCacheWarmer(globalData)
+
+	paths := []string{}
+	for _, route := range globalData.warmer.routes() {
+		paths = append(paths, route.path)
+	}
+	expected := "/ /feed /2014/05/second-post /2014/05/first-post /tag/"
+	if !strings.HasPrefix(strings.Join(paths, " "), expected) || len(paths) != 5 {
+		t.Errorf("Expected routes %s<tag>, saw %v", expected, paths)
+	}
+
+	globalData.warmer.Warm()
+	waitForWarmer(t, globalData.warmer)
+
+	// Every page is filled in each encoding.
+	for _, base := range []string{"index.html", "atom.xml", "2014/05/second-post.md",
+		"2014/05/first-post.md", "tags/" + strings.TrimPrefix(paths[4], "/tag/")} {
+
+		for _, key := range cacheKeyVariants(base) {
+			if !isCached(globalData.cache, key) {
+				t.Errorf("%s was not warmed", key)
+			}
+		}
+	}
+	if isCached(globalData.cache, "2014/04/april-post.md") {
+		t.Error("Warmed more posts than CacheWarmPosts")
+	}
+
+	// Pages with a nonce are compressed as they're sent, so only the feed has variants.
+	globalData.cache.Del("*")
+	config.SecurityHeaders.Default.ContentSecurityPolicy = "script-src 'nonce-{nonce}'"
+	globalData.warmer.Warm()
+	waitForWarmer(t, globalData.warmer)
+	if !isCached(globalData.cache, "index.html") || isCached(globalData.cache, "index.html#br") ||
+		!isCached(globalData.cache, "atom.xml#br") {
+		t.Error("Expected only the uncompressed index and every variant of the feed")
+	}
+
+	// Nothing is warmed when it's all turned off.
+	globalData.cache.Del("*")
+	config.CacheWarmIndex = false
+	config.CacheWarmFeed = false
+	config.CacheWarmPosts = 0
+	config.CacheWarmTags = 0
+	if routes := globalData.warmer.routes(); len(routes) != 0 {
+		t.Errorf("Expected no routes, saw %v", routes)
+	}
+	globalData.warmer.Warm()
+	waitForWarmer(t, globalData.warmer)
+	if isCached(globalData.cache, "index.html") {
+		t.Error("Warmer ran with nothing to warm")
+	}
+}
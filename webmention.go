@@ -0,0 +1,506 @@
+package main
+
+import (
+	"bytes"
+	"code.google.com/p/go.net/html"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/dimfeld/glog"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// Route type for received webmentions.
+const RouteWebmention = "webmention"
+
+// Maximum number of bytes read from a document fetched for a webmention.
+const maxWebmentionFetch = 1024 * 1024
+
+var errNoLink = errors.New("Source does not link to target")
+
+// HTTPClient makes the outgoing requests for webmentions. It is satisfied by *http.Client,
+// and replaced in tests.
+type HTTPClient interface {
+	Do(req *http.Request) (*http.Response, error)
+}
+
+// newWebmentionClient returns an HTTP client that refuses to connect to loopback and
+// private addresses, so that webmentions can't be used to probe the local network.
+func newWebmentionClient() *http.Client {
+	dialer := &net.Dialer{
+		Timeout: 10 * time.Second,
+		Control: func(network, address string, c syscall.RawConn) error {
+			host, _, err := net.SplitHostPort(address)
+			if err != nil {
+				return err
+			}
+			ip := net.ParseIP(host)
+			if ip == nil || ip.IsLoopback() || ip.IsPrivate() || ip.IsUnspecified() ||
+				ip.IsLinkLocalUnicast() || ip.IsLinkLocalMulticast() {
+				return fmt.Errorf("Refusing to connect to %s", address)
+			}
+			return nil
+		},
+	}
+
+	return &http.Client{
+		Timeout:   30 * time.Second,
+		Transport: &http.Transport{DialContext: dialer.DialContext},
+	}
+}
+
+// Webmention is a verified mention of one of our posts on another site.
+type Webmention struct {
+	Source string
+	Target string
+	// The post that was mentioned, as returned by postKey.
+	Post string
+	// Title of the source document, if it has one.
+	Title    string `json:",omitempty"`
+	Received time.Time
+	// Last time the mention was verified.
+	Updated time.Time
+}
+
+// WebmentionStore keeps the webmentions for each post in a JSON file, under a directory
+// that mirrors the posts directory.
+type WebmentionStore struct {
+	lock  sync.Mutex
+	dir   string
+	posts map[string][]*Webmention
+}
+
+func NewWebmentionStore(dir string) (*WebmentionStore, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+	return &WebmentionStore{dir: dir, posts: make(map[string][]*Webmention)}, nil
+}
+
+func (ws *WebmentionStore) postFile(post string) string {
+	return filepath.Join(ws.dir, filepath.FromSlash(post)+".json")
+}
+
+// load returns the webmentions for a post, reading them from disk if needed.
+// The lock must be held.
+func (ws *WebmentionStore) load(post string) ([]*Webmention, error) {
+	if mentions, ok := ws.posts[post]; ok {
+		return mentions, nil
+	}
+
+	mentions := []*Webmention{}
+	data, err := ioutil.ReadFile(ws.postFile(post))
+	if err == nil {
+		err = json.Unmarshal(data, &mentions)
+	} else if os.IsNotExist(err) {
+		err = nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	ws.posts[post] = mentions
+	return mentions, nil
+}
+
+// save writes the webmentions for a post, replacing the file atomically.
+// The lock must be held.
+func (ws *WebmentionStore) save(post string, mentions []*Webmention) error {
+	data, err := json.MarshalIndent(mentions, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	filePath := ws.postFile(post)
+	if err := os.MkdirAll(filepath.Dir(filePath), 0755); err != nil {
+		return err
+	}
+
+	tempPath := filePath + ".tmp"
+	if err := ioutil.WriteFile(tempPath, data, 0644); err != nil {
+		return err
+	}
+	if err := os.Rename(tempPath, filePath); err != nil {
+		return err
+	}
+
+	ws.posts[post] = mentions
+	return nil
+}
+
+// Mentions returns the webmentions for a post, oldest first.
+func (ws *WebmentionStore) Mentions(post string) ([]*Webmention, error) {
+	ws.lock.Lock()
+	defer ws.lock.Unlock()
+	return ws.load(post)
+}
+
+// Put adds a webmention, or updates the existing one from the same source.
+func (ws *WebmentionStore) Put(m *Webmention) error {
+	ws.lock.Lock()
+	defer ws.lock.Unlock()
+
+	mentions, err := ws.load(m.Post)
+	if err != nil {
+		return err
+	}
+
+	updated := make([]*Webmention, 0, len(mentions)+1)
+	for _, existing := range mentions {
+		if existing.Source == m.Source {
+			m.Received = existing.Received
+		} else {
+			updated = append(updated, existing)
+		}
+	}
+	if m.Received.IsZero() {
+		m.Received = m.Updated
+	}
+	return ws.save(m.Post, append(updated, m))
+}
+
+// Remove deletes the webmention from source, returning false if there wasn't one.
+func (ws *WebmentionStore) Remove(post, source string) (bool, error) {
+	ws.lock.Lock()
+	defer ws.lock.Unlock()
+
+	mentions, err := ws.load(post)
+	if err != nil {
+		return false, err
+	}
+
+	updated := make([]*Webmention, 0, len(mentions))
+	for _, existing := range mentions {
+		if existing.Source != source {
+			updated = append(updated, existing)
+		}
+	}
+	if len(updated) == len(mentions) {
+		return false, nil
+	}
+	return true, ws.save(post, updated)
+}
+
+// Number of received webmentions that can wait to be verified, and the number verified at once.
+const (
+	webmentionQueueSize = 100
+	webmentionVerifiers = 4
+)
+
+type webmentionJob struct {
+	source, target, post string
+}
+
+// Webmentions receives and sends webmentions.
+type Webmentions struct {
+	store  *WebmentionStore
+	client HTTPClient
+	// Called after the webmentions for a post change.
+	onChange func(post string)
+	// Limits the number of sends in progress.
+	sem chan struct{}
+
+	// Received webmentions waiting to be verified, and the source and target of each, so
+	// that a mention sent again before it is verified is only verified once.
+	queue       chan webmentionJob
+	pendingLock sync.Mutex
+	pending     map[string]bool
+
+	sentLock sync.Mutex
+	// What was last sent for each post, saved in sentPath so that it survives restarts.
+	// If sentPath is empty, it isn't saved.
+	sent     map[string]sentWebmentions
+	sentPath string
+}
+
+// NewWebmentions sets up sending and receiving webmentions. Received webmentions are kept
+// in store, which is nil if they aren't accepted, and the record of those sent in the
+// file at sentPath.
+func NewWebmentions(store *WebmentionStore, sentPath string, client HTTPClient,
+	onChange func(post string)) *Webmentions {
+
+	wm := &Webmentions{
+		store:    store,
+		client:   client,
+		onChange: onChange,
+		sem:      make(chan struct{}, 4),
+		queue:    make(chan webmentionJob, webmentionQueueSize),
+		pending:  make(map[string]bool),
+		sent:     make(map[string]sentWebmentions),
+		sentPath: sentPath,
+	}
+	if sentPath != "" {
+		data, err := ioutil.ReadFile(sentPath)
+		if err == nil {
+			err = json.Unmarshal(data, &wm.sent)
+		}
+		if err != nil && !os.IsNotExist(err) {
+			glog.Errorln("Could not read sent webmentions:", err)
+		}
+	}
+	for i := 0; i < webmentionVerifiers; i++ {
+		go wm.verifyQueued()
+	}
+	return wm
+}
+
+// siteURL returns the URL of the site, with no trailing slash.
+func siteURL() string {
+	return "http://" + strings.TrimSuffix(config.Domain, "/")
+}
+
+// postKeyFromURL returns the key of the post at a URL on this site, or false if the URL
+// isn't one of our posts.
+func postKeyFromURL(target string) (string, bool) {
+	u, err := url.Parse(target)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") {
+		return "", false
+	}
+
+	domain := strings.ToLower(strings.TrimSuffix(config.Domain, "/"))
+	if host := strings.ToLower(u.Host); host != domain && strings.ToLower(u.Hostname()) != domain {
+		return "", false
+	}
+
+	post := strings.Trim(u.Path, "/")
+	if !validPostKey(post) || strings.Count(post, "/") != 2 {
+		return "", false
+	}
+	if _, err := os.Stat(postSourcePath(post)); err != nil {
+		return "", false
+	}
+	return post, true
+}
+
+// fetch gets a document for webmention processing, returning its body and the URL it was
+// finally retrieved from after any redirects.
+func (wm *Webmentions) fetch(target string) (*http.Response, []byte, *url.URL, error) {
+	req, err := http.NewRequest("GET", target, nil)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	req.Header.Set("Accept", "text/html, */*;q=0.5")
+
+	resp, err := wm.client.Do(req)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	defer resp.Body.Close()
+
+	body, err := ioutil.ReadAll(io.LimitReader(resp.Body, maxWebmentionFetch))
+	if err != nil {
+		return nil, nil, nil, err
+	}
+
+	finalURL := req.URL
+	if resp.Request != nil && resp.Request.URL != nil {
+		finalURL = resp.Request.URL
+	}
+	return resp, body, finalURL, nil
+}
+
+// sameURL compares two URLs, ignoring fragments.
+func sameURL(a, b *url.URL) bool {
+	a2, b2 := *a, *b
+	a2.Fragment, b2.Fragment = "", ""
+	return strings.EqualFold(a2.Host, b2.Host) && a2.Scheme == b2.Scheme &&
+		strings.TrimSuffix(a2.Path, "/") == strings.TrimSuffix(b2.Path, "/") &&
+		a2.RawQuery == b2.RawQuery
+}
+
+// linkAttributes are the attributes that can link to another document, for each tag.
+var linkAttributes = map[string]string{
+	"a":      "href",
+	"link":   "href",
+	"area":   "href",
+	"img":    "src",
+	"audio":  "src",
+	"video":  "src",
+	"source": "src",
+}
+
+// htmlLinks returns the title of an HTML document and the URLs it links to,
+// resolved against base.
+func htmlLinks(body []byte, base *url.URL) (title string, links []*url.URL) {
+	z := html.NewTokenizer(bytes.NewReader(body))
+	inTitle := false
+	for {
+		switch z.Next() {
+		case html.ErrorToken:
+			return title, links
+		case html.TextToken:
+			if inTitle {
+				title += z.Token().Data
+			}
+		case html.EndTagToken:
+			if z.Token().Data == "title" {
+				inTitle = false
+			}
+		case html.StartTagToken, html.SelfClosingTagToken:
+			token := z.Token()
+			if token.Data == "title" && title == "" {
+				inTitle = true
+				continue
+			}
+
+			attrName, ok := linkAttributes[token.Data]
+			if !ok {
+				continue
+			}
+			for _, attr := range token.Attr {
+				if attr.Key != attrName {
+					continue
+				}
+				if link, err := base.Parse(strings.TrimSpace(attr.Val)); err == nil {
+					links = append(links, link)
+				}
+			}
+		}
+	}
+}
+
+// Verify fetches source and checks that it links to target, then stores or updates the
+// webmention. If source no longer links to target, any existing webmention is removed.
+func (wm *Webmentions) Verify(source, target, post string) error {
+	targetURL, err := url.Parse(target)
+	if err != nil {
+		return err
+	}
+
+	resp, body, sourceURL, err := wm.fetch(source)
+	if err != nil {
+		return err
+	}
+
+	found := false
+	title := ""
+	switch {
+	case resp.StatusCode == http.StatusGone || resp.StatusCode == http.StatusNotFound:
+		// The source was deleted.
+	case resp.StatusCode < 200 || resp.StatusCode > 299:
+		return fmt.Errorf("Fetching %s returned status %d", source, resp.StatusCode)
+	case strings.Contains(resp.Header.Get("Content-Type"), "html") || resp.Header.Get("Content-Type") == "":
+		var links []*url.URL
+		title, links = htmlLinks(body, sourceURL)
+		for _, link := range links {
+			if sameURL(link, targetURL) {
+				found = true
+				break
+			}
+		}
+	default:
+		found = bytes.Contains(body, []byte(target))
+	}
+
+	if !found {
+		removed, err := wm.store.Remove(post, source)
+		if err != nil {
+			return err
+		}
+		if removed && wm.onChange != nil {
+			wm.onChange(post)
+		}
+		return errNoLink
+	}
+
+	err = wm.store.Put(&Webmention{
+		Source:  source,
+		Target:  target,
+		Post:    post,
+		Title:   strings.TrimSpace(title),
+		Updated: time.Now(),
+	})
+	if err != nil {
+		return err
+	}
+	if wm.onChange != nil {
+		wm.onChange(post)
+	}
+	return nil
+}
+
+// verifyAsync queues a received webmention to be verified in the background. It returns
+// false if the queue is full. A webmention that is already waiting isn't queued again.
+func (wm *Webmentions) verifyAsync(source, target, post string) bool {
+	key := source + " " + target
+
+	wm.pendingLock.Lock()
+	defer wm.pendingLock.Unlock()
+	if wm.pending[key] {
+		return true
+	}
+
+	select {
+	case wm.queue <- webmentionJob{source: source, target: target, post: post}:
+		wm.pending[key] = true
+		return true
+	default:
+		return false
+	}
+}
+
+// verifyQueued verifies queued webmentions forever.
+func (wm *Webmentions) verifyQueued() {
+	for job := range wm.queue {
+		// The source may change again while it is being verified, so a new mention with
+		// the same source and target is queued again from now on.
+		wm.pendingLock.Lock()
+		delete(wm.pending, job.source+" "+job.target)
+		wm.pendingLock.Unlock()
+
+		if err := wm.Verify(job.source, job.target, job.post); err != nil {
+			glog.Infof("Webmention from %s to %s not accepted: %s", job.source, job.target, err)
+		} else {
+			glog.Infof("Accepted webmention from %s to %s", job.source, job.target)
+		}
+	}
+}
+
+// webmentionHandler receives webmentions. The mention is verified in the background,
+// as allowed by the Webmention specification. If too many are waiting, the sender is
+// asked to try again later.
+func webmentionHandler(globalData *GlobalData, w http.ResponseWriter,
+	r *http.Request, urlParams map[string]string) {
+
+	r.Body = http.MaxBytesReader(w, r.Body, 16*1024)
+	if err := r.ParseForm(); err != nil {
+		http.Error(w, "Invalid form", http.StatusBadRequest)
+		return
+	}
+
+	source := r.PostFormValue("source")
+	target := r.PostFormValue("target")
+	sourceURL, err := url.Parse(source)
+	if err != nil || (sourceURL.Scheme != "http" && sourceURL.Scheme != "https") {
+		http.Error(w, "source must be an http or https URL", http.StatusBadRequest)
+		return
+	}
+	if source == target {
+		http.Error(w, "source and target must be different", http.StatusBadRequest)
+		return
+	}
+
+	post, ok := postKeyFromURL(target)
+	if !ok {
+		http.Error(w, "target is not a post on this site", http.StatusBadRequest)
+		return
+	}
+
+	if !globalData.webmentions.verifyAsync(source, target, post) {
+		w.Header().Set("Retry-After", "60")
+		http.Error(w, "Too many webmentions are waiting. Please try again later.",
+			http.StatusServiceUnavailable)
+		return
+	}
+	w.WriteHeader(http.StatusAccepted)
+}
@@ -0,0 +1,233 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+)
+
+type stubResponse struct {
+	status int
+	header http.Header
+	body   string
+}
+
+// stubClient answers requests from a fixed set of responses and records POSTs.
+type stubClient struct {
+	lock      sync.Mutex
+	responses map[string]stubResponse
+	posts     []url.Values
+}
+
+func (c *stubClient) Do(req *http.Request) (*http.Response, error) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	if req.Method == "POST" {
+		req.ParseForm()
+		c.posts = append(c.posts, req.PostForm)
+		return &http.Response{StatusCode: http.StatusAccepted, Header: http.Header{},
+			Body: ioutil.NopCloser(strings.NewReader("")), Request: req}, nil
+	}
+
+	resp, ok := c.responses[req.URL.String()]
+	if !ok {
+		resp = stubResponse{status: http.StatusNotFound}
+	}
+	header := resp.header
+	if header == nil {
+		header = http.Header{"Content-Type": {"text/html; charset=utf-8"}}
+	}
+	return &http.Response{StatusCode: resp.status, Header: header,
+		Body: ioutil.NopCloser(strings.NewReader(resp.body)), Request: req}, nil
+}
+
+// blockingClient answers every request with a 404 once release is closed.
+type blockingClient struct {
+	release chan struct{}
+}
+
+func (c *blockingClient) Do(req *http.Request) (*http.Response, error) {
+	<-c.release
+	return &http.Response{StatusCode: http.StatusNotFound, Header: http.Header{},
+		Body: ioutil.NopCloser(strings.NewReader("")), Request: req}, nil
+}
+
+func TestWebmentionVerify(t *testing.T) {
+	dir, _, cleanup := setupSiteTest(t, "webmentions")
+	defer cleanup()
+
+	store, _ := NewWebmentionStore(dir)
+	client := &stubClient{responses: map[string]stubResponse{
+		"http://other.example/links": {200, nil,
+			`<html><title>A reply</title><p>See <a href="http://example.com/2014/05/first-post#top">this</a></p>`},
+		"http://other.example/relative": {200, nil,
+			`<a href="//example.com/2014/05/first-post">this</a>`},
+		"http://other.example/nolink": {200, nil, `<a href="http://example.com/2014/05/second-post">other</a>`},
+		"http://other.example/text": {200, http.Header{"Content-Type": {"text/plain"}},
+			"Read http://example.com/2014/05/first-post"},
+	}}
+	changed := []string{}
+	wm := NewWebmentions(store, "", client, func(post string) { changed = append(changed, post) })
+
+	target := "http://example.com/2014/05/first-post"
+	post := "2014/05/first-post"
+	for _, source := range []string{"http://other.example/links", "http://other.example/relative",
+		"http://other.example/text"} {
+		if err := wm.Verify(source, target, post); err != nil {
+			t.Errorf("Verifying %s: %s", source, err)
+		}
+	}
+	if err := wm.Verify("http://other.example/nolink", target, post); err != errNoLink {
+		t.Errorf("Expected errNoLink, saw %v", err)
+	}
+
+	mentions, _ := store.Mentions(post)
+	if len(mentions) != 3 || mentions[0].Title != "A reply" {
+		t.Fatalf("Unexpected mentions %v", mentions)
+	}
+	if len(changed) != 3 {
+		t.Errorf("Expected 3 change notifications, saw %d", len(changed))
+	}
+
+	// The source was deleted, so the mention goes away.
+	delete(client.responses, "http://other.example/links")
+	wm.Verify("http://other.example/links", target, post)
+	mentions, _ = store.Mentions(post)
+	if len(mentions) != 2 {
+		t.Errorf("Mention of deleted source was not removed, saw %v", mentions)
+	}
+}
+
+func TestWebmentionHandler(t *testing.T) {
+	dir, globalData, cleanup := setupSiteTest(t, "webmentions")
+	defer cleanup()
+
+	store, _ := NewWebmentionStore(dir)
+	client := &blockingClient{release: make(chan struct{})}
+	defer close(client.release)
+	globalData.webmentions = NewWebmentions(store, "", client, nil)
+
+	send := func(source, target string) int {
+		form := url.Values{"source": {source}, "target": {target}}
+		r, _ := http.NewRequest("POST", "/webmention", strings.NewReader(form.Encode()))
+		r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		w := httptest.NewRecorder()
+		webmentionHandler(globalData, w, r, nil)
+		return w.Code
+	}
+
+	tests := []struct {
+		source, target string
+		code           int
+	}{
+		{"http://other.example/a", "http://example.com/2014/05/first-post", http.StatusAccepted},
+		{"http://other.example/a", "http://example.com/2014/05/first-post/", http.StatusAccepted},
+		{"ftp://other.example/a", "http://example.com/2014/05/first-post", http.StatusBadRequest},
+		{"http://other.example/a", "http://elsewhere.com/2014/05/first-post", http.StatusBadRequest},
+		{"http://other.example/a", "http://example.com/2014/05/missing", http.StatusBadRequest},
+		{"http://other.example/a", "http://example.com/2014/../../etc/passwd", http.StatusBadRequest},
+		{"http://example.com/2014/05/first-post", "http://example.com/2014/05/first-post",
+			http.StatusBadRequest},
+	}
+
+	for _, test := range tests {
+		if code := send(test.source, test.target); code != test.code {
+			t.Errorf("%s -> %s: expected %d, saw %d", test.source, test.target, test.code, code)
+		}
+	}
+
+	// The verifiers are stuck, so the queue fills up.
+	globalData.webmentions = NewWebmentions(store, "", client, nil)
+	target := "http://example.com/2014/05/first-post"
+	accepted := 0
+	for send(fmt.Sprintf("http://other.example/%d", accepted), target) == http.StatusAccepted {
+		accepted++
+		if accepted > webmentionQueueSize+webmentionVerifiers+1 {
+			t.Fatal("The queue never filled up")
+		}
+	}
+	if accepted < webmentionQueueSize {
+		t.Errorf("Only %d webmentions were queued", accepted)
+	}
+	// A webmention that is already waiting doesn't need room in the queue.
+	if code := send(fmt.Sprintf("http://other.example/%d", accepted-1), target); code != http.StatusAccepted {
+		t.Errorf("Queued webmention sent again was refused with %d", code)
+	}
+}
+
+func TestWebmentionSend(t *testing.T) {
+	dir, _, cleanup := setupSiteTest(t, "webmentions")
+	defer cleanup()
+
+	config.PostsDir = filepath.Join(dir, "posts")
+	postDir := filepath.Join(config.PostsDir, "2014", "05")
+	os.MkdirAll(postDir, 0755)
+	postPath := filepath.Join(postDir, "linking-post.md")
+	writePost := func(content string) {
+		ioutil.WriteFile(postPath, []byte("Linking Post\n5/14/14 11:14PM -0500\ntag\n\n"+content), 0644)
+	}
+	writePost(`<a href="http://header.example/post">One</a> <a href="http://html.example/post">Two</a>
+<a href="http://none.example/post">Three</a> <a href="/2014/05/first-post">Local</a>`)
+
+	client := &stubClient{responses: map[string]stubResponse{
+		"http://header.example/post": {200, http.Header{
+			"Link":         {`<http://header.example/other>; rel="other", </mention>; rel="webmention"`},
+			"Content-Type": {"text/html"}}, ""},
+		"http://html.example/post": {200, nil,
+			`<html><head><link rel="stylesheet" href="/s.css"><link href="endpoint" rel="webmention"></head></html>`},
+		"http://none.example/post": {200, nil, `<html></html>`},
+	}}
+	sentPath := filepath.Join(dir, "webmentions", "sent.json")
+	wm := NewWebmentions(nil, sentPath, client, nil)
+
+	wm.sendForPost(postPath)
+	sent := map[string]bool{}
+	for _, form := range client.posts {
+		if form.Get("source") != "http://example.com/2014/05/linking-post" {
+			t.Errorf("Unexpected source %s", form.Get("source"))
+		}
+		sent[form.Get("target")] = true
+	}
+	if len(client.posts) != 2 || !sent["http://header.example/post"] || !sent["http://html.example/post"] {
+		t.Errorf("Unexpected webmentions sent: %v", client.posts)
+	}
+
+	// Unchanged content isn't sent again, even after a restart.
+	client.posts = nil
+	wm.sendForPost(postPath)
+	wm = NewWebmentions(nil, sentPath, client, nil)
+	wm.sendForPost(postPath)
+	if len(client.posts) != 0 {
+		t.Errorf("Webmentions were sent again for unchanged post")
+	}
+
+	// A link removed from the post is still notified, though it was sent before the restart.
+	writePost(`<a href="http://html.example/post">Two</a>`)
+	wm.sendForPost(postPath)
+	sent = map[string]bool{}
+	for _, form := range client.posts {
+		sent[form.Get("target")] = true
+	}
+	if !sent["http://header.example/post"] || !sent["http://html.example/post"] {
+		t.Errorf("Expected webmentions for current and removed links, saw %v", client.posts)
+	}
+}
+
+func TestDiscoverEndpointRelative(t *testing.T) {
+	client := &stubClient{responses: map[string]stubResponse{
+		"http://html.example/dir/post": {200, nil, `<a rel="nofollow webmention" href="">self</a>`},
+	}}
+	wm := NewWebmentions(nil, "", client, nil)
+	endpoint, err := wm.discoverEndpoint("http://html.example/dir/post")
+	if err != nil || endpoint != "http://html.example/dir/post" {
+		t.Errorf("Expected the document itself as the endpoint, saw %s, %v", endpoint, err)
+	}
+}
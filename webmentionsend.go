@@ -0,0 +1,252 @@
+package main
+
+import (
+	"bytes"
+	"code.google.com/p/go.net/html"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"github.com/dimfeld/glog"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// sentWebmentions records the webmentions last sent for a post.
+type sentWebmentions struct {
+	// SHA-256 of the post's content, so that a post that hasn't changed isn't sent again.
+	ContentHash string
+	// The links found in the post, so that links removed from it are notified too.
+	Links []string
+}
+
+// relContains returns true if a space-separated rel value contains "webmention".
+func relContains(rel string) bool {
+	for _, value := range strings.Fields(rel) {
+		if strings.EqualFold(value, "webmention") {
+			return true
+		}
+	}
+	return false
+}
+
+// linkHeaderEndpoint looks for a webmention endpoint in Link headers.
+func linkHeaderEndpoint(headers []string) (string, bool) {
+	for _, header := range headers {
+		for _, link := range strings.Split(header, ",") {
+			parts := strings.Split(link, ";")
+			target := strings.TrimSpace(parts[0])
+			if !strings.HasPrefix(target, "<") || !strings.HasSuffix(target, ">") {
+				continue
+			}
+
+			for _, param := range parts[1:] {
+				param = strings.TrimSpace(param)
+				if !strings.HasPrefix(strings.ToLower(param), "rel=") {
+					continue
+				}
+				if relContains(strings.Trim(param[4:], `"`)) {
+					return target[1 : len(target)-1], true
+				}
+			}
+		}
+	}
+	return "", false
+}
+
+// htmlEndpoint looks for the first <link> or <a> element with rel="webmention".
+func htmlEndpoint(body []byte) (string, bool) {
+	z := html.NewTokenizer(bytes.NewReader(body))
+	for {
+		switch z.Next() {
+		case html.ErrorToken:
+			return "", false
+		case html.StartTagToken, html.SelfClosingTagToken:
+			token := z.Token()
+			if token.Data != "link" && token.Data != "a" {
+				continue
+			}
+
+			isEndpoint := false
+			href, hasHref := "", false
+			for _, attr := range token.Attr {
+				switch attr.Key {
+				case "rel":
+					isEndpoint = relContains(attr.Val)
+				case "href":
+					href, hasHref = attr.Val, true
+				}
+			}
+			if isEndpoint && hasHref {
+				return href, true
+			}
+		}
+	}
+}
+
+// discoverEndpoint finds the webmention endpoint for target, returning an empty string
+// if it doesn't have one.
+func (wm *Webmentions) discoverEndpoint(target string) (string, error) {
+	resp, body, finalURL, err := wm.fetch(target)
+	if err != nil {
+		return "", err
+	}
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return "", fmt.Errorf("Fetching %s returned status %d", target, resp.StatusCode)
+	}
+
+	endpoint, ok := linkHeaderEndpoint(resp.Header["Link"])
+	if !ok && strings.Contains(resp.Header.Get("Content-Type"), "html") {
+		endpoint, ok = htmlEndpoint(body)
+	}
+	if !ok {
+		return "", nil
+	}
+
+	// An empty href refers to the document itself.
+	endpointURL, err := finalURL.Parse(strings.TrimSpace(endpoint))
+	if err != nil {
+		return "", err
+	}
+	return endpointURL.String(), nil
+}
+
+// send notifies an endpoint that source mentions target.
+func (wm *Webmentions) send(endpoint, source, target string) error {
+	form := url.Values{"source": {source}, "target": {target}}
+	req, err := http.NewRequest("POST", endpoint, strings.NewReader(form.Encode()))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+
+	resp, err := wm.client.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("Endpoint %s returned status %d", endpoint, resp.StatusCode)
+	}
+	return nil
+}
+
+// externalLinks returns the links in a post to other sites.
+func externalLinks(post *Post) []string {
+	base, err := url.Parse(siteURL() + "/" + postKey(post.SourcePath))
+	if err != nil {
+		return nil
+	}
+
+	_, links := htmlLinks([]byte(post.HTMLContent(true)), base)
+	seen := make(map[string]bool)
+	result := []string{}
+	for _, link := range links {
+		if (link.Scheme != "http" && link.Scheme != "https") || strings.EqualFold(link.Host, base.Host) {
+			continue
+		}
+		link.Fragment = ""
+		s := link.String()
+		if !seen[s] {
+			seen[s] = true
+			result = append(result, s)
+		}
+	}
+	return result
+}
+
+// saveSent writes the record of sent webmentions, replacing the file atomically. The
+// sentLock must be held.
+func (wm *Webmentions) saveSent() error {
+	if wm.sentPath == "" {
+		return nil
+	}
+	data, err := json.Marshal(wm.sent)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(wm.sentPath), 0755); err != nil {
+		return err
+	}
+	tempPath := wm.sentPath + ".tmp"
+	if err := ioutil.WriteFile(tempPath, data, 0644); err != nil {
+		return err
+	}
+	return os.Rename(tempPath, wm.sentPath)
+}
+
+// SendForPost notifies the sites that a new or changed post links to, or used to link to,
+// in the background.
+func (wm *Webmentions) SendForPost(sourcePath string) {
+	go func() {
+		wm.sem <- struct{}{}
+		defer func() { <-wm.sem }()
+		wm.sendForPost(sourcePath)
+	}()
+}
+
+func (wm *Webmentions) sendForPost(sourcePath string) {
+	post := postKey(sourcePath)
+
+	// If the post was deleted, the sites it linked to are still notified, and will see that
+	// it's gone when they verify the mention.
+	content := ""
+	var links []string
+	if p, err := NewPost(sourcePath, true); err == nil {
+		content = string(p.Content)
+		links = externalLinks(p)
+	}
+
+	sum := sha256.Sum256([]byte(content))
+	contentHash := hex.EncodeToString(sum[:])
+
+	wm.sentLock.Lock()
+	if sent, ok := wm.sent[post]; ok && sent.ContentHash == contentHash {
+		// The file system watcher often sends several events for one change.
+		wm.sentLock.Unlock()
+		return
+	}
+	oldLinks := wm.sent[post].Links
+	wm.sent[post] = sentWebmentions{ContentHash: contentHash, Links: links}
+	if err := wm.saveSent(); err != nil {
+		glog.Errorln("Could not save sent webmentions:", err)
+	}
+	wm.sentLock.Unlock()
+
+	targets := append([]string{}, links...)
+	for _, old := range oldLinks {
+		found := false
+		for _, link := range links {
+			if link == old {
+				found = true
+				break
+			}
+		}
+		if !found {
+			targets = append(targets, old)
+		}
+	}
+
+	source := siteURL() + "/" + post
+	for _, target := range targets {
+		endpoint, err := wm.discoverEndpoint(target)
+		if err != nil {
+			glog.Infof("Could not discover webmention endpoint for %s: %s", target, err)
+			continue
+		}
+		if endpoint == "" {
+			continue
+		}
+
+		if err := wm.send(endpoint, source, target); err != nil {
+			glog.Infof("Could not send webmention for %s to %s: %s", target, endpoint, err)
+		} else if glog.V(1) {
+			glog.Infof("Sent webmention for %s to %s", target, endpoint)
+		}
+	}
+}